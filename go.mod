@@ -1,3 +1,3 @@
-module snap
+module github.com/akhlakm/Snap_Shot
 
 go 1.18
@@ -2,63 +2,309 @@ package argparser
 
 import (
 	"errors"
-	"snap/internal/logger"
+	"fmt"
 	"strconv"
 	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/logger"
 )
 
+type Kind int
+
+const (
+	Flag Kind = iota
+	String
+	Int
+	// flag given more than once, -vv is counted twice
+	Count
+)
+
+// Option of a command, given as --name, or -s if it has a short name.
+// String and Int options take a value as --name=value or --name value,
+// -s value or -svalue.
+type Option struct {
+	Name  string
+	Short string
+	// other spellings, e.g. -go
+	Aliases []string
+	Kind    Kind
+	// placeholder of the value in the help
+	Value string
+	Help  string
+}
+
+// Subcommand with its arguments, used for the parsing and the help.
+type Command struct {
+	Name string
+	// usage of the positional arguments, e.g. <path> [<snapshot id>]
+	Args string
+	// positional arguments accepted, -1 for any number
+	MaxArgs int
+	Summary string
+	Options []Option
+	Run     func() error
+}
+
+var help_option = Option{Name: "help", Short: "h", Kind: Flag, Help: "show this help"}
+
 type Parser struct {
-	args []string
+	cmd        *Command
+	values     map[string]string
+	positional []string
+	// position of the first argument after --, -1 if none
+	dashed int
 }
 
 var initialized *Parser = nil
 
-func Create(a []string) {
-	initialized = &Parser{
-		args: a,
+// Parse the arguments of the command, the command name excluded.
+// Options and positional arguments can be mixed, everything
+// after -- is positional.
+func Create(cmd *Command, a []string) error {
+	p := &Parser{
+		cmd:        cmd,
+		values:     make(map[string]string),
+		positional: []string{cmd.Name},
+		dashed:     -1,
 	}
+	for i := 0; i < len(a); i++ {
+		arg := a[i]
+		if arg == "--" {
+			p.dashed = len(p.positional)
+			p.positional = append(p.positional, a[i+1:]...)
+			break
+		}
+		if !is_option(arg) {
+			p.positional = append(p.positional, arg)
+			continue
+		}
+
+		var err error
+		if opt := p.alias(arg); opt != nil {
+			i, err = p.set(opt, arg, "", false, a, i)
+		} else if strings.HasPrefix(arg, "--") {
+			i, err = p.parse_long(arg, a, i)
+		} else {
+			i, err = p.parse_short(arg, a, i)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.MaxArgs >= 0 && len(p.positional)-1 > cmd.MaxArgs && !p.HasFlag("help") {
+		return fmt.Errorf("too many arguments: %s", strings.Join(p.positional[cmd.MaxArgs+1:], " "))
+	}
+	initialized = p
+	return nil
 }
 
 func GetParser() *Parser {
 	return initialized
 }
 
+// Negative numbers are positional arguments.
+func is_option(arg string) bool {
+	if len(arg) < 2 || arg[0] != '-' {
+		return false
+	}
+	_, err := strconv.Atoi(arg)
+	return err != nil
+}
+
+func (p *Parser) parse_long(arg string, a []string, i int) (int, error) {
+	name, value, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+	opt := p.option(name)
+	if opt == nil {
+		return i, fmt.Errorf("unknown option --%s", name)
+	}
+	return p.set(opt, "--"+name, value, hasValue, a, i)
+}
+
+// Combined short flags, -in is -i -n. The first option with a value
+// takes the rest of the group as its value, or the next argument.
+func (p *Parser) parse_short(arg string, a []string, i int) (int, error) {
+	group := arg[1:]
+	for j := 0; j < len(group); j++ {
+		opt := p.short(group[j : j+1])
+		if opt == nil {
+			return i, fmt.Errorf("unknown option -%s", group[j:j+1])
+		}
+		if (opt.Kind == String || opt.Kind == Int) && j+1 < len(group) {
+			return p.set(opt, "-"+opt.Short, group[j+1:], true, a, i)
+		}
+		var err error
+		if i, err = p.set(opt, "-"+opt.Short, "", false, a, i); err != nil {
+			return i, err
+		}
+	}
+	return i, nil
+}
+
+func (p *Parser) set(opt *Option, given string, value string, hasValue bool, a []string, i int) (int, error) {
+	if opt.Kind == Flag || opt.Kind == Count {
+		if hasValue {
+			return i, fmt.Errorf("option %s does not take a value", given)
+		}
+		if opt.Kind == Count {
+			n, _ := strconv.Atoi(p.values[opt.Name])
+			p.values[opt.Name] = strconv.Itoa(n + 1)
+		} else {
+			p.values[opt.Name] = "true"
+		}
+		return i, nil
+	}
+	if !hasValue {
+		if i+1 >= len(a) {
+			return i, fmt.Errorf("option %s needs a value", given)
+		}
+		i++
+		value = a[i]
+	}
+	if opt.Kind == Int {
+		if _, err := strconv.Atoi(value); err != nil {
+			return i, fmt.Errorf("option %s expects an integer, got %s", given, value)
+		}
+	}
+	p.values[opt.Name] = value
+	return i, nil
+}
+
+func (p *Parser) options() []Option {
+	return append(append([]Option{}, p.cmd.Options...), help_option)
+}
+
+func (p *Parser) option(name string) *Option {
+	for _, opt := range p.options() {
+		if opt.Name == name {
+			return &opt
+		}
+	}
+	return nil
+}
+
+func (p *Parser) short(name string) *Option {
+	for _, opt := range p.options() {
+		if opt.Short != "" && opt.Short == name {
+			return &opt
+		}
+	}
+	return nil
+}
+
+func (p *Parser) alias(arg string) *Option {
+	for _, opt := range p.options() {
+		for _, alias := range opt.Aliases {
+			if alias == arg {
+				return &opt
+			}
+		}
+	}
+	return nil
+}
+
+// Positional argument, 0 is the command name.
 func (p *Parser) GetStr(position int) (string, error) {
-	if position < len(p.args) {
-		return p.args[position], nil
+	if position < len(p.positional) {
+		return p.positional[position], nil
 	}
 	return "", errors.New("not enough arguments")
 }
 
-func (p *Parser) ReqStr(position int, errormsg string) string {
-	if position < len(p.args) {
-		return p.args[position]
+func (p *Parser) ReqStr(position int, errormsg string) (string, error) {
+	if position < len(p.positional) {
+		return p.positional[position], nil
 	}
-	logger.Error("required-arg", "not enough arguments", errormsg)
-	return ""
+	return "", logger.FailCode(logger.ExitUsage, "required-arg", "not enough arguments", errormsg)
 }
 
 func (p *Parser) GetInt(position int) (int, error) {
-	if position < len(p.args) {
-		return strconv.Atoi(p.args[position])
+	if position < len(p.positional) {
+		return strconv.Atoi(p.positional[position])
 	}
 	return -1, errors.New("not enough arguments")
 }
 
-func (p *Parser) HasFlag(flag string) bool {
-	for _, v := range p.args {
-		if strings.TrimSpace(v) == strings.TrimSpace(flag) {
-			return true
-		}
+// Positional arguments from the position on.
+func (p *Parser) GetRest(position int) []string {
+	if position < len(p.positional) {
+		return p.positional[position:]
+	}
+	return []string{}
+}
+
+// Positional arguments from the position on, up to the --.
+func (p *Parser) GetUndashed(position int) []string {
+	end := len(p.positional)
+	if p.dashed >= 0 {
+		end = p.dashed
+	}
+	if position < end {
+		return p.positional[position:end]
 	}
-	return false
+	return []string{}
 }
 
-// getInt(position, default=)
-// needStr(position, errormsg)
-// needInt(position, errormsg)
-// hasFlag(flag)
-// getKeyStr(flag, default=)
-// getKeyInt(flag, default=)
-// needKeyStr(flag, errormsg)
-// needKeyInt(flag, errormsg)
+// Positional arguments given after --, empty if none.
+func (p *Parser) GetDashed() []string {
+	if p.dashed >= 0 {
+		return p.positional[p.dashed:]
+	}
+	return []string{}
+}
+
+// Whether the flag option of the name was given.
+func (p *Parser) HasFlag(name string) bool {
+	_, ok := p.values[name]
+	return ok
+}
+
+// Value of the option of the name.
+func (p *Parser) GetKeyStr(name string, def string) string {
+	if val, ok := p.values[name]; ok {
+		return val
+	}
+	return def
+}
+
+// Value of the option of the name, the parser checked it is an integer.
+// Count options are the number of times they were given.
+func (p *Parser) GetKeyInt(name string, def int) int {
+	if val, ok := p.values[name]; ok {
+		ival, _ := strconv.Atoi(val)
+		return ival
+	}
+	return def
+}
+
+// Usage of the command, with its options.
+func (c *Command) Help() string {
+	var b strings.Builder
+	usage := "snap " + c.Name
+	if c.Args != "" {
+		usage += " " + c.Args
+	}
+	b.WriteString(fmt.Sprintf("USAGE: %s [options]\n\n%s\n\nOptions:\n", usage, c.Summary))
+
+	opts := append(append([]Option{}, c.Options...), help_option)
+	names := []string{}
+	width := 0
+	for _, opt := range opts {
+		name := "    "
+		if opt.Short != "" {
+			name = "-" + opt.Short + ", "
+		}
+		name += "--" + opt.Name
+		if opt.Kind == String || opt.Kind == Int {
+			name += " " + opt.Value
+		}
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	for i, opt := range opts {
+		b.WriteString(fmt.Sprintf("  %-*s  %s\n", width, names[i], opt.Help))
+	}
+	return b.String()
+}
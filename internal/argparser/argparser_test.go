@@ -0,0 +1,151 @@
+package argparser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The options of snap pull, with a string and a count option.
+var test_command = &Command{
+	Name:    "pull",
+	Args:    "[<snapshot id|tag>]",
+	MaxArgs: 1,
+	Summary: "Restore the current directory to a snapshot.",
+	Options: []Option{
+		{Name: "dry", Short: "n", Kind: Flag, Help: "only show the changes"},
+		{Name: "go", Aliases: []string{"-go"}, Kind: Flag, Help: "perform the changes"},
+		{Name: "ignores", Short: "i", Kind: Flag, Help: "also list the ignored files"},
+		{Name: "jobs", Short: "j", Kind: Int, Value: "N", Help: "number of files"},
+		{Name: "message", Short: "m", Kind: String, Value: "TEXT", Help: "description"},
+		{Name: "verbose", Short: "v", Kind: Count, Help: "show the steps"},
+	},
+}
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		values     map[string]string
+		positional []string
+		dashed     []string
+	}{
+		{"pull --go 5", []string{"--go", "5"},
+			map[string]string{"go": "true"}, []string{"pull", "5"}, nil},
+		{"id before the flag", []string{"5", "--go"},
+			map[string]string{"go": "true"}, []string{"pull", "5"}, nil},
+		{"alias", []string{"-go"},
+			map[string]string{"go": "true"}, []string{"pull"}, nil},
+		{"short flag", []string{"-n"},
+			map[string]string{"dry": "true"}, []string{"pull"}, nil},
+		{"combined short flags", []string{"-in"},
+			map[string]string{"ignores": "true", "dry": "true"}, []string{"pull"}, nil},
+		{"combined with a value", []string{"-ij8"},
+			map[string]string{"ignores": "true", "jobs": "8"}, []string{"pull"}, nil},
+		{"combined with the next value", []string{"-nj", "8", "3"},
+			map[string]string{"dry": "true", "jobs": "8"}, []string{"pull", "3"}, nil},
+		{"long with =", []string{"--jobs=2"},
+			map[string]string{"jobs": "2"}, []string{"pull"}, nil},
+		{"long with the next value", []string{"--message", "a b"},
+			map[string]string{"message": "a b"}, []string{"pull"}, nil},
+		{"value starting with a dash", []string{"-m", "--go"},
+			map[string]string{"message": "--go"}, []string{"pull"}, nil},
+		{"empty value", []string{"--message="},
+			map[string]string{"message": ""}, []string{"pull"}, nil},
+		{"short value", []string{"-mfirst"},
+			map[string]string{"message": "first"}, []string{"pull"}, nil},
+		{"count", []string{"-vv", "--verbose", "-v"},
+			map[string]string{"verbose": "4"}, []string{"pull"}, nil},
+		{"negative number", []string{"-3"},
+			map[string]string{}, []string{"pull", "-3"}, nil},
+		{"help", []string{"-h"},
+			map[string]string{"help": "true"}, []string{"pull"}, nil},
+		{"dashes", []string{"-n", "--", "--go"},
+			map[string]string{"dry": "true"}, []string{"pull", "--go"}, []string{"--go"}},
+		{"dashes after an id", []string{"--go", "5", "--"},
+			map[string]string{"go": "true"}, []string{"pull", "5"}, []string{}},
+		{"too many arguments with help", []string{"--help", "1", "2"},
+			map[string]string{"help": "true"}, []string{"pull", "1", "2"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Create(test_command, tt.args); err != nil {
+				t.Fatal(err)
+			}
+			p := GetParser()
+			if !reflect.DeepEqual(p.values, tt.values) {
+				t.Errorf("values = %v, want %v", p.values, tt.values)
+			}
+			if !reflect.DeepEqual(p.positional, tt.positional) {
+				t.Errorf("positional = %q, want %q", p.positional, tt.positional)
+			}
+			dashed := tt.dashed
+			if dashed == nil {
+				dashed = []string{}
+			}
+			if got := p.GetDashed(); !reflect.DeepEqual(got, dashed) {
+				t.Errorf("GetDashed() = %q, want %q", got, dashed)
+			}
+		})
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--force"}, "unknown option --force"},
+		{[]string{"-x"}, "unknown option -x"},
+		{[]string{"-nx"}, "unknown option -x"},
+		{[]string{"--jobs"}, "option --jobs needs a value"},
+		{[]string{"-j"}, "option -j needs a value"},
+		{[]string{"-m"}, "option -m needs a value"},
+		{[]string{"--jobs=many"}, "option --jobs expects an integer, got many"},
+		{[]string{"-j", "x"}, "option -j expects an integer, got x"},
+		{[]string{"--go=yes"}, "option --go does not take a value"},
+		{[]string{"1", "2"}, "too many arguments: 2"},
+		{[]string{"--", "-n", "--go"}, "too many arguments: --go"},
+	}
+	for _, tt := range tests {
+		err := Create(test_command, tt.args)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("Create(%q) = %v, want %s", tt.args, err, tt.err)
+		}
+	}
+}
+
+func TestGetters(t *testing.T) {
+	if err := Create(test_command, []string{"--go", "5", "-j", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	p := GetParser()
+	if id, err := p.GetInt(1); err != nil || id != 5 {
+		t.Errorf("GetInt(1) = %d, %v", id, err)
+	}
+	if _, err := p.GetStr(2); err == nil {
+		t.Error("GetStr(2) without an argument")
+	}
+	if !p.HasFlag("go") || p.HasFlag("dry") {
+		t.Errorf("HasFlag go = %v, dry = %v", p.HasFlag("go"), p.HasFlag("dry"))
+	}
+	if p.GetKeyInt("jobs", 4) != 2 || p.GetKeyInt("verbose", 0) != 0 || p.GetKeyStr("message", "none") != "none" {
+		t.Errorf("jobs = %d, verbose = %d, message = %s",
+			p.GetKeyInt("jobs", 4), p.GetKeyInt("verbose", 0), p.GetKeyStr("message", "none"))
+	}
+}
+
+func TestHelp(t *testing.T) {
+	help := test_command.Help()
+	for _, want := range []string{
+		"USAGE: snap pull [<snapshot id|tag>] [options]",
+		"-n, --dry ",
+		"    --go ",
+		"-j, --jobs N ",
+		"-h, --help ",
+	} {
+		if !strings.Contains(help, want) {
+			t.Errorf("help without %q:\n%s", want, help)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cat
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
+)
+
+// Write the contents of a file in a snapshot to stdout.
+func Execute() error {
+	// stdout is the file, the messages go to stderr
+	logger.SetOutput(os.Stderr)
+
+	args := argparser.GetParser()
+	errmsg := "\nUSAGE: cat <snapshot id|tag> <path>\n"
+
+	rem, err := settings.Remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	if !remote.Available(rem) {
+		errmsg := "Remote directory does not exist.\n" +
+			"\nMake sure it is mounted or reachable.\n"
+		return logger.FailCode(logger.ExitRemote, "cat-execute", rem.String(), errmsg)
+	}
+	rootname := settings.RootName()
+
+	arg, err := args.ReqStr(1, errmsg)
+	if err != nil {
+		return err
+	}
+	ssid, err := tags.ResolveArg(rem, rootname, arg)
+	if err != nil {
+		return err
+	}
+	arg, err = args.ReqStr(2, errmsg)
+	if err != nil {
+		return err
+	}
+	// relative to the working directory, which can be below the root
+	relpath, err := fileutils.RootRelPath(settings.Current().Dir(), arg)
+	if err != nil {
+		return logger.FailCode(logger.ExitUsage, "cat-path", arg, err.Error())
+	}
+
+	hist := history.Make(ssid, rem, rootname)
+	if !hist.SnapFileExists() {
+		return logger.Fail("cat-ssid", fmt.Sprint(ssid), "No such snapshot exists in the remote.")
+	}
+	if err := hist.Load(); err != nil {
+		return err
+	}
+
+	phash := fileutils.CalcPathHash(relpath)
+	if !hist.IsPathHash(phash) {
+		return logger.Fail("cat-path", relpath, fmt.Sprintf("No such file in snapshot %d.\n", ssid)+
+			fmt.Sprintf("\nPlease run 'list %d' for the files of the snapshot.", ssid))
+	}
+	switch hist.GetCrud(phash) {
+	case "D":
+		return logger.Fail("cat-path", relpath, fmt.Sprintf("The file was deleted in snapshot %d.\n", ssid)+
+			"\nPlease run 'log <path>' for the snapshots that have it.")
+	case "I":
+		return logger.Fail("cat-path", relpath, fmt.Sprintf("The file is ignored in snapshot %d, its contents are not stored.", ssid))
+	}
+
+	// the blob of the snapshot that last created or updated the file
+	blob := hist.GetRestorePath(phash)
+	logger.Trace("cat-blob", blob)
+	in, err := fileutils.OpenBlob(rem, blob, hist.GetCodec(phash))
+	if err != nil {
+		return logger.Fail("cat-blob", blob, fmt.Sprintf("Failed to open the file in the remote.\n\n%s", err))
+	}
+	defer in.Close()
+	if _, err := io.Copy(os.Stdout, in); err != nil {
+		return logger.Fail("cat-blob", blob, fmt.Sprintf("Failed to read the file.\n\n%s", err))
+	}
+	return nil
+}
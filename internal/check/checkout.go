@@ -2,94 +2,152 @@ package check
 
 import (
 	"fmt"
-	"io/fs"
-	"path/filepath"
-	"snap/internal/argparser"
-	"snap/internal/fileutils"
-	"snap/internal/history"
-	"snap/internal/logger"
-	"snap/internal/settings"
-	"strings"
+	"sort"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/lock"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/progress"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
 )
 
-func Execute() {
+func Execute() error {
 	args := argparser.GetParser()
 
-	remote := settings.DefaultRemote()
-	if !fileutils.DirExists(remote) {
+	rem, err := settings.Remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	if !remote.Available(rem) {
 		errmsg := "Remote directory does not exist.\n" +
 			"\nMake sure it is mounted. Or take your first snapshot and it will be created automatically.\n"
-		logger.Error("restore-execute", remote, errmsg)
+		return logger.FailCode(logger.ExitRemote, "restore-execute", rem.String(), errmsg)
 	}
 
 	rootname := settings.RootName()
 
+	rootlock, err := lock.Acquire(rem, rootname, "check", logger.Default())
+	if err != nil {
+		return err
+	}
+	defer rootlock.Release()
+
 	errmsg := "\nUSAGE: check <path to file/dir to checkout> [<snapshot id>]\n"
 
-	checkoutPath := args.ReqStr(1, errmsg)
-	remotePath := fileutils.PathJoin(fileutils.BackPath(remote, rootname), checkoutPath)
+	arg, err := args.ReqStr(1, errmsg)
+	if err != nil {
+		return err
+	}
+	// relative to the working directory, which can be below the root
+	root := settings.Current().Dir()
+	checkoutPath, err := fileutils.RootRelPath(root, arg)
+	if err != nil {
+		return logger.FailCode(logger.ExitUsage, "check-path", arg, err.Error())
+	}
 
-	ssid, err := args.GetInt(2)
+	ssid, err := tags.ArgSnapId(rem, rootname, 2)
 	if err != nil {
-		ssid = 0
+		return err
 	}
 
+	snapids := history.SnapIds(rem, rootname)
 	if ssid > 0 {
-		hist := history.Make(ssid, remote, rootname)
+		hist := history.Make(ssid, rem, rootname)
 		if !hist.SnapFileExists() {
-			logger.Error("check-ssid", fmt.Sprint(ssid), "No such snapshot exists in the remote.")
+			return logger.Fail("check-ssid", fmt.Sprint(ssid), "No such snapshot exists in the remote.")
+		}
+		snapids = []int{ssid}
+	}
+
+	// plan the copies first, to know the total for the progress
+	hists := []*history.Hist{}
+	nfiles := 0
+	var planned int64
+	for _, id := range snapids {
+		hist := history.Make(id, rem, rootname)
+		if err := hist.Load(); err != nil {
+			return err
+		}
+		hists = append(hists, hist)
+		for _, phash := range checkout_paths(hist, checkoutPath) {
+			nfiles++
+			planned += fileutils.FileHashSize(hist.GetFileHash(phash))
 		}
 	}
 
-	if !fileutils.DirExists(remotePath) {
+	if nfiles == 0 {
 		errmsg := "No such file/directory exists in the remote.\n" +
 			"\nPlease run list [<snapshot id>] for a complete list of available files."
 
-		logger.Error("check-path", remotePath, errmsg)
+		return logger.Fail("check-path", checkoutPath, errmsg)
 	}
 
-	ncopy := copy_directory(remotePath, ssid)
+	prog := progress.Start(logger.Default(), "check", nfiles, planned)
+	ncopy := 0
+	for _, hist := range hists {
+		n, err := copy_directory(root, hist, checkoutPath, prog)
+		ncopy += n
+		if err != nil {
+			prog.Finish()
+			return err
+		}
+	}
+	prog.Finish()
+
 	logger.Print(fmt.Sprintf("%d files copied", ncopy))
+	return nil
+}
+
+// Path hashes of the files created or updated in the snapshot under checkoutPath.
+func checkout_paths(hist *history.Hist, checkoutPath string) []string {
+	phashes := hist.PathHashList()
+	sort.Strings(phashes)
+
+	paths := []string{}
+	for _, phash := range phashes {
+		crud := hist.GetCrud(phash)
+		if crud != "C" && crud != "U" {
+			continue
+		}
+		if fileutils.UnderPath(checkoutPath, hist.GetRelPath(phash)) {
+			paths = append(paths, phash)
+		}
+	}
+	return paths
 }
 
-func copy_directory(remotePath string, ssid int) int {
+// Copy the files created or updated in the snapshot under checkoutPath
+// to the _.shot directory of the root, with the snapshot number prefixed to their names.
+func copy_directory(root string, hist *history.Hist, checkoutPath string, prog *progress.Progress) (int, error) {
 	ccount := 0
-	filepath.WalkDir(remotePath, func(s string, d fs.DirEntry, e error) error {
-		if e != nil {
-			logger.Error("check-copy-path", remotePath, "Failed to walk remote directory.")
-			return e
+
+	for _, phash := range checkout_paths(hist, checkoutPath) {
+		relpath := hist.GetRelPath(phash)
+		relout, err := fileutils.CalcRelativePath(checkoutPath, relpath)
+		if err != nil {
+			return ccount, logger.Fail("check-copy-path", relpath, "Failed to determine relative path.")
 		}
+		name := fileutils.FormatSnap(hist.GetTarget(phash)) + "_" + hist.GetName(phash)
+		relout = fileutils.PathJoin(relout, name)
+
+		srcpath := hist.GetRestorePath(phash)
+		dstpath := fileutils.ShotPath(root, relout)
 
-		// copy the files
-		if !d.IsDir() {
-
-			// specific version specified
-			if ssid > 0 {
-				ssname := fileutils.FormatSnap(ssid)
-				if !strings.HasPrefix(d.Name(), ssname) {
-					// do not copy
-					return nil
-				}
-			}
-
-			relpath, err := fileutils.CalcRelativePath(remotePath, s)
-			if err != nil {
-				logger.Error("check-copy-path", s, "Failed to determine relative path.")
-			}
-
-			dstpath := fileutils.ShotPath(relpath)
-
-			//@todo: check bytes copied.
-			cpbytes, err := fileutils.CopyFile(s, dstpath)
-			if err != nil {
-				fmt.Println(err)
-				logger.Error("copy-file", s, "Failed to copy file.")
-			}
-			ccount++
-			logger.Print(fmt.Sprintf("OK -- %s (%d bytes)", relpath, cpbytes))
+		//@todo: check bytes copied.
+		cpbytes, err := fileutils.Download(hist.Remote, srcpath, dstpath, hist.GetCodec(phash), prog)
+		if err != nil {
+			return ccount, logger.Fail("copy-file", srcpath, fmt.Sprintf("Failed to copy file.\n\n%s", err))
 		}
-		return nil
-	})
+		fileutils.SetModTime(dstpath, hist.GetFileHash(phash))
+		prog.FileDone(0)
+		ccount++
+		logger.Print(fmt.Sprintf("OK -- %s (%d bytes)", relout, cpbytes))
+	}
 
-	return ccount
+	return ccount, nil
 }
@@ -0,0 +1,127 @@
+package codec
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Codecs of the blobs stored in the remote, recorded per shot file entry.
+const None string = ""
+const Gzip string = "gzip"
+const Zstd string = "zstd"
+
+// Extensions of the formats that are already compressed.
+var DefaultSkip = []string{
+	".gz", ".tgz", ".bz2", ".xz", ".zst", ".lz4", ".zip", ".7z", ".rar", ".jar",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic",
+	".mp3", ".ogg", ".flac", ".mp4", ".mkv", ".mov", ".avi", ".webm",
+	".pdf", ".docx", ".xlsx", ".pptx", ".odt", ".epub",
+}
+
+// Parse a codec name of the settings, none is stored as is.
+func Parse(name string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return None, nil
+	case "gzip", "gz":
+		return Gzip, nil
+	case "zstd", "zst":
+		return Zstd, nil
+	}
+	return None, fmt.Errorf("unknown compression: %s", name)
+}
+
+// Suffix of the blob keys, so that a compressed blob is never
+// confused with an uncompressed one of the same file.
+func Suffix(codec string) string {
+	switch codec {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// Whether a file should be compressed, given its name and size.
+func ShouldCompress(codec string, name string, size int64, min int64, skip []string) bool {
+	if codec == None || size < min {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(name))
+	for _, s := range skip {
+		if ext == s {
+			return false
+		}
+	}
+	return true
+}
+
+// Compressed contents of r. Close must be called to release
+// the compressor if the reader is not read until the end.
+func Compress(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case None:
+		return io.NopCloser(r), nil
+	case Gzip:
+		pr, pw := io.Pipe()
+		go func() {
+			zw := gzip.NewWriter(pw)
+			_, err := io.Copy(zw, r)
+			if err == nil {
+				err = zw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, nil
+	case Zstd:
+		pr, pw := io.Pipe()
+		go func() {
+			zw := new_zstd_writer(pw)
+			_, err := io.Copy(zw, r)
+			if err == nil {
+				err = zw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, nil
+	}
+	return nil, fmt.Errorf("unknown compression: %s", codec)
+}
+
+type decompressor struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decompressor) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Original contents of a blob, closes r on Close.
+func Decompress(codec string, r io.ReadCloser) (io.ReadCloser, error) {
+	switch codec {
+	case None:
+		return r, nil
+	case Gzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("invalid gzip blob: %s", err)
+		}
+		return &decompressor{Reader: zr, closers: []io.Closer{zr, r}}, nil
+	case Zstd:
+		return &decompressor{Reader: new_zstd_reader(r), closers: []io.Closer{r}}, nil
+	}
+	r.Close()
+	return nil, fmt.Errorf("unknown compression: %s", codec)
+}
@@ -0,0 +1,100 @@
+package codec
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// XXH64 with a seed of 0, the content checksum of the zstd frames.
+const (
+	xxh_prime1 uint64 = 11400714785074694791
+	xxh_prime2 uint64 = 14029467366897019727
+	xxh_prime3 uint64 = 1609587929392839161
+	xxh_prime4 uint64 = 9650029242287828579
+	xxh_prime5 uint64 = 2870177450012600261
+)
+
+type xxhash64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	nbuf  int
+}
+
+func new_xxhash64() *xxhash64 {
+	p1 := xxh_prime1
+	return &xxhash64{v: [4]uint64{p1 + xxh_prime2, xxh_prime2, 0, -p1}}
+}
+
+func xxh_round(acc uint64, input uint64) uint64 {
+	acc += input * xxh_prime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxh_prime1
+}
+
+func xxh_merge(acc uint64, val uint64) uint64 {
+	acc ^= xxh_round(0, val)
+	return acc*xxh_prime1 + xxh_prime4
+}
+
+func (h *xxhash64) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxh_round(h.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+	}
+}
+
+func (h *xxhash64) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	if h.nbuf > 0 {
+		c := copy(h.buf[h.nbuf:], p)
+		h.nbuf += c
+		p = p[c:]
+		if h.nbuf < 32 {
+			return n, nil
+		}
+		h.stripe(h.buf[:])
+		h.nbuf = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		h.stripe(p)
+	}
+	h.nbuf = copy(h.buf[:], p)
+	return n, nil
+}
+
+func (h *xxhash64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		acc = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) +
+			bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			acc = xxh_merge(acc, v)
+		}
+	} else {
+		acc = xxh_prime5
+	}
+	acc += h.total
+
+	p := h.buf[:h.nbuf]
+	for ; len(p) >= 8; p = p[8:] {
+		acc ^= xxh_round(0, binary.LittleEndian.Uint64(p))
+		acc = bits.RotateLeft64(acc, 27)*xxh_prime1 + xxh_prime4
+	}
+	if len(p) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(p)) * xxh_prime1
+		acc = bits.RotateLeft64(acc, 23)*xxh_prime2 + xxh_prime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		acc ^= uint64(b) * xxh_prime5
+		acc = bits.RotateLeft64(acc, 11) * xxh_prime1
+	}
+
+	acc ^= acc >> 33
+	acc *= xxh_prime2
+	acc ^= acc >> 29
+	acc *= xxh_prime3
+	acc ^= acc >> 32
+	return acc
+}
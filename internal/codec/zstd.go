@@ -0,0 +1,471 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// Zstandard frames, RFC 8878. Frames with a dictionary are not
+// supported, snap never writes them.
+
+const zstd_magic uint32 = 0xFD2FB528
+
+// skippable frames have the magics 0x184D2A50 to 0x184D2A5F
+const zstd_skippable_mask uint32 = 0xFFFFFFF0
+const zstd_skippable_magic uint32 = 0x184D2A50
+
+const zstd_block_max = 128 * 1024
+
+// largest window accepted by the decoder, as the zstd command line
+const zstd_window_max = 1 << 27
+
+const (
+	zstd_block_raw        = 0
+	zstd_block_rle        = 1
+	zstd_block_compressed = 2
+)
+
+const (
+	zstd_literals_raw        = 0
+	zstd_literals_rle        = 1
+	zstd_literals_compressed = 2
+	zstd_literals_treeless   = 3
+)
+
+const (
+	zstd_mode_predefined = 0
+	zstd_mode_rle        = 1
+	zstd_mode_fse        = 2
+	zstd_mode_repeat     = 3
+)
+
+// longest prefix code of the literals
+const huffman_max_bits = 11
+
+var errZstdCorrupt = errors.New("invalid zstd blob")
+
+// Baselines and extra bits of the literal length codes.
+var ll_base = [36]uint32{
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+	16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+	8192, 16384, 32768, 65536,
+}
+var ll_bits = [36]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+	13, 14, 15, 16,
+}
+
+// Baselines and extra bits of the match length codes.
+var ml_base = [53]uint32{
+	3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+	19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+	35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+	4099, 8195, 16387, 32771, 65539,
+}
+var ml_bits = [53]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+	12, 13, 14, 15, 16,
+}
+
+// Default distributions of the codes, for the predefined mode.
+var ll_default = []int16{
+	4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+	-1, -1, -1, -1,
+}
+var ml_default = []int16{
+	1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+	-1, -1, -1, -1, -1,
+}
+var of_default = []int16{
+	1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+}
+
+const (
+	ll_default_log = 6
+	ml_default_log = 6
+	of_default_log = 5
+	ll_max_log     = 9
+	ml_max_log     = 9
+	of_max_log     = 8
+	// largest offset code the decoder accepts
+	of_max_code = 31
+)
+
+func highbit(v uint32) int {
+	return bits.Len32(v) - 1
+}
+
+// Cells of the table of a distribution, in the order of the states.
+// Symbols with a probability of less than 1 take the last cells.
+func fse_spread(norm []int16, log int) ([]uint8, error) {
+	size := 1 << log
+	symbols := make([]uint8, size)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			if high < 0 {
+				return nil, errZstdCorrupt
+			}
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+	pos := 0
+	step := (size >> 1) + (size >> 3) + 3
+	mask := size - 1
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, errZstdCorrupt
+	}
+	return symbols, nil
+}
+
+type fse_cell struct {
+	symbol   uint8
+	nbits    uint8
+	baseline uint16
+}
+
+// Decoding table of a distribution, the state is the index of its cell.
+type fse_table struct {
+	log   int
+	cells []fse_cell
+}
+
+func new_fse_table(norm []int16, log int) (*fse_table, error) {
+	symbols, err := fse_spread(norm, log)
+	if err != nil {
+		return nil, err
+	}
+	size := 1 << log
+	next := make([]uint32, len(norm))
+	for s, n := range norm {
+		if n == -1 {
+			next[s] = 1
+		} else {
+			next[s] = uint32(n)
+		}
+	}
+	t := &fse_table{log: log, cells: make([]fse_cell, size)}
+	for state, s := range symbols {
+		n := next[s]
+		next[s]++
+		nbits := log - highbit(n)
+		t.cells[state] = fse_cell{
+			symbol:   s,
+			nbits:    uint8(nbits),
+			baseline: uint16((n << nbits) - uint32(size)),
+		}
+	}
+	return t, nil
+}
+
+// Table of a single symbol, the state never changes.
+func rle_fse_table(symbol uint8) *fse_table {
+	return &fse_table{log: 0, cells: []fse_cell{{symbol: symbol}}}
+}
+
+func must_fse_table(norm []int16, log int) *fse_table {
+	t, err := new_fse_table(norm, log)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+var (
+	ll_default_table = must_fse_table(ll_default, ll_default_log)
+	ml_default_table = must_fse_table(ml_default, ml_default_log)
+	of_default_table = must_fse_table(of_default, of_default_log)
+)
+
+// Distribution of the counts over the 1<<log cells of a table, every
+// symbol counted has at least one cell.
+func fse_normalize(counts []int, log int) []int16 {
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	size := 1 << log
+	norm := make([]int16, len(counts))
+	sum := 0
+	largest := -1
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		n := c * size / total
+		if n < 1 {
+			n = 1
+		}
+		norm[s] = int16(n)
+		sum += n
+		if largest < 0 || c > counts[largest] {
+			largest = s
+		}
+	}
+	// the rounding goes to the most frequent symbols
+	if sum < size {
+		norm[largest] += int16(size - sum)
+	}
+	for ; sum > size; sum-- {
+		most := largest
+		for s, n := range norm {
+			if n > norm[most] {
+				most = s
+			}
+		}
+		norm[most]--
+	}
+	return norm
+}
+
+// Append the description of a distribution, read by read_fse_table.
+func write_fse_table(w *bit_writer, norm []int16, log int) {
+	w.add(uint64(log-5), 4)
+	remaining := (1 << log) + 1
+	threshold := 1 << log
+	nbits := log + 1
+	previous0 := false
+	for s := 0; s < len(norm) && remaining > 1; {
+		if previous0 {
+			start := s
+			for s < len(norm) && norm[s] == 0 {
+				s++
+			}
+			zeros := s - start
+			for ; zeros >= 3; zeros -= 3 {
+				w.add(3, 2)
+			}
+			w.add(uint64(zeros), 2)
+		}
+		count := int(norm[s])
+		s++
+		limit := (2*threshold - 1) - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += limit
+		}
+		if count < limit {
+			w.add(uint64(count), uint(nbits-1))
+		} else {
+			w.add(uint64(count), uint(nbits))
+		}
+		previous0 = count == 1
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+}
+
+// Read a table description, the distribution of the symbols up to
+// max. Returns the table and the bytes read.
+func read_fse_table(data []byte, max int, maxlog int) (*fse_table, int, error) {
+	r := forward_bits{buf: data}
+	log := int(r.read(4)) + 5
+	if log > maxlog {
+		return nil, 0, errZstdCorrupt
+	}
+	remaining := (1 << log) + 1
+	threshold := 1 << log
+	nbits := log + 1
+	norm := []int16{}
+	previous0 := false
+	for remaining > 1 && len(norm) <= max {
+		if previous0 {
+			zeros := 0
+			for {
+				repeat := int(r.read(2))
+				zeros += repeat
+				if repeat != 3 {
+					break
+				}
+			}
+			for i := 0; i < zeros; i++ {
+				norm = append(norm, 0)
+			}
+			if len(norm) > max {
+				return nil, 0, errZstdCorrupt
+			}
+		}
+		limit := (2*threshold - 1) - remaining
+		var count int
+		if low := int(r.peek(nbits - 1)); low < limit {
+			count = low
+			r.skip(nbits - 1)
+		} else {
+			count = int(r.peek(nbits))
+			if count >= threshold {
+				count -= limit
+			}
+			r.skip(nbits)
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		norm = append(norm, int16(count))
+		previous0 = count == 0
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || len(norm) > max+1 || r.overflow() {
+		return nil, 0, errZstdCorrupt
+	}
+	t, err := new_fse_table(norm, log)
+	if err != nil {
+		return nil, 0, err
+	}
+	return t, (r.pos + 7) / 8, nil
+}
+
+// Bits read from the first byte, least significant first.
+type forward_bits struct {
+	buf []byte
+	pos int
+}
+
+func (r *forward_bits) peek(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		p := r.pos + i
+		if p/8 < len(r.buf) && r.buf[p/8]&(1<<(p%8)) != 0 {
+			v |= 1 << i
+		}
+	}
+	return v
+}
+
+func (r *forward_bits) skip(n int) {
+	r.pos += n
+}
+
+func (r *forward_bits) read(n int) uint32 {
+	v := r.peek(n)
+	r.skip(n)
+	return v
+}
+
+func (r *forward_bits) overflow() bool {
+	return r.pos > 8*len(r.buf)
+}
+
+// Bits read from the end, as written by bit_writer. The last byte
+// has a 1 bit above the data. Reads past the start give zeros.
+type reverse_bits struct {
+	buf []byte
+	// bits left to read
+	pos int
+}
+
+func new_reverse_bits(buf []byte) (*reverse_bits, error) {
+	if len(buf) == 0 || buf[len(buf)-1] == 0 {
+		return nil, errZstdCorrupt
+	}
+	pos := 8*(len(buf)-1) + highbit(uint32(buf[len(buf)-1]))
+	return &reverse_bits{buf: buf, pos: pos}, nil
+}
+
+// The n bits below the position, without reading them.
+func (r *reverse_bits) peek(n int) uint64 {
+	if n == 0 {
+		return 0
+	}
+	p := r.pos - n
+	shift := 0
+	if p < 0 {
+		// past the start, the missing low bits are zeros
+		shift = -p
+		n += p
+		p = 0
+		if n <= 0 {
+			return 0
+		}
+	}
+	i := p >> 3
+	var v uint64
+	if i+8 <= len(r.buf) {
+		v = binary.LittleEndian.Uint64(r.buf[i:])
+	} else {
+		for j := len(r.buf) - 1; j >= i; j-- {
+			v = v<<8 | uint64(r.buf[j])
+		}
+	}
+	v = (v >> (p & 7)) & (1<<n - 1)
+	return v << shift
+}
+
+func (r *reverse_bits) skip(n int) {
+	r.pos -= n
+}
+
+func (r *reverse_bits) read(n int) uint64 {
+	v := r.peek(n)
+	r.skip(n)
+	return v
+}
+
+// More bits were read than the stream has.
+func (r *reverse_bits) overflow() bool {
+	return r.pos < 0
+}
+
+// Bits written from the first byte, least significant first.
+type bit_writer struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+// Write the low n bits of v, n up to 32.
+func (w *bit_writer) add(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// Pad to a byte, for forward_bits.
+func (w *bit_writer) pad() []byte {
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc = 0
+		w.nbits = 0
+	}
+	return w.out
+}
+
+// Mark the end for reverse_bits, and pad to a byte.
+func (w *bit_writer) close() []byte {
+	w.add(1, 1)
+	return w.pad()
+}
@@ -0,0 +1,666 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Reads the contents of zstd frames, one block at a time.
+type zstd_reader struct {
+	in  *bufio.Reader
+	err error
+	// decoded, not read yet
+	out []byte
+	// a frame was read, the input can end
+	frames int
+
+	// state of the current frame
+	inframe  bool
+	window   int
+	size     int64 // content size, -1 if not given
+	decoded  int64
+	checksum *xxhash64
+	// the window, followed by the last block
+	hist  []byte
+	block []byte
+	reps  [3]uint32
+	// tables of the previous blocks, for the repeat modes
+	huffman    *huffman_table
+	ll, of, ml *fse_table
+}
+
+func new_zstd_reader(r io.Reader) *zstd_reader {
+	return &zstd_reader{in: bufio.NewReader(r)}
+}
+
+func (z *zstd_reader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// Decode the next block, of the next frame if the current one ended.
+func (z *zstd_reader) next() error {
+	if !z.inframe {
+		if err := z.read_frame_header(); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(z.in, header[:]); err != nil {
+		return truncated(err)
+	}
+	h := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+	last := h&1 != 0
+	btype := (h >> 1) & 3
+	size := int(h >> 3)
+	blockmax := zstd_block_max
+	if z.window < blockmax {
+		blockmax = z.window
+	}
+	if size > blockmax {
+		return errZstdCorrupt
+	}
+
+	// keep the window before the block, the output was read
+	if len(z.hist) > 2*z.window+zstd_block_max {
+		keep := copy(z.hist, z.hist[len(z.hist)-z.window:])
+		z.hist = z.hist[:keep]
+	}
+	start := len(z.hist)
+
+	switch btype {
+	case zstd_block_raw:
+		z.hist = grow(z.hist, size)
+		if _, err := io.ReadFull(z.in, z.hist[start:]); err != nil {
+			return truncated(err)
+		}
+	case zstd_block_rle:
+		b, err := z.in.ReadByte()
+		if err != nil {
+			return truncated(err)
+		}
+		for i := 0; i < size; i++ {
+			z.hist = append(z.hist, b)
+		}
+	case zstd_block_compressed:
+		if cap(z.block) < size {
+			z.block = make([]byte, size)
+		}
+		z.block = z.block[:size]
+		if _, err := io.ReadFull(z.in, z.block); err != nil {
+			return truncated(err)
+		}
+		if err := z.decode_block(z.block); err != nil {
+			return err
+		}
+	default:
+		return errZstdCorrupt
+	}
+
+	z.out = z.hist[start:]
+	z.decoded += int64(len(z.out))
+	if z.checksum != nil {
+		z.checksum.Write(z.out)
+	}
+	if z.size >= 0 && z.decoded > z.size {
+		return errZstdCorrupt
+	}
+	if last {
+		return z.end_frame()
+	}
+	return nil
+}
+
+func (z *zstd_reader) read_frame_header() error {
+	var magic [4]byte
+	for {
+		n, err := io.ReadFull(z.in, magic[:])
+		if n == 0 && err == io.EOF && z.frames > 0 {
+			return io.EOF
+		}
+		if err != nil {
+			return truncated(err)
+		}
+		m := binary.LittleEndian.Uint32(magic[:])
+		if m&zstd_skippable_mask != zstd_skippable_magic {
+			if m != zstd_magic {
+				return fmt.Errorf("invalid zstd blob: not a zstd frame")
+			}
+			break
+		}
+		if _, err := io.ReadFull(z.in, magic[:]); err != nil {
+			return truncated(err)
+		}
+		skip := int64(binary.LittleEndian.Uint32(magic[:]))
+		if _, err := io.CopyN(io.Discard, z.in, skip); err != nil {
+			return truncated(err)
+		}
+		z.frames++
+	}
+
+	fhd, err := z.in.ReadByte()
+	if err != nil {
+		return truncated(err)
+	}
+	if fhd&0x08 != 0 {
+		return errZstdCorrupt
+	}
+	single := fhd&0x20 != 0
+	window := 0
+	if !single {
+		wd, err := z.in.ReadByte()
+		if err != nil {
+			return truncated(err)
+		}
+		wlog := 10 + int(wd>>3)
+		if wlog > 30 {
+			return fmt.Errorf("zstd window too large")
+		}
+		base := 1 << wlog
+		window = base + (base/8)*int(wd&7)
+	}
+
+	var field [8]byte
+	dictsize := []int{0, 1, 2, 4}[fhd&3]
+	if _, err := io.ReadFull(z.in, field[:dictsize]); err != nil {
+		return truncated(err)
+	}
+	if binary.LittleEndian.Uint64(field[:]) != 0 {
+		return fmt.Errorf("zstd dictionaries are not supported")
+	}
+
+	field = [8]byte{}
+	fcssize := []int{0, 2, 4, 8}[fhd>>6]
+	if fcssize == 0 && single {
+		fcssize = 1
+	}
+	if _, err := io.ReadFull(z.in, field[:fcssize]); err != nil {
+		return truncated(err)
+	}
+	z.size = -1
+	if fcssize > 0 {
+		z.size = int64(binary.LittleEndian.Uint64(field[:]))
+		if fcssize == 2 {
+			z.size += 256
+		}
+		if z.size < 0 {
+			return errZstdCorrupt
+		}
+	}
+	if single {
+		if z.size > zstd_window_max {
+			return fmt.Errorf("zstd window too large")
+		}
+		window = int(z.size)
+	}
+	if window > zstd_window_max {
+		return fmt.Errorf("zstd window too large")
+	}
+
+	z.inframe = true
+	z.window = window
+	z.decoded = 0
+	z.checksum = nil
+	if fhd&0x04 != 0 {
+		z.checksum = new_xxhash64()
+	}
+	z.hist = z.hist[:0]
+	z.reps = [3]uint32{1, 4, 8}
+	z.huffman = nil
+	z.ll, z.of, z.ml = nil, nil, nil
+	return nil
+}
+
+func (z *zstd_reader) end_frame() error {
+	if z.size >= 0 && z.decoded != z.size {
+		return errZstdCorrupt
+	}
+	if z.checksum != nil {
+		var sum [4]byte
+		if _, err := io.ReadFull(z.in, sum[:]); err != nil {
+			return truncated(err)
+		}
+		if binary.LittleEndian.Uint32(sum[:]) != uint32(z.checksum.Sum64()) {
+			return fmt.Errorf("invalid zstd blob: checksum mismatch")
+		}
+	}
+	z.inframe = false
+	z.frames++
+	return nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("invalid zstd blob: %w", io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// s extended by n bytes.
+func grow(s []byte, n int) []byte {
+	if cap(s)-len(s) < n {
+		bigger := make([]byte, len(s), 2*cap(s)+n)
+		copy(bigger, s)
+		s = bigger
+	}
+	return s[:len(s)+n]
+}
+
+// Decode a compressed block to the end of the window.
+func (z *zstd_reader) decode_block(data []byte) error {
+	literals, rest, err := z.decode_literals(data)
+	if err != nil {
+		return err
+	}
+	start := len(z.hist)
+	if err := z.decode_sequences(rest, literals); err != nil {
+		return err
+	}
+	if len(z.hist)-start > zstd_block_max {
+		return errZstdCorrupt
+	}
+	return nil
+}
+
+func (z *zstd_reader) decode_literals(data []byte) ([]byte, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errZstdCorrupt
+	}
+	ltype := data[0] & 3
+	format := (data[0] >> 2) & 3
+
+	if ltype == zstd_literals_raw || ltype == zstd_literals_rle {
+		var size, hsize int
+		switch format {
+		case 0, 2:
+			size, hsize = int(data[0]>>3), 1
+		case 1:
+			if len(data) < 2 {
+				return nil, nil, errZstdCorrupt
+			}
+			size, hsize = int(data[0]>>4)+int(data[1])<<4, 2
+		case 3:
+			if len(data) < 3 {
+				return nil, nil, errZstdCorrupt
+			}
+			size, hsize = int(data[0]>>4)+int(data[1])<<4+int(data[2])<<12, 3
+		}
+		if size > zstd_block_max {
+			return nil, nil, errZstdCorrupt
+		}
+		if ltype == zstd_literals_raw {
+			if len(data) < hsize+size {
+				return nil, nil, errZstdCorrupt
+			}
+			return data[hsize : hsize+size], data[hsize+size:], nil
+		}
+		if len(data) < hsize+1 {
+			return nil, nil, errZstdCorrupt
+		}
+		literals := make([]byte, size)
+		for i := range literals {
+			literals[i] = data[hsize]
+		}
+		return literals, data[hsize+1:], nil
+	}
+
+	streams := 4
+	var hsize, nbits int
+	switch format {
+	case 0:
+		streams, hsize, nbits = 1, 3, 10
+	case 1:
+		hsize, nbits = 3, 10
+	case 2:
+		hsize, nbits = 4, 14
+	case 3:
+		hsize, nbits = 5, 18
+	}
+	if len(data) < hsize {
+		return nil, nil, errZstdCorrupt
+	}
+	var field [8]byte
+	copy(field[:], data[:hsize])
+	h := binary.LittleEndian.Uint64(field[:])
+	mask := uint64(1)<<nbits - 1
+	size := int((h >> 4) & mask)
+	csize := int((h >> (4 + nbits)) & mask)
+	if size > zstd_block_max || len(data) < hsize+csize {
+		return nil, nil, errZstdCorrupt
+	}
+	payload := data[hsize : hsize+csize]
+	rest := data[hsize+csize:]
+
+	if ltype == zstd_literals_compressed {
+		table, used, err := read_huffman_table(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		z.huffman = table
+		payload = payload[used:]
+	} else if z.huffman == nil {
+		return nil, nil, errZstdCorrupt
+	}
+
+	literals := make([]byte, 0, size)
+	if streams == 1 {
+		literals, err := z.huffman.decode(literals, payload, size)
+		return literals, rest, err
+	}
+	if len(payload) < 6 {
+		return nil, nil, errZstdCorrupt
+	}
+	sizes := [4]int{
+		int(binary.LittleEndian.Uint16(payload[0:])),
+		int(binary.LittleEndian.Uint16(payload[2:])),
+		int(binary.LittleEndian.Uint16(payload[4:])),
+	}
+	payload = payload[6:]
+	sizes[3] = len(payload) - sizes[0] - sizes[1] - sizes[2]
+	segment := (size + 3) / 4
+	if sizes[3] < 0 || size < 3*segment {
+		return nil, nil, errZstdCorrupt
+	}
+	for i, csize := range sizes {
+		n := segment
+		if i == 3 {
+			n = size - 3*segment
+		}
+		var err error
+		if literals, err = z.huffman.decode(literals, payload[:csize], n); err != nil {
+			return nil, nil, err
+		}
+		payload = payload[csize:]
+	}
+	return literals, rest, nil
+}
+
+type huffman_entry struct {
+	symbol uint8
+	nbits  uint8
+}
+
+// Decoding table of the prefix codes of the literals, indexed by
+// the next max bits of the stream.
+type huffman_table struct {
+	max     int
+	entries []huffman_entry
+}
+
+// Read the weights of the literals, returns the table and the bytes read.
+func read_huffman_table(data []byte) (*huffman_table, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	weights := []uint8{}
+	used := 0
+	if header := int(data[0]); header >= 128 {
+		// 4 bits per weight
+		n := header - 127
+		used = 1 + (n+1)/2
+		if len(data) < used {
+			return nil, 0, errZstdCorrupt
+		}
+		for i := 0; i < n; i++ {
+			b := data[1+i/2]
+			if i%2 == 0 {
+				weights = append(weights, b>>4)
+			} else {
+				weights = append(weights, b&15)
+			}
+		}
+	} else {
+		// weights compressed by two interleaved fse states
+		used = 1 + header
+		if len(data) < used {
+			return nil, 0, errZstdCorrupt
+		}
+		var err error
+		if weights, err = read_fse_weights(data[1:used]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// the weight of the last symbol completes a power of 2
+	total := uint32(0)
+	for _, w := range weights {
+		if w > huffman_max_bits+1 {
+			return nil, 0, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 || len(weights) > 255 {
+		return nil, 0, errZstdCorrupt
+	}
+	max := highbit(total) + 1
+	rest := uint32(1)<<max - total
+	if max > huffman_max_bits+1 || rest&(rest-1) != 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	weights = append(weights, uint8(highbit(rest)+1))
+
+	// codes of the lowest weights first, the symbols in order
+	t := &huffman_table{max: max, entries: make([]huffman_entry, 1<<max)}
+	pos := 0
+	for w := 1; w <= max; w++ {
+		for s, sw := range weights {
+			if int(sw) != w {
+				continue
+			}
+			n := 1 << (w - 1)
+			for i := pos; i < pos+n; i++ {
+				t.entries[i] = huffman_entry{symbol: uint8(s), nbits: uint8(max + 1 - w)}
+			}
+			pos += n
+		}
+	}
+	return t, used, nil
+}
+
+func read_fse_weights(data []byte) ([]uint8, error) {
+	table, used, err := read_fse_table(data, 255, 6)
+	if err != nil {
+		return nil, err
+	}
+	br, err := new_reverse_bits(data[used:])
+	if err != nil {
+		return nil, err
+	}
+	states := [2]int{int(br.read(table.log)), int(br.read(table.log))}
+	weights := []uint8{}
+	for i := 0; ; i = 1 - i {
+		if len(weights) >= 255 {
+			return nil, errZstdCorrupt
+		}
+		cell := table.cells[states[i]]
+		weights = append(weights, cell.symbol)
+		states[i] = int(cell.baseline) + int(br.read(int(cell.nbits)))
+		if br.overflow() {
+			weights = append(weights, table.cells[states[1-i]].symbol)
+			break
+		}
+	}
+	return weights, nil
+}
+
+// Append the n literals of a stream to out.
+func (t *huffman_table) decode(out []byte, stream []byte, n int) ([]byte, error) {
+	br, err := new_reverse_bits(stream)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		e := t.entries[br.peek(t.max)]
+		out = append(out, e.symbol)
+		br.skip(int(e.nbits))
+	}
+	if br.pos != 0 {
+		return nil, errZstdCorrupt
+	}
+	return out, nil
+}
+
+// Table of a sequence code, by its compression mode.
+func (z *zstd_reader) sequence_table(mode byte, data []byte, previous *fse_table,
+	predefined *fse_table, max int, maxlog int) (*fse_table, int, error) {
+	switch mode {
+	case zstd_mode_predefined:
+		return predefined, 0, nil
+	case zstd_mode_rle:
+		if len(data) < 1 || int(data[0]) > max {
+			return nil, 0, errZstdCorrupt
+		}
+		return rle_fse_table(data[0]), 1, nil
+	case zstd_mode_fse:
+		return read_fse_table(data, max, maxlog)
+	}
+	if previous == nil {
+		return nil, 0, errZstdCorrupt
+	}
+	return previous, 0, nil
+}
+
+var errZstdSequence = errors.New("invalid zstd blob: bad sequence")
+
+// Decode the sequences, and append the literals and the matches to the window.
+func (z *zstd_reader) decode_sequences(data []byte, literals []byte) error {
+	if len(data) == 0 {
+		return errZstdCorrupt
+	}
+	count := int(data[0])
+	switch {
+	case count == 0:
+		if len(data) != 1 {
+			return errZstdCorrupt
+		}
+		z.hist = append(z.hist, literals...)
+		return nil
+	case count < 128:
+		data = data[1:]
+	case count < 255:
+		if len(data) < 2 {
+			return errZstdCorrupt
+		}
+		count = (count-128)<<8 + int(data[1])
+		data = data[2:]
+	default:
+		if len(data) < 3 {
+			return errZstdCorrupt
+		}
+		count = int(data[1]) + int(data[2])<<8 + 0x7F00
+		data = data[3:]
+	}
+	if len(data) < 1 || data[0]&3 != 0 {
+		return errZstdCorrupt
+	}
+	modes := data[0]
+	data = data[1:]
+
+	var used int
+	var err error
+	if z.ll, used, err = z.sequence_table(modes>>6, data, z.ll, ll_default_table, 35, ll_max_log); err != nil {
+		return err
+	}
+	data = data[used:]
+	if z.of, used, err = z.sequence_table((modes>>4)&3, data, z.of, of_default_table, of_max_code, of_max_log); err != nil {
+		return err
+	}
+	data = data[used:]
+	if z.ml, used, err = z.sequence_table((modes>>2)&3, data, z.ml, ml_default_table, 52, ml_max_log); err != nil {
+		return err
+	}
+	data = data[used:]
+
+	br, err := new_reverse_bits(data)
+	if err != nil {
+		return err
+	}
+	llstate := int(br.read(z.ll.log))
+	ofstate := int(br.read(z.of.log))
+	mlstate := int(br.read(z.ml.log))
+
+	for i := 0; i < count; i++ {
+		llcell := z.ll.cells[llstate]
+		ofcell := z.of.cells[ofstate]
+		mlcell := z.ml.cells[mlstate]
+		if ofcell.symbol > of_max_code || int(mlcell.symbol) >= len(ml_base) || int(llcell.symbol) >= len(ll_base) {
+			return errZstdSequence
+		}
+
+		ofvalue := uint32(1)<<ofcell.symbol + uint32(br.read(int(ofcell.symbol)))
+		matchlen := int(ml_base[mlcell.symbol]) + int(br.read(int(ml_bits[mlcell.symbol])))
+		litlen := int(ll_base[llcell.symbol]) + int(br.read(int(ll_bits[llcell.symbol])))
+
+		var offset uint32
+		if ofvalue > 3 {
+			offset = ofvalue - 3
+			z.reps = [3]uint32{offset, z.reps[0], z.reps[1]}
+		} else {
+			repeat := int(ofvalue) - 1
+			if litlen == 0 {
+				repeat++
+			}
+			switch repeat {
+			case 0:
+				offset = z.reps[0]
+			case 1:
+				offset = z.reps[1]
+				z.reps[1] = z.reps[0]
+				z.reps[0] = offset
+			default:
+				if repeat == 3 {
+					offset = z.reps[0] - 1
+				} else {
+					offset = z.reps[2]
+				}
+				z.reps = [3]uint32{offset, z.reps[0], z.reps[1]}
+			}
+		}
+
+		if i < count-1 {
+			llstate = int(llcell.baseline) + int(br.read(int(llcell.nbits)))
+			mlstate = int(mlcell.baseline) + int(br.read(int(mlcell.nbits)))
+			ofstate = int(ofcell.baseline) + int(br.read(int(ofcell.nbits)))
+		}
+		if br.overflow() {
+			return errZstdSequence
+		}
+
+		if litlen > len(literals) {
+			return errZstdSequence
+		}
+		z.hist = append(z.hist, literals[:litlen]...)
+		literals = literals[litlen:]
+
+		if offset == 0 || int(offset) > len(z.hist) {
+			return errZstdSequence
+		}
+		from := len(z.hist) - int(offset)
+		if int(offset) >= matchlen {
+			z.hist = append(z.hist, z.hist[from:from+matchlen]...)
+		} else {
+			for k := 0; k < matchlen; k++ {
+				z.hist = append(z.hist, z.hist[from+k])
+			}
+		}
+	}
+	if br.pos != 0 {
+		return errZstdSequence
+	}
+	z.hist = append(z.hist, literals...)
+	return nil
+}
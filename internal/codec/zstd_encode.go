@@ -0,0 +1,791 @@
+package codec
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+)
+
+// Matches are searched in the last MiB, the window of the frames.
+const zstd_window_log = 20
+const zstd_window = 1 << zstd_window_log
+
+const zstd_hash_log = 17
+const zstd_min_match = 4
+
+// Writes a single zstd frame, with a checksum of the contents. The
+// literals are coded by Huffman codes when it is shorter, the
+// sequences by the tables of their counts in the block or the
+// predefined ones.
+type zstd_writer struct {
+	w   io.Writer
+	err error
+	// the window, followed by the input of the next block
+	hist []byte
+	// start of the input not written yet
+	pos int
+	// positions+1 of the last 4 bytes of each hash
+	table    []int32
+	reps     [3]uint32
+	checksum *xxhash64
+	started  bool
+	closed   bool
+
+	// buffers of a block
+	literals  []byte
+	sequences []zstd_sequence
+	out       []byte
+}
+
+type zstd_sequence struct {
+	litlen   uint32
+	matchlen uint32
+	// offset value, the repeat codes 1 to 3 or the offset + 3
+	offvalue uint32
+}
+
+func new_zstd_writer(w io.Writer) *zstd_writer {
+	return &zstd_writer{
+		w:        w,
+		table:    make([]int32, 1<<zstd_hash_log),
+		reps:     [3]uint32{1, 4, 8},
+		checksum: new_xxhash64(),
+	}
+}
+
+func (z *zstd_writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	z.checksum.Write(p)
+	n := len(p)
+	for len(p) > 0 {
+		room := zstd_block_max - (len(z.hist) - z.pos)
+		if room > len(p) {
+			room = len(p)
+		}
+		z.hist = append(z.hist, p[:room]...)
+		p = p[room:]
+		// a block is written once more input follows it, the last one on Close
+		if len(z.hist)-z.pos == zstd_block_max && len(p) > 0 {
+			if z.err = z.write_block(false); z.err != nil {
+				return 0, z.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Write the last block and the checksum.
+func (z *zstd_writer) Close() error {
+	if z.err != nil || z.closed {
+		return z.err
+	}
+	z.closed = true
+	if z.err = z.write_block(true); z.err != nil {
+		return z.err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(z.checksum.Sum64()))
+	_, z.err = z.w.Write(sum[:])
+	return z.err
+}
+
+func (z *zstd_writer) write_header() error {
+	// no content size, a window descriptor, a checksum
+	header := []byte{0, 0, 0, 0, 0x04, (zstd_window_log - 10) << 3}
+	binary.LittleEndian.PutUint32(header, zstd_magic)
+	_, err := z.w.Write(header)
+	return err
+}
+
+func (z *zstd_writer) write_block(last bool) error {
+	if !z.started {
+		z.started = true
+		if err := z.write_header(); err != nil {
+			return err
+		}
+	}
+	z.slide()
+	src := z.hist[z.pos:]
+	flag := uint32(0)
+	if last {
+		flag = 1
+	}
+
+	z.out = z.out[:0]
+	if len(src) > 0 && all_same(src) {
+		z.out = append_block_header(z.out, flag|zstd_block_rle<<1, len(src))
+		z.out = append(z.out, src[0])
+	} else {
+		z.out = append_block_header(z.out, flag|zstd_block_compressed<<1, 0)
+		var reps [3]uint32
+		z.out, reps = z.compress_block(z.out)
+		size := len(z.out) - 3
+		if size >= len(src) {
+			// stored as is, the repeat offsets are unchanged
+			z.out = append_block_header(z.out[:0], flag|zstd_block_raw<<1, len(src))
+			z.out = append(z.out, src...)
+		} else {
+			append_block_header(z.out[:0], flag|zstd_block_compressed<<1, size)
+			z.reps = reps
+		}
+	}
+	z.pos = len(z.hist)
+	_, err := z.w.Write(z.out)
+	return err
+}
+
+func append_block_header(out []byte, flags uint32, size int) []byte {
+	h := flags | uint32(size)<<3
+	return append(out, byte(h), byte(h>>8), byte(h>>16))
+}
+
+func all_same(b []byte) bool {
+	for _, c := range b[1:] {
+		if c != b[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// Drop the data before the window, the positions of the hash table
+// are moved with it.
+func (z *zstd_writer) slide() {
+	if z.pos <= 2*zstd_window {
+		return
+	}
+	shift := z.pos - zstd_window
+	copy(z.hist, z.hist[shift:])
+	z.hist = z.hist[:len(z.hist)-shift]
+	z.pos -= shift
+	for i, p := range z.table {
+		if int(p) > shift {
+			z.table[i] = p - int32(shift)
+		} else {
+			z.table[i] = 0
+		}
+	}
+}
+
+func hash4(b []byte) uint32 {
+	return (binary.LittleEndian.Uint32(b) * 2654435761) >> (32 - zstd_hash_log)
+}
+
+// Length of the common prefix of a and b.
+func match_length(a []byte, b []byte) int {
+	n := 0
+	for n+8 <= len(a) && n+8 <= len(b) {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			for x&0xff == 0 {
+				x >>= 8
+				n++
+			}
+			return n
+		}
+		n += 8
+	}
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// Find the matches of the block, greedily. Returns the block appended
+// to out, and the repeat offsets after it.
+func (z *zstd_writer) compress_block(out []byte) ([]byte, [3]uint32) {
+	hist := z.hist
+	end := len(hist)
+	reps := z.reps
+	z.literals = z.literals[:0]
+	z.sequences = z.sequences[:0]
+
+	anchor := z.pos
+	i := z.pos
+	// the last bytes are left to the literals
+	limit := end - 8
+	for i < limit {
+		var offset, length int
+		h := hash4(hist[i:])
+		candidate := int(z.table[h]) - 1
+		z.table[h] = int32(i + 1)
+
+		// the last offset is cheaper, checked first
+		if r := int(reps[0]); i > anchor && r <= i &&
+			binary.LittleEndian.Uint32(hist[i:]) == binary.LittleEndian.Uint32(hist[i-r:]) {
+			offset = r
+			length = zstd_min_match + match_length(hist[i+zstd_min_match:end], hist[i-r+zstd_min_match:])
+		} else if candidate >= 0 && i-candidate <= zstd_window &&
+			binary.LittleEndian.Uint32(hist[i:]) == binary.LittleEndian.Uint32(hist[candidate:]) {
+			offset = i - candidate
+			length = zstd_min_match + match_length(hist[i+zstd_min_match:end], hist[candidate+zstd_min_match:])
+		} else {
+			// skip faster over the data without matches
+			i += 1 + (i-anchor)>>6
+			continue
+		}
+
+		// extend backwards over the literals
+		for i > anchor && i-offset > 0 && hist[i-1] == hist[i-offset-1] {
+			i--
+			length++
+		}
+
+		litlen := i - anchor
+		z.literals = append(z.literals, hist[anchor:i]...)
+		z.sequences = append(z.sequences, zstd_sequence{
+			litlen:   uint32(litlen),
+			matchlen: uint32(length),
+			offvalue: offset_value(&reps, uint32(offset), litlen),
+		})
+
+		// index some of the matched positions
+		next := i + length
+		for p := i + 1; p < next && p < limit; p += 3 {
+			z.table[hash4(hist[p:])] = int32(p + 1)
+		}
+		i = next
+		anchor = next
+	}
+	z.literals = append(z.literals, hist[anchor:end]...)
+
+	out = encode_literals(out, z.literals)
+	out = encode_sequences(out, z.sequences)
+	return out, reps
+}
+
+// Offset value of a match, a repeat code if it is one of the
+// repeat offsets, and the repeat offsets after it.
+func offset_value(reps *[3]uint32, offset uint32, litlen int) uint32 {
+	if litlen > 0 {
+		switch offset {
+		case reps[0]:
+			return 1
+		case reps[1]:
+			reps[0], reps[1] = reps[1], reps[0]
+			return 2
+		case reps[2]:
+			*reps = [3]uint32{offset, reps[0], reps[1]}
+			return 3
+		}
+	} else {
+		switch offset {
+		case reps[1]:
+			reps[0], reps[1] = reps[1], reps[0]
+			return 1
+		case reps[2]:
+			*reps = [3]uint32{offset, reps[0], reps[1]}
+			return 2
+		case reps[0] - 1:
+			*reps = [3]uint32{offset, reps[0], reps[1]}
+			return 3
+		}
+	}
+	*reps = [3]uint32{offset, reps[0], reps[1]}
+	return offset + 3
+}
+
+// Append the literals section, Huffman coded if shorter than raw.
+func encode_literals(out []byte, literals []byte) []byte {
+	n := len(literals)
+	if n > 0 && all_same(literals) {
+		out = append_literals_header(out, zstd_literals_rle, n)
+		return append(out, literals[0])
+	}
+	if n >= 64 {
+		if coded := huffman_literals(literals); coded != nil && len(coded) < n {
+			return append(out, coded...)
+		}
+	}
+	out = append_literals_header(out, zstd_literals_raw, n)
+	return append(out, literals...)
+}
+
+func append_literals_header(out []byte, ltype byte, size int) []byte {
+	switch {
+	case size < 32:
+		return append(out, ltype|byte(size)<<3)
+	case size < 4096:
+		return append(out, ltype|1<<2|byte(size)<<4, byte(size>>4))
+	}
+	return append(out, ltype|3<<2|byte(size)<<4, byte(size>>4), byte(size>>12))
+}
+
+// Huffman coded literals section, nil if it cannot be written.
+func huffman_literals(literals []byte) []byte {
+	var counts [256]int
+	for _, b := range literals {
+		counts[b]++
+	}
+	lengths := huffman_lengths(counts[:], huffman_max_bits)
+	last := 0
+	maxbits := 0
+	for s, l := range lengths {
+		if l > 0 {
+			last = s
+			if l > maxbits {
+				maxbits = l
+			}
+		}
+	}
+	// weights of the symbols but the last
+	weights := make([]uint8, last)
+	for s := range weights {
+		weights[s] = huffman_weight(lengths[s], maxbits)
+	}
+	tree := fse_weights(weights)
+	if last <= 128 && (tree == nil || len(tree) > 1+(last+1)/2) {
+		tree = []byte{byte(127 + last)}
+		for s := 0; s < last; s += 2 {
+			b := weights[s] << 4
+			if s+1 < last {
+				b |= weights[s+1]
+			}
+			tree = append(tree, b)
+		}
+	}
+	if tree == nil {
+		return nil
+	}
+	codes := huffman_codes(lengths, maxbits)
+
+	n := len(literals)
+	var streams [][]byte
+	if n <= 1023 {
+		streams = [][]byte{huffman_stream(literals, codes, lengths)}
+	} else {
+		segment := (n + 3) / 4
+		for i := 0; i < 4; i++ {
+			from, to := i*segment, (i+1)*segment
+			if to > n {
+				to = n
+			}
+			streams = append(streams, huffman_stream(literals[from:to], codes, lengths))
+		}
+	}
+
+	payload := append([]byte{}, tree...)
+	if len(streams) == 4 {
+		for _, s := range streams[:3] {
+			if len(s) > 0xffff {
+				return nil
+			}
+			payload = append(payload, byte(len(s)), byte(len(s)>>8))
+		}
+	}
+	for _, s := range streams {
+		payload = append(payload, s...)
+	}
+
+	size, csize := uint64(n), uint64(len(payload))
+	var header []byte
+	switch {
+	case len(streams) == 1 && csize <= 1023:
+		h := uint64(zstd_literals_compressed) | size<<4 | csize<<14
+		header = []byte{byte(h), byte(h >> 8), byte(h >> 16)}
+	case len(streams) == 1:
+		return nil
+	case size <= 1023 && csize <= 1023:
+		h := uint64(zstd_literals_compressed) | 1<<2 | size<<4 | csize<<14
+		header = []byte{byte(h), byte(h >> 8), byte(h >> 16)}
+	case size <= 16383 && csize <= 16383:
+		h := uint64(zstd_literals_compressed) | 2<<2 | size<<4 | csize<<18
+		header = []byte{byte(h), byte(h >> 8), byte(h >> 16), byte(h >> 24)}
+	default:
+		h := uint64(zstd_literals_compressed) | 3<<2 | size<<4 | csize<<22
+		header = []byte{byte(h), byte(h >> 8), byte(h >> 16), byte(h >> 24), byte(h >> 32)}
+	}
+	return append(header, payload...)
+}
+
+// Weights compressed by two interleaved fse states, nil if they do
+// not fit. The decoder stops when it reads past the stream, which a
+// state without bits cannot do, the description is read back to be
+// sure of it.
+func fse_weights(weights []uint8) []byte {
+	n := len(weights)
+	if n < 2 {
+		return nil
+	}
+	counts := make([]int, huffman_max_bits+1)
+	for _, w := range weights {
+		counts[w]++
+	}
+	const log = 6
+	norm := fse_normalize(counts, log)
+	w := bit_writer{out: []byte{0}}
+	write_fse_table(&w, norm, log)
+	w.pad()
+	enc := new_fse_encoder(norm, log)
+
+	// the first weight is read from the first state, written last
+	var state1, state2 uint32
+	i := n - 2
+	if n%2 == 1 {
+		state1, state2 = enc.init(weights[n-1]), enc.init(weights[n-2])
+		state1 = enc.encode(&w, state1, weights[n-3])
+		i = n - 3
+	} else {
+		state2, state1 = enc.init(weights[n-1]), enc.init(weights[n-2])
+	}
+	for ; i > 0; i -= 2 {
+		state2 = enc.encode(&w, state2, weights[i-1])
+		state1 = enc.encode(&w, state1, weights[i-2])
+	}
+	enc.flush(&w, state2)
+	enc.flush(&w, state1)
+	tree := w.close()
+	if len(tree)-1 >= 128 {
+		return nil
+	}
+	tree[0] = byte(len(tree) - 1)
+	if read, err := read_fse_weights(tree[1:]); err != nil || !bytes.Equal(read, weights) {
+		return nil
+	}
+	return tree
+}
+
+func huffman_weight(length int, maxbits int) byte {
+	if length == 0 {
+		return 0
+	}
+	return byte(maxbits + 1 - length)
+}
+
+// Codes of the lengths, in the order of read_huffman_table: the
+// longest codes first, the symbols in order.
+func huffman_codes(lengths []int, maxbits int) []uint32 {
+	codes := make([]uint32, len(lengths))
+	pos := uint32(0)
+	for l := maxbits; l >= 1; l-- {
+		for s, sl := range lengths {
+			if sl == l {
+				codes[s] = pos >> (maxbits - l)
+				pos += 1 << (maxbits - l)
+			}
+		}
+	}
+	return codes
+}
+
+// The literals are read from the end, the first one is written last.
+func huffman_stream(literals []byte, codes []uint32, lengths []int) []byte {
+	w := bit_writer{}
+	for i := len(literals) - 1; i >= 0; i-- {
+		s := literals[i]
+		w.add(uint64(codes[s]), uint(lengths[s]))
+	}
+	return w.close()
+}
+
+type huffman_node struct {
+	count   int
+	symbol  int
+	initial int
+	left    *huffman_node
+	right   *huffman_node
+}
+
+type huffman_heap []*huffman_node
+
+func (h huffman_heap) Len() int { return len(h) }
+func (h huffman_heap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].initial < h[j].initial
+}
+func (h huffman_heap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffman_heap) Push(x interface{}) { *h = append(*h, x.(*huffman_node)) }
+func (h *huffman_heap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// Code lengths of the symbols, at most max bits. The counts are
+// halved until the longest code fits.
+func huffman_lengths(counts []int, max int) []int {
+	counts = append([]int{}, counts...)
+	for {
+		lengths := make([]int, len(counts))
+		h := huffman_heap{}
+		order := 0
+		for s, c := range counts {
+			if c > 0 {
+				h = append(h, &huffman_node{count: c, symbol: s, initial: order})
+				order++
+			}
+		}
+		if len(h) == 1 {
+			lengths[h[0].symbol] = 1
+			return lengths
+		}
+		heap.Init(&h)
+		for h.Len() > 1 {
+			a := heap.Pop(&h).(*huffman_node)
+			b := heap.Pop(&h).(*huffman_node)
+			heap.Push(&h, &huffman_node{count: a.count + b.count, symbol: -1, initial: order, left: a, right: b})
+			order++
+		}
+		longest := assign_lengths(h[0], 0, lengths)
+		if longest <= max {
+			return lengths
+		}
+		for s, c := range counts {
+			if c > 0 {
+				counts[s] = (c + 1) / 2
+			}
+		}
+	}
+}
+
+func assign_lengths(n *huffman_node, depth int, lengths []int) int {
+	if n.symbol >= 0 {
+		lengths[n.symbol] = depth
+		return depth
+	}
+	l := assign_lengths(n.left, depth+1, lengths)
+	if r := assign_lengths(n.right, depth+1, lengths); r > l {
+		return r
+	}
+	return l
+}
+
+// Encoding table of a distribution, the states are the cells of
+// new_fse_table plus the table size.
+type fse_encoder struct {
+	log    int
+	states []uint16
+	// per symbol
+	deltabits  []uint32
+	deltastate []int32
+}
+
+func new_fse_encoder(norm []int16, log int) *fse_encoder {
+	symbols, err := fse_spread(norm, log)
+	if err != nil {
+		panic(err)
+	}
+	size := 1 << log
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			n = 1
+		}
+		cumul[s+1] = cumul[s] + int(n)
+	}
+	e := &fse_encoder{
+		log:        log,
+		states:     make([]uint16, size),
+		deltabits:  make([]uint32, len(norm)),
+		deltastate: make([]int32, len(norm)),
+	}
+	// the cells of a symbol in the order of the decoding states
+	next := append([]int{}, cumul...)
+	for u, s := range symbols {
+		e.states[next[s]] = uint16(size + u)
+		next[s]++
+	}
+	for s, n := range norm {
+		switch {
+		case n == 0:
+			e.deltabits[s] = uint32((log+1)<<16 - size)
+		case n == -1 || n == 1:
+			e.deltabits[s] = uint32(log<<16 - size)
+			e.deltastate[s] = int32(cumul[s] - 1)
+		default:
+			maxbits := log - highbit(uint32(n-1))
+			minstate := int(n) << maxbits
+			e.deltabits[s] = uint32(maxbits<<16 - minstate)
+			e.deltastate[s] = int32(cumul[s] - int(n))
+		}
+	}
+	return e
+}
+
+// Encoder of a single symbol, written without bits.
+var rle_fse_encoder = &fse_encoder{}
+
+// State of the last symbol written, the first one read.
+func (e *fse_encoder) init(symbol uint8) uint32 {
+	if e.log == 0 {
+		return 0
+	}
+	nbits := (e.deltabits[symbol] + 1<<15) >> 16
+	value := nbits<<16 - e.deltabits[symbol]
+	return uint32(e.states[int32(value>>nbits)+e.deltastate[symbol]])
+}
+
+func (e *fse_encoder) encode(w *bit_writer, state uint32, symbol uint8) uint32 {
+	if e.log == 0 {
+		return 0
+	}
+	nbits := (state + e.deltabits[symbol]) >> 16
+	w.add(uint64(state), uint(nbits))
+	return uint32(e.states[int32(state>>nbits)+e.deltastate[symbol]])
+}
+
+func (e *fse_encoder) flush(w *bit_writer, state uint32) {
+	w.add(uint64(state), uint(e.log))
+}
+
+var (
+	ll_default_encoder = new_fse_encoder(ll_default, ll_default_log)
+	ml_default_encoder = new_fse_encoder(ml_default, ml_default_log)
+	of_default_encoder = new_fse_encoder(of_default, of_default_log)
+)
+
+// codes of the short lengths, the longer ones are computed
+var ll_codes = code_table(ll_base[:], 64)
+var ml_codes = code_table(ml_base[:], 128+3)
+
+func code_table(base []uint32, n int) []uint8 {
+	codes := make([]uint8, n)
+	for v := range codes {
+		c := sort.Search(len(base), func(i int) bool { return base[i] > uint32(v) }) - 1
+		if c < 0 {
+			c = 0
+		}
+		codes[v] = uint8(c)
+	}
+	return codes
+}
+
+func ll_code(litlen uint32) uint8 {
+	if litlen < 64 {
+		return ll_codes[litlen]
+	}
+	return uint8(highbit(litlen) + 19)
+}
+
+func ml_code(matchlen uint32) uint8 {
+	if matchlen < 128+3 {
+		return ml_codes[matchlen]
+	}
+	return uint8(highbit(matchlen-3) + 36)
+}
+
+// Table of the codes of a block, by its compression mode and the
+// description written before the sequences.
+type seq_table struct {
+	mode byte
+	desc []byte
+	enc  *fse_encoder
+}
+
+// The table writing the codes in the fewest bits, estimated from their
+// counts: a single code, the predefined table or the table of the counts.
+func choose_table(codes []uint8, nsymbols int, predefined []int16, deflog int,
+	defenc *fse_encoder, maxlog int) seq_table {
+	counts := make([]int, nsymbols)
+	distinct := 0
+	for _, c := range codes {
+		if counts[c] == 0 {
+			distinct++
+		}
+		counts[c]++
+	}
+	if distinct == 1 {
+		return seq_table{mode: zstd_mode_rle, desc: []byte{codes[0]}, enc: rle_fse_encoder}
+	}
+
+	log := highbit(uint32(len(codes)))
+	for 1<<log < distinct {
+		log++
+	}
+	if log < 5 {
+		log = 5
+	} else if log > maxlog {
+		log = maxlog
+	}
+	norm := fse_normalize(counts, log)
+	w := bit_writer{}
+	write_fse_table(&w, norm, log)
+	desc := w.pad()
+
+	if table_cost(counts, predefined, deflog) <= table_cost(counts, norm, log)+8*float64(len(desc)) {
+		return seq_table{mode: zstd_mode_predefined, enc: defenc}
+	}
+	return seq_table{mode: zstd_mode_fse, desc: desc, enc: new_fse_encoder(norm, log)}
+}
+
+// Bits of the states writing the counts, infinite if a symbol counted
+// has no cell.
+func table_cost(counts []int, norm []int16, log int) float64 {
+	bits := 0.0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if s >= len(norm) || norm[s] == 0 {
+			return math.Inf(1)
+		}
+		n := float64(norm[s])
+		if n < 0 {
+			n = 1
+		}
+		bits += float64(c) * (float64(log) - math.Log2(n))
+	}
+	return bits
+}
+
+// Append the sequences section.
+func encode_sequences(out []byte, seqs []zstd_sequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8)+128, byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	if n == 0 {
+		return out
+	}
+
+	llcodes := make([]uint8, n)
+	mlcodes := make([]uint8, n)
+	ofcodes := make([]uint8, n)
+	for i, s := range seqs {
+		llcodes[i] = ll_code(s.litlen)
+		mlcodes[i] = ml_code(s.matchlen)
+		ofcodes[i] = uint8(highbit(s.offvalue))
+	}
+	llt := choose_table(llcodes, len(ll_base), ll_default, ll_default_log, ll_default_encoder, ll_max_log)
+	oft := choose_table(ofcodes, of_max_code+1, of_default, of_default_log, of_default_encoder, of_max_log)
+	mlt := choose_table(mlcodes, len(ml_base), ml_default, ml_default_log, ml_default_encoder, ml_max_log)
+	out = append(out, llt.mode<<6|oft.mode<<4|mlt.mode<<2)
+	out = append(out, llt.desc...)
+	out = append(out, oft.desc...)
+	out = append(out, mlt.desc...)
+
+	ll, of, ml := llt.enc, oft.enc, mlt.enc
+	w := bit_writer{out: out}
+	// the extra bits of a sequence, read in the reverse order
+	extra := func(i int) {
+		s, llc, mlc, ofc := seqs[i], llcodes[i], mlcodes[i], ofcodes[i]
+		w.add(uint64(s.litlen-ll_base[llc]), uint(ll_bits[llc]))
+		w.add(uint64(s.matchlen-ml_base[mlc]), uint(ml_bits[mlc]))
+		w.add(uint64(s.offvalue-1<<ofc), uint(ofc))
+	}
+
+	mlstate, ofstate, llstate := ml.init(mlcodes[n-1]), of.init(ofcodes[n-1]), ll.init(llcodes[n-1])
+	extra(n - 1)
+	for i := n - 2; i >= 0; i-- {
+		ofstate = of.encode(&w, ofstate, ofcodes[i])
+		mlstate = ml.encode(&w, mlstate, mlcodes[i])
+		llstate = ll.encode(&w, llstate, llcodes[i])
+		extra(i)
+	}
+	ml.flush(&w, mlstate)
+	of.flush(&w, ofstate)
+	ll.flush(&w, llstate)
+	return w.close()
+}
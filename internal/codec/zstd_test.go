@@ -0,0 +1,220 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func zstd_compress(t *testing.T, data []byte) []byte {
+	t.Helper()
+	r, err := Compress(Zstd, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func zstd_decompress(blob []byte) ([]byte, error) {
+	r, err := Decompress(Zstd, ioutil.NopCloser(bytes.NewReader(blob)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Test contents of n bytes: random, text, a single byte repeated,
+// and random chunks repeated with a few changes.
+func zstd_data(kind string, n int) []byte {
+	r := rand.New(rand.NewSource(int64(n)))
+	data := make([]byte, n)
+	switch kind {
+	case "random":
+		r.Read(data)
+	case "text":
+		words := []string{"snap ", "shot ", "über ", "files\n", "restored, ", "42 ", "the "}
+		var b bytes.Buffer
+		for b.Len() < n {
+			b.WriteString(words[r.Intn(len(words))])
+		}
+		copy(data, b.Bytes())
+	case "same":
+		for i := range data {
+			data[i] = 'x'
+		}
+	case "chunks":
+		chunk := make([]byte, 5000)
+		r.Read(chunk)
+		for i := 0; i < n; i += len(chunk) {
+			copy(data[i:], chunk)
+		}
+		for i := 0; i < n/100; i++ {
+			data[r.Intn(n)] = byte(r.Intn(256))
+		}
+	}
+	return data
+}
+
+var zstd_sizes = []int{0, 1, 7, 64, 1000, zstd_block_max, zstd_block_max + 1, 300000}
+
+func TestZstdRoundTrip(t *testing.T) {
+	sizes := zstd_sizes
+	if !testing.Short() {
+		// past the window, the history is moved
+		sizes = append(sizes, 3*zstd_window+12345)
+	}
+	for _, kind := range []string{"random", "text", "same", "chunks"} {
+		for _, n := range sizes {
+			data := zstd_data(kind, n)
+			blob := zstd_compress(t, data)
+			got, err := zstd_decompress(blob)
+			if err != nil {
+				t.Errorf("%s %d bytes: %s", kind, n, err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("%s %d bytes: decompressed contents differ", kind, n)
+			}
+			if kind != "random" && n >= 10000 && len(blob) > n/2 {
+				t.Errorf("%s %d bytes: compressed to %d bytes", kind, n, len(blob))
+			}
+		}
+	}
+}
+
+// Written by zstd -19, with a content size and a checksum.
+const zstd_golden = "28b52ffd64e0053d020022430b10a0ed048af8ce185551bbe596d1ef9911091d" +
+	"5308109b6bf5d07de56a73ee03e773ecd9fa4c3fdeda382ac8010800a9ddac1f" +
+	"80730093014c0198073019c0083e4d9501a9929830"
+
+func zstd_golden_text() string {
+	var b strings.Builder
+	for i := 0; i < 40; i++ {
+		b.WriteString("snapshot " + string(rune('0'+i%7)) + " of the files, restored in order.\n")
+	}
+	return b.String()
+}
+
+func TestZstdGolden(t *testing.T) {
+	blob, _ := hex.DecodeString(zstd_golden)
+	got, err := zstd_decompress(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != zstd_golden_text() {
+		t.Errorf("decompressed %q", got)
+	}
+
+	// frames are read one after the other, skippable frames are ignored
+	skippable := []byte{0x50, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 1, 2, 3}
+	two := append(append(append([]byte{}, blob...), skippable...), zstd_compress(t, []byte("more"))...)
+	got, err = zstd_decompress(two)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != zstd_golden_text()+"more" {
+		t.Errorf("decompressed two frames to %d bytes", len(got))
+	}
+}
+
+func TestZstdErrors(t *testing.T) {
+	blob := zstd_compress(t, zstd_data("text", 5000))
+	last := len(blob) - 1
+
+	mismatch := append([]byte{}, blob...)
+	mismatch[last] ^= 1
+	if _, err := zstd_decompress(mismatch); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("checksum mismatch: %v", err)
+	}
+	for _, n := range []int{0, 3, 5, 20, last} {
+		if _, err := zstd_decompress(blob[:n]); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("truncated to %d bytes: %v", n, err)
+		}
+	}
+	if _, err := zstd_decompress([]byte("not a zstd blob")); err == nil {
+		t.Error("decompressed a blob without the magic")
+	}
+	// a corrupt block fails or gives other contents, it never panics
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		corrupt := append([]byte{}, blob...)
+		corrupt[6+r.Intn(last-6)] ^= byte(1 + r.Intn(255))
+		if _, err := zstd_decompress(corrupt); err == nil {
+			t.Errorf("corrupt blob %d decompressed without an error", i)
+		}
+	}
+}
+
+func TestXXHash64(t *testing.T) {
+	tests := []struct {
+		data string
+		sum  uint64
+	}{
+		{"", 0xEF46DB3751D8E999},
+		{"a", 0xD24EC4F1A98C6E5B},
+		{"abc", 0x44BC2CF5AD770999},
+		{"Nobody inspects the spammish repetition", 0xFBCEA83C8A378BF1},
+	}
+	for _, tt := range tests {
+		h := new_xxhash64()
+		// written in pieces, as by the frames
+		for i := 0; i < len(tt.data); i += 5 {
+			end := i + 5
+			if end > len(tt.data) {
+				end = len(tt.data)
+			}
+			h.Write([]byte(tt.data[i:end]))
+		}
+		if got := h.Sum64(); got != tt.sum {
+			t.Errorf("XXH64(%q) = %#x, want %#x", tt.data, got, tt.sum)
+		}
+	}
+}
+
+// Blobs are read by the zstd command, and its blobs by Decompress.
+func TestZstdCommand(t *testing.T) {
+	command, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("no zstd command")
+	}
+	dir := t.TempDir()
+	for _, kind := range []string{"random", "text", "chunks"} {
+		for _, n := range zstd_sizes {
+			data := zstd_data(kind, n)
+			path := filepath.Join(dir, "blob.zst")
+			if err := ioutil.WriteFile(path, zstd_compress(t, data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := exec.Command(command, "-d", "-q", "-c", path).Output()
+			if err != nil {
+				t.Errorf("%s %d bytes: zstd -d: %s", kind, n, err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("%s %d bytes: contents of zstd -d differ", kind, n)
+			}
+
+			path = filepath.Join(dir, "data")
+			if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			for _, level := range []string{"-1", "-19", "--fast=5", "--long=24"} {
+				blob, err := exec.Command(command, level, "-q", "-c", path).Output()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err := zstd_decompress(blob); err != nil || !bytes.Equal(got, data) {
+					t.Errorf("%s %d bytes: zstd %s not decompressed: %v", kind, n, level, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package compare
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/diff"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/progress"
+	"github.com/akhlakm/Snap_Shot/internal/report"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/repo"
+)
+
+// Changes between two snapshots, a snapshot and the working tree,
+// or the last snapshot synced and the working tree.
+func Execute() error {
+	args := argparser.GetParser()
+	r, err := repo.Open(settings.Current().Dir(), "")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	r.SetOutput(logger.Default())
+
+	// paths are relative to the working directory, which can be below the root
+	paths := []string{}
+	for _, arg := range args.GetDashed() {
+		relpath, err := fileutils.RootRelPath(r.Root(), arg)
+		if err != nil {
+			return logger.FailCode(logger.ExitUsage, "diff-path", arg, err.Error())
+		}
+		paths = append(paths, relpath)
+	}
+
+	snaps := args.GetUndashed(1)
+	if len(snaps) > 2 {
+		return logger.FailCode(logger.ExitUsage, "diff-args", snaps[2],
+			"Too many snapshots, at most two can be compared.\n"+
+				"\nUSAGE: diff [<snapshot id|tag> [<snapshot id|tag>]] [-- <path>...]\n")
+	}
+	from := r.LastSnapshot()
+	to := 0
+	if len(snaps) > 0 {
+		if from, err = r.Resolve(snaps[0]); err != nil {
+			return err
+		}
+	}
+	if len(snaps) > 1 {
+		if to, err = r.Resolve(snaps[1]); err != nil {
+			return err
+		}
+	}
+
+	changes, err := r.Diff(from, to, paths...)
+	if err != nil {
+		return err
+	}
+
+	if report.Machine() {
+		return report.PrintDiff(report.Diff{From: from, To: to, Changes: changes})
+	}
+	if args.HasFlag("stat") {
+		print_stat(changes)
+	} else if len(paths) > 0 && !args.HasFlag("name-status") {
+		p := &patcher{repo: r, from: from, to: to, context: args.GetKeyInt("unified", 3), words: args.HasFlag("word-diff")}
+		for _, c := range changes {
+			if err := p.print_patch(c); err != nil {
+				return err
+			}
+		}
+	} else {
+		print_changes(from, to, changes)
+	}
+	return nil
+}
+
+// Larger files are not compared line by line.
+const max_patch_size = 16 << 20
+
+// Name of the snapshot of the id, 0 is the working tree.
+func snap_name(ssid int) string {
+	if ssid == 0 {
+		return "the working tree"
+	}
+	return fmt.Sprintf("snapshot %d", ssid)
+}
+
+func print_changes(from int, to int, changes []diff.Change) {
+	target := snap_name(to)
+	if len(changes) == 0 {
+		logger.Print(fmt.Sprintf("No changes from snapshot %d to %s.", from, target))
+		return
+	}
+	logger.Print(fmt.Sprintf("Changes from snapshot %d to %s:\n", from, target))
+
+	names := []string{}
+	width := 0
+	for _, c := range changes {
+		name := c.RelPath
+		if c.Status == "R" {
+			name = c.OldPath + " -> " + c.RelPath
+		}
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	for i, c := range changes {
+		logger.Print(fmt.Sprintf("%s  %-*s  %s", c.Status, width, names[i], format_delta(c.Delta)))
+	}
+}
+
+// Contents of the changed files of two snapshots, to is 0 for the working tree.
+type patcher struct {
+	repo    *repo.Repo
+	from    int
+	to      int
+	context int
+	words   bool
+	// the snapshots read so far
+	files map[int]*repo.Files
+}
+
+// Unified diff of the contents of a changed file, a notice for the binary
+// and the large files.
+func (p *patcher) print_patch(c diff.Change) error {
+	oldpath := c.RelPath
+	if c.Status == "R" {
+		oldpath = c.OldPath
+	}
+	header := fmt.Sprintf("diff a/%s b/%s", oldpath, c.RelPath)
+	switch c.Status {
+	case "A":
+		header += fmt.Sprintf("\n--- /dev/null\n+++ b/%s\t(%s)", c.RelPath, snap_name(p.to))
+	case "D":
+		header += fmt.Sprintf("\n--- a/%s\t(%s)\n+++ /dev/null", oldpath, snap_name(p.from))
+	default:
+		header += fmt.Sprintf("\n--- a/%s\t(%s)\n+++ b/%s\t(%s)", oldpath, snap_name(p.from), c.RelPath, snap_name(p.to))
+	}
+
+	var a, b []byte
+	var err error
+	if c.Status != "A" {
+		if a, err = p.contents(p.from, oldpath); err != nil {
+			return err
+		}
+	}
+	if c.Status != "D" {
+		if b, err = p.contents(p.to, c.RelPath); err != nil {
+			return err
+		}
+	}
+
+	if len(a) > max_patch_size || len(b) > max_patch_size || diff.IsBinary(a) || diff.IsBinary(b) {
+		logger.Print(header)
+		logger.Print(fmt.Sprintf("Binary or large files differ, %s -> %s\n",
+			progress.FormatBytes(fileutils.FileHashSize(c.OldHash)), progress.FormatBytes(fileutils.FileHashSize(c.NewHash))))
+		return nil
+	}
+	var patch string
+	if p.words {
+		patch = diff.WordDiff(string(a), string(b), p.context)
+	} else {
+		patch = diff.Unified(string(a), string(b), p.context)
+	}
+	if patch == "" {
+		// renamed, or only the modification time changed
+		logger.Print(header + "\n")
+		return nil
+	}
+	logger.Print(header)
+	logger.Print(patch)
+	return nil
+}
+
+// Contents of the file in the snapshot, or in the working tree if 0, up to
+// one byte more than the files compared.
+func (p *patcher) contents(ssid int, relpath string) ([]byte, error) {
+	var in io.ReadCloser
+	var err error
+	if ssid == 0 {
+		in, err = os.Open(fileutils.PathJoin(p.repo.Root(), relpath))
+	} else {
+		if p.files == nil {
+			p.files = make(map[int]*repo.Files)
+		}
+		files, ok := p.files[ssid]
+		if !ok {
+			if files, err = p.repo.Files(ssid); err != nil {
+				return nil, err
+			}
+			p.files[ssid] = files
+		}
+		in, err = files.Open(relpath)
+	}
+	if err != nil {
+		return nil, logger.Fail("diff-contents", relpath, fmt.Sprintf("Failed to read the file.\n\n%s", err))
+	}
+	defer in.Close()
+	data, err := io.ReadAll(io.LimitReader(in, max_patch_size+1))
+	if err != nil {
+		return nil, logger.Fail("diff-contents", relpath, fmt.Sprintf("Failed to read the file.\n\n%s", err))
+	}
+	return data, nil
+}
+
+// Number of changes by status, and the total change of size.
+func print_stat(changes []diff.Change) {
+	counts := make(map[string]int)
+	var delta int64
+	for _, c := range changes {
+		counts[c.Status]++
+		delta += c.Delta
+	}
+	logger.Print(fmt.Sprintf("%d files changed, %d added, %d modified, %d deleted, %d renamed, %s",
+		len(changes), counts["A"], counts["M"], counts["D"], counts["R"], format_delta(delta)))
+}
+
+// Size change with its sign, e.g. +1.2 KiB
+func format_delta(n int64) string {
+	if n < 0 {
+		return "-" + progress.FormatBytes(-n)
+	}
+	return "+" + progress.FormatBytes(n)
+}
@@ -0,0 +1,395 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Contents are encrypted in chunks with AES-256-GCM, under a key of the
+// blob derived with HKDF from a random salt, so the nonces of different
+// blobs never collide. Each chunk is authenticated with its position,
+// whether it is the last one, and the key of the blob, so chunks cannot
+// be reordered, truncated or swapped between blobs.
+//
+//	magic (8) | salt (32) | chunk ... | last chunk
+const magic string = "SNAPENC2"
+const chunk_size int = 64 * 1024
+const salt_size int = 32
+const header_size int = len(magic) + salt_size
+
+// Magic of the key info wrapping, kept from the first version.
+const keyinfo_magic string = "SNAPENC1"
+
+const kdf_name string = "pbkdf2-sha256"
+const kdf_iterations int = 600000
+
+var ErrPassphrase = errors.New("wrong passphrase")
+var ErrAuth = errors.New("decryption failed, the data is corrupted or was encrypted with a different key")
+
+var names = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+type Keys struct {
+	// the blob keys are derived from it
+	contents []byte
+	nameEnc  cipher.Block
+	nameMac  []byte
+}
+
+func derive_keys(master []byte) (*Keys, error) {
+	nameEnc, err := aes.NewCipher(subkey(master, "snap names"))
+	if err != nil {
+		return nil, err
+	}
+	return &Keys{
+		contents: subkey(master, "snap contents"),
+		nameEnc:  nameEnc,
+		nameMac:  subkey(master, "snap names mac"),
+	}, nil
+}
+
+func subkey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Cipher of a blob, with its key derived from the salt of the blob.
+func (k *Keys) blob_cipher(salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdf_sha256(k.contents, salt, "snap blob", 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// HKDF of RFC 5869 with HMAC-SHA256.
+func hkdf_sha256(secret []byte, salt []byte, info string, keylen int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	okm := []byte{}
+	prev := []byte{}
+	for n := byte(1); len(okm) < keylen; n++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(prev)
+		expand.Write([]byte(info))
+		expand.Write([]byte{n})
+		prev = expand.Sum(nil)
+		okm = append(okm, prev...)
+	}
+	return okm[:keylen]
+}
+
+// Create a new random key, wrapped with the passphrase.
+// Returns the contents of the key info file to store in the remote.
+func NewKeyInfo(passphrase []byte) ([]byte, *Keys, error) {
+	master := make([]byte, 32)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(master); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+
+	wrapper, err := wrapping_cipher(passphrase, salt, kdf_iterations)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, wrapper.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	wrapped := wrapper.Seal(nonce, nonce, master, []byte(keyinfo_magic))
+
+	var info bytes.Buffer
+	info.WriteString("# Encryption key of the remote, wrapped with the passphrase.\n")
+	info.WriteString("# Do not edit or delete, the snapshots cannot be read without it.\n")
+	info.WriteString("VERSION\t=\t1\n")
+	info.WriteString(fmt.Sprintf("KDF\t=\t%s\n", kdf_name))
+	info.WriteString(fmt.Sprintf("ITERATIONS\t=\t%d\n", kdf_iterations))
+	info.WriteString(fmt.Sprintf("SALT\t=\t%s\n", hex.EncodeToString(salt)))
+	info.WriteString(fmt.Sprintf("KEY\t=\t%s\n", hex.EncodeToString(wrapped)))
+
+	keys, err := derive_keys(master)
+	return info.Bytes(), keys, err
+}
+
+// Unwrap the key of a key info file with the passphrase.
+func OpenKeyInfo(info []byte, passphrase []byte) (*Keys, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(info))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || !strings.Contains(line, "=") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	if values["VERSION"] != "1" || values["KDF"] != kdf_name {
+		return nil, fmt.Errorf("unsupported key info version %s, %s", values["VERSION"], values["KDF"])
+	}
+	iterations, err := strconv.Atoi(values["ITERATIONS"])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("invalid key info iterations: %s", values["ITERATIONS"])
+	}
+	salt, err := hex.DecodeString(values["SALT"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key info salt: %s", err)
+	}
+	wrapped, err := hex.DecodeString(values["KEY"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key info key: %s", err)
+	}
+
+	wrapper, err := wrapping_cipher(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < wrapper.NonceSize() {
+		return nil, fmt.Errorf("invalid key info key length")
+	}
+	nonce := wrapped[:wrapper.NonceSize()]
+	master, err := wrapper.Open(nil, nonce, wrapped[wrapper.NonceSize():], []byte(keyinfo_magic))
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	return derive_keys(master)
+}
+
+func wrapping_cipher(passphrase []byte, salt []byte, iterations int) (cipher.AEAD, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	block, err := aes.NewCipher(pbkdf2_sha256(passphrase, salt, iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PBKDF2 of RFC 8018 with HMAC-SHA256.
+func pbkdf2_sha256(password []byte, salt []byte, iterations int, keylen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashlen := prf.Size()
+	nblocks := (keylen + hashlen - 1) / hashlen
+
+	dk := make([]byte, 0, nblocks*hashlen)
+	u := make([]byte, hashlen)
+	var counter [4]byte
+	for block := 1; block <= nblocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashlen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keylen]
+}
+
+// Deterministic encryption of a file or directory name, the same name
+// always encrypts to the same string, so the blobs can still be found by
+// their keys. The synthetic iv is a mac of the name, which also
+// authenticates it. The result is lowercase, safe for any filesystem.
+func (k *Keys) EncryptName(name string) string {
+	mac := hmac.New(sha256.New, k.nameMac)
+	mac.Write([]byte(name))
+	iv := mac.Sum(nil)[:aes.BlockSize]
+
+	out := make([]byte, aes.BlockSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(k.nameEnc, iv).XORKeyStream(out[aes.BlockSize:], []byte(name))
+	return strings.ToLower(names.EncodeToString(out))
+}
+
+func (k *Keys) DecryptName(encrypted string) (string, error) {
+	data, err := names.DecodeString(strings.ToUpper(encrypted))
+	if err != nil || len(data) < aes.BlockSize {
+		return "", ErrAuth
+	}
+	iv := data[:aes.BlockSize]
+	name := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCTR(k.nameEnc, iv).XORKeyStream(name, data[aes.BlockSize:])
+
+	mac := hmac.New(sha256.New, k.nameMac)
+	mac.Write(name)
+	if !hmac.Equal(mac.Sum(nil)[:aes.BlockSize], iv) {
+		return "", ErrAuth
+	}
+	return string(name), nil
+}
+
+// Size of the contents of an encrypted blob of the given size.
+func PlainSize(size int64) int64 {
+	sealed := int64(chunk_size + 16)
+	n := size - int64(header_size)
+	if n < 16 {
+		return 0
+	}
+	full := n / sealed
+	rest := n % sealed
+	if rest == 0 {
+		return full * int64(chunk_size)
+	}
+	return full*int64(chunk_size) + rest - 16
+}
+
+// Nonce of a chunk, unique under the key of the blob.
+func chunk_nonce(counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encrypter struct {
+	aead    cipher.AEAD
+	src     *bufio.Reader
+	aad     []byte
+	counter uint32
+	plain   []byte
+	out     []byte
+	done    bool
+}
+
+// Encrypted contents of r, bound to the key of the blob.
+func (k *Keys) Encrypt(r io.Reader, key string) (io.Reader, error) {
+	salt := make([]byte, salt_size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := k.blob_cipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	e := &encrypter{
+		aead:  aead,
+		src:   bufio.NewReaderSize(r, chunk_size),
+		aad:   []byte(key),
+		plain: make([]byte, chunk_size),
+	}
+	e.out = append([]byte(magic), salt...)
+	return e, nil
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.src, e.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := err != nil
+		if !last {
+			// a full chunk is the last one, if nothing follows
+			if _, perr := e.src.Peek(1); perr == io.EOF {
+				last = true
+			} else if perr != nil {
+				return 0, perr
+			}
+		}
+		nonce := chunk_nonce(e.counter, last)
+		e.out = e.aead.Seal(e.out[:0], nonce, e.plain[:n], e.aad)
+		e.counter++
+		e.done = last
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+type decrypter struct {
+	keys    *Keys
+	aead    cipher.AEAD
+	src     *bufio.Reader
+	aad     []byte
+	counter uint32
+	sealed  []byte
+	out     []byte
+	done    bool
+}
+
+// Contents of an encrypted blob, fails if it was modified,
+// truncated, or belongs to another key.
+func (k *Keys) Decrypt(r io.Reader, key string) io.Reader {
+	return &decrypter{
+		keys:   k,
+		src:    bufio.NewReaderSize(r, chunk_size+16),
+		aad:    []byte(key),
+		sealed: make([]byte, chunk_size+16),
+	}
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	if d.aead == nil {
+		header := make([]byte, header_size)
+		if _, err := io.ReadFull(d.src, header); err != nil || string(header[:len(magic)]) != magic {
+			return 0, fmt.Errorf("not an encrypted blob")
+		}
+		aead, err := d.keys.blob_cipher(header[len(magic):])
+		if err != nil {
+			return 0, err
+		}
+		d.aead = aead
+	}
+
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.src, d.sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := err != nil
+		if !last {
+			if _, perr := d.src.Peek(1); perr == io.EOF {
+				last = true
+			} else if perr != nil {
+				return 0, perr
+			}
+		}
+		nonce := chunk_nonce(d.counter, last)
+		plain, oerr := d.aead.Open(d.out[:0], nonce, d.sealed[:n], d.aad)
+		if oerr != nil {
+			return 0, ErrAuth
+		}
+		d.out = plain
+		d.counter++
+		d.done = last
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
@@ -0,0 +1,216 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func test_keys(t *testing.T) *Keys {
+	t.Helper()
+	master := make([]byte, 32)
+	if _, err := rand.Read(master); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := derive_keys(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func encrypt(t *testing.T, k *Keys, data []byte, key string) []byte {
+	t.Helper()
+	r, err := k.Encrypt(bytes.NewReader(data), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func decrypt(k *Keys, blob []byte, key string) ([]byte, error) {
+	return ioutil.ReadAll(k.Decrypt(bytes.NewReader(blob), key))
+}
+
+func random_bytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := test_keys(t)
+	sealed := chunk_size + 16
+	sizes := []int{0, 1, chunk_size - 1, chunk_size, chunk_size + 1, 3 * chunk_size, 3*chunk_size + 100}
+	for _, size := range sizes {
+		data := random_bytes(t, size)
+		blob := encrypt(t, k, data, "r/files/a.txt")
+
+		chunks := (size + chunk_size - 1) / chunk_size
+		if size == 0 {
+			chunks = 1
+		}
+		if want := header_size + size + chunks*16; len(blob) != want {
+			t.Errorf("%d bytes: encrypted to %d bytes, want %d", size, len(blob), want)
+		}
+		if got := PlainSize(int64(len(blob))); got != int64(size) {
+			t.Errorf("%d bytes: PlainSize = %d", size, got)
+		}
+		if size >= chunk_size && len(blob) < header_size+sealed {
+			t.Errorf("%d bytes: no full chunk", size)
+		}
+
+		plain, err := decrypt(k, blob, "r/files/a.txt")
+		if err != nil {
+			t.Errorf("%d bytes: %s", size, err)
+		} else if !bytes.Equal(plain, data) {
+			t.Errorf("%d bytes: decrypted contents differ", size)
+		}
+	}
+
+	// a random salt per blob
+	data := []byte("same contents")
+	if bytes.Equal(encrypt(t, k, data, "a"), encrypt(t, k, data, "a")) {
+		t.Error("the same contents encrypted twice are equal")
+	}
+}
+
+func TestTamper(t *testing.T) {
+	k := test_keys(t)
+	sealed := chunk_size + 16
+	data := random_bytes(t, 2*chunk_size+100)
+	blob := encrypt(t, k, data, "r/files/a.txt")
+	chunk := func(i int) []byte {
+		end := header_size + (i+1)*sealed
+		if end > len(blob) {
+			end = len(blob)
+		}
+		return blob[header_size+i*sealed : end]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	flipped := append([]byte{}, blob...)
+	flipped[header_size+sealed+10] ^= 1
+	salted := append([]byte{}, blob...)
+	salted[len(magic)] ^= 1
+
+	cases := []struct {
+		name string
+		blob []byte
+		key  string
+	}{
+		{"flipped byte", flipped, "r/files/a.txt"},
+		{"flipped salt", salted, "r/files/a.txt"},
+		{"truncated last chunk", blob[:len(blob)-1], "r/files/a.txt"},
+		{"last chunk removed", join(blob[:header_size], chunk(0), chunk(1)), "r/files/a.txt"},
+		{"chunks reordered", join(blob[:header_size], chunk(1), chunk(0), chunk(2)), "r/files/a.txt"},
+		{"other key", blob, "r/files/b.txt"},
+	}
+	for _, c := range cases {
+		if _, err := decrypt(k, c.blob, c.key); !errors.Is(err, ErrAuth) {
+			t.Errorf("%s: err = %v, want ErrAuth", c.name, err)
+		}
+	}
+
+	if _, err := decrypt(test_keys(t), blob, "r/files/a.txt"); !errors.Is(err, ErrAuth) {
+		t.Errorf("other keys: err = %v, want ErrAuth", err)
+	}
+	if _, err := decrypt(k, data[:100], "r/files/a.txt"); err == nil {
+		t.Error("unencrypted contents were decrypted")
+	}
+}
+
+// The contents of _keyinfo in the remote.
+func TestKeyInfo(t *testing.T) {
+	info, keys, err := NewKeyInfo([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(info), "KDF\t=\tpbkdf2-sha256\n") {
+		t.Errorf("key info:\n%s", info)
+	}
+
+	if _, err := OpenKeyInfo(info, []byte("wrong")); !errors.Is(err, ErrPassphrase) {
+		t.Errorf("wrong passphrase: err = %v, want ErrPassphrase", err)
+	}
+	if _, err := OpenKeyInfo(info, nil); err == nil {
+		t.Error("empty passphrase accepted")
+	}
+
+	opened, err := OpenKeyInfo(info, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := encrypt(t, keys, []byte("hello"), "a")
+	if plain, err := decrypt(opened, blob, "a"); err != nil || string(plain) != "hello" {
+		t.Errorf("unwrapped keys decrypt %q, %v", plain, err)
+	}
+	if opened.EncryptName("a.txt") != keys.EncryptName("a.txt") {
+		t.Error("unwrapped keys encrypt names differently")
+	}
+
+	edited := strings.Replace(string(info), "VERSION\t=\t1", "VERSION\t=\t2", 1)
+	if _, err := OpenKeyInfo([]byte(edited), []byte("secret")); err == nil || errors.Is(err, ErrPassphrase) {
+		t.Errorf("unsupported version: err = %v", err)
+	}
+}
+
+// Test vector of RFC 7914, section 11.
+func TestPBKDF2(t *testing.T) {
+	got := pbkdf2_sha256([]byte("passwd"), []byte("salt"), 1, 64)
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if hex.EncodeToString(got) != want {
+		t.Errorf("pbkdf2 = %x\nwant %s", got, want)
+	}
+}
+
+func TestEncryptName(t *testing.T) {
+	k := test_keys(t)
+	for _, name := range []string{"a.txt", "A.TXT", "", "with space", "ünïcode", strings.Repeat("x", 200)} {
+		enc := k.EncryptName(name)
+		if enc != k.EncryptName(name) {
+			t.Errorf("%q: not deterministic", name)
+		}
+		if enc != strings.ToLower(enc) || strings.ContainsAny(enc, "/\\") {
+			t.Errorf("%q: encrypted to %q", name, enc)
+		}
+		if dec, err := k.DecryptName(enc); err != nil || dec != name {
+			t.Errorf("%q: decrypted to %q, %v", name, dec, err)
+		}
+	}
+
+	if k.EncryptName("a.txt") == k.EncryptName("b.txt") {
+		t.Error("different names encrypt equal")
+	}
+	if k.EncryptName("a.txt") == test_keys(t).EncryptName("a.txt") {
+		t.Error("different keys encrypt names equal")
+	}
+
+	// the last digit can hold only padding bits, the first is of the iv
+	enc := []byte(k.EncryptName("a.txt"))
+	if enc[0] == 'a' {
+		enc[0] = 'b'
+	} else {
+		enc[0] = 'a'
+	}
+	if _, err := k.DecryptName(string(enc)); !errors.Is(err, ErrAuth) {
+		t.Errorf("modified name: err = %v, want ErrAuth", err)
+	}
+	if _, err := k.DecryptName("not base32!"); !errors.Is(err, ErrAuth) {
+		t.Errorf("invalid name: err = %v, want ErrAuth", err)
+	}
+}
@@ -0,0 +1,143 @@
+package diff
+
+import (
+	"path"
+	"sort"
+
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+)
+
+// Change of a file between two snapshots.
+type Change struct {
+	// A added, M modified, D deleted, R renamed
+	Status  string `json:"status"`
+	RelPath string `json:"relpath"`
+	// path in the old snapshot of a renamed file
+	OldPath string `json:"old_relpath,omitempty"`
+	// file hashes in the old and the new snapshot, empty if not there
+	OldHash string `json:"old_filehash,omitempty"`
+	NewHash string `json:"new_filehash,omitempty"`
+	// change of the size in bytes
+	Delta int64 `json:"delta"`
+}
+
+// Changes of the files from the old snapshot to the new one,
+// in the order of the relative paths. A file deleted and added
+// elsewhere with the same hash is renamed.
+func Snapshots(old, new *history.Hist) []Change {
+	changes := []Change{}
+	added := []Change{}
+	deleted := []Change{}
+	for _, phash := range new.PathHashList() {
+		if !Present(new, phash) {
+			continue
+		}
+		if !Present(old, phash) {
+			added = append(added, Change{
+				Status:  "A",
+				RelPath: new.GetRelPath(phash),
+				NewHash: new.GetFileHash(phash),
+			})
+		} else if !fileutils.FileHashSame(old.GetFileHash(phash), new.GetFileHash(phash)) {
+			changes = append(changes, Change{
+				Status:  "M",
+				RelPath: new.GetRelPath(phash),
+				OldHash: old.GetFileHash(phash),
+				NewHash: new.GetFileHash(phash),
+			})
+		}
+	}
+	for _, phash := range old.PathHashList() {
+		if Present(old, phash) && !Present(new, phash) {
+			deleted = append(deleted, Change{
+				Status:  "D",
+				RelPath: old.GetRelPath(phash),
+				OldHash: old.GetFileHash(phash),
+			})
+		}
+	}
+
+	changes = append(changes, renames(added, deleted)...)
+	for i := range changes {
+		c := &changes[i]
+		c.Delta = fileutils.FileHashSize(c.NewHash) - fileutils.FileHashSize(c.OldHash)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].RelPath < changes[j].RelPath
+	})
+	return changes
+}
+
+// Pair the added files with the deleted ones of the same hash, the ones
+// of the same name first. Empty files are never paired, they all match.
+func renames(added, deleted []Change) []Change {
+	sort.Slice(added, func(i, j int) bool { return added[i].RelPath < added[j].RelPath })
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].RelPath < deleted[j].RelPath })
+
+	paired := make(map[int]bool)
+	match := func(a Change, samename bool) int {
+		for i, d := range deleted {
+			if paired[i] || fileutils.FileHashSize(d.OldHash) == 0 {
+				continue
+			}
+			if samename && path.Base(d.RelPath) != path.Base(a.RelPath) {
+				continue
+			}
+			if fileutils.FileHashSame(d.OldHash, a.NewHash) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	changes := []Change{}
+	for _, a := range added {
+		i := match(a, true)
+		if i < 0 {
+			i = match(a, false)
+		}
+		if i < 0 {
+			changes = append(changes, a)
+			continue
+		}
+		paired[i] = true
+		changes = append(changes, Change{
+			Status:  "R",
+			RelPath: a.RelPath,
+			OldPath: deleted[i].RelPath,
+			OldHash: deleted[i].OldHash,
+			NewHash: a.NewHash,
+		})
+	}
+	for i, d := range deleted {
+		if !paired[i] {
+			changes = append(changes, d)
+		}
+	}
+	return changes
+}
+
+// Changes of the files under the paths, either path of a rename.
+func Filter(changes []Change, paths []string) []Change {
+	if len(paths) == 0 {
+		return changes
+	}
+	filtered := []Change{}
+	for _, c := range changes {
+		if fileutils.InScope(paths, c.RelPath) || (c.OldPath != "" && fileutils.InScope(paths, c.OldPath)) {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// Whether the file is in the snapshot, deleted and ignored files are
+// only recorded in it.
+func Present(hist *history.Hist, phash string) bool {
+	if !hist.IsPathHash(phash) {
+		return false
+	}
+	crud := hist.GetCrud(phash)
+	return crud != "D" && crud != "I"
+}
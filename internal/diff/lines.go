@@ -0,0 +1,357 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Edits beyond this distance are not searched for, the rest of the
+// texts is replaced as a whole. Keeps the memory of the trace bounded.
+const max_distance = 2000
+
+// Edit of a line or a word, ' ' kept, '-' deleted, '+' added.
+type Edit struct {
+	Op   byte
+	Text string
+}
+
+// Whether the contents look binary, a NUL byte in the first 8000 bytes as git does.
+func IsBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// Lines of the text, with their line endings.
+func SplitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Shortest edit script turning a into b.
+func Edits(a, b []string) []Edit {
+	// the common prefix and suffix are kept as is
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	edits := []Edit{}
+	for _, s := range a[:pre] {
+		edits = append(edits, Edit{' ', s})
+	}
+	edits = append(edits, myers(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, s := range a[len(a)-suf:] {
+		edits = append(edits, Edit{' ', s})
+	}
+	return edits
+}
+
+// Myers' O(ND) difference algorithm. The furthest x of each diagonal k
+// is traced for every distance d, then followed back from the end.
+func myers(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] holds the diagonals -d..d before the step d
+	trace := [][]int{}
+
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		if d > max_distance {
+			return replace(a, b)
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	edits := []Edit{}
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		if d == 0 {
+			for x > 0 && y > 0 {
+				edits = append(edits, Edit{' ', a[x-1]})
+				x--
+				y--
+			}
+			break
+		}
+		at := func(k int) int { return trace[d][k+d] }
+		k := x - y
+		var prevk int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevk = k + 1
+		} else {
+			prevk = k - 1
+		}
+		prevx := at(prevk)
+		prevy := prevx - prevk
+		for x > prevx && y > prevy {
+			edits = append(edits, Edit{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevx {
+			edits = append(edits, Edit{'+', b[y-1]})
+		} else {
+			edits = append(edits, Edit{'-', a[x-1]})
+		}
+		x, y = prevx, prevy
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// Delete all of a and add all of b.
+func replace(a, b []string) []Edit {
+	edits := []Edit{}
+	for _, s := range a {
+		edits = append(edits, Edit{'-', s})
+	}
+	for _, s := range b {
+		edits = append(edits, Edit{'+', s})
+	}
+	return edits
+}
+
+// Unified diff of two texts with the lines of context around the changes,
+// without the file headers. Empty if the texts are the same.
+func Unified(old, new string, context int) string {
+	return hunks(Edits(SplitLines(old), SplitLines(new)), context, false)
+}
+
+// Unified diff with the changed words marked inline as [-deleted-]{+added+},
+// like git diff --word-diff.
+func WordDiff(old, new string, context int) string {
+	return hunks(Edits(SplitLines(old), SplitLines(new)), context, true)
+}
+
+// Group the line edits into hunks, changes closer than twice the context
+// share a hunk.
+func hunks(edits []Edit, context int, words bool) string {
+	if context < 0 {
+		context = 0
+	}
+	changed := []int{}
+	for i, e := range edits {
+		if e.Op != ' ' {
+			changed = append(changed, i)
+		}
+	}
+	if len(changed) == 0 {
+		return ""
+	}
+
+	// line numbers of the old and the new text before each edit
+	oldline := make([]int, len(edits)+1)
+	newline := make([]int, len(edits)+1)
+	for i, e := range edits {
+		oldline[i+1] = oldline[i]
+		newline[i+1] = newline[i]
+		if e.Op != '+' {
+			oldline[i+1]++
+		}
+		if e.Op != '-' {
+			newline[i+1]++
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(changed); {
+		j := i
+		for j+1 < len(changed) && changed[j+1]-changed[j] <= 2*context+1 {
+			j++
+		}
+		start := changed[i] - context
+		if start < 0 {
+			start = 0
+		}
+		end := changed[j] + context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		oldcount := oldline[end] - oldline[start]
+		newcount := newline[end] - newline[start]
+		b.WriteString(fmt.Sprintf("@@ -%s +%s @@\n",
+			hunk_range(oldline[start], oldcount), hunk_range(newline[start], newcount)))
+		if words {
+			write_words(&b, edits[start:end])
+		} else {
+			for _, e := range edits[start:end] {
+				write_line(&b, string(e.Op), e.Text)
+			}
+		}
+		i = j + 1
+	}
+	return b.String()
+}
+
+// Start and count of a hunk as git numbers them, the count is left out
+// if 1 and an empty side starts at the line before, 0,0 for an empty text.
+func hunk_range(before int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprint(before + 1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+func write_line(b *strings.Builder, prefix string, line string) {
+	b.WriteString(prefix)
+	b.WriteString(strings.TrimSuffix(line, "\n"))
+	b.WriteString("\n")
+	if !strings.HasSuffix(line, "\n") {
+		b.WriteString("\\ No newline at end of file\n")
+	}
+}
+
+// Kept lines as is, the deleted and added lines of each change
+// compared word by word.
+func write_words(b *strings.Builder, edits []Edit) {
+	for i := 0; i < len(edits); {
+		if edits[i].Op == ' ' {
+			b.WriteString(strings.TrimSuffix(edits[i].Text, "\n") + "\n")
+			i++
+			continue
+		}
+		var old, new strings.Builder
+		for ; i < len(edits) && edits[i].Op != ' '; i++ {
+			if edits[i].Op == '-' {
+				old.WriteString(edits[i].Text)
+			} else {
+				new.WriteString(edits[i].Text)
+			}
+		}
+		b.WriteString(strings.TrimSuffix(diff_words(old.String(), new.String()), "\n") + "\n")
+	}
+}
+
+// Offsets of a word in its text.
+type word struct {
+	begin int
+	end   int
+}
+
+// Words of the text, the runs of non-space characters.
+func split_words(text string) []word {
+	words := []word{}
+	start := -1
+	for i, r := range text {
+		if !unicode.IsSpace(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			words = append(words, word{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, word{start, len(text)})
+	}
+	return words
+}
+
+// The new text with the changed words marked, as git diff --word-diff:
+// only the words are compared, the spaces and line breaks around them
+// are the ones of the new text.
+func diff_words(old, new string) string {
+	oldwords, newwords := split_words(old), split_words(new)
+	texts := func(text string, words []word) []string {
+		out := make([]string, len(words))
+		for i, w := range words {
+			out[i] = text[w.begin:w.end]
+		}
+		return out
+	}
+	edits := Edits(texts(old, oldwords), texts(new, newwords))
+
+	var b strings.Builder
+	written := 0
+	o, n := 0, 0
+	for i := 0; i < len(edits); {
+		if edits[i].Op == ' ' {
+			o, n, i = o+1, n+1, i+1
+			continue
+		}
+		ofirst, nfirst := o, n
+		for ; i < len(edits) && edits[i].Op != ' '; i++ {
+			if edits[i].Op == '-' {
+				o++
+			} else {
+				n++
+			}
+		}
+		obegin, oend := words_span(oldwords, ofirst, o)
+		nbegin, nend := words_span(newwords, nfirst, n)
+		b.WriteString(new[written:nbegin])
+		mark_words(&b, old[obegin:oend], "[-", "-]")
+		mark_words(&b, new[nbegin:nend], "{+", "+}")
+		written = nend
+	}
+	b.WriteString(new[written:])
+	return b.String()
+}
+
+// Offsets of the words from..to, at the end of the word before if none.
+func words_span(words []word, from int, to int) (int, int) {
+	if from < to {
+		return words[from].begin, words[to-1].end
+	}
+	if from == 0 {
+		return 0, 0
+	}
+	return words[from-1].end, words[from-1].end
+}
+
+// Marked words, each line of them marked on its own.
+func mark_words(b *strings.Builder, text string, open string, close string) {
+	if text == "" {
+		return
+	}
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		if line != "" {
+			b.WriteString(open + line + close)
+		}
+	}
+}
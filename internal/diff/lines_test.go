@@ -0,0 +1,126 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The outputs are the ones of git diff --no-index, without the
+// function names git adds after the hunk ranges.
+func TestUnified(t *testing.T) {
+	five := "one\ntwo\nthree\nfour\nfive\n"
+	tests := []struct {
+		name    string
+		old     string
+		new     string
+		context int
+		want    string
+	}{
+		{"same", five, five, 3, ""},
+		{"new file", "", "one\ntwo\nthree\n", 3,
+			"@@ -0,0 +1,3 @@\n+one\n+two\n+three\n"},
+		{"deleted file", "one\ntwo\nthree\n", "", 3,
+			"@@ -1,3 +0,0 @@\n-one\n-two\n-three\n"},
+		{"insert", five, "one\ntwo\nnew\nthree\nfour\nfive\n", 3,
+			"@@ -1,5 +1,6 @@\n one\n two\n+new\n three\n four\n five\n"},
+		{"insert without context", five, "one\ntwo\nnew\nthree\nfour\nfive\n", 0,
+			"@@ -2,0 +3 @@\n+new\n"},
+		{"delete", five, "one\ntwo\nfour\nfive\n", 3,
+			"@@ -1,5 +1,4 @@\n one\n two\n-three\n four\n five\n"},
+		{"delete without context", five, "one\ntwo\nfour\nfive\n", 0,
+			"@@ -3 +2,0 @@\n-three\n"},
+		{"delete the first line", five, "two\nthree\nfour\nfive\n", 0,
+			"@@ -1 +0,0 @@\n-one\n"},
+		{"newline removed", "one\ntwo\n", "one\ntwo", 3,
+			"@@ -1,2 +1,2 @@\n one\n-two\n+two\n\\ No newline at end of file\n"},
+		{"newline added", "one\ntwo", "one\ntwo\n", 0,
+			"@@ -2 +2 @@\n-two\n\\ No newline at end of file\n+two\n"},
+		{"two hunks", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "1\nx\n3\n4\n5\n6\n7\n8\ny\n10\n", 1,
+			"@@ -1,3 +1,3 @@\n 1\n-2\n+x\n 3\n@@ -8,3 +8,3 @@\n 8\n-9\n+y\n 10\n"},
+		{"one hunk", "1\n2\n3\n4\n5\n6\n", "1\nx\n3\n4\ny\n6\n", 1,
+			"@@ -1,6 +1,6 @@\n 1\n-2\n+x\n 3\n 4\n-5\n+y\n 6\n"},
+	}
+	for _, tt := range tests {
+		if got := Unified(tt.old, tt.new, tt.context); got != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWordDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want string
+	}{
+		{"changed words", "the quick brown fox\njumps over\nthe dog\n", "the slow brown fox\njumps over\nthe lazy dog\n",
+			"@@ -1,3 +1,3 @@\nthe [-quick-]{+slow+} brown fox\njumps over\nthe {+lazy+} dog\n"},
+		{"deleted word", "the lazy dog\n", "the dog\n",
+			"@@ -1 +1 @@\nthe[-lazy-] dog\n"},
+		{"added words", "a b\n", "a b c d\n",
+			"@@ -1 +1 @@\na b {+c d+}\n"},
+		{"spaces of the new text", "a b c\n", "a  x   c\n",
+			"@@ -1 +1 @@\na  [-b-]{+x+}   c\n"},
+		{"only spaces changed", "  lead\n", "lead\n",
+			"@@ -1 +1 @@\nlead\n"},
+		{"lines marked apart", "a\nb\n", "c\nd\n",
+			"@@ -1,2 +1,2 @@\n[-a-]\n[-b-]{+c+}\n{+d+}\n"},
+		{"across lines", "k\na b\nc\n", "k\na x\ny c\n",
+			"@@ -1,3 +1,3 @@\nk\na [-b-]{+x+}\n{+y+} c\n"},
+		{"deleted line", "one\ntwo\n", "one\n",
+			"@@ -1,2 +1 @@\none\n[-two-]\n"},
+		{"no newline", "k\nold", "k\nnew",
+			"@@ -1,2 +1,2 @@\nk\n[-old-]{+new+}\n"},
+	}
+	for _, tt := range tests {
+		if got := WordDiff(tt.old, tt.new, 3); got != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Beyond max_distance the texts are replaced as a whole, the common
+// line in the middle is deleted and added.
+func TestMaxDistance(t *testing.T) {
+	var a, b []string
+	for i := 0; i < max_distance; i++ {
+		a = append(a, fmt.Sprintf("a%d\n", i))
+		b = append(b, fmt.Sprintf("b%d\n", i))
+		if i == max_distance/2 {
+			a = append(a, "same\n")
+			b = append(b, "same\n")
+		}
+	}
+	edits := Edits(a, b)
+	if len(edits) != len(a)+len(b) {
+		t.Fatalf("%d edits, want %d", len(edits), len(a)+len(b))
+	}
+	for i, e := range edits {
+		want := byte('-')
+		if i >= len(a) {
+			want = '+'
+		}
+		if e.Op != want {
+			t.Fatalf("edit %d is %c %q", i, e.Op, e.Text)
+		}
+	}
+
+	patch := Unified(strings.Join(a, ""), strings.Join(b, ""), 3)
+	header := fmt.Sprintf("@@ -1,%d +1,%d @@\n", len(a), len(b))
+	if !strings.HasPrefix(patch, header) || strings.Count(patch, "@@") != 2 {
+		t.Errorf("patch starts with %q", patch[:40])
+	}
+
+	// within the distance the common line is kept
+	kept := 0
+	for _, e := range Edits(a[990:1012], b[990:1012]) {
+		if e.Op == ' ' {
+			kept++
+		}
+	}
+	if kept != 1 {
+		t.Errorf("%d lines kept around the common line, want 1", kept)
+	}
+}
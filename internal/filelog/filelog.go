@@ -0,0 +1,129 @@
+package filelog
+
+import (
+	"fmt"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/diff"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/progress"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/report"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+)
+
+// Snapshots in which a file was created, updated, deleted or renamed.
+func Execute() error {
+	args := argparser.GetParser()
+	rem, err := settings.Remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	if !remote.Available(rem) {
+		errmsg := "Remote directory does not exist.\n" +
+			"\nMake sure it is mounted. Or take your first snapshot and it will be created automatically.\n"
+		return logger.FailCode(logger.ExitRemote, "log-execute", rem.String(), errmsg)
+	}
+	rootname := settings.RootName()
+
+	arg, err := args.ReqStr(1, "\nUSAGE: log <path>\n")
+	if err != nil {
+		return err
+	}
+	// relative to the working directory, which can be below the root
+	relpath, err := fileutils.RootRelPath(settings.Current().Dir(), arg)
+	if err != nil {
+		return logger.FailCode(logger.ExitUsage, "log-path", arg, err.Error())
+	}
+
+	hists := []*history.Hist{}
+	for _, ssid := range history.SnapIds(rem, rootname) {
+		hist := history.Make(ssid, rem, rootname)
+		if err := hist.Load(); err != nil {
+			return err
+		}
+		hists = append(hists, hist)
+	}
+
+	entries := file_log(hists, relpath)
+	if len(entries) == 0 {
+		return logger.Fail("log-path", relpath, "The file is not in any snapshot.\n"+
+			"\nPlease run 'list <snapshot id>' for the files of a snapshot.")
+	}
+	if report.Machine() {
+		return report.PrintLog(report.Log{RelPath: relpath, Entries: entries})
+	}
+	for _, e := range entries {
+		line := fmt.Sprintf("snapshot %d  %s  %s", e.SnapId, e.Crud, e.RelPath)
+		if e.Crud == "R" {
+			line = fmt.Sprintf("snapshot %d  %s  %s -> %s", e.SnapId, e.Crud, e.OldPath, e.RelPath)
+		}
+		line += fmt.Sprintf("  (%s, target %d)", progress.FormatBytes(e.Size), e.Target)
+		line += fmt.Sprintf("\n    %s  %s", e.Date, e.Host)
+		if e.Desc != "" {
+			line += "\n    " + e.Desc
+		}
+		logger.Print(line + "\n")
+	}
+	return nil
+}
+
+// Changes of the file in the snapshots, the newest first. The file is
+// followed back through its renames, a rename is a file created in a
+// snapshot with the same hash as a file deleted in it.
+func file_log(hists []*history.Hist, relpath string) []report.LogEntry {
+	entries := []report.LogEntry{}
+	for i := len(hists) - 1; i >= 0; i-- {
+		hist := hists[i]
+		phash := fileutils.CalcPathHash(relpath)
+		if !hist.IsPathHash(phash) {
+			continue
+		}
+		crud := hist.GetCrud(phash)
+		if crud != "C" && crud != "U" && crud != "D" {
+			continue
+		}
+		entry := report.LogEntry{
+			SnapId:   hist.SnapId,
+			Crud:     crud,
+			RelPath:  relpath,
+			Date:     meta(hist, "DATE"),
+			Host:     meta(hist, "HOST"),
+			Desc:     meta(hist, "DESC"),
+			Size:     fileutils.FileHashSize(hist.GetFileHash(phash)),
+			Target:   hist.GetTarget(phash),
+			FileHash: hist.GetFileHash(phash),
+		}
+		if crud == "C" && i > 0 {
+			if oldpath := renamed_from(hists[i-1], hist, relpath); oldpath != "" {
+				entry.Crud = "R"
+				entry.OldPath = oldpath
+				relpath = oldpath
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Path the file was renamed from since the previous snapshot, empty if not renamed.
+func renamed_from(prev, hist *history.Hist, relpath string) string {
+	for _, c := range diff.Snapshots(prev, hist) {
+		if c.Status == "R" && c.RelPath == relpath {
+			return c.OldPath
+		}
+	}
+	return ""
+}
+
+// Meta value of the snapshot, empty if not recorded.
+func meta(hist *history.Hist, key string) string {
+	val := hist.GetMeta(key)
+	if val == "<none>" {
+		return ""
+	}
+	return val
+}
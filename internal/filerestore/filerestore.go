@@ -0,0 +1,152 @@
+package filerestore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/lock"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/restore"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
+	"github.com/akhlakm/Snap_Shot/internal/workpool"
+)
+
+// Restore files and directories of a snapshot to the root, or to another
+// directory, without changing the last snapshot synced.
+func Execute() error {
+	args := argparser.GetParser()
+	errmsg := "\nUSAGE: restore <snapshot id|tag> <path>... [--to <dir>] [--overwrite|--keep-both|--skip]\n"
+
+	rem, err := settings.Remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	if !remote.Available(rem) {
+		errmsg := "Remote directory does not exist.\n" +
+			"\nMake sure it is mounted or reachable.\n"
+		return logger.FailCode(logger.ExitRemote, "restore-files", rem.String(), errmsg)
+	}
+	rootname := settings.RootName()
+	root := settings.Current().Dir()
+
+	arg, err := args.ReqStr(1, errmsg)
+	if err != nil {
+		return err
+	}
+	ssid, err := tags.ResolveArg(rem, rootname, arg)
+	if err != nil {
+		return err
+	}
+
+	// paths are relative to the working directory, which can be below the root
+	if len(args.GetRest(2)) == 0 {
+		return logger.FailCode(logger.ExitUsage, "restore-files", "no paths", "Please give the files or directories to restore.\n"+errmsg)
+	}
+	paths := []string{}
+	for _, arg := range args.GetRest(2) {
+		relpath, err := fileutils.RootRelPath(root, arg)
+		if err != nil {
+			return logger.FailCode(logger.ExitUsage, "restore-path", arg, err.Error())
+		}
+		paths = append(paths, relpath)
+	}
+
+	mode := ""
+	for _, flag := range []string{restore.Overwrite, restore.KeepBoth, restore.Skip} {
+		if args.HasFlag(flag) {
+			if mode != "" {
+				return logger.FailCode(logger.ExitUsage, "restore-files", "--"+flag,
+					fmt.Sprintf("Only one of --%s, --%s and --%s can be given.", restore.Overwrite, restore.KeepBoth, restore.Skip))
+			}
+			mode = flag
+		}
+	}
+
+	dest := root
+	if to := args.GetKeyStr("to", ""); to != "" {
+		abs, err := fileutils.AbsolutePath(to)
+		if err != nil {
+			return logger.FailCode(logger.ExitUsage, "restore-to", to, err.Error())
+		}
+		dest = fileutils.PathNormalize(abs)
+	}
+
+	// --dry has a higher priority over --go
+	commit := !args.HasFlag("dry") && args.HasFlag("go")
+	if commit {
+		// the blobs must not be pruned while they are copied
+		rootlock, err := lock.Acquire(rem, rootname, "restore", logger.Default())
+		if err != nil {
+			return err
+		}
+		defer rootlock.Release()
+	}
+
+	hist := history.Make(ssid, rem, rootname)
+	if !hist.SnapFileExists() {
+		return logger.Fail("restore-files", fmt.Sprint(ssid), "No such snapshot exists in the remote.")
+	}
+	if err := hist.Load(); err != nil {
+		return err
+	}
+
+	items := restore.PlanFiles(hist, paths, dest, mode)
+	if len(items) == 0 {
+		return logger.Fail("restore-files", strings.Join(paths, " "), "No such file/directory exists in the snapshot.\n"+
+			fmt.Sprintf("\nPlease run 'list %d' for the files of the snapshot.", ssid))
+	}
+
+	conflicts, blocked := 0, 0
+	for _, it := range items {
+		switch {
+		case it.Conflict && mode == restore.Skip:
+			logger.Print(fmt.Sprintf("SKIP -- %s differs from the snapshot", it.RelPath))
+		case it.Conflict && mode == restore.KeepBoth:
+			logger.Print(fmt.Sprintf("KEEP -- %s, restored as %s", it.RelPath, filepath.Base(it.DstPath)))
+		case it.Directory:
+			// a directory is never replaced by a file, even with --overwrite
+			blocked++
+			logger.Print(fmt.Sprintf("BLOCKED -- %s is a local directory", it.RelPath))
+		case it.Conflict && mode == "":
+			conflicts++
+			logger.Print(fmt.Sprintf("CONFLICT -- %s differs from the snapshot", it.RelPath))
+		case it.Conflict:
+			logger.Print(fmt.Sprintf("OVERWRITE -- %s", it.RelPath))
+		case it.Skip:
+			logger.Info(fmt.Sprintf("SAME -- %s", it.RelPath))
+		default:
+			logger.Print(fmt.Sprintf("RESTORE -- %s", it.RelPath))
+		}
+	}
+
+	if conflicts > 0 || blocked > 0 {
+		errmsg := ""
+		if conflicts > 0 {
+			errmsg += fmt.Sprintf("%d local files differ from the snapshot, nothing is restored.\n", conflicts) +
+				fmt.Sprintf("\nPlease specify --%s, --%s or --%s.\n", restore.Overwrite, restore.KeepBoth, restore.Skip)
+		}
+		if blocked > 0 {
+			errmsg += fmt.Sprintf("%d local directories have the paths of files of the snapshot, nothing is restored.\n", blocked) +
+				fmt.Sprintf("\nPlease move them away, or specify --%s or --%s.\n", restore.KeepBoth, restore.Skip)
+		}
+		errmsg = strings.TrimSuffix(errmsg, "\n")
+		if !commit {
+			logger.Print("\n" + errmsg)
+			return nil
+		}
+		return logger.Fail("restore-conflict", fmt.Sprintf("%d files", conflicts+blocked), errmsg)
+	}
+	if !commit {
+		logger.Print(fmt.Sprintf("\nDry run of snapshot %d to %s. Files are NOT restored.", ssid, dest))
+		logger.Print("Please specify --go to restore the files.")
+		return nil
+	}
+	return restore.CopyFiles(hist, items, args.GetKeyInt("jobs", workpool.DefaultJobs), logger.Default())
+}
@@ -2,23 +2,35 @@ package fileutils
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/akhlakm/Snap_Shot/internal/codec"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/workpool"
 )
 
 const root_settings_name string = ".shot-settings"
+const root_hashcache_name string = ".shot-hashcache"
 const back_snap_format string = "_%04d"
 const back_files_directory string = "files"
 const back_hist_directory string = "history"
 const back_snap_file_format string = "%04d.shot"
+const back_objects_directory string = "_objects"
+const back_keyinfo_name string = "_keyinfo"
+const back_pending_name string = "pending"
+const back_lock_name string = "lock"
+const back_tags_name string = "tags"
+const time_format string = "Mon 2006-01-02 03:04:05PM -07:00 UTC"
+const mtime_format string = "2006-01-02 03:04:05PM UTC-07:00"
 
 func FileExists(filename string) bool {
 	info, err := os.Stat(filename)
@@ -36,23 +48,56 @@ func DirExists(filename string) bool {
 	return info.IsDir()
 }
 
-func SSExists(ssid int, remote string, rootname string) bool {
-	ssname := FormatSnapFile(ssid)
-	fullpath := PathJoin(remote, rootname, back_hist_directory, ssname)
-	return FileExists(fullpath)
+// Remote keys are slash separated paths relative to the remote location.
+
+func SSExists(ssid int, rem remote.Remote, rootname string) bool {
+	return remote.Exists(rem, SSFilePath(ssid, rootname))
 }
 
-func SSFilePath(ssid int, remote string, rootname string) string {
+func SSFilePath(ssid int, rootname string) string {
 	ssname := FormatSnapFile(ssid)
-	return PathJoin(remote, rootname, back_hist_directory, ssname)
+	return remote.Join(rootname, back_hist_directory, ssname)
+}
+
+func SSHistoryDir(rootname string) string {
+	return remote.Join(rootname, back_hist_directory)
 }
 
-func SSHistoryDir(remote, rootname string) string {
-	return PathJoin(remote, rootname, back_hist_directory)
+// Journal of the snapshot being committed
+func PendingPath(rootname string) string {
+	return remote.Join(rootname, back_pending_name)
 }
 
-func BackPath(remote string, rootname string) string {
-	return PathJoin(remote, rootname, back_files_directory)
+// Owner of the root while it is modified
+func LockPath(rootname string) string {
+	return remote.Join(rootname, back_lock_name)
+}
+
+// Names of the snapshots, tags are added after committing
+func TagsPath(rootname string) string {
+	return remote.Join(rootname, back_tags_name)
+}
+
+func BackPath(rootname string) string {
+	return remote.Join(rootname, back_files_directory)
+}
+
+// content addressed blob in the remote, shared by all roots
+func ObjectPath(objectid string) string {
+	prefix := objectid
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	return remote.Join(back_objects_directory, prefix, objectid)
+}
+
+func ObjectsDir() string {
+	return back_objects_directory
+}
+
+// Wrapped encryption key of an encrypted remote
+func KeyInfoPath() string {
+	return back_keyinfo_name
 }
 
 // Production, executable path
@@ -70,16 +115,22 @@ func BackPath(remote string, rootname string) string {
 
 // Debug
 func CurrentWD() string {
-	cwd, err2 := os.Getwd()
-	if err2 != nil {
-		log.Fatalln("Cannot determine current working directory!", err2)
+	cwd, err := os.Getwd()
+	if err != nil {
+		// relative paths still work
+		return "."
 	}
 	return PathNormalize(cwd)
 }
 
-// temporary checkout directory
-func ShotPath(path string) string {
-	return PathJoin(CurrentWD(), "_.shot", path)
+// temporary checkout directory of the root
+func ShotPath(root string, path string) string {
+	return PathJoin(ShotDir(root), path)
+}
+
+// temporary checkout directory of a root, never snapshotted
+func ShotDir(root string) string {
+	return PathJoin(root, "_.shot")
 }
 
 func CalcPathMd5(path string) string {
@@ -114,13 +165,90 @@ func CalcFileHash(fullpath string, d fs.DirEntry) (string, error) {
 		return "", err
 	}
 	size := strconv.FormatInt(finfo.Size(), 10)
-	modt := finfo.ModTime().Format("2006-01-02 03:04:05PM UTC-07:00")
+	modt := finfo.ModTime().Format(mtime_format)
 	hash = size + "; " + modt
 	return hash, nil
 }
 
+// sha256 digest of the file contents
+func CalcContentDigest(fullpath string) (string, error) {
+	file, err := os.Open(fullpath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	digest, _, err := CalcReaderDigest(file)
+	return digest, err
+}
+
+// sha256 digest of a stream, and its length
+func CalcReaderDigest(r io.Reader) (string, int64, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return "", size, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// Append a content digest to a size+mtime file hash.
+// hash = size + "; " + modt + "; " + algo:digest
+func FileHashWithDigest(stathash string, algo string, digest string) string {
+	return stathash + "; " + algo + ":" + digest
+}
+
+// The "algo:digest" part of a file hash, empty if it only has size+mtime.
+func FileHashDigest(filehash string) string {
+	parts := strings.Split(filehash, ";")
+	if len(parts) < 3 {
+		return ""
+	}
+	return strings.TrimSpace(parts[2])
+}
+
+// The size+mtime part of a file hash.
+func FileHashStat(filehash string) string {
+	parts := strings.Split(filehash, ";")
+	if len(parts) < 2 {
+		return strings.TrimSpace(filehash)
+	}
+	return strings.TrimSpace(parts[0]) + "; " + strings.TrimSpace(parts[1])
+}
+
+// Compare the contents when both hashes have a digest of the same kind,
+// otherwise fall back to size+mtime, so that old shot files can be compared.
 func FileHashSame(hash1, hash2 string) bool {
-	return hash1 == hash2
+	digest1 := FileHashDigest(hash1)
+	digest2 := FileHashDigest(hash2)
+	if digest1 != "" && digest2 != "" && digest_algo(digest1) == digest_algo(digest2) {
+		size1 := strings.TrimSpace(strings.Split(hash1, ";")[0])
+		size2 := strings.TrimSpace(strings.Split(hash2, ";")[0])
+		return size1 == size2 && digest1 == digest2
+	}
+	return FileHashStat(hash1) == FileHashStat(hash2)
+}
+
+func digest_algo(digest string) string {
+	return strings.Split(digest, ":")[0]
+}
+
+// Modification time recorded in a file hash.
+func FileHashModTime(filehash string) (time.Time, error) {
+	parts := strings.Split(filehash, ";")
+	if len(parts) < 2 {
+		return time.Time{}, fmt.Errorf("no modification time in file hash: %s", filehash)
+	}
+	return time.Parse(mtime_format, strings.TrimSpace(parts[1]))
+}
+
+// Size of the file recorded in the file hash, 0 if unknown.
+func FileHashSize(filehash string) int64 {
+	size, err := strconv.ParseInt(strings.TrimSpace(strings.Split(filehash, ";")[0]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
 }
 
 func FileSizeSame(filehash string, size int64) bool {
@@ -171,15 +299,82 @@ func GetTimeString() string {
 	//in the time portion, 03 or 15 is the hour and 04 is the minutes while 05 is the seconds
 	//at the end the UTC offset will always begin with - (negative) and 0700 [-0700]
 	// Example: "Mon 01/02/06 03:04:05PM -07:00"
-	return time.Now().Local().Format("Mon 2006-01-02 03:04:05PM -07:00 UTC")
+	return time.Now().Local().Format(time_format)
+}
+
+// Parse a time string formatted by GetTimeString
+func ParseTimeString(value string) (time.Time, error) {
+	return time.Parse(time_format, value)
+}
+
+func GetHashCachePath() string {
+	return PathNormalize(root_hashcache_name)
 }
 
 func GetRootSettingsPath() string {
-	// @todo: back navigate to top to find any existing
-	// settings file in a parent directory.
 	return PathNormalize(root_settings_name)
 }
 
+// Nearest directory with a root settings file, dir itself or one of its parents.
+func FindRoot(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		if FileExists(filepath.Join(dir, root_settings_name)) {
+			return PathNormalize(dir), true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// Path given on the command line, relative to the working directory,
+// as a path relative to the root. Empty for the root itself.
+func RootRelPath(root string, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(CurrentWD(), path)
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+	rel = PathNormalize(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is outside of the root %s", path, root)
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return rel, nil
+}
+
+// Whether the relative path is the parent path or under it,
+// an empty parent is the whole root.
+func UnderPath(parent string, relpath string) bool {
+	if parent == "" || parent == "." {
+		return true
+	}
+	return relpath == parent || strings.HasPrefix(relpath, parent+"/")
+}
+
+// Whether the relative path is under one of the paths, no paths is the whole root.
+func InScope(paths []string, relpath string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, parent := range paths {
+		if UnderPath(parent, relpath) {
+			return true
+		}
+	}
+	return false
+}
+
 func PathJoin(elem ...string) string {
 	return filepath.Join(elem...)
 }
@@ -267,6 +462,133 @@ func CopyFile(src, dst string) (int64, error) {
 	return bytesWritten, nil
 }
 
+// Receives the number of bytes copied, while copying.
+type ByteCounter interface {
+	AddBytes(n int64)
+}
+
+// Upload a local file to the remote, compressed with the codec.
+// Returns the number of bytes read from the file, and stored in the remote.
+func Upload(rem remote.Remote, src string, key string, comp string, progress ByteCounter) (int64, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, 0, fmt.Errorf("couldn't open source file: %s", err)
+	}
+	defer in.Close()
+
+	sfinfo, err := in.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("coundn't stat srcfile: %s", err)
+	}
+
+	counter := &counting_reader{r: in, progress: progress}
+	blob, err := codec.Compress(comp, counter)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer blob.Close()
+
+	stored, err := rem.Put(key, blob)
+	if err != nil {
+		return counter.n, stored, err
+	}
+
+	// check if copy was okay
+	if counter.n != sfinfo.Size() {
+		return counter.n, stored, fmt.Errorf("coundn't copy all bytes, src %d bytes, copied %d bytes",
+			sfinfo.Size(), counter.n)
+	}
+	return counter.n, stored, nil
+}
+
+type counting_reader struct {
+	r        io.Reader
+	n        int64
+	progress ByteCounter
+}
+
+func (c *counting_reader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.progress != nil && n > 0 {
+		c.progress.AddBytes(int64(n))
+	}
+	return n, err
+}
+
+// Open a remote blob for reading its original contents.
+func OpenBlob(rem remote.Remote, key string, comp string) (io.ReadCloser, error) {
+	in, err := rem.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decompress(comp, in)
+}
+
+// Error of a file copied to or from the remote. Stops the other copies
+// of the work pool if the remote is gone, they would fail the same way.
+func CopyError(rem remote.Remote, err error) error {
+	err = fmt.Errorf("failed to copy file: %s", err)
+	if !remote.Available(rem) {
+		return workpool.Stop(err)
+	}
+	return err
+}
+
+// Download a remote blob to a temp file first, then rename.
+// Create the parent dir, if not exist.
+// Returns the number of bytes written after decompression.
+func Download(rem remote.Remote, key string, dst string, comp string, progress ByteCounter) (int64, error) {
+	in, err := OpenBlob(rem, key, comp)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't open remote file: %s", err)
+	}
+	defer in.Close()
+
+	// create the parent directory
+	err = CreateDirectory(filepath.Dir(dst))
+	if err != nil {
+		return 0, err
+	}
+
+	tmpfile := dst + ".tmp"
+	tmp, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't open dest tmpfile: %s", err)
+	}
+
+	bytesWritten, err := io.Copy(tmp, &counting_reader{r: in, progress: progress})
+	if err != nil {
+		tmp.Close()
+		return bytesWritten, fmt.Errorf("writing to dest tmpfile failed: %s", err)
+	}
+
+	// flush
+	err = tmp.Sync()
+	tmp.Close()
+	if err != nil {
+		return bytesWritten, fmt.Errorf("tmpfile flush error: %s", err)
+	}
+
+	// rename the temp file
+	err = os.Rename(tmpfile, dst)
+	if err != nil {
+		return bytesWritten, fmt.Errorf("coundn't rename tmpfile: %s", err)
+	}
+
+	return bytesWritten, nil
+}
+
+// Set the modification time recorded in the file hash,
+// so that the restored file hashes the same again.
+func SetModTime(path string, filehash string) error {
+	mtime, err := FileHashModTime(filehash)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, mtime, mtime)
+}
+
 func ReadOnly(filepath string) error {
 	return os.Chmod(filepath, 0444)
 }
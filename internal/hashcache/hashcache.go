@@ -0,0 +1,169 @@
+package hashcache
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+)
+
+// Files modified this recently are not cached, they can still be
+// rewritten within the same mtime resolution without us noticing.
+const racy_window = 2 * time.Second
+
+type entry struct {
+	size   int64
+	mtime  int64
+	digest string
+}
+
+// Stat cache of the content digests of the files in the root,
+// so that unchanged files are not read again on every walk.
+// Safe to use from multiple goroutines.
+type Cache struct {
+	mu      sync.Mutex
+	file    string
+	mode    string
+	entries map[string]entry
+	seen    map[string]bool
+	// paths walked, the whole root if empty
+	scope   []string
+	changed bool
+	log     *logger.Logger
+}
+
+func Load(file string, mode string, log *logger.Logger) *Cache {
+	cache := &Cache{
+		file:    file,
+		mode:    mode,
+		log:     log,
+		entries: make(map[string]entry),
+		seen:    make(map[string]bool),
+	}
+	if mode != "stat" {
+		cache.read()
+	}
+	return cache
+}
+
+// File hash of a file in the root, with a content digest
+// unless the hash mode is stat.
+func (c *Cache) FileHash(fullpath string, relpath string, d fs.DirEntry) (string, error) {
+	stathash, err := fileutils.CalcFileHash(fullpath, d)
+	if err != nil || c.mode == "stat" {
+		return stathash, err
+	}
+
+	finfo, err := d.Info()
+	if err != nil {
+		return "", err
+	}
+	relpath = fileutils.PathNormalize(relpath)
+	size := finfo.Size()
+	mtime := finfo.ModTime().UnixNano()
+
+	c.mu.Lock()
+	c.seen[relpath] = true
+	e, ok := c.entries[relpath]
+	c.mu.Unlock()
+
+	if ok && e.size == size && e.mtime == mtime {
+		return fileutils.FileHashWithDigest(stathash, c.mode, e.digest), nil
+	}
+
+	c.log.Trace("hashcache-digest", relpath)
+	digest, err := fileutils.CalcContentDigest(fullpath)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(finfo.ModTime()) > racy_window {
+		c.entries[relpath] = entry{size: size, mtime: mtime, digest: digest}
+		c.changed = true
+	} else if _, ok := c.entries[relpath]; ok {
+		delete(c.entries, relpath)
+		c.changed = true
+	}
+
+	return fileutils.FileHashWithDigest(stathash, c.mode, digest), nil
+}
+
+// Only the files under the paths are walked, the entries of
+// the other files are kept when writing.
+func (c *Cache) Limit(paths []string) {
+	c.scope = paths
+}
+
+// Write the cache file, forgetting the files not seen since loading.
+func (c *Cache) Write() {
+	if c.mode == "stat" {
+		return
+	}
+	for relpath := range c.entries {
+		if !c.seen[relpath] && fileutils.InScope(c.scope, relpath) {
+			delete(c.entries, relpath)
+			c.changed = true
+		}
+	}
+	if !c.changed {
+		return
+	}
+	c.log.Trace("hashcache-write", c.file)
+	file, err := os.OpenFile(c.file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		// not a big deal, we will hash again next time
+		c.log.Warn("failed to write the hash cache file.")
+		return
+	}
+	defer file.Close()
+
+	datawriter := bufio.NewWriter(file)
+	datawriter.WriteString(fmt.Sprintf("# %s\n", c.mode))
+	for relpath, e := range c.entries {
+		datawriter.WriteString(fmt.Sprintf("%d\t%d\t%s\t%s\n", e.size, e.mtime, e.digest, relpath))
+	}
+	datawriter.Flush()
+	c.changed = false
+	c.log.Done("hashcache-write", c.file)
+}
+
+func (c *Cache) read() {
+	file, err := os.Open(c.file)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			// digests of a different hash mode are useless
+			if strings.TrimSpace(line[1:]) != c.mode {
+				c.entries = make(map[string]entry)
+				c.changed = true
+				return
+			}
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 4)
+		if len(parts) < 4 {
+			continue
+		}
+		size, err1 := strconv.ParseInt(parts[0], 10, 64)
+		mtime, err2 := strconv.ParseInt(parts[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		c.entries[parts[3]] = entry{size: size, mtime: mtime, digest: parts[2]}
+	}
+}
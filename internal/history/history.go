@@ -2,13 +2,16 @@ package history
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
-	"log"
-	"os"
-	"snap/internal/fileutils"
-	"snap/internal/logger"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/codec"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
 )
 
 type FileItem struct {
@@ -16,10 +19,13 @@ type FileItem struct {
 	Name     string
 	Target   int
 	FileHash string
+	ObjectId string
+	Codec    string
+	BlobSize int64
 }
 
 type Hist struct {
-	Remote       string
+	Remote       remote.Remote
 	RootName     string
 	SnapId       int
 	SnapFilePath string
@@ -28,25 +34,34 @@ type Hist struct {
 	Name         map[string]string
 	Target       map[string]int
 	FileHash     map[string]string
+	ObjectId     map[string]string
+	Codec        map[string]string
+	BlobSize     map[string]int64
 	CRUD         map[string]string
+	// messages of the loads and prints, the logger of the process by default
+	Log *logger.Logger
 }
 
-func Make(ssid int, remote string, rootname string) *Hist {
+func Make(ssid int, rem remote.Remote, rootname string) *Hist {
 	hist := &Hist{
-		Remote:       remote,
+		Remote:       rem,
 		RootName:     rootname,
 		SnapId:       ssid,
-		SnapFilePath: fileutils.SSFilePath(ssid, remote, rootname),
+		SnapFilePath: fileutils.SSFilePath(ssid, rootname),
 		Meta:         make(map[string]string),
 		RelPath:      make(map[string]string),
 		Name:         make(map[string]string),
 		Target:       make(map[string]int),
 		FileHash:     make(map[string]string),
+		ObjectId:     make(map[string]string),
+		Codec:        make(map[string]string),
+		BlobSize:     make(map[string]int64),
 		CRUD:         make(map[string]string),
+		Log:          logger.Default(),
 	}
 
 	hist.SetMetaString("SSID", fmt.Sprint(ssid))
-	hist.SetMetaString("REMOTE", remote)
+	hist.SetMetaString("REMOTE", rem.String())
 	hist.SetMetaString("ROOT", rootname)
 	return hist
 }
@@ -71,9 +86,9 @@ func (h *Hist) SnapFileExists() bool {
 }
 
 func (h *Hist) SnapFileOfNameExists(ssname string) bool {
-	histDir := fileutils.SSHistoryDir(h.Remote, h.RootName)
-	snapfile := fileutils.PathJoin(histDir, ssname)
-	return fileutils.FileExists(snapfile)
+	histDir := fileutils.SSHistoryDir(h.RootName)
+	snapfile := remote.Join(histDir, ssname)
+	return remote.Exists(h.Remote, snapfile)
 }
 
 func (h *Hist) IsPathHash(pathhash string) bool {
@@ -111,30 +126,47 @@ func (h *Hist) GetRelPath(pathHash string) string {
 	return fileutils.PathNormalize(val)
 }
 
-// full path in the remote
+// Content digest of the blob in the remote object store,
+// empty if the file is stored under files/
+func (h *Hist) GetObjectId(pathHash string) string {
+	val := h.ObjectId[pathHash]
+	return val
+}
+
+// Compression of the blob in the remote, empty if stored as is
+func (h *Hist) GetCodec(pathHash string) string {
+	val := h.Codec[pathHash]
+	return val
+}
+
+// Size of the compressed blob in the remote, 0 if not recorded
+func (h *Hist) GetBlobSize(pathHash string) int64 {
+	val := h.BlobSize[pathHash]
+	return val
+}
+
+// key of the blob to upload to the remote
 func (h *Hist) GetBackupPath(phash string) string {
-	backpath := fileutils.BackPath(h.Remote, h.RootName)
+	suffix := codec.Suffix(h.Codec[phash])
+	if objectid := h.ObjectId[phash]; objectid != "" {
+		return fileutils.ObjectPath(objectid) + suffix
+	}
+	backpath := fileutils.BackPath(h.RootName)
 	fmtsnap := fileutils.FormatSnap(h.SnapId)
 	filename := h.Name[phash]
-	relbackpath := fileutils.PathJoin(backpath, phash, fmtsnap+"_"+filename)
-	abspath, err := fileutils.AbsolutePath(relbackpath)
-	if err != nil {
-		logger.Error("history-backup-path", relbackpath, "Failed to calculate absolute path.")
-	}
-	return abspath
+	return remote.Join(backpath, phash, fmtsnap+"_"+filename+suffix)
 }
 
-// full path in the remote
+// key of the blob to restore from the remote
 func (h *Hist) GetRestorePath(phash string) string {
-	backpath := fileutils.BackPath(h.Remote, h.RootName)
+	suffix := codec.Suffix(h.Codec[phash])
+	if objectid := h.ObjectId[phash]; objectid != "" {
+		return fileutils.ObjectPath(objectid) + suffix
+	}
+	backpath := fileutils.BackPath(h.RootName)
 	fmtsnap := fileutils.FormatSnap(h.GetTarget(phash))
 	filename := h.Name[phash]
-	relbackpath := fileutils.PathJoin(backpath, phash, fmtsnap+"_"+filename)
-	abspath, err := fileutils.AbsolutePath(relbackpath)
-	if err != nil {
-		logger.Error("history-restore-path", relbackpath, "Failed to calculate absolute path.")
-	}
-	return abspath
+	return remote.Join(backpath, phash, fmtsnap+"_"+filename+suffix)
 }
 
 func (h *Hist) GetFileHash(pathHash string) string {
@@ -148,6 +180,9 @@ func (h *Hist) GetAction(phash string) *FileItem {
 		RelPath:  h.RelPath[phash],
 		Target:   h.Target[phash],
 		FileHash: h.FileHash[phash],
+		ObjectId: h.ObjectId[phash],
+		Codec:    h.Codec[phash],
+		BlobSize: h.BlobSize[phash],
 	}
 }
 
@@ -156,6 +191,9 @@ func (h *Hist) SetAction(phash string, fi *FileItem) {
 	h.RelPath[phash] = fi.RelPath
 	h.Target[phash] = fi.Target
 	h.FileHash[phash] = fi.FileHash
+	h.SetObjectId(phash, fi.ObjectId)
+	h.SetCodec(phash, fi.Codec)
+	h.SetBlobSize(phash, fi.BlobSize)
 }
 
 func (h *Hist) CountCrud(crud string) int {
@@ -168,17 +206,49 @@ func (h *Hist) CountCrud(crud string) int {
 	return total
 }
 
+// Set the action of the file, one of C, R, U, D or I.
 func (h *Hist) SetCrud(pathhash string, crud string) {
-	if len(crud) > 1 {
-		logger.Error("history-set-crud", crud, "CRUD must be single character")
-	}
 	h.CRUD[pathhash] = strings.ToUpper(crud)
 }
 
+// Whether the action of a line of a shot file is known.
+func valid_crud(crud string) bool {
+	switch strings.ToUpper(crud) {
+	case "C", "R", "U", "D", "I":
+		return true
+	}
+	return false
+}
+
 func (h *Hist) SetFileHash(pathhash string, hash string) {
 	h.FileHash[pathhash] = hash
 }
 
+func (h *Hist) SetObjectId(pathhash string, objectid string) {
+	if objectid == "" {
+		delete(h.ObjectId, pathhash)
+	} else {
+		h.ObjectId[pathhash] = objectid
+	}
+}
+
+func (h *Hist) SetCodec(pathhash string, comp string) {
+	if comp == codec.None {
+		delete(h.Codec, pathhash)
+	} else {
+		h.Codec[pathhash] = comp
+	}
+}
+
+// Recorded at upload, so that the compressed blobs can be checked without reading them.
+func (h *Hist) SetBlobSize(pathhash string, size int64) {
+	if size <= 0 {
+		delete(h.BlobSize, pathhash)
+	} else {
+		h.BlobSize[pathhash] = size
+	}
+}
+
 func (h *Hist) SetTarget(pathhash string, target int) {
 	h.Target[pathhash] = target
 }
@@ -195,16 +265,14 @@ func (h *Hist) AddMetaInt(key string, value int) {
 	if _, ok := h.Meta[key]; !ok {
 		h.Meta[key] = "0"
 	}
-	prev, err := strconv.Atoi(h.Meta[key])
-	if err != nil {
-		logger.Error("history-add-meta", key, "Cannot parse meta as an integer to add to.")
-	}
+	// an invalid value starts over
+	prev, _ := strconv.Atoi(h.Meta[key])
 	h.Meta[key] = strconv.Itoa(prev + value)
 }
 
 func (h *Hist) get_action_string(phash string) string {
-	// Root1>RelPath>CU>PathHash>02>Name>FileHash
-	return fmt.Sprintf("    %s > %s > %s > %s > %04d > %s > %s",
+	// Root1>RelPath>CU>PathHash>02>Name>FileHash[>ObjectId[>Codec[>BlobSize]]]
+	line := fmt.Sprintf("    %s > %s > %s > %s > %04d > %s > %s",
 		h.RootName,
 		h.RelPath[phash],
 		strings.ToUpper(h.CRUD[phash]),
@@ -212,17 +280,39 @@ func (h *Hist) get_action_string(phash string) string {
 		h.Target[phash],
 		h.Name[phash],
 		h.FileHash[phash])
+	objectid, hasobject := h.ObjectId[phash]
+	comp, hascodec := h.Codec[phash]
+	if hasobject || hascodec {
+		line += " > " + objectid
+	}
+	if hascodec {
+		line += " > " + comp
+		if size, ok := h.BlobSize[phash]; ok {
+			line += fmt.Sprintf(" > %d", size)
+		}
+	}
+	return line
 }
 
 func (h *Hist) formatted_action_string(phash string) string {
 	// Root1>RelPath>CU>PathHash>02>Name>FileHash
-	return fmt.Sprintf("  %s > %s\n      FileHash: %s\n      LastSnapshot: %s > %04d > %s\n",
+	line := fmt.Sprintf("  %s > %s\n      FileHash: %s\n      LastSnapshot: %s > %04d > %s\n",
 		h.RootName,
 		h.RelPath[phash],
 		h.FileHash[phash],
 		phash,
 		h.Target[phash],
 		h.Name[phash])
+	if objectid, ok := h.ObjectId[phash]; ok {
+		line += fmt.Sprintf("      Object: %s\n", objectid)
+	}
+	if comp, ok := h.Codec[phash]; ok {
+		line += fmt.Sprintf("      Codec: %s\n", comp)
+	}
+	if size, ok := h.BlobSize[phash]; ok {
+		line += fmt.Sprintf("      BlobSize: %d\n", size)
+	}
+	return line
 }
 
 func (h *Hist) Print() {
@@ -235,23 +325,33 @@ func (h *Hist) Print() {
 }
 
 func (h *Hist) PrintCrud(crud string) {
-	logger.Print(crud + " ----------------------------------------------------")
+	h.Log.Print(crud + " ----------------------------------------------------")
 	for phash := range h.RelPath {
 		if h.GetCrud(phash) == strings.ToUpper(crud) {
-			logger.Print(h.formatted_action_string(phash))
+			h.Log.Print(h.formatted_action_string(phash))
 		}
 	}
 }
 
 func (h *Hist) PrintMeta() {
-	logger.Print("M ----------------------------------------------------")
+	h.Log.Print("M ----------------------------------------------------")
 	for key, val := range h.Meta {
-		logger.Print(fmt.Sprintf("    %s\t=\t%s", key, val))
+		h.Log.Print(fmt.Sprintf("    %s\t=\t%s", key, val))
 	}
-	logger.Print("------------------------------------------------------")
+	h.Log.Print("------------------------------------------------------")
+}
+
+func (h *Hist) Write() error {
+	return h.write_to(h.SnapFilePath)
+}
+
+// Journal of the snapshot being committed, written before the blobs
+// are uploaded, and removed once the shot file is published.
+func (h *Hist) WritePending() error {
+	return h.write_to(fileutils.PendingPath(h.RootName))
 }
 
-func (h *Hist) Write() {
+func (h *Hist) write_to(snapfile string) error {
 	lines := []string{}
 
 	for key, val := range h.Meta {
@@ -267,44 +367,114 @@ func (h *Hist) Write() {
 		}
 	}
 
-	snapfile := fileutils.SSFilePath(h.SnapId, h.Remote, h.RootName)
-	err := fileutils.CreateParent(snapfile)
-	if err != nil {
-		log.Fatalf("failed creating directory: %s", err)
+	var content bytes.Buffer
+	for _, data := range lines {
+		content.WriteString(data + "\n")
 	}
 
-	file, err := os.OpenFile(snapfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	// the shot file is replaced as a whole, never appended to
+	_, err := h.Remote.Put(snapfile, &content)
 	if err != nil {
-		log.Fatalf("failed creating file: %s", err)
+		return logger.Fail("history-write", snapfile, fmt.Sprintf("Failed to write the snapshot file.\n\n%s", err))
 	}
+	return nil
+}
 
-	datawriter := bufio.NewWriter(file)
-	for _, data := range lines {
-		_, _ = datawriter.WriteString(data + "\n")
+// The pending snapshot of an interrupted commit, nil if none.
+func LoadPending(rem remote.Remote, rootname string, log *logger.Logger) (*Hist, error) {
+	pendingfile := fileutils.PendingPath(rootname)
+	if !remote.Exists(rem, pendingfile) {
+		return nil, nil
+	}
+	h := Make(0, rem, rootname)
+	h.Log = log
+	if err := h.load_from(pendingfile); err != nil {
+		return nil, err
 	}
 
-	datawriter.Flush()
-	file.Close()
+	ssid, err := strconv.Atoi(h.GetMeta("SSID"))
+	if err != nil || ssid < 1 {
+		return nil, logger.Fail("history-load-pending", pendingfile, "Invalid SSID in the pending snapshot file!")
+	}
+	h.SnapId = ssid
+	h.SnapFilePath = fileutils.SSFilePath(ssid, rootname)
+	return h, nil
+}
+
+func ClearPending(rem remote.Remote, rootname string) error {
+	return rem.Delete(fileutils.PendingPath(rootname))
 }
 
 func (h *Hist) MakeReadOnly() {
-	snapfile := fileutils.SSFilePath(h.SnapId, h.Remote, h.RootName)
-	if err := fileutils.ReadOnly(snapfile); err != nil {
-		logger.Print("WARN -- failed to make history file read-only.")
+	if err := h.Remote.ReadOnly(h.SnapFilePath); err != nil {
+		h.Log.Warn("failed to make history file read-only.")
 	}
 }
 
+// Ids of all the snapshot files in the remote history directory, sorted
+func SnapIds(rem remote.Remote, rootname string) []int {
+	histDir := fileutils.SSHistoryDir(rootname)
+	files, err := rem.List(histDir)
+	if err != nil {
+		return []int{}
+	}
+
+	ids := []int{}
+	for _, f := range files {
+		if f.IsDir || !strings.HasSuffix(f.Name, ".shot") {
+			continue
+		}
+		ssid, err := strconv.Atoi(strings.TrimSuffix(f.Name, ".shot"))
+		if err == nil && ssid > 0 {
+			ids = append(ids, ssid)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Names of all the roots in the remote with a history directory
+func RootNames(rem remote.Remote) []string {
+	entries, err := rem.List("")
+	if err != nil {
+		return []string{}
+	}
+
+	names := []string{}
+	for _, e := range entries {
+		if e.IsDir && remote.DirExists(rem, fileutils.SSHistoryDir(e.Name)) {
+			names = append(names, e.Name)
+		}
+	}
+	return names
+}
+
+// Keys of the remote blobs needed to restore the snapshot
+func (h *Hist) BlobPaths() []string {
+	paths := []string{}
+	for phash := range h.RelPath {
+		crud := h.GetCrud(phash)
+		if crud != "D" && crud != "I" {
+			paths = append(paths, h.GetRestorePath(phash))
+		}
+	}
+	return paths
+}
+
 // Load and parse history file
-func (h *Hist) Load() {
+func (h *Hist) Load() error {
 	if h.SnapId == 0 {
-		return
+		return nil
 	}
-	snapfile := fileutils.SSFilePath(h.SnapId, h.Remote, h.RootName)
-	logger.Trace("history-load", snapfile)
+	return h.load_from(h.SnapFilePath)
+}
+
+func (h *Hist) load_from(snapfile string) error {
+	h.Log.Trace("history-load", snapfile)
 
-	file, err := os.Open(snapfile)
+	file, err := h.Remote.Get(snapfile)
 	if err != nil {
-		log.Fatal(err)
+		return logger.Fail("history-load", snapfile, fmt.Sprintf("Failed to read the snapshot file.\n\n%s", err))
 	}
 	defer file.Close()
 
@@ -331,13 +501,13 @@ func (h *Hist) Load() {
 				errmsg := "Snapshot file unreadable.\n" +
 					"\nPlease make sure you have not manually edited the shot files in the history/ directory.\n" +
 					"Expected format: Root1>RelPath>CU>PathHash>02>Name>FileHash\n"
-				logger.Error("history-load", line, errmsg)
+				return logger.Fail("history-load", line, errmsg)
 			}
 			if h.RootName != strings.TrimSpace(parts[0]) {
 				errmsg := "Snapshot was taken under a different root or different rootname.\n" +
 					"\nPlease make sure you initialized with the same rootname.\n" +
 					"If you want, you can manually rename the root directory in the remote.\n"
-				logger.Error("history-load", parts[0], errmsg)
+				return logger.Fail("history-load", parts[0], errmsg)
 			}
 
 			relpath := strings.TrimSpace(parts[1])
@@ -347,32 +517,53 @@ func (h *Hist) Load() {
 			name := strings.TrimSpace(parts[5])
 			filehash := strings.TrimSpace(parts[6])
 
+			if !valid_crud(crud) {
+				return logger.Fail("history-load", crud,
+					fmt.Sprintf("Not a valid CRUD, shot file unreadable.\n\n%s", line))
+			}
+
 			h.AddPath(pathhash, relpath, name, filehash)
+			// optional, the object id is empty if not in the object store
+			if len(parts) > 7 {
+				h.SetObjectId(pathhash, strings.TrimSpace(parts[7]))
+			}
+			if len(parts) > 8 {
+				h.SetCodec(pathhash, strings.TrimSpace(parts[8]))
+			}
+			if len(parts) > 9 {
+				size, err := strconv.ParseInt(strings.TrimSpace(parts[9]), 10, 64)
+				if err != nil {
+					return logger.Fail("history-load", parts[9],
+						fmt.Sprintf("Not a valid blob size, shot file unreadable.\n\n%s\n%s", line, err))
+				}
+				h.SetBlobSize(pathhash, size)
+			}
 			h.SetCrud(pathhash, crud)
 			itarget, err := strconv.ParseInt(target, 10, 0)
 			if err != nil {
-				fmt.Println(line, "\n", err)
-				logger.Error("history-load", target, "Not a valid snapshot target, shot file unreadable.")
+				return logger.Fail("history-load", target,
+					fmt.Sprintf("Not a valid snapshot target, shot file unreadable.\n\n%s\n%s", line, err))
 			}
 			h.SetTarget(pathhash, int(itarget))
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return logger.Fail("history-load", snapfile, fmt.Sprintf("Failed to read the snapshot file.\n\n%s", err))
 	}
-	logger.Done("history-load", snapfile)
+	h.Log.Done("history-load", snapfile)
+	return nil
 }
 
 // Load and parse the initial meta section of the history file
-func (h *Hist) LoadFileMeta(ssname string) {
-	histDir := fileutils.SSHistoryDir(h.Remote, h.RootName)
-	snapfile := fileutils.PathJoin(histDir, ssname)
-	logger.Trace("history-load-meta", snapfile)
+func (h *Hist) LoadFileMeta(ssname string) error {
+	histDir := fileutils.SSHistoryDir(h.RootName)
+	snapfile := remote.Join(histDir, ssname)
+	h.Log.Trace("history-load-meta", snapfile)
 
-	file, err := os.Open(snapfile)
+	file, err := h.Remote.Get(snapfile)
 	if err != nil {
-		log.Fatal(err)
+		return logger.Fail("history-load-meta", snapfile, fmt.Sprintf("Failed to read the snapshot file.\n\n%s", err))
 	}
 	defer file.Close()
 
@@ -395,8 +586,9 @@ func (h *Hist) LoadFileMeta(ssname string) {
 			if key == "SSID" {
 				h.SnapId, err = strconv.Atoi(val)
 				if err != nil {
-					logger.Error("history-load-meta", val, "Invalid SSID in the snapshot file!")
+					return logger.Fail("history-load-meta", val, "Invalid SSID in the snapshot file!")
 				}
+				h.SnapFilePath = fileutils.SSFilePath(h.SnapId, h.RootName)
 			}
 		} else if strings.Contains(line, ">") {
 			break
@@ -404,7 +596,8 @@ func (h *Hist) LoadFileMeta(ssname string) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return logger.Fail("history-load-meta", snapfile, fmt.Sprintf("Failed to read the snapshot file.\n\n%s", err))
 	}
-	logger.Done("history-load-meta", snapfile)
+	h.Log.Done("history-load-meta", snapfile)
+	return nil
 }
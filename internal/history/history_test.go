@@ -0,0 +1,156 @@
+package history
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+)
+
+func TestMain(m *testing.M) {
+	logger.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func sample_hist(rem remote.Remote) *Hist {
+	h := Make(3, rem, "r")
+	h.SetMetaString("DATE", "Mon 2024-01-01 10:00:00AM +00:00 UTC")
+	h.SetMetaString("DESC", "a = b")
+
+	h.AddPath("a.txt", "a.txt", "a.txt", "5; 2024-01-01 10:00:00AM UTC+00:00")
+	h.SetCrud("a.txt", "C")
+	h.SetTarget("a.txt", 3)
+
+	h.AddPath("d/b.txt", "d/b.txt", "b.txt", "7; 2024-01-01 09:00:00AM UTC+00:00")
+	h.SetCrud("d/b.txt", "R")
+	h.SetTarget("d/b.txt", 2)
+	h.SetObjectId("d/b.txt", "0123456789abcdef")
+	h.SetCodec("d/b.txt", "gzip")
+	h.SetBlobSize("d/b.txt", 31)
+
+	h.AddPath("old.txt", "old.txt", "old.txt", "1; 2023-12-31 10:00:00AM UTC+00:00")
+	h.SetCrud("old.txt", "D")
+	h.SetTarget("old.txt", 1)
+
+	h.AddPath("tmp.log", "tmp.log", "tmp.log", "9; 2024-01-01 10:00:00AM UTC+00:00")
+	h.SetCrud("tmp.log", "I")
+	return h
+}
+
+func TestWriteLoad(t *testing.T) {
+	rem := remote.NewMemory()
+	h := sample_hist(rem)
+	if err := h.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := Make(3, rem, "r")
+	if !got.SnapFileExists() {
+		t.Fatal("snapshot file not written")
+	}
+	if err := got.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"SSID", "ROOT", "DATE", "DESC"} {
+		if got.GetMeta(key) != h.GetMeta(key) {
+			t.Errorf("meta %s = %q, want %q", key, got.GetMeta(key), h.GetMeta(key))
+		}
+	}
+	for _, phash := range []string{"a.txt", "d/b.txt", "old.txt"} {
+		if !got.IsPathHash(phash) {
+			t.Errorf("%s not loaded", phash)
+			continue
+		}
+		if *got.GetAction(phash) != *h.GetAction(phash) {
+			t.Errorf("%s = %+v, want %+v", phash, *got.GetAction(phash), *h.GetAction(phash))
+		}
+		if got.GetCrud(phash) != h.GetCrud(phash) {
+			t.Errorf("%s crud = %s, want %s", phash, got.GetCrud(phash), h.GetCrud(phash))
+		}
+	}
+	if got.IsPathHash("tmp.log") {
+		t.Error("ignored file written to the snapshot file")
+	}
+}
+
+func TestPending(t *testing.T) {
+	rem := remote.NewMemory()
+	if p, err := LoadPending(rem, "r", logger.Default()); err != nil || p != nil {
+		t.Fatalf("LoadPending without journal = %v, %v", p, err)
+	}
+
+	h := sample_hist(rem)
+	if err := h.WritePending(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPending(rem, "r", logger.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.SnapId != 3 || p.SnapFilePath != h.SnapFilePath {
+		t.Fatalf("LoadPending = %+v", p)
+	}
+	if p.GetObjectId("d/b.txt") != "0123456789abcdef" {
+		t.Errorf("object id = %q", p.GetObjectId("d/b.txt"))
+	}
+	if ids := SnapIds(rem, "r"); len(ids) != 0 {
+		t.Error("pending journal listed as a snapshot")
+	}
+
+	if err := ClearPending(rem, "r"); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := LoadPending(rem, "r", logger.Default()); p != nil {
+		t.Error("journal not removed")
+	}
+}
+
+func TestSnapIds(t *testing.T) {
+	rem := remote.NewMemory()
+	for _, ssid := range []int{10, 2, 1} {
+		if err := Make(ssid, rem, "r").Write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := SnapIds(rem, "r")
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 10 {
+		t.Errorf("SnapIds = %v", ids)
+	}
+	if names := RootNames(rem); len(names) != 1 || names[0] != "r" {
+		t.Errorf("RootNames = %v", names)
+	}
+}
+
+func TestLoadCrud(t *testing.T) {
+	cases := []struct {
+		crud string
+		ok   bool
+	}{
+		{"C", true},
+		{"u", true},
+		{"I", true},
+		{"X", false},
+		{"CU", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		rem := remote.NewMemory()
+		line := "r > a.txt > " + c.crud + " > a.txt > 0003 > a.txt > 5; 2024-01-01 10:00:00AM UTC+00:00\n"
+		if _, err := rem.Put(fileutils.SSFilePath(3, "r"), strings.NewReader("SSID\t=\t3\n"+line)); err != nil {
+			t.Fatal(err)
+		}
+		h := Make(3, rem, "r")
+		err := h.Load()
+		if c.ok && (err != nil || h.GetCrud("a.txt") != strings.ToUpper(c.crud)) {
+			t.Errorf("crud %q: loaded %q, %v", c.crud, h.GetCrud("a.txt"), err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("crud %q: loaded", c.crud)
+		}
+	}
+}
@@ -1,38 +1,75 @@
 package initialize
 
 import (
+	"bytes"
 	"fmt"
-	"snap/internal/argparser"
-	"snap/internal/fileutils"
-	"snap/internal/logger"
-	"snap/internal/settings"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/crypt"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
 )
 
-func Execute() {
+func Execute() error {
 	logger.Trace("init-execute", "")
 	args := argparser.GetParser()
 
 	errmsg := "\nPlease run 'init' with a rootname (a name for the current project directory),\n" +
 		"and a path to a remote folder to backup to.\n" +
-		"\nUSAGE: init <rootname> <remote folder path>\n"
-
-	rootname := args.ReqStr(1, errmsg)
-	remotepath := args.ReqStr(2, errmsg)
+		"\nUSAGE: init <rootname> <remote folder path, s3:// or sftp:// url> [--encrypt [--key-file <path>]]\n"
 
-	remotepath = fileutils.PathNormalize(remotepath)
-	remotepath, _ = fileutils.AbsolutePath(remotepath)
-	cwd, _ := fileutils.AbsolutePath(fileutils.CurrentWD())
-	// sanity check
-	if remotepath == cwd {
-		logger.Error("init-execute", remotepath, "Cannot set current directory as a remote.")
+	rootname, err := args.ReqStr(1, errmsg)
+	if err != nil {
+		return err
+	}
+	remotepath, err := args.ReqStr(2, errmsg)
+	if err != nil {
+		return err
 	}
 
-	if fileutils.IsASubPath(cwd, remotepath) {
-		logger.Error("init-execute", remotepath, "Cannot set a remote inside the current directory.")
+	if remote.IsURL(remotepath) {
+		// kept verbatim, make sure we can open it
+		if _, err := remote.Open(remotepath); err != nil {
+			return logger.Fail("init-execute", remotepath, fmt.Sprintf("Cannot open the remote.\n\n%s", err))
+		}
+	} else {
+		remotepath = fileutils.PathNormalize(remotepath)
+		remotepath, _ = fileutils.AbsolutePath(remotepath)
+		cwd, _ := fileutils.AbsolutePath(fileutils.CurrentWD())
+		// sanity check
+		if remotepath == cwd {
+			return logger.Fail("init-execute", remotepath, "Cannot set current directory as a remote.")
+		}
+
+		if fileutils.IsASubPath(cwd, remotepath) {
+			return logger.Fail("init-execute", remotepath, "Cannot set a remote inside the current directory.")
+		}
 	}
 
 	settings.Create(rootname, remotepath)
-	settings.Write()
+	if args.HasFlag("encrypt") {
+		keyfile := args.GetKeyStr("key-file", "")
+		if keyfile != "" {
+			keyfile, _ = fileutils.AbsolutePath(keyfile)
+		}
+		settings.SetEncryption(keyfile)
+		if err := setup_encryption(remotepath); err != nil {
+			return err
+		}
+	} else if rem, err := remote.Open(remotepath); err == nil {
+		encrypted := remote.Exists(rem, fileutils.KeyInfoPath())
+		rem.Close()
+		if encrypted {
+			return logger.Fail("init-execute", remotepath, "The remote is encrypted.\n"+
+				"\nPlease rerun 'init' with --encrypt, and the passphrase of the remote.")
+		}
+	}
+	if err := settings.Write(); err != nil {
+		return err
+	}
 
 	msg := fmt.Sprintf("OK -- current directory initialized as a project root.\n"+
 		"RootName:\t%s\nRemotePath:\t%s\n"+
@@ -42,4 +79,45 @@ func Execute() {
 	logger.Print(msg)
 
 	logger.Done("init-execute", "")
+	return nil
+}
+
+// Create the encryption key of the remote, or check the passphrase
+// if the remote is already encrypted. Roots of a remote share the key,
+// so that the object store can be shared.
+func setup_encryption(remotepath string) error {
+	rem, err := remote.Open(remotepath)
+	if err != nil {
+		return logger.Fail("init-encrypt", remotepath, fmt.Sprintf("Cannot open the remote.\n\n%s", err))
+	}
+	defer rem.Close()
+
+	if remote.Exists(rem, fileutils.KeyInfoPath()) {
+		if _, err := settings.UnlockRemote(rem); err != nil {
+			return logger.Fail("init-encrypt", remotepath, fmt.Sprintf("Cannot unlock the encrypted remote.\n\n%s", err))
+		}
+		logger.Print("OK -- passphrase of the encrypted remote verified.")
+		return nil
+	}
+
+	if len(history.RootNames(rem)) > 0 {
+		return logger.Fail("init-encrypt", remotepath, "The remote already contains unencrypted roots.\n"+
+			"\nPlease use a new remote for the encrypted roots.")
+	}
+
+	passphrase, err := settings.Passphrase()
+	if err != nil {
+		return logger.Fail("init-encrypt", remotepath, fmt.Sprintf("Cannot create the encryption key.\n\n%s", err))
+	}
+	info, _, err := crypt.NewKeyInfo(passphrase)
+	if err != nil {
+		return logger.Fail("init-encrypt", remotepath, fmt.Sprintf("Cannot create the encryption key.\n\n%s", err))
+	}
+	if _, err := rem.Put(fileutils.KeyInfoPath(), bytes.NewReader(info)); err != nil {
+		return logger.Fail("init-encrypt", remotepath, fmt.Sprintf("Cannot store the encryption key in the remote.\n\n%s", err))
+	}
+	rem.ReadOnly(fileutils.KeyInfoPath())
+	logger.Print("OK -- encryption key created in the remote.\n" +
+		"\nKeep the passphrase safe, the snapshots cannot be restored without it.")
+	return nil
 }
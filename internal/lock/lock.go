@@ -0,0 +1,302 @@
+package lock
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+)
+
+// The owner rewrites the lock file this often while it runs.
+const heartbeat_interval = 30 * time.Second
+
+// A lock without a heartbeat for this long belongs to a dead process.
+const stale_after = 5 * time.Minute
+
+// Time for a concurrent writer of the lock file to show up.
+const settle_time = 500 * time.Millisecond
+
+// Contents of the lock file of a root.
+type Owner struct {
+	Host      string
+	Pid       int
+	Operation string
+	Token     string
+	Started   time.Time
+	Heartbeat time.Time
+}
+
+// Lock of a root held by this process.
+type Lock struct {
+	rem      remote.Remote
+	key      string
+	owner    Owner
+	stop     chan struct{}
+	signals  chan os.Signal
+	released sync.Once
+	mu       sync.Mutex
+	lost     bool
+	log      *logger.Logger
+}
+
+// Whether the locks are released and the process exits on an interrupt,
+// or when a lock is taken over. Set by the command line, the library
+// checks the lock with Check instead.
+var exit_on_signal = false
+
+// Release the locks and exit on SIGINT and SIGTERM, and exit when
+// a lock is taken over by another process.
+func ExitOnSignal() {
+	exit_on_signal = true
+}
+
+// Take the lock of the root for the operation, fails if another
+// process holds it. Stale locks are taken over, with a warning to the log.
+//
+// Remotes have no atomic create, so the lock file is written and read back
+// after a while: of two processes racing for the lock, only the last writer
+// finds its own token. The heartbeat checks the token again.
+func Acquire(rem remote.Remote, rootname string, operation string, log *logger.Logger) (*Lock, error) {
+	key := fileutils.LockPath(rootname)
+	owner, err := Read(rem, rootname)
+	if err != nil {
+		return nil, logger.Fail("lock-read", key, fmt.Sprintf("Failed to read the lock file of the root.\n\n%s", err))
+	}
+	if owner != nil {
+		if !owner.Stale() {
+			return nil, logger.FailCode(logger.ExitLocked, "lock-acquire", rootname,
+				"The root is locked by "+owner.String()+".\n"+
+					"\nPlease wait for it to finish. If it is not running anymore,\n"+
+					"run 'unlock' to remove the lock.")
+		}
+		log.Warn("taking over the stale lock of " + owner.String())
+	}
+
+	token, err := new_token()
+	if err != nil {
+		return nil, logger.Fail("lock-token", "", fmt.Sprintf("Failed to generate a random token.\n\n%s", err))
+	}
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	l := &Lock{
+		rem: rem,
+		key: key,
+		owner: Owner{
+			Host:      host,
+			Pid:       os.Getpid(),
+			Operation: operation,
+			Token:     token,
+			Started:   now,
+			Heartbeat: now,
+		},
+		stop: make(chan struct{}),
+		log:  log,
+	}
+	if err := l.write(); err != nil {
+		return nil, logger.Fail("lock-write", key, fmt.Sprintf("Failed to write the lock file of the root.\n\n%s", err))
+	}
+
+	time.Sleep(settle_time)
+	if !l.held() {
+		return nil, logger.FailCode(logger.ExitLocked, "lock-acquire", rootname,
+			"Another process took the lock of the root at the same time.\n"+
+				"\nPlease try again later.")
+	}
+
+	l.signals = make(chan os.Signal, 1)
+	if exit_on_signal {
+		logger.OnExit(l.Release)
+		signal.Notify(l.signals, os.Interrupt, syscall.SIGTERM)
+	}
+	go l.run()
+	return l, nil
+}
+
+// Remove the lock file, unless another process took it over.
+// Safe to call more than once.
+func (l *Lock) Release() {
+	l.released.Do(func() {
+		close(l.stop)
+		signal.Stop(l.signals)
+		if l.held() {
+			l.rem.Delete(l.key)
+		}
+	})
+}
+
+func (l *Lock) run() {
+	ticker := time.NewTicker(heartbeat_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.signals:
+			logger.Error("lock-interrupt", l.key, "Interrupted, the lock is released.")
+		case <-ticker.C:
+			if !l.held() {
+				if exit_on_signal {
+					logger.Exit(l.Check())
+				}
+				l.mu.Lock()
+				l.lost = true
+				l.mu.Unlock()
+				return
+			}
+			l.owner.Heartbeat = time.Now().UTC()
+			if err := l.write(); err != nil {
+				// the lock stays valid until it gets stale
+				l.log.Warn(fmt.Sprintf("failed to refresh the lock, %s", err))
+			}
+		}
+	}
+}
+
+// Error if the lock was taken over by another process since acquired.
+func (l *Lock) Check() error {
+	l.mu.Lock()
+	lost := l.lost
+	l.mu.Unlock()
+	if lost || !l.held() {
+		return logger.FailCode(logger.ExitLocked, "lock-heartbeat", l.key,
+			"The lock of the root was taken over by another process.\n"+
+				"\nStopping, the work done so far may be incomplete.")
+	}
+	return nil
+}
+
+func (l *Lock) held() bool {
+	owner, err := read_owner(l.rem, l.key)
+	return err == nil && owner != nil && owner.Token == l.owner.Token
+}
+
+func (l *Lock) write() error {
+	var content bytes.Buffer
+	o := l.owner
+	content.WriteString(fmt.Sprintf("HOST\t=\t%s\n", o.Host))
+	content.WriteString(fmt.Sprintf("PID\t=\t%d\n", o.Pid))
+	content.WriteString(fmt.Sprintf("OPERATION\t=\t%s\n", o.Operation))
+	content.WriteString(fmt.Sprintf("TOKEN\t=\t%s\n", o.Token))
+	content.WriteString(fmt.Sprintf("STARTED\t=\t%s\n", o.Started.Format(time.RFC3339)))
+	content.WriteString(fmt.Sprintf("HEARTBEAT\t=\t%s\n", o.Heartbeat.Format(time.RFC3339)))
+	_, err := l.rem.Put(l.key, &content)
+	return err
+}
+
+// Owner of the lock of the root, nil if the root is not locked.
+func Read(rem remote.Remote, rootname string) (*Owner, error) {
+	return read_owner(rem, fileutils.LockPath(rootname))
+}
+
+// Another root of the remote with a live lock, and its owner. The roots
+// share the object store of the remote. Empty if there is none.
+func OtherHolder(rem remote.Remote, rootname string) (string, *Owner) {
+	for _, other := range history.RootNames(rem) {
+		if other == rootname {
+			continue
+		}
+		owner, err := Read(rem, other)
+		if err == nil && owner != nil && !owner.Stale() {
+			return other, owner
+		}
+	}
+	return "", nil
+}
+
+// Remove the lock of the root, whoever holds it.
+func Remove(rem remote.Remote, rootname string) error {
+	return rem.Delete(fileutils.LockPath(rootname))
+}
+
+func read_owner(rem remote.Remote, key string) (*Owner, error) {
+	if !remote.Exists(rem, key) {
+		return nil, nil
+	}
+	file, err := rem.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	o := &Owner{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		val := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "HOST":
+			o.Host = val
+		case "PID":
+			o.Pid, _ = strconv.Atoi(val)
+		case "OPERATION":
+			o.Operation = val
+		case "TOKEN":
+			o.Token = val
+		case "STARTED":
+			o.Started, _ = time.Parse(time.RFC3339, val)
+		case "HEARTBEAT":
+			o.Heartbeat, _ = time.Parse(time.RFC3339, val)
+		}
+	}
+	return o, scanner.Err()
+}
+
+// Whether the owner is gone: no heartbeat for a while, or its
+// process is not running anymore on this host.
+func (o *Owner) Stale() bool {
+	if time.Since(o.Heartbeat) > stale_after {
+		return true
+	}
+	host, _ := os.Hostname()
+	return o.Host == host && !process_alive(o.Pid)
+}
+
+func (o *Owner) String() string {
+	return fmt.Sprintf("'%s' of %s (pid %d) since %s, last seen %s ago",
+		o.Operation, o.Host, o.Pid, o.Started.Local().Format(time.RFC1123),
+		time.Since(o.Heartbeat).Round(time.Second))
+}
+
+func process_alive(pid int) bool {
+	if pid < 1 {
+		return false
+	}
+	if pid == os.Getpid() {
+		return true
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// finding the process already opened it
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+func new_token() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
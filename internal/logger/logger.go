@@ -1,43 +1,306 @@
 package logger
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-const trace bool = false
-const info bool = false
+type Level int
 
-func Trace(process string, item string) {
-	if trace {
-		line := fmt.Sprintf("%s < %s ...", process, shorten_message(item))
-		fmt.Println(line)
+const (
+	// errors and warnings only
+	LevelQuiet Level = iota
+	LevelNormal
+	// -v, the steps of the commands
+	LevelInfo
+	// -vv, every file and remote operation
+	LevelTrace
+)
+
+// Exit codes of the errors.
+const (
+	ExitError   int = 10
+	ExitUsage   int = 2
+	ExitRemote  int = 11
+	ExitLocked  int = 12
+	ExitPartial int = 13
+)
+
+// Destination and level of the messages. The functions of the package
+// print with the logger of the process, set up by the command line.
+// Safe to use from multiple goroutines.
+type Logger struct {
+	// lines of concurrent workers are never interleaved
+	mu    sync.Mutex
+	level Level
+	out   io.Writer
+	// JSON lines log file, if any
+	logfile *os.File
+	// live status line, kept below the printed lines
+	status string
+}
+
+// the messages of the commands, stderr when stdout is for the machine readable output
+var std = &Logger{level: LevelNormal, out: os.Stdout}
+
+// cleanups of the command line to run before exiting on an error
+var exit_hooks []func()
+
+// Logger printing the messages up to the level to w.
+func New(w io.Writer, l Level) *Logger {
+	return &Logger{level: l, out: w}
+}
+
+// Logger of the process, used by the functions of the package.
+func Default() *Logger {
+	return std
+}
+
+// Error to print and exit with, returned up to main.
+type Failure struct {
+	Process string
+	Item    string
+	Message string
+	Code    int
+}
+
+func (f *Failure) Error() string {
+	msg := strings.TrimSpace(strings.SplitN(f.Message, "\n", 2)[0])
+	return fmt.Sprintf("%s > %s: %s", f.Process, f.Item, msg)
+}
+
+// Failure of a process, printed like Error when returned to main.
+func Fail(process string, item string, message string) error {
+	return &Failure{Process: process, Item: item, Message: message, Code: ExitError}
+}
+
+func FailCode(code int, process string, item string, message string) error {
+	return &Failure{Process: process, Item: item, Message: message, Code: code}
+}
+
+// Level of a name given in SNAP_LOG_LEVEL.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "quiet", "error", "warn":
+		return LevelQuiet, nil
+	case "", "normal":
+		return LevelNormal, nil
+	case "info", "verbose":
+		return LevelInfo, nil
+	case "trace", "debug":
+		return LevelTrace, nil
 	}
+	return LevelNormal, fmt.Errorf("unknown log level %s, expected quiet, normal, info or trace", name)
+}
+
+func SetLevel(l Level) {
+	std.SetLevel(l)
+}
+
+func GetLevel() Level {
+	return std.GetLevel()
+}
+
+// Print the messages to w instead of stdout.
+func SetOutput(w io.Writer) {
+	std.SetOutput(w)
+}
+
+// Also write every message as a JSON line to the file, appended.
+func SetLogFile(path string) error {
+	return std.SetLogFile(path)
+}
+
+func Trace(process string, item string) {
+	std.Trace(process, item)
 }
 
 func Done(process string, item string) {
-	if info {
-		line := fmt.Sprintf("OK  -- %s > %s", process, shorten_message(item))
-		fmt.Println(line)
-	}
+	std.Done(process, item)
 }
 
 func Info(item string) {
-	if info {
-		line := fmt.Sprintf("\t%s", shorten_message(item))
-		fmt.Println(line)
+	std.Info(item)
+}
+
+// Print a warning, shown even when quiet.
+func Warn(message string) {
+	std.Warn(message)
+}
+
+func Print(message string) {
+	std.Print(message)
+}
+
+// Show a status line below the output, updated in place.
+// Only for terminals, an empty line removes it. Not shown when quiet.
+func Status(line string) {
+	std.Status(line)
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+}
+
+func (l *Logger) GetLevel() Level {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.level
+}
+
+func (l *Logger) SetOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out = w
+}
+
+func (l *Logger) SetLogFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logfile = file
+	return nil
+}
+
+// Whether the messages go to a terminal, for the status lines.
+func (l *Logger) IsTerminal() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, ok := l.out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (l *Logger) Trace(process string, item string) {
+	line := fmt.Sprintf("%s < %s ...", process, shorten_message(item))
+	l.emit(LevelTrace, "trace", line, process, item, "")
+}
+
+func (l *Logger) Done(process string, item string) {
+	line := fmt.Sprintf("OK  -- %s > %s", process, shorten_message(item))
+	l.emit(LevelInfo, "info", line, process, item, "done")
+}
+
+func (l *Logger) Info(item string) {
+	line := fmt.Sprintf("\t%s", shorten_message(item))
+	l.emit(LevelInfo, "info", line, "", "", item)
+}
+
+func (l *Logger) Warn(message string) {
+	l.emit(LevelQuiet, "warn", "WARN -- "+message, "", "", message)
+}
+
+func (l *Logger) Print(message string) {
+	l.emit(LevelNormal, "print", message, "", "", message)
+}
+
+// Print the lines written, so the logger can be given as a writer.
+func (l *Logger) Write(p []byte) (int, error) {
+	l.Print(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func (l *Logger) Status(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.level < LevelNormal {
+		return
 	}
+	l.clear_status()
+	l.status = line
+	fmt.Fprint(l.out, l.status)
 }
 
+// Print the error and exit.
 func Error(process string, item string, message string) {
-	line := fmt.Sprintf("ERR -- %s > %s", process, shorten_message(item))
-	fmt.Println(line)
-	fmt.Println("       " + message)
-	os.Exit(10)
+	Exit(Fail(process, item, message))
 }
 
-func Print(message string) {
-	fmt.Println(message)
+// Print the error and exit with its code, failures keep their code.
+func Exit(err error) {
+	var f *Failure
+	if !errors.As(err, &f) {
+		f = &Failure{Process: "error", Message: err.Error(), Code: ExitError}
+	}
+	line := fmt.Sprintf("ERR -- %s > %s", f.Process, shorten_message(f.Item))
+	// the lock is never released, nothing else is printed while exiting
+	std.mu.Lock()
+	hooks := exit_hooks
+	exit_hooks = nil
+	for _, hook := range hooks {
+		hook()
+	}
+	std.clear_status()
+	fmt.Fprintln(std.out, line)
+	fmt.Fprintln(std.out, "       "+f.Message)
+	std.write_record("error", f.Process, f.Item, f.Message)
+	os.Exit(f.Code)
+}
+
+// Run fn before exiting on an error. It must not print, the output
+// is locked by then.
+func OnExit(fn func()) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	exit_hooks = append(exit_hooks, fn)
+}
+
+func (l *Logger) emit(level Level, name string, line string, process string, item string, message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level <= l.level {
+		l.clear_status()
+		fmt.Fprintln(l.out, line)
+		fmt.Fprint(l.out, l.status)
+	}
+	// the log file has the normal output even when quiet
+	if level <= l.level || level <= LevelNormal {
+		l.write_record(name, process, item, message)
+	}
+}
+
+type record struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Process string `json:"process,omitempty"`
+	Item    string `json:"item,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (l *Logger) write_record(name string, process string, item string, message string) {
+	if l.logfile == nil {
+		return
+	}
+	data, err := json.Marshal(record{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Level:   name,
+		Process: process,
+		Item:    item,
+		Message: strings.TrimSpace(message),
+	})
+	if err == nil {
+		l.logfile.Write(append(data, '\n'))
+	}
+}
+
+func (l *Logger) clear_status() {
+	if l.status != "" {
+		fmt.Fprint(l.out, "\r\033[K")
+	}
 }
 
 func shorten_message(msg string) string {
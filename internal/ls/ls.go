@@ -0,0 +1,207 @@
+package ls
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/diff"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/progress"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
+)
+
+// File or directory of the tree of a snapshot.
+type node struct {
+	name string
+	// path hash of a file, empty for the directories
+	phash    string
+	size     int64
+	children map[string]*node
+}
+
+type listing struct {
+	hist *history.Hist
+	long bool
+}
+
+// List the files of a snapshot as they were when it was taken.
+func Execute() error {
+	args := argparser.GetParser()
+	errmsg := "\nUSAGE: ls <snapshot id|tag> [<dir>] [-l] [-R|--tree] [--glob <pattern>]\n"
+
+	rem, err := settings.Remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	if !remote.Available(rem) {
+		errmsg := "Remote directory does not exist.\n" +
+			"\nMake sure it is mounted or reachable.\n"
+		return logger.FailCode(logger.ExitRemote, "ls-execute", rem.String(), errmsg)
+	}
+	rootname := settings.RootName()
+
+	arg, err := args.ReqStr(1, errmsg)
+	if err != nil {
+		return err
+	}
+	ssid, err := tags.ResolveArg(rem, rootname, arg)
+	if err != nil {
+		return err
+	}
+
+	// relative to the working directory, which can be below the root
+	dir := ""
+	if arg, err := args.GetStr(2); err == nil {
+		if dir, err = fileutils.RootRelPath(settings.Current().Dir(), arg); err != nil {
+			return logger.FailCode(logger.ExitUsage, "ls-path", arg, err.Error())
+		}
+	}
+	glob := args.GetKeyStr("glob", "")
+	if _, err := path.Match(glob, ""); err != nil {
+		return logger.FailCode(logger.ExitUsage, "ls-glob", glob, "Invalid pattern.\n"+errmsg)
+	}
+
+	hist := history.Make(ssid, rem, rootname)
+	if !hist.SnapFileExists() {
+		return logger.Fail("ls-ssid", fmt.Sprint(ssid), "No such snapshot exists in the remote.")
+	}
+	if err := hist.Load(); err != nil {
+		return err
+	}
+
+	root, found := build_tree(hist, dir, glob)
+	if !found {
+		return logger.Fail("ls-path", dir, fmt.Sprintf("No such file or directory in snapshot %d.\n", ssid)+
+			fmt.Sprintf("\nPlease run 'ls %d' for the files of the snapshot.", ssid))
+	}
+
+	l := &listing{hist: hist, long: args.HasFlag("long")}
+	switch {
+	case args.HasFlag("tree"):
+		label := dir
+		if label == "" {
+			label = "."
+		}
+		logger.Print(l.line(root, label+"/"))
+		l.print_tree(root, "")
+	case args.HasFlag("recursive"):
+		l.print_recursive(root, "")
+	default:
+		for _, child := range sorted_children(root) {
+			l.print_node(child, child.name)
+		}
+	}
+	return nil
+}
+
+// Tree of the files of the snapshot under dir, with their names matching
+// the glob if given. A file given as dir is listed alone.
+func build_tree(hist *history.Hist, dir string, glob string) (*node, bool) {
+	root := &node{children: make(map[string]*node)}
+	found := false
+	for _, phash := range hist.PathHashList() {
+		relpath := hist.GetRelPath(phash)
+		if !diff.Present(hist, phash) || !fileutils.UnderPath(dir, relpath) {
+			continue
+		}
+		found = true
+		if glob != "" {
+			if ok, _ := path.Match(glob, path.Base(relpath)); !ok {
+				continue
+			}
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(relpath, dir), "/")
+		if rel == "" {
+			rel = path.Base(relpath)
+		}
+		size := fileutils.FileHashSize(hist.GetFileHash(phash))
+		n := root
+		parts := strings.Split(rel, "/")
+		for i, part := range parts {
+			n.size += size
+			child, ok := n.children[part]
+			if !ok {
+				child = &node{name: part, children: make(map[string]*node)}
+				n.children[part] = child
+			}
+			if i == len(parts)-1 {
+				child.phash = phash
+				child.size = size
+			}
+			n = child
+		}
+	}
+	return root, found
+}
+
+func sorted_children(n *node) []*node {
+	children := []*node{}
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+	return children
+}
+
+// Name of the node, with the size, modification time and the snapshot
+// holding the blob of a file for the long listing.
+func (l *listing) line(n *node, name string) string {
+	if !l.long {
+		return name
+	}
+	if n.phash == "" {
+		return fmt.Sprintf("%10s  %-16s  %4s  %s", progress.FormatBytes(n.size), "-", "-", name)
+	}
+	mtime := "-"
+	if t, err := fileutils.FileHashModTime(l.hist.GetFileHash(n.phash)); err == nil {
+		mtime = t.Format("2006-01-02 15:04")
+	}
+	return fmt.Sprintf("%10s  %-16s  %04d  %s", progress.FormatBytes(n.size), mtime, l.hist.GetTarget(n.phash), name)
+}
+
+func (l *listing) print_node(n *node, name string) {
+	if n.phash == "" {
+		name += "/"
+	}
+	logger.Print(l.line(n, name))
+}
+
+// The files under the node, with their paths relative to it.
+func (l *listing) print_recursive(n *node, prefix string) {
+	for _, child := range sorted_children(n) {
+		if child.phash != "" {
+			l.print_node(child, prefix+child.name)
+		} else {
+			l.print_recursive(child, prefix+child.name+"/")
+		}
+	}
+}
+
+func (l *listing) print_tree(n *node, indent string) {
+	children := sorted_children(n)
+	for i, child := range children {
+		branch, next := "├── ", "│   "
+		if i == len(children)-1 {
+			branch, next = "└── ", "    "
+		}
+		name := child.name
+		if child.phash == "" {
+			name += "/"
+		}
+		logger.Print(l.line(child, indent+branch+name))
+		if child.phash == "" {
+			l.print_tree(child, indent+next)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package progress
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+)
+
+// How often the status line of a terminal is redrawn,
+// and how often a progress line is printed otherwise.
+const tty_interval = 200 * time.Millisecond
+const plain_interval = 10 * time.Second
+
+// Files and bytes done of the planned ones, with the rate and the ETA.
+// Safe to use from multiple goroutines.
+type Progress struct {
+	mu         sync.Mutex
+	label      string
+	totalFiles int
+	totalBytes int64
+	doneFiles  int
+	doneBytes  int64
+	start      time.Time
+	tty        bool
+	log        *logger.Logger
+	stop       chan bool
+	stopped    chan bool
+}
+
+// Start reporting the progress of the planned files and bytes to the log.
+func Start(log *logger.Logger, label string, files int, bytes int64) *Progress {
+	p := &Progress{
+		label:      label,
+		totalFiles: files,
+		totalBytes: bytes,
+		start:      time.Now(),
+		tty:        log.IsTerminal(),
+		log:        log,
+		stop:       make(chan bool),
+		stopped:    make(chan bool),
+	}
+	go p.report()
+	return p
+}
+
+// Count the bytes copied so far.
+func (p *Progress) AddBytes(n int64) {
+	p.mu.Lock()
+	p.doneBytes += n
+	p.mu.Unlock()
+}
+
+// Count a finished file, with the bytes of it not counted while copying,
+// e.g. the size of a skipped file.
+func (p *Progress) FileDone(skipped int64) {
+	p.mu.Lock()
+	p.doneFiles++
+	p.doneBytes += skipped
+	p.mu.Unlock()
+}
+
+// Stop reporting, and remove the status line.
+func (p *Progress) Finish() {
+	close(p.stop)
+	<-p.stopped
+	if p.tty {
+		p.log.Status("")
+	}
+}
+
+func (p *Progress) report() {
+	interval := plain_interval
+	if p.tty {
+		interval = tty_interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(p.stopped)
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if p.tty {
+				p.log.Status(p.String())
+			} else {
+				p.log.Print("PROGRESS -- " + p.String())
+			}
+		}
+	}
+}
+
+// e.g. shot: 37/200 files, 12.3 MiB/40.0 MiB, 2.1 MiB/s, ETA 0:13
+func (p *Progress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.doneBytes) / elapsed
+	}
+	eta := "-"
+	if rate > 0 && p.totalBytes >= p.doneBytes {
+		eta = format_duration(time.Duration(float64(p.totalBytes-p.doneBytes) / rate * float64(time.Second)))
+	}
+	return fmt.Sprintf("%s: %d/%d files, %s/%s, %s/s, ETA %s",
+		p.label, p.doneFiles, p.totalFiles,
+		FormatBytes(p.doneBytes), FormatBytes(p.totalBytes), FormatBytes(int64(rate)), eta)
+}
+
+func format_duration(d time.Duration) string {
+	secs := int64(d.Seconds())
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs%3600/60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+// Human readable size, e.g. 12.3 MiB
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := -1
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
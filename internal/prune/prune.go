@@ -0,0 +1,351 @@
+package prune
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/lock"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
+)
+
+type policy struct {
+	last    int
+	daily   int
+	weekly  int
+	monthly int
+	tagged  bool
+}
+
+type snapinfo struct {
+	ssid   int
+	date   time.Time
+	dated  bool
+	tagged bool
+	hist   *history.Hist
+	keep   []string
+}
+
+func Execute() error {
+	args := argparser.GetParser()
+
+	rem, err := settings.Remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	if !remote.Available(rem) {
+		errmsg := "Remote directory does not exist.\n" +
+			"\nMake sure it is mounted.\n"
+		return logger.FailCode(logger.ExitRemote, "prune-execute", rem.String(), errmsg)
+	}
+
+	rootname := settings.RootName()
+
+	pol := policy{
+		last:    args.GetKeyInt("keep-last", 0),
+		daily:   args.GetKeyInt("keep-daily", 0),
+		weekly:  args.GetKeyInt("keep-weekly", 0),
+		monthly: args.GetKeyInt("keep-monthly", 0),
+		tagged:  args.HasFlag("keep-tagged"),
+	}
+	if pol.last <= 0 && pol.daily <= 0 && pol.weekly <= 0 && pol.monthly <= 0 && !pol.tagged {
+		return logger.FailCode(logger.ExitUsage, "prune-policy", "", "No retention policy given.\n"+
+			"\nPlease specify at least one of the following options.\n"+
+			"\nUSAGE: prune [--keep-last N] [--keep-daily N] [--keep-weekly N]\n"+
+			"             [--keep-monthly N] [--keep-tagged] [--go]\n")
+	}
+
+	// plan under the lock, nothing may be committed until the garbage is removed
+	commit := !args.HasFlag("dry") && args.HasFlag("go")
+	if commit {
+		rootlock, err := lock.Acquire(rem, rootname, "prune", logger.Default())
+		if err != nil {
+			return err
+		}
+		defer rootlock.Release()
+		if err := check_shared_locks(rem, rootname); err != nil {
+			return err
+		}
+	}
+
+	snaps, err := load_snapshots(rem, rootname)
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		logger.Print("No snapshot to prune in the remote.")
+		return nil
+	}
+	apply_policy(snaps, pol, settings.LastSnapshot())
+
+	removed := []*snapinfo{}
+	kept := []*snapinfo{}
+	for _, snap := range snaps {
+		if len(snap.keep) > 0 {
+			kept = append(kept, snap)
+		} else {
+			removed = append(removed, snap)
+		}
+	}
+
+	logger.Print("\nSnapshots:\n")
+	for _, snap := range snaps {
+		if len(snap.keep) > 0 {
+			logger.Print(fmt.Sprintf("    keep    %04d  %s  [%s]",
+				snap.ssid, snap.hist.GetMeta("DATE"), strings.Join(snap.keep, ", ")))
+		} else {
+			logger.Print(fmt.Sprintf("    remove  %04d  %s", snap.ssid, snap.hist.GetMeta("DATE")))
+		}
+	}
+
+	// blobs of the removed snapshots can still be referenced
+	// by the R entries of the kept ones
+	referenced := make(map[string]bool)
+	for _, snap := range kept {
+		if err := snap.hist.Load(); err != nil {
+			return err
+		}
+		for _, blob := range snap.hist.BlobPaths() {
+			referenced[blob] = true
+		}
+	}
+	// and so can the blobs already uploaded by an interrupted commit
+	pending, err := history.LoadPending(rem, rootname, logger.Default())
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		for _, blob := range pending.BlobPaths() {
+			referenced[blob] = true
+		}
+	}
+
+	garbage, err := find_garbage(rem, rootname, referenced)
+	if err != nil {
+		return err
+	}
+
+	var histBytes, blobBytes int64
+	for _, snap := range removed {
+		histBytes += file_size(rem, snap.hist.SnapFilePath)
+	}
+	for _, blob := range garbage {
+		blobBytes += file_size(rem, blob)
+	}
+
+	logger.Print(fmt.Sprintf("\n%d snapshots to remove (%d bytes), %d snapshots to keep.",
+		len(removed), histBytes, len(kept)))
+	logger.Print(fmt.Sprintf("%d unreferenced blobs to remove (%d bytes).", len(garbage), blobBytes))
+	logger.Print(fmt.Sprintf("Total reclaimed: %d bytes", histBytes+blobBytes))
+
+	if !commit {
+		logger.Print("\nDry run. Nothing is removed.")
+		logger.Print("Please specify --go to remove the snapshots.")
+		return nil
+	}
+
+	// shot files first, a blob must never be missing for an existing snapshot
+	for _, snap := range removed {
+		if err := rem.Delete(snap.hist.SnapFilePath); err != nil {
+			return logger.Fail("prune-snapshot", snap.hist.SnapFilePath, fmt.Sprintf("Failed to remove the snapshot file.\n\n%s", err))
+		}
+		logger.Print(fmt.Sprintf("OK -- snapshot %04d (delete)", snap.ssid))
+	}
+
+	for _, blob := range garbage {
+		if err := rem.Delete(blob); err != nil {
+			logger.Warn(fmt.Sprintf("failed to remove blob: %s, %s", blob, err))
+		}
+	}
+
+	// tags of the removed snapshots would point to nothing
+	snaptags, err := tags.Load(rem, rootname)
+	if err != nil {
+		return err
+	}
+	untagged := 0
+	for _, snap := range removed {
+		for _, name := range snaptags.Of(snap.ssid) {
+			snaptags.Delete(name)
+			untagged++
+		}
+	}
+	if untagged > 0 {
+		if err := snaptags.Write(); err != nil {
+			return err
+		}
+		logger.Print(fmt.Sprintf("OK -- %d tags of the removed snapshots removed", untagged))
+	}
+
+	logger.Print(fmt.Sprintf("DONE -- %d snapshots removed, %d blobs removed", len(removed), len(garbage)))
+	return nil
+}
+
+func load_snapshots(rem remote.Remote, rootname string) ([]*snapinfo, error) {
+	snaps := []*snapinfo{}
+	snaptags, err := tags.Load(rem, rootname)
+	if err != nil {
+		return nil, err
+	}
+	for _, ssid := range history.SnapIds(rem, rootname) {
+		hist := history.Make(ssid, rem, rootname)
+		if err := hist.LoadFileMeta(fileutils.FormatSnapFile(ssid)); err != nil {
+			return nil, err
+		}
+		date, err := fileutils.ParseTimeString(hist.GetMeta("DATE"))
+		snaps = append(snaps, &snapinfo{
+			ssid:   ssid,
+			date:   date,
+			dated:  err == nil,
+			tagged: len(snaptags.Of(ssid)) > 0,
+			hist:   hist,
+		})
+	}
+	return snaps, nil
+}
+
+// Mark the snapshots to keep with the reasons, snaps must be sorted by id.
+func apply_policy(snaps []*snapinfo, pol policy, lastsynced int) {
+	newest := []*snapinfo{}
+	for i := len(snaps) - 1; i >= 0; i-- {
+		newest = append(newest, snaps[i])
+	}
+
+	// new snapshot ids are calculated from the latest one
+	newest[0].keep = append(newest[0].keep, "latest")
+
+	for i, snap := range newest {
+		if snap.ssid == lastsynced {
+			snap.keep = append(snap.keep, "synced")
+		}
+		if i < pol.last {
+			snap.keep = append(snap.keep, "last")
+		}
+		if pol.tagged && snap.tagged {
+			snap.keep = append(snap.keep, "tagged")
+		}
+		if !snap.dated {
+			// cannot tell the age, so better keep it
+			snap.keep = append(snap.keep, "undated")
+		}
+	}
+
+	keep_buckets(newest, pol.daily, "daily", func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keep_buckets(newest, pol.weekly, "weekly", func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%02d", year, week)
+	})
+	keep_buckets(newest, pol.monthly, "monthly", func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+}
+
+// Keep the newest snapshot of each of the last n periods with snapshots.
+func keep_buckets(newest []*snapinfo, n int, reason string, bucket func(time.Time) string) {
+	seen := make(map[string]bool)
+	for _, snap := range newest {
+		if len(seen) >= n {
+			return
+		}
+		if !snap.dated {
+			continue
+		}
+		key := bucket(snap.date)
+		if !seen[key] {
+			seen[key] = true
+			snap.keep = append(snap.keep, reason)
+		}
+	}
+}
+
+// Blobs of the root and the shared object store not referenced by
+// any of the kept snapshots, or by the snapshots of the other roots.
+func find_garbage(rem remote.Remote, rootname string, referenced map[string]bool) ([]string, error) {
+	garbage, err := walk_unreferenced(rem, fileutils.BackPath(rootname), referenced)
+	if err != nil {
+		return nil, err
+	}
+
+	objectsDir := fileutils.ObjectsDir()
+	if remote.DirExists(rem, objectsDir) {
+		for _, other := range history.RootNames(rem) {
+			if other == rootname {
+				continue
+			}
+			for _, id := range history.SnapIds(rem, other) {
+				hist := history.Make(id, rem, other)
+				if err := hist.Load(); err != nil {
+					return nil, err
+				}
+				for _, blob := range hist.BlobPaths() {
+					referenced[blob] = true
+				}
+			}
+			pending, err := history.LoadPending(rem, other, logger.Default())
+			if err != nil {
+				return nil, err
+			}
+			if pending != nil {
+				for _, blob := range pending.BlobPaths() {
+					referenced[blob] = true
+				}
+			}
+		}
+		shared, err := walk_unreferenced(rem, objectsDir, referenced)
+		if err != nil {
+			return nil, err
+		}
+		garbage = append(garbage, shared...)
+	}
+
+	sort.Strings(garbage)
+	return garbage, nil
+}
+
+// Objects are shared by the roots of the remote, another root
+// may be uploading or deduplicating against the garbage.
+func check_shared_locks(rem remote.Remote, rootname string) error {
+	if !remote.DirExists(rem, fileutils.ObjectsDir()) {
+		return nil
+	}
+	if other, owner := lock.OtherHolder(rem, rootname); owner != nil {
+		return logger.FailCode(logger.ExitLocked, "prune-lock", other, "The root shares the object store and is locked by "+owner.String()+".\n"+
+			"\nPlease wait for it to finish before pruning.")
+	}
+	return nil
+}
+
+func walk_unreferenced(rem remote.Remote, dir string, referenced map[string]bool) ([]string, error) {
+	unreferenced := []string{}
+	if !remote.DirExists(rem, dir) {
+		return unreferenced, nil
+	}
+	err := remote.Walk(rem, dir, func(key string, e remote.Entry) error {
+		if !referenced[key] {
+			unreferenced = append(unreferenced, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, logger.FailCode(logger.ExitRemote, "prune-walk", dir, fmt.Sprintf("Failed to walk remote directory.\n\n%s", err))
+	}
+	return unreferenced, nil
+}
+
+func file_size(rem remote.Remote, key string) int64 {
+	info, err := rem.Stat(key)
+	if err != nil {
+		return 0
+	}
+	return info.Size
+}
@@ -0,0 +1,183 @@
+package prune
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
+)
+
+// DATE of the shot files
+const date_format = "Mon 2006-01-02 03:04:05PM -07:00 UTC"
+
+func TestMain(m *testing.M) {
+	logger.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Shot file of the snapshot, undated if date is empty.
+func write_snapshot(t *testing.T, rem remote.Remote, rootname string, ssid int, date string, objectids ...string) {
+	hist := history.Make(ssid, rem, rootname)
+	if date != "" {
+		d, err := time.Parse("2006-01-02 15:04", date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hist.SetMetaString("DATE", d.Format(date_format))
+	}
+	for _, id := range objectids {
+		hist.AddPath(id+".txt", id+".txt", id+".txt", "1; t0")
+		hist.SetCrud(id+".txt", "C")
+		hist.SetTarget(id+".txt", ssid)
+		hist.SetObjectId(id+".txt", id)
+	}
+	if err := hist.Write(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func kept(snaps []*snapinfo) map[int]string {
+	keep := make(map[int]string)
+	for _, snap := range snaps {
+		if len(snap.keep) > 0 {
+			keep[snap.ssid] = strings.Join(snap.keep, ",")
+		}
+	}
+	return keep
+}
+
+func TestApplyPolicy(t *testing.T) {
+	rem := remote.NewMemory()
+	dates := []string{
+		"2024-01-01 09:00", // 1
+		"2024-01-01 10:00", // 2
+		"2024-01-01 11:00", // 3
+		"2024-01-02 09:00", // 4
+		"2024-01-02 10:00", // 5
+		"2024-01-09 09:00", // 6
+		"2024-02-01 09:00", // 7
+		"2024-02-01 10:00", // 8
+	}
+	for i, date := range dates {
+		write_snapshot(t, rem, "r", i+1, date)
+	}
+	snaptags, err := tags.Load(rem, "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snaptags.Set("release", 2)
+	if err := snaptags.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		pol  policy
+		want map[int]string
+	}{
+		{"latest only", policy{}, map[int]string{8: "latest", 5: "synced"}},
+		{"last", policy{last: 3}, map[int]string{8: "latest,last", 7: "last", 6: "last", 5: "synced"}},
+		{"tagged", policy{tagged: true}, map[int]string{8: "latest", 5: "synced", 2: "tagged"}},
+		{"daily", policy{daily: 3}, map[int]string{8: "latest,daily", 6: "daily", 5: "synced,daily"}},
+		{"weekly", policy{weekly: 10}, map[int]string{8: "latest,weekly", 6: "weekly", 5: "synced,weekly"}},
+		{"monthly", policy{monthly: 1}, map[int]string{8: "latest,monthly", 5: "synced"}},
+		{"combined", policy{last: 1, daily: 1, monthly: 2}, map[int]string{8: "latest,last,daily,monthly", 6: "monthly", 5: "synced"}},
+	}
+	for _, c := range cases {
+		snaps, err := load_snapshots(rem, "r")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snaps) != len(dates) {
+			t.Fatalf("%d snapshots loaded, want %d", len(snaps), len(dates))
+		}
+		apply_policy(snaps, c.pol, 5)
+		if got := kept(snaps); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: kept %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestApplyPolicyUndated(t *testing.T) {
+	rem := remote.NewMemory()
+	write_snapshot(t, rem, "r", 1, "")
+	write_snapshot(t, rem, "r", 2, "2024-01-01 09:00")
+	write_snapshot(t, rem, "r", 3, "2024-01-02 09:00")
+
+	snaps, err := load_snapshots(rem, "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply_policy(snaps, policy{daily: 1}, 0)
+	want := map[int]string{1: "undated", 3: "latest,daily"}
+	if got := kept(snaps); !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
+
+func TestFindGarbage(t *testing.T) {
+	rem := remote.NewMemory()
+	write_snapshot(t, rem, "r", 1, "2024-01-01 09:00", "aa01", "bb01")
+	write_snapshot(t, rem, "r", 2, "2024-01-02 09:00", "aa01", "cc01")
+	// another root shares the object store
+	write_snapshot(t, rem, "s", 1, "2024-01-01 09:00", "bb01")
+
+	first := history.Make(1, rem, "r")
+	if err := first.Load(); err != nil {
+		t.Fatal(err)
+	}
+	second := history.Make(2, rem, "r")
+	if err := second.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, hist := range []*history.Hist{first, second} {
+		for _, blob := range hist.BlobPaths() {
+			if _, err := rem.Put(blob, strings.NewReader("x")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	orphan := remote.Join(fileutils.BackPath("r"), "old.txt", "_0001_old.txt")
+	if _, err := rem.Put(orphan, strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshot 1 is removed, only snapshot 2 is kept
+	referenced := func() map[string]bool {
+		blobs := make(map[string]bool)
+		for _, blob := range second.BlobPaths() {
+			blobs[blob] = true
+		}
+		return blobs
+	}
+	garbage, err := find_garbage(rem, "r", referenced())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{orphan}
+	if !reflect.DeepEqual(garbage, want) {
+		t.Errorf("garbage = %v, want %v", garbage, want)
+	}
+
+	// once the other root no longer needs it either
+	if err := rem.Delete(fileutils.SSFilePath(1, "s")); err != nil {
+		t.Fatal(err)
+	}
+	write_snapshot(t, rem, "s", 2, "2024-01-02 09:00")
+	garbage, err = find_garbage(rem, "r", referenced())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{first.GetRestorePath("bb01.txt"), orphan}
+	if !reflect.DeepEqual(garbage, want) {
+		t.Errorf("garbage = %v, want %v", garbage, want)
+	}
+}
@@ -0,0 +1,73 @@
+package pull
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/report"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/workpool"
+	"github.com/akhlakm/Snap_Shot/repo"
+)
+
+// Restore the root to a snapshot, the latest one if not given.
+// A dry run unless --go.
+func Execute() error {
+	args := argparser.GetParser()
+	r, err := repo.Open(settings.Current().Dir(), "")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	r.SetOutput(logger.Default())
+
+	id := 0
+	if arg, err := args.GetStr(1); err == nil {
+		if id, err = r.Resolve(arg); err != nil {
+			return err
+		}
+	}
+
+	// --dry has a higher priority over --go
+	committed := !args.HasFlag("dry") && args.HasFlag("go")
+	pull, err := r.PrepareRestore(id, repo.RestoreOptions{
+		Jobs:   args.GetKeyInt("jobs", workpool.DefaultJobs),
+		DryRun: !committed,
+	})
+	if errors.Is(err, repo.ErrNoSnapshot) {
+		logger.Print("No available snapshot to restore from remote.")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer pull.Close()
+
+	ignores := args.HasFlag("ignores")
+	// the machine readable result is printed once synced
+	if !report.Machine() {
+		logger.Print("\nChanges to commit:\n")
+		report.PrintChanges(*pull.Snapshot(ignores), r.Name(), ignores)
+	}
+
+	if committed {
+		if err := pull.Commit(); err != nil {
+			return err
+		}
+		logger.Print(fmt.Sprintf("Last snapshot synced: %d", pull.SnapId()))
+	} else {
+		logger.Print(fmt.Sprintf("\nDry run %d < %d. Snapshot is NOT restored.", pull.Last(), pull.SnapId()))
+		logger.Print("Please specify --go to commit the changes, -i to list the ignored items.")
+	}
+
+	if !report.Machine() {
+		return nil
+	}
+	return report.PrintResult(report.Result{
+		Command:   "pull",
+		Committed: committed,
+		Last:      pull.Last(),
+		Snapshot:  *pull.Snapshot(ignores),
+	})
+}
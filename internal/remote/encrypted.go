@@ -0,0 +1,177 @@
+package remote
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/crypt"
+)
+
+// Layout of the remote, same as in fileutils.
+const objects_dir = "_objects"
+const files_dir = "files"
+
+// Client side encryption of another remote. All the contents are
+// encrypted, and the names of the blobs, i.e. the relative paths of the
+// files under rootname/files/ and the object ids under _objects/, are
+// encrypted component by component. Root names and snapshot file names
+// are kept readable. Keys and sizes are always the plain ones.
+type Encrypted struct {
+	inner Remote
+	keys  *crypt.Keys
+}
+
+func NewEncrypted(inner Remote, keys *crypt.Keys) *Encrypted {
+	return &Encrypted{inner: inner, keys: keys}
+}
+
+func (e *Encrypted) String() string {
+	return e.inner.String()
+}
+
+// Index of the first encrypted component of a key.
+func encrypted_from(parts []string) int {
+	if len(parts) > 0 && parts[0] == objects_dir {
+		return 1
+	}
+	if len(parts) > 1 && parts[1] == files_dir {
+		return 2
+	}
+	return len(parts) + 1
+}
+
+func (e *Encrypted) obscure(key string) string {
+	if key == "" {
+		return key
+	}
+	parts := strings.Split(key, "/")
+	for i := encrypted_from(parts); i < len(parts); i++ {
+		if strings.HasPrefix(parts[i], TmpPrefix) {
+			// partial uploads of the inner remote
+			prefix, name := split_tmp_name(parts[i])
+			parts[i] = prefix + e.keys.EncryptName(name)
+		} else {
+			parts[i] = e.keys.EncryptName(parts[i])
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func (e *Encrypted) reveal(name string) (string, error) {
+	if strings.HasPrefix(name, TmpPrefix) {
+		prefix, encrypted := split_tmp_name(name)
+		plain, err := e.keys.DecryptName(encrypted)
+		return prefix + plain, err
+	}
+	return e.keys.DecryptName(name)
+}
+
+// Whether the children of a directory have encrypted names.
+func (e *Encrypted) child_encrypted(dir string) bool {
+	parts := []string{}
+	if dir != "" {
+		parts = strings.Split(dir, "/")
+	}
+	return encrypted_from(append(parts, "")) <= len(parts)
+}
+
+func (e *Encrypted) List(dir string) ([]Entry, error) {
+	entries, err := e.inner.List(e.obscure(dir))
+	if err != nil {
+		return nil, err
+	}
+	encrypted := e.child_encrypted(dir)
+	plain := []Entry{}
+	for _, entry := range entries {
+		if encrypted {
+			name, err := e.reveal(entry.Name)
+			if err != nil {
+				// not ours
+				continue
+			}
+			entry.Name = name
+		}
+		if !entry.IsDir {
+			entry.Size = crypt.PlainSize(entry.Size)
+		}
+		plain = append(plain, entry)
+	}
+	sort.Slice(plain, func(i, j int) bool { return plain[i].Name < plain[j].Name })
+	return plain, nil
+}
+
+func (e *Encrypted) Stat(key string) (Entry, error) {
+	entry, err := e.inner.Stat(e.obscure(key))
+	if err != nil {
+		return entry, err
+	}
+	if !entry.IsDir {
+		entry.Size = crypt.PlainSize(entry.Size)
+	}
+	if key != "" {
+		entry.Name = key[strings.LastIndex(key, "/")+1:]
+	}
+	return entry, nil
+}
+
+type decrypted_blob struct {
+	io.Reader
+	io.Closer
+}
+
+func (e *Encrypted) Get(key string) (io.ReadCloser, error) {
+	in, err := e.inner.Get(e.obscure(key))
+	if err != nil {
+		return nil, err
+	}
+	return &decrypted_blob{Reader: e.keys.Decrypt(in, key), Closer: in}, nil
+}
+
+func (e *Encrypted) Put(key string, r io.Reader) (int64, error) {
+	counter := &counting_reader{r: r}
+	sealed, err := e.keys.Encrypt(counter, key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encrypt: %s", err)
+	}
+	_, err = e.inner.Put(e.obscure(key), sealed)
+	return counter.n, err
+}
+
+func (e *Encrypted) Delete(key string) error {
+	return e.inner.Delete(e.obscure(key))
+}
+
+// The contents are bound to the key, so they are encrypted again.
+func (e *Encrypted) Rename(from string, to string) error {
+	in, err := e.Get(from)
+	if err != nil {
+		return err
+	}
+	_, err = e.Put(to, in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+	return e.Delete(from)
+}
+
+func (e *Encrypted) ReadOnly(key string) error {
+	return e.inner.ReadOnly(e.obscure(key))
+}
+
+func (e *Encrypted) Close() error {
+	return e.inner.Close()
+}
+
+type counting_reader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counting_reader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,141 @@
+package remote
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A directory in the local filesystem, or a mounted one.
+type Local struct {
+	base string
+}
+
+func NewLocal(base string) *Local {
+	return &Local{base: base}
+}
+
+func (l *Local) String() string {
+	return l.base
+}
+
+func (l *Local) path(key string) string {
+	return filepath.Join(l.base, filepath.FromSlash(key))
+}
+
+func (l *Local) List(dir string) ([]Entry, error) {
+	files, err := os.ReadDir(l.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil {
+			// removed while listing
+			continue
+		}
+		entries = append(entries, Entry{
+			Name:    f.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			IsDir:   f.IsDir(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func (l *Local) Stat(key string) (Entry, error) {
+	info, err := os.Stat(l.path(key))
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}, nil
+}
+
+func (l *Local) Get(key string) (io.ReadCloser, error) {
+	return os.Open(l.path(key))
+}
+
+// Write to a temp file first, then rename.
+// Create the parent dir, if not exist.
+func (l *Local) Put(key string, r io.Reader) (int64, error) {
+	dst := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return 0, fmt.Errorf("error creating directory: %s", err)
+	}
+
+	tmpfile := l.path(TmpKey(key))
+	tmp, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't open dest tmpfile: %s", err)
+	}
+
+	bytesWritten, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return bytesWritten, fmt.Errorf("writing to dest tmpfile failed: %s", err)
+	}
+
+	// flush
+	err = tmp.Sync()
+	tmp.Close()
+	if err != nil {
+		return bytesWritten, fmt.Errorf("tmpfile flush error: %s", err)
+	}
+
+	// a read-only destination cannot be replaced on some systems
+	os.Chmod(dst, 0644)
+	err = os.Rename(tmpfile, dst)
+	if err != nil {
+		return bytesWritten, fmt.Errorf("coundn't rename tmpfile: %s", err)
+	}
+
+	return bytesWritten, nil
+}
+
+// Remove the file, and the parent directories left empty,
+// directories are implicit for the remotes.
+func (l *Local) Delete(key string) error {
+	fullpath := l.path(key)
+	os.Chmod(fullpath, 0644)
+	if err := os.Remove(fullpath); err != nil {
+		return err
+	}
+
+	base := filepath.Clean(l.base)
+	dir := filepath.Dir(fullpath)
+	for dir != base && len(dir) > len(base) {
+		if os.Remove(dir) != nil {
+			// not empty
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+func (l *Local) Rename(from string, to string) error {
+	dst := l.path(to)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %s", err)
+	}
+	return os.Rename(l.path(from), dst)
+}
+
+func (l *Local) ReadOnly(key string) error {
+	return os.Chmod(l.path(key), 0444)
+}
+
+// Nothing to release.
+func (l *Local) Close() error {
+	return nil
+}
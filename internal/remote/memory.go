@@ -0,0 +1,136 @@
+package remote
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memfile struct {
+	data    []byte
+	modtime time.Time
+}
+
+// Remote kept in memory, for testing the snapshot logic.
+type Memory struct {
+	mu    sync.Mutex
+	files map[string]*memfile
+}
+
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]*memfile)}
+}
+
+func (m *Memory) String() string {
+	return "memory"
+}
+
+func (m *Memory) List(dir string) ([]Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix := Join(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	found := make(map[string]Entry)
+	for key, f := range m.files {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			found[rest[:i]] = Entry{Name: rest[:i], IsDir: true}
+		} else {
+			found[rest] = Entry{Name: rest, Size: int64(len(f.data)), ModTime: f.modtime}
+		}
+	}
+	if len(found) == 0 && prefix != "" {
+		return nil, &fs.PathError{Op: "list", Path: dir, Err: fs.ErrNotExist}
+	}
+
+	entries := []Entry{}
+	for _, e := range found {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func (m *Memory) Stat(key string) (Entry, error) {
+	m.mu.Lock()
+	key = Join(key)
+	f, ok := m.files[key]
+	m.mu.Unlock()
+	if ok {
+		return Entry{Name: path.Base(key), Size: int64(len(f.data)), ModTime: f.modtime}, nil
+	}
+	if _, err := m.List(key); err == nil {
+		return Entry{Name: path.Base(key), IsDir: true}, nil
+	}
+	return Entry{}, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+}
+
+func (m *Memory) Get(key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[Join(key)]
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: key, Err: fs.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (m *Memory) Put(key string, r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[Join(key)] = &memfile{data: data, modtime: time.Now()}
+	return int64(len(data)), nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[Join(key)]; !ok {
+		return &fs.PathError{Op: "delete", Path: key, Err: fs.ErrNotExist}
+	}
+	delete(m.files, Join(key))
+	return nil
+}
+
+func (m *Memory) Rename(from string, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[Join(from)]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrNotExist}
+	}
+	delete(m.files, Join(from))
+	m.files[Join(to)] = f
+	return nil
+}
+
+func (m *Memory) ReadOnly(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[Join(key)]; !ok {
+		return &fs.PathError{Op: "readonly", Path: key, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// Nothing to release.
+func (m *Memory) Close() error {
+	return nil
+}
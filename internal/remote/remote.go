@@ -0,0 +1,146 @@
+package remote
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// Entry of a remote listing, directories are implicit
+// in some remotes and only show up in listings.
+type Entry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Storage of the snapshots. Keys are slash separated paths relative
+// to the remote location, e.g. rootname/history/0001.shot
+type Remote interface {
+	// Location of the remote as given in the settings.
+	String() string
+	// Direct children of a directory.
+	List(dir string) ([]Entry, error)
+	Stat(key string) (Entry, error)
+	Get(key string) (io.ReadCloser, error)
+	// Write the contents atomically, a partial upload
+	// must never be visible under the key.
+	Put(key string, r io.Reader) (int64, error)
+	Delete(key string) error
+	Rename(from string, to string) error
+	ReadOnly(key string) error
+	// Release the connections of the remote.
+	Close() error
+}
+
+// Open the remote of a location given in the settings.
+func Open(location string) (Remote, error) {
+	if !IsURL(location) {
+		return NewLocal(location), nil
+	}
+	scheme := strings.ToLower(strings.SplitN(location, "://", 2)[0])
+	switch scheme {
+	case "sftp", "ssh":
+		return NewSFTP(location)
+	case "s3":
+		return NewS3(location)
+	}
+	return nil, fmt.Errorf("unsupported remote type: %s", scheme)
+}
+
+// Whether the location is a url, rather than a local path.
+func IsURL(location string) bool {
+	return strings.Contains(location, "://")
+}
+
+// Partial uploads are written next to the key with this prefix,
+// no blob, shot file or directory of the remote starts with it.
+const TmpPrefix = ".tmp-"
+
+// Length of the random part of the partial uploads, in hex digits.
+const tmp_rand_size = 8
+
+// Key of a partial upload, with a random part so the concurrent
+// uploads to the same key never write to the same file.
+func TmpKey(key string) string {
+	buf := make([]byte, tmp_rand_size/2)
+	if _, err := rand.Read(buf); err != nil {
+		// unlikely, fall back to the time
+		binary.BigEndian.PutUint32(buf, uint32(time.Now().UnixNano()))
+	}
+	return path.Join(path.Dir(key), TmpPrefix+hex.EncodeToString(buf)+"-"+path.Base(key))
+}
+
+// Key a partial upload was written for.
+func TmpTarget(key string) string {
+	_, name := split_tmp_name(path.Base(key))
+	return Join(path.Dir(key), name)
+}
+
+// Name of a partial upload split into its prefix, with the random part
+// if any, and the name of the key it was uploaded to.
+func split_tmp_name(name string) (string, string) {
+	rest := strings.TrimPrefix(name, TmpPrefix)
+	if len(rest) > tmp_rand_size && rest[tmp_rand_size] == '-' {
+		if _, err := hex.DecodeString(rest[:tmp_rand_size]); err == nil {
+			return name[:len(TmpPrefix)+tmp_rand_size+1], rest[tmp_rand_size+1:]
+		}
+	}
+	return TmpPrefix, rest
+}
+
+// Whether the key is a leftover of an interrupted upload.
+func IsTmpKey(key string) bool {
+	return strings.HasPrefix(path.Base(key), TmpPrefix)
+}
+
+func Join(elem ...string) string {
+	return strings.TrimPrefix(path.Join(elem...), "/")
+}
+
+func Exists(r Remote, key string) bool {
+	e, err := r.Stat(key)
+	return err == nil && !e.IsDir
+}
+
+func DirExists(r Remote, dir string) bool {
+	e, err := r.Stat(dir)
+	return err == nil && e.IsDir
+}
+
+// Whether the remote location itself can be reached.
+func Available(r Remote) bool {
+	return DirExists(r, "")
+}
+
+func IsNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// Call fn for every file under dir, recursively, in lexical order.
+func Walk(r Remote, dir string, fn func(key string, e Entry) error) error {
+	entries, err := r.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		key := Join(dir, e.Name)
+		if e.IsDir {
+			err = Walk(r, key, fn)
+		} else {
+			err = fn(key, e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
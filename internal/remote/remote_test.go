@@ -0,0 +1,170 @@
+package remote
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func put(t *testing.T, rem Remote, key string, contents string) {
+	t.Helper()
+	n, err := rem.Put(key, strings.NewReader(contents))
+	if err != nil {
+		t.Fatalf("Put %s: %s", key, err)
+	}
+	if n != int64(len(contents)) {
+		t.Fatalf("Put %s = %d bytes, want %d", key, n, len(contents))
+	}
+}
+
+func get(t *testing.T, rem Remote, key string) string {
+	t.Helper()
+	r, err := rem.Get(key)
+	if err != nil {
+		t.Fatalf("Get %s: %s", key, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Get %s: %s", key, err)
+	}
+	return string(data)
+}
+
+func names(t *testing.T, rem Remote, dir string) []string {
+	t.Helper()
+	entries, err := rem.List(dir)
+	if err != nil {
+		t.Fatalf("List %s: %s", dir, err)
+	}
+	list := []string{}
+	for _, e := range entries {
+		if e.IsDir {
+			list = append(list, e.Name+"/")
+		} else {
+			list = append(list, e.Name)
+		}
+	}
+	return list
+}
+
+// Behavior every remote must have, the snapshot logic relies on it.
+func conformance(t *testing.T, rem Remote) {
+	if !Available(rem) {
+		t.Fatal("remote not available")
+	}
+
+	put(t, rem, "r/history/0001.shot", "first")
+	put(t, rem, "r/files/a.txt/_0001_a.txt", "hello")
+	put(t, rem, "r/files/b.txt/_0001_b.txt", "")
+	put(t, rem, "r/history/0001.shot", "replaced")
+
+	if got := get(t, rem, "r/history/0001.shot"); got != "replaced" {
+		t.Errorf("Get after a second Put = %q", got)
+	}
+	if got := get(t, rem, "r/files/b.txt/_0001_b.txt"); got != "" {
+		t.Errorf("Get of an empty file = %q", got)
+	}
+
+	info, err := rem.Stat("r/files/a.txt/_0001_a.txt")
+	if err != nil || info.IsDir || info.Size != 5 || info.Name != "_0001_a.txt" {
+		t.Errorf("Stat of a file = %+v, %v", info, err)
+	}
+	if info, err := rem.Stat("r/files"); err != nil || !info.IsDir {
+		t.Errorf("Stat of a directory = %+v, %v", info, err)
+	}
+	if _, err := rem.Stat("r/missing"); !IsNotExist(err) {
+		t.Errorf("Stat of a missing key = %v, want not exist", err)
+	}
+	if _, err := rem.Get("r/missing"); !IsNotExist(err) {
+		t.Errorf("Get of a missing key = %v, want not exist", err)
+	}
+	if !Exists(rem, "r/history/0001.shot") || Exists(rem, "r/history") || !DirExists(rem, "r/history") {
+		t.Error("Exists and DirExists do not tell files from directories")
+	}
+
+	// sorted, no partial uploads left behind
+	if got, want := names(t, rem, "r"), []string{"files/", "history/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List r = %v, want %v", got, want)
+	}
+	if got, want := names(t, rem, "r/files"), []string{"a.txt/", "b.txt/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List r/files = %v, want %v", got, want)
+	}
+	if got, want := names(t, rem, "r/history"), []string{"0001.shot"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List r/history = %v, want %v", got, want)
+	}
+	if _, err := rem.List("r/missing"); !IsNotExist(err) {
+		t.Errorf("List of a missing directory = %v, want not exist", err)
+	}
+
+	// rename to a new key, then over an existing read-only one
+	if err := rem.Rename("r/history/0001.shot", "r/history/0002.shot"); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	if Exists(rem, "r/history/0001.shot") || get(t, rem, "r/history/0002.shot") != "replaced" {
+		t.Error("Rename did not move the contents")
+	}
+	put(t, rem, "r/history/0003.shot", "third")
+	if err := rem.ReadOnly("r/history/0003.shot"); err != nil {
+		t.Fatalf("ReadOnly: %s", err)
+	}
+	if err := rem.Rename("r/history/0002.shot", "r/history/0003.shot"); err != nil {
+		t.Fatalf("Rename over an existing key: %s", err)
+	}
+	if got := get(t, rem, "r/history/0003.shot"); got != "replaced" {
+		t.Errorf("Rename over an existing key = %q", got)
+	}
+	if got, want := names(t, rem, "r/history"), []string{"0003.shot"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List after Rename = %v, want %v", got, want)
+	}
+	if err := rem.Rename("r/missing", "r/other"); !IsNotExist(err) {
+		t.Errorf("Rename of a missing key = %v, want not exist", err)
+	}
+
+	// a read-only key can be replaced and deleted
+	put(t, rem, "r/history/0003.shot", "again")
+	if err := rem.Delete("r/history/0003.shot"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if Exists(rem, "r/history/0003.shot") {
+		t.Error("Delete left the key")
+	}
+	if err := rem.Delete("r/history/0003.shot"); !IsNotExist(err) {
+		t.Errorf("Delete of a missing key = %v, want not exist", err)
+	}
+
+	// directories are implicit, an emptied one is gone
+	if err := rem.Delete("r/files/b.txt/_0001_b.txt"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if got, want := names(t, rem, "r/files"), []string{"a.txt/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List after Delete = %v, want %v", got, want)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	conformance(t, NewLocal(t.TempDir()))
+}
+
+func TestMemory(t *testing.T) {
+	conformance(t, NewMemory())
+}
+
+func TestTmpKey(t *testing.T) {
+	key := "r/files/a.txt/_0001_a.txt"
+	tmp := TmpKey(key)
+	if !IsTmpKey(tmp) || IsTmpKey(key) {
+		t.Errorf("IsTmpKey(%s) = false", tmp)
+	}
+	if TmpKey(key) == tmp {
+		t.Error("TmpKey is not unique")
+	}
+	if got := TmpTarget(tmp); got != key {
+		t.Errorf("TmpTarget(%s) = %s, want %s", tmp, got, key)
+	}
+	// written before the random part was added
+	if got := TmpTarget("r/history/.tmp-0001.shot"); got != "r/history/0001.shot" {
+		t.Errorf("TmpTarget of a legacy name = %s", got)
+	}
+}
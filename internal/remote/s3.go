@@ -0,0 +1,604 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Uploads larger than this are sent in parts of this size.
+const s3_part_size = 8 * 1024 * 1024
+
+// Objects larger than this cannot be copied by a single request,
+// they are copied in parts of s3_copy_part_size.
+var s3_copy_max int64 = 5 * 1024 * 1024 * 1024
+var s3_copy_part_size int64 = 512 * 1024 * 1024
+
+// S3 compatible object storage, s3://bucket/prefix
+//
+// The endpoint and region can be given as query parameters of the url,
+// e.g. s3://bucket/prefix?endpoint=http://localhost:9000&region=us-east-1
+// or by the AWS_ENDPOINT_URL and AWS_REGION environment variables.
+// Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and the optional AWS_SESSION_TOKEN.
+type S3 struct {
+	location  string
+	bucket    string
+	prefix    string
+	endpoint  *url.URL
+	region    string
+	pathStyle bool
+	accessKey string
+	secretKey string
+	token     string
+	client    *http.Client
+}
+
+func NewS3(location string) (*S3, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 url: %s", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no bucket in s3 url: %s", location)
+	}
+
+	query := u.Query()
+	s := &S3{
+		location:  location,
+		bucket:    u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		region:    first_of(query.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{},
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for s3 remotes")
+	}
+
+	endpoint := first_of(query.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+	if endpoint == "" {
+		// virtual hosted bucket of AWS
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", s.bucket, s.region)
+	} else {
+		// custom endpoints are usually addressed with the bucket in the path
+		s.pathStyle = query.Get("path_style") != "false"
+	}
+	s.endpoint, err = url.Parse(endpoint)
+	if err != nil || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", endpoint)
+	}
+	return s, nil
+}
+
+func first_of(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// The url without the query, which can hold endpoint details.
+func (s *S3) String() string {
+	return strings.SplitN(s.location, "?", 2)[0]
+}
+
+func (s *S3) object_key(key string) string {
+	return Join(s.prefix, key)
+}
+
+func (s *S3) dir_prefix(dir string) string {
+	prefix := s.object_key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+type s3_list_result struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+func (s *S3) list(prefix string, maxkeys int, token string) (*s3_list_result, error) {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	query.Set("delimiter", "/")
+	if maxkeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxkeys))
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+
+	resp, err := s.request("GET", "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &s3_list_result{}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("invalid s3 list response: %s", err)
+	}
+	return result, nil
+}
+
+func (s *S3) List(dir string) ([]Entry, error) {
+	prefix := s.dir_prefix(dir)
+	entries := []Entry{}
+	token := ""
+	for {
+		result, err := s.list(prefix, 0, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			if name == "" {
+				continue
+			}
+			entries = append(entries, Entry{Name: name, Size: c.Size, ModTime: c.LastModified})
+		}
+		for _, p := range result.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			entries = append(entries, Entry{Name: name, IsDir: true})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	if len(entries) == 0 && Join(dir) != "" {
+		return nil, &fs.PathError{Op: "list", Path: dir, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// A missing key is forbidden rather than not found without the
+// ListBucket permission, it is then not found if the list is denied too.
+func (s *S3) Stat(key string) (Entry, error) {
+	forbidden := false
+	if Join(key) != "" {
+		resp, err := s.request("HEAD", s.object_key(key), nil, nil, nil)
+		if err == nil {
+			resp.Body.Close()
+			modtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+			return Entry{Name: path.Base(key), Size: resp.ContentLength, ModTime: modtime}, nil
+		}
+		forbidden = s3_status(err) == http.StatusForbidden
+		if !IsNotExist(err) && !forbidden {
+			return Entry{}, err
+		}
+	}
+
+	// directories only exist as prefixes of the keys
+	result, err := s.list(s.dir_prefix(key), 1, "")
+	if err != nil {
+		// denied, unlike wrong credentials
+		if forbidden && s3_denied(err) {
+			return Entry{}, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+		}
+		return Entry{}, err
+	}
+	if Join(key) == "" || len(result.Contents) > 0 || len(result.CommonPrefixes) > 0 {
+		return Entry{Name: path.Base(key), IsDir: true}, nil
+	}
+	return Entry{}, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+}
+
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.request("GET", s.object_key(key), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Objects only become visible when the upload completes,
+// so no temp object is needed.
+func (s *S3) Put(key string, r io.Reader) (int64, error) {
+	objkey := s.object_key(key)
+	part, err := read_part(r)
+	if err != nil {
+		return int64(len(part)), err
+	}
+	if len(part) < s3_part_size {
+		resp, err := s.request("PUT", objkey, nil, nil, part)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return int64(len(part)), nil
+	}
+	return s.put_multipart(objkey, part, r)
+}
+
+func read_part(r io.Reader) ([]byte, error) {
+	buf := make([]byte, s3_part_size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+type s3_complete_part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3) start_multipart(objkey string) (string, error) {
+	resp, err := s.request("POST", objkey, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	initiated := struct{ UploadId string }{}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadId == "" {
+		return "", fmt.Errorf("failed to start s3 multipart upload: %v", err)
+	}
+	return initiated.UploadId, nil
+}
+
+func (s *S3) complete_multipart(objkey string, uploadid string, parts []s3_complete_part) error {
+	complete := struct {
+		XMLName xml.Name           `xml:"CompleteMultipartUpload"`
+		Parts   []s3_complete_part `xml:"Part"`
+	}{Parts: parts}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := s.request("POST", objkey, url.Values{"uploadId": {uploadid}}, nil, body)
+	if err != nil {
+		return err
+	}
+	// errors can also come back with a 200 status
+	result, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if bytes.Contains(result, []byte("<Error>")) {
+		return fmt.Errorf("failed to complete s3 multipart upload: %s", result)
+	}
+	return nil
+}
+
+func (s *S3) abort_multipart(objkey string, uploadid string) {
+	resp, err := s.request("DELETE", objkey, url.Values{"uploadId": {uploadid}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (s *S3) put_multipart(objkey string, first []byte, r io.Reader) (int64, error) {
+	uploadid, err := s.start_multipart(objkey)
+	if err != nil {
+		return 0, err
+	}
+	abort := func(err error) (int64, error) {
+		s.abort_multipart(objkey, uploadid)
+		return 0, err
+	}
+
+	var total int64
+	parts := []s3_complete_part{}
+	part := first
+	for len(part) > 0 {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(len(parts) + 1)},
+			"uploadId":   {uploadid},
+		}
+		resp, err := s.request("PUT", objkey, query, nil, part)
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body.Close()
+		parts = append(parts, s3_complete_part{PartNumber: len(parts) + 1, ETag: resp.Header.Get("ETag")})
+		total += int64(len(part))
+
+		if len(part) < s3_part_size {
+			break
+		}
+		part, err = read_part(r)
+		if err != nil {
+			return abort(err)
+		}
+	}
+
+	if err := s.complete_multipart(objkey, uploadid, parts); err != nil {
+		return abort(err)
+	}
+	return total, nil
+}
+
+// Deleting a missing key succeeds on S3, it is checked first
+// to fail like the other remotes.
+func (s *S3) Delete(key string) error {
+	if _, err := s.Stat(key); err != nil {
+		return err
+	}
+	resp, err := s.request("DELETE", s.object_key(key), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Server side copy, then delete. Put uploads to the key directly,
+// a rename is never needed to publish an upload.
+func (s *S3) Rename(from string, to string) error {
+	info, err := s.Stat(from)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return fmt.Errorf("cannot rename s3 prefix: %s", from)
+	}
+	source := "/" + s.bucket + "/" + uri_encode(s.object_key(from), false)
+	if info.Size > s3_copy_max {
+		err = s.copy_multipart(source, s.object_key(to), info.Size)
+	} else {
+		_, err = s.copy(source, s.object_key(to), nil)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Delete(from)
+}
+
+// Copy the source object, or a part of it if query is the part of a multipart upload.
+// Returns the ETag of the copy.
+func (s *S3) copy(source string, objkey string, query url.Values, headers ...string) (string, error) {
+	h := map[string]string{"x-amz-copy-source": source}
+	for i := 0; i+1 < len(headers); i += 2 {
+		h[headers[i]] = headers[i+1]
+	}
+	resp, err := s.request("PUT", objkey, query, h, nil)
+	if err != nil {
+		return "", err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// errors can also come back with a 200 status
+	if bytes.Contains(body, []byte("<Error>")) {
+		return "", fmt.Errorf("failed to copy s3 object: %s", body)
+	}
+	result := struct{ ETag string }{}
+	xml.Unmarshal(body, &result)
+	return result.ETag, nil
+}
+
+func (s *S3) copy_multipart(source string, objkey string, size int64) error {
+	uploadid, err := s.start_multipart(objkey)
+	if err != nil {
+		return err
+	}
+	parts := []s3_complete_part{}
+	for start := int64(0); start < size; start += s3_copy_part_size {
+		end := start + s3_copy_part_size - 1
+		if end >= size {
+			end = size - 1
+		}
+		query := url.Values{
+			"partNumber": {strconv.Itoa(len(parts) + 1)},
+			"uploadId":   {uploadid},
+		}
+		etag, err := s.copy(source, objkey, query, "x-amz-copy-source-range", fmt.Sprintf("bytes=%d-%d", start, end))
+		if err != nil {
+			s.abort_multipart(objkey, uploadid)
+			return err
+		}
+		parts = append(parts, s3_complete_part{PartNumber: len(parts) + 1, ETag: etag})
+	}
+	if err := s.complete_multipart(objkey, uploadid, parts); err != nil {
+		s.abort_multipart(objkey, uploadid)
+		return err
+	}
+	return nil
+}
+
+// Does nothing, S3 has no read-only objects. Use the object lock
+// or a policy of the bucket to protect the snapshots.
+func (s *S3) ReadOnly(key string) error {
+	return nil
+}
+
+func (s *S3) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func (s *S3) request(method string, objkey string, query url.Values, headers map[string]string, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket
+		if objkey != "" {
+			u.Path += "/" + objkey
+		}
+	} else {
+		u.Path = "/" + objkey
+	}
+	u.RawPath = uri_encode(u.Path, false)
+	u.RawQuery = canonical_query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	s.sign(req, u.RawPath, body, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &fs.PathError{Op: strings.ToLower(method), Path: objkey, Err: fs.ErrNotExist}
+		}
+		return nil, &s3_error{method: method, key: objkey, status: resp.Status, code: resp.StatusCode, detail: s3_error_code(msg)}
+	}
+	return resp, nil
+}
+
+// Error status of a request, other than not found.
+type s3_error struct {
+	method string
+	key    string
+	status string
+	code   int
+	detail string
+}
+
+func (e *s3_error) Error() string {
+	return fmt.Sprintf("s3 %s %s: %s %s", e.method, e.key, e.status, e.detail)
+}
+
+// Status code of a failed request, 0 if it did not get a response.
+func s3_status(err error) int {
+	var e *s3_error
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return 0
+}
+
+// The request was refused for lack of a permission.
+func s3_denied(err error) bool {
+	var e *s3_error
+	return errors.As(err, &e) && e.code == http.StatusForbidden && strings.HasPrefix(e.detail, "AccessDenied:")
+}
+
+func s3_error_code(body []byte) string {
+	e := struct{ Code, Message string }{}
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return e.Code + ": " + e.Message
+	}
+	return ""
+}
+
+// AWS signature version 4
+func (s *S3) sign(req *http.Request, canonicalURI string, body []byte, now time.Time) {
+	now = now.UTC()
+	amzdate := now.Format("20060102T150405Z")
+	datestamp := now.Format("20060102")
+
+	payload := sha256.Sum256(body)
+	req.Header.Set("x-amz-date", amzdate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payload[:]))
+	if s.token != "" {
+		req.Header.Set("x-amz-security-token", s.token)
+	}
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+			values[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + values[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+
+	scope := datestamp + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	tosign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmac_sha256([]byte("AWS4"+s.secretKey), datestamp)
+	key = hmac_sha256(key, s.region)
+	key = hmac_sha256(key, "s3")
+	key = hmac_sha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmac_sha256(key, tosign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmac_sha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonical_query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, uri_encode(k, true)+"="+uri_encode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Percent encode all but the unreserved characters, and the slashes of paths.
+func uri_encode(value string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			buf.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return buf.String()
+}
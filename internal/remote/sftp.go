@@ -0,0 +1,803 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// packet types of the sftp protocol, version 3
+const (
+	ssh_fxp_init           = 1
+	ssh_fxp_version        = 2
+	ssh_fxp_open           = 3
+	ssh_fxp_close          = 4
+	ssh_fxp_read           = 5
+	ssh_fxp_write          = 6
+	ssh_fxp_setstat        = 9
+	ssh_fxp_opendir        = 11
+	ssh_fxp_readdir        = 12
+	ssh_fxp_remove         = 13
+	ssh_fxp_mkdir          = 14
+	ssh_fxp_rmdir          = 15
+	ssh_fxp_stat           = 17
+	ssh_fxp_rename         = 18
+	ssh_fxp_status         = 101
+	ssh_fxp_handle         = 102
+	ssh_fxp_data           = 103
+	ssh_fxp_name           = 104
+	ssh_fxp_attrs          = 105
+	ssh_fxp_extended       = 200
+	ssh_fxp_extended_reply = 201
+)
+
+const (
+	ssh_fx_ok                = 0
+	ssh_fx_eof               = 1
+	ssh_fx_no_such_file      = 2
+	ssh_fx_permission_denied = 3
+)
+
+const (
+	ssh_fxf_read  = 0x01
+	ssh_fxf_write = 0x02
+	ssh_fxf_creat = 0x08
+	ssh_fxf_trunc = 0x10
+)
+
+const (
+	ssh_filexfer_attr_size        = 0x01
+	ssh_filexfer_attr_uidgid      = 0x02
+	ssh_filexfer_attr_permissions = 0x04
+	ssh_filexfer_attr_acmodtime   = 0x08
+	ssh_filexfer_attr_extended    = 0x80000000
+)
+
+// largest read or write request all servers accept
+const sftp_chunk_size = 32768
+
+// A directory on a server reachable over ssh, sftp://user@host:port/path
+//
+// The connection is made by the ssh client of the system, so the keys,
+// agent, known hosts and config of ~/.ssh are used. No password prompts
+// are shown, key based authentication is required. The ssh command can
+// be replaced by the SNAP_SSH_COMMAND environment variable.
+// Paths starting with /~/ are relative to the home directory.
+type SFTP struct {
+	location string
+	host     string
+	user     string
+	port     string
+	base     string
+	// opens a connection, replaced by the tests
+	dial func() (*sftp_conn, error)
+
+	mu   sync.Mutex
+	conn *sftp_conn
+}
+
+// The requests of all the goroutines are sent without waiting
+// for the previous responses, which are matched by their id.
+type sftp_conn struct {
+	cmd         *exec.Cmd
+	in          io.WriteCloser
+	out         io.Reader
+	posixRename bool
+
+	// serializes the writes of the requests
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	nextid  uint32
+	pending map[uint32]chan sftp_response
+	// the connection is broken, set once
+	err error
+	// closed when the responses stop
+	done chan struct{}
+}
+
+type sftp_response struct {
+	ptype   byte
+	payload []byte
+	err     error
+}
+
+// time given to the ssh client to exit once its input is closed
+const sftp_close_timeout = 5 * time.Second
+
+type sftp_status struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftp_status) Error() string {
+	return fmt.Sprintf("sftp error %d: %s", e.code, e.msg)
+}
+
+func NewSFTP(location string) (*SFTP, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sftp url: %s", err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in sftp url: %s", location)
+	}
+
+	base := u.Path
+	if strings.HasPrefix(base, "/~/") || base == "/~" {
+		// relative paths are resolved from the home directory
+		base = strings.TrimPrefix(strings.TrimPrefix(base, "/~"), "/")
+	}
+	if base == "" {
+		base = "."
+	}
+
+	s := &SFTP{
+		location: location,
+		host:     u.Hostname(),
+		user:     u.User.Username(),
+		port:     u.Port(),
+		base:     base,
+	}
+	s.dial = s.dial_ssh
+	return s, nil
+}
+
+func (s *SFTP) String() string {
+	return s.location
+}
+
+func (s *SFTP) path(key string) string {
+	return path.Join(s.base, key)
+}
+
+// The open connection, or a new one if it broke.
+func (s *SFTP) connect() (*sftp_conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && s.conn.broken() == nil {
+		return s.conn, nil
+	}
+	if s.conn != nil {
+		s.conn.close()
+		s.conn = nil
+	}
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// Stop the ssh client, a later request connects again.
+func (s *SFTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.close()
+	s.conn = nil
+	return err
+}
+
+func (s *SFTP) dial_ssh() (*sftp_conn, error) {
+	args := []string{}
+	if command := os.Getenv("SNAP_SSH_COMMAND"); command != "" {
+		args = strings.Fields(command)
+	} else {
+		args = []string{"ssh", "-o", "BatchMode=yes"}
+	}
+	if s.port != "" {
+		args = append(args, "-p", s.port)
+	}
+	target := s.host
+	if s.user != "" {
+		target = s.user + "@" + s.host
+	}
+	args = append(args, "-s", target, "sftp")
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ssh: %s", err)
+	}
+
+	conn, err := open_sftp_conn(cmd, in, out)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("failed to connect to %s: %s", target, err)
+	}
+	return conn, nil
+}
+
+// Agree on the version of the protocol, then read the responses
+// in the background.
+func open_sftp_conn(cmd *exec.Cmd, in io.WriteCloser, out io.Reader) (*sftp_conn, error) {
+	conn := &sftp_conn{
+		cmd:     cmd,
+		in:      in,
+		out:     out,
+		pending: make(map[uint32]chan sftp_response),
+		done:    make(chan struct{}),
+	}
+
+	init := new_packet(ssh_fxp_init)
+	init.uint32(3)
+	if err := conn.send(init); err != nil {
+		in.Close()
+		return nil, err
+	}
+	ptype, payload, err := conn.recv()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	if ptype != ssh_fxp_version {
+		in.Close()
+		return nil, fmt.Errorf("unexpected sftp server response: %d", ptype)
+	}
+	r := &packet_reader{buf: payload}
+	r.uint32()
+	for r.remaining() > 0 {
+		name := r.string()
+		r.string()
+		if name == "posix-rename@openssh.com" {
+			conn.posixRename = true
+		}
+	}
+
+	go conn.read_responses()
+	return conn, nil
+}
+
+func (c *sftp_conn) read_responses() {
+	defer close(c.done)
+	for {
+		ptype, payload, err := c.recv()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		id := (&packet_reader{buf: payload}).uint32()
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if !ok {
+			c.fail(fmt.Errorf("unexpected sftp response id: %d", id))
+			return
+		}
+		ch <- sftp_response{ptype: ptype, payload: payload}
+	}
+}
+
+// Fail the pending requests, and the later ones.
+func (c *sftp_conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for id, ch := range c.pending {
+		ch <- sftp_response{err: c.err}
+		delete(c.pending, id)
+	}
+}
+
+func (c *sftp_conn) broken() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// The server exits when its input is closed, an ssh client
+// which does not exit in time is killed.
+func (c *sftp_conn) close() error {
+	c.fail(errors.New("sftp connection closed"))
+	c.in.Close()
+	if c.cmd == nil {
+		select {
+		case <-c.done:
+		case <-time.After(sftp_close_timeout):
+		}
+		return nil
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- c.cmd.Wait() }()
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(sftp_close_timeout):
+		c.cmd.Process.Kill()
+		return <-exited
+	}
+}
+
+// One request and its response. The requests of the other
+// goroutines are sent while waiting.
+func (c *sftp_conn) call(ptype byte, build func(p *packet)) (byte, *packet_reader, error) {
+	ch := make(chan sftp_response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return 0, nil, c.err
+	}
+	c.nextid++
+	id := c.nextid
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	p := new_packet(ptype)
+	p.uint32(id)
+	build(p)
+	c.wmu.Lock()
+	err := c.send(p)
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+
+	resp := <-ch
+	if resp.err != nil {
+		return 0, nil, resp.err
+	}
+	r := &packet_reader{buf: resp.payload}
+	r.uint32()
+	if resp.ptype == ssh_fxp_status {
+		status := &sftp_status{code: r.uint32(), msg: r.string()}
+		if status.code != ssh_fx_ok {
+			return resp.ptype, r, status
+		}
+	}
+	return resp.ptype, r, nil
+}
+
+// A request on the current connection. Handles are only valid on
+// the connection that opened them, they are used with conn.call.
+func (s *SFTP) call(ptype byte, build func(p *packet)) (byte, *packet_reader, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return 0, nil, err
+	}
+	return conn.call(ptype, build)
+}
+
+// Convert the status errors of a path operation.
+func sftp_error(op string, key string, err error) error {
+	var status *sftp_status
+	if errors.As(err, &status) {
+		switch status.code {
+		case ssh_fx_no_such_file:
+			return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+		case ssh_fx_permission_denied:
+			return &fs.PathError{Op: op, Path: key, Err: fs.ErrPermission}
+		}
+	}
+	if err != nil {
+		return &fs.PathError{Op: op, Path: key, Err: err}
+	}
+	return nil
+}
+
+func (s *SFTP) List(dir string) ([]Entry, error) {
+	conn, handle, err := s.open_handle(ssh_fxp_opendir, s.path(dir), func(p *packet) {})
+	if err != nil {
+		return nil, sftp_error("list", dir, err)
+	}
+	defer close_handle(conn, handle)
+
+	entries := []Entry{}
+	for {
+		rtype, r, err := conn.call(ssh_fxp_readdir, func(p *packet) { p.string(handle) })
+		var status *sftp_status
+		if errors.As(err, &status) && status.code == ssh_fx_eof {
+			break
+		}
+		if err != nil {
+			return nil, sftp_error("list", dir, err)
+		}
+		if rtype != ssh_fxp_name {
+			return nil, fmt.Errorf("unexpected sftp response: %d", rtype)
+		}
+		count := r.uint32()
+		for i := uint32(0); i < count; i++ {
+			name := r.string()
+			r.string()
+			e := r.attrs()
+			if name == "." || name == ".." {
+				continue
+			}
+			e.Name = name
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func (s *SFTP) Stat(key string) (Entry, error) {
+	rtype, r, err := s.call(ssh_fxp_stat, func(p *packet) { p.string(s.path(key)) })
+	if err != nil {
+		return Entry{}, sftp_error("stat", key, err)
+	}
+	if rtype != ssh_fxp_attrs {
+		return Entry{}, fmt.Errorf("unexpected sftp response: %d", rtype)
+	}
+	e := r.attrs()
+	e.Name = path.Base(key)
+	return e, nil
+}
+
+func (s *SFTP) open_handle(ptype byte, fullpath string, build func(p *packet)) (*sftp_conn, string, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, "", err
+	}
+	rtype, r, err := conn.call(ptype, func(p *packet) {
+		p.string(fullpath)
+		build(p)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if rtype != ssh_fxp_handle {
+		return nil, "", fmt.Errorf("unexpected sftp response: %d", rtype)
+	}
+	return conn, r.string(), nil
+}
+
+func close_handle(conn *sftp_conn, handle string) error {
+	_, _, err := conn.call(ssh_fxp_close, func(p *packet) { p.string(handle) })
+	return err
+}
+
+type sftp_reader struct {
+	conn   *sftp_conn
+	handle string
+	offset uint64
+	eof    bool
+}
+
+func (f *sftp_reader) Read(buf []byte) (int, error) {
+	if f.eof {
+		return 0, io.EOF
+	}
+	size := len(buf)
+	if size > sftp_chunk_size {
+		size = sftp_chunk_size
+	}
+	rtype, r, err := f.conn.call(ssh_fxp_read, func(p *packet) {
+		p.string(f.handle)
+		p.uint64(f.offset)
+		p.uint32(uint32(size))
+	})
+	var status *sftp_status
+	if errors.As(err, &status) && status.code == ssh_fx_eof {
+		f.eof = true
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	if rtype != ssh_fxp_data {
+		return 0, fmt.Errorf("unexpected sftp response: %d", rtype)
+	}
+	n := copy(buf, r.string())
+	f.offset += uint64(n)
+	return n, nil
+}
+
+func (f *sftp_reader) Close() error {
+	return close_handle(f.conn, f.handle)
+}
+
+func (s *SFTP) Get(key string) (io.ReadCloser, error) {
+	conn, handle, err := s.open_handle(ssh_fxp_open, s.path(key), func(p *packet) {
+		p.uint32(ssh_fxf_read)
+		p.uint32(0)
+	})
+	if err != nil {
+		return nil, sftp_error("get", key, err)
+	}
+	return &sftp_reader{conn: conn, handle: handle}, nil
+}
+
+// Write to a temp file first, then rename.
+// Create the parent dir, if not exist.
+func (s *SFTP) Put(key string, r io.Reader) (int64, error) {
+	if err := s.mkdir_all(path.Dir(key)); err != nil {
+		return 0, err
+	}
+
+	tmpkey := TmpKey(key)
+	conn, handle, err := s.open_handle(ssh_fxp_open, s.path(tmpkey), func(p *packet) {
+		p.uint32(ssh_fxf_write | ssh_fxf_creat | ssh_fxf_trunc)
+		p.uint32(0)
+	})
+	if err != nil {
+		return 0, sftp_error("put", tmpkey, err)
+	}
+
+	var written int64
+	buf := make([]byte, sftp_chunk_size)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			_, _, err = conn.call(ssh_fxp_write, func(p *packet) {
+				p.string(handle)
+				p.uint64(uint64(written))
+				p.bytes(buf[:n])
+			})
+			if err != nil {
+				close_handle(conn, handle)
+				return written, fmt.Errorf("writing to dest tmpfile failed: %s", err)
+			}
+			written += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			close_handle(conn, handle)
+			return written, rerr
+		}
+	}
+
+	// the server flushes the file on close
+	if err := close_handle(conn, handle); err != nil {
+		return written, fmt.Errorf("tmpfile flush error: %s", err)
+	}
+
+	if err := s.Rename(tmpkey, key); err != nil {
+		return written, fmt.Errorf("coundn't rename tmpfile: %s", err)
+	}
+	return written, nil
+}
+
+func (s *SFTP) mkdir_all(dir string) error {
+	if dir == "." || dir == "" || dir == "/" {
+		return nil
+	}
+	if e, err := s.Stat(dir); err == nil {
+		if !e.IsDir {
+			return fmt.Errorf("not a directory: %s", dir)
+		}
+		return nil
+	}
+	if err := s.mkdir_all(path.Dir(dir)); err != nil {
+		return err
+	}
+	_, _, err := s.call(ssh_fxp_mkdir, func(p *packet) {
+		p.string(s.path(dir))
+		p.uint32(0)
+	})
+	if err != nil {
+		// created in the meantime
+		if e, serr := s.Stat(dir); serr == nil && e.IsDir {
+			return nil
+		}
+		return sftp_error("mkdir", dir, err)
+	}
+	return nil
+}
+
+// Remove the file, and the parent directories left empty,
+// directories are implicit for the remotes.
+func (s *SFTP) Delete(key string) error {
+	_, _, err := s.call(ssh_fxp_remove, func(p *packet) { p.string(s.path(key)) })
+	if err != nil {
+		return sftp_error("delete", key, err)
+	}
+	for dir := path.Dir(key); dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+		_, _, err := s.call(ssh_fxp_rmdir, func(p *packet) { p.string(s.path(dir)) })
+		if err != nil {
+			// not empty
+			break
+		}
+	}
+	return nil
+}
+
+func (s *SFTP) Rename(from string, to string) error {
+	if err := s.mkdir_all(path.Dir(to)); err != nil {
+		return err
+	}
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	if conn.posixRename {
+		_, _, err = conn.call(ssh_fxp_extended, func(p *packet) {
+			p.string("posix-rename@openssh.com")
+			p.string(s.path(from))
+			p.string(s.path(to))
+		})
+		return sftp_error("rename", from, err)
+	}
+
+	// plain sftp renames fail if the target exists, it is moved
+	// aside and put back if the rename fails
+	backup := ""
+	if Exists(s, to) {
+		backup = TmpKey(to)
+		if err := s.rename(to, backup); err != nil {
+			return sftp_error("rename", to, err)
+		}
+	}
+	if err := s.rename(from, to); err != nil {
+		if backup != "" {
+			s.rename(backup, to)
+		}
+		return sftp_error("rename", from, err)
+	}
+	if backup != "" {
+		s.call(ssh_fxp_setstat, func(p *packet) {
+			p.string(s.path(backup))
+			p.uint32(ssh_filexfer_attr_permissions)
+			p.uint32(0644)
+		})
+		s.call(ssh_fxp_remove, func(p *packet) { p.string(s.path(backup)) })
+	}
+	return nil
+}
+
+// Plain rename, fails if the target exists.
+func (s *SFTP) rename(from string, to string) error {
+	_, _, err := s.call(ssh_fxp_rename, func(p *packet) {
+		p.string(s.path(from))
+		p.string(s.path(to))
+	})
+	return err
+}
+
+func (s *SFTP) ReadOnly(key string) error {
+	_, _, err := s.call(ssh_fxp_setstat, func(p *packet) {
+		p.string(s.path(key))
+		p.uint32(ssh_filexfer_attr_permissions)
+		p.uint32(0444)
+	})
+	return sftp_error("readonly", key, err)
+}
+
+func (c *sftp_conn) send(p *packet) error {
+	data := p.buf.Bytes()
+	binary.BigEndian.PutUint32(data[:4], uint32(len(data)-4))
+	_, err := c.in.Write(data)
+	return err
+}
+
+func (c *sftp_conn) recv() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.out, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 1<<24 {
+		return 0, nil, fmt.Errorf("invalid sftp packet length: %d", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.out, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+type packet struct {
+	buf bytes.Buffer
+}
+
+func new_packet(ptype byte) *packet {
+	p := &packet{}
+	// length is filled in when sent
+	p.buf.Write([]byte{0, 0, 0, 0, ptype})
+	return p
+}
+
+func (p *packet) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	p.buf.Write(b[:])
+}
+
+func (p *packet) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	p.buf.Write(b[:])
+}
+
+func (p *packet) string(v string) {
+	p.bytes([]byte(v))
+}
+
+func (p *packet) bytes(v []byte) {
+	p.uint32(uint32(len(v)))
+	p.buf.Write(v)
+}
+
+// Reads the fields of a response, a short packet reads as zero values.
+type packet_reader struct {
+	buf []byte
+}
+
+func (r *packet_reader) remaining() int {
+	return len(r.buf)
+}
+
+func (r *packet_reader) uint32() uint32 {
+	if len(r.buf) < 4 {
+		r.buf = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf[:4])
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *packet_reader) uint64() uint64 {
+	if len(r.buf) < 8 {
+		r.buf = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.buf[:8])
+	r.buf = r.buf[8:]
+	return v
+}
+
+func (r *packet_reader) string() string {
+	n := int(r.uint32())
+	if n > len(r.buf) {
+		n = len(r.buf)
+	}
+	v := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *packet_reader) attrs() Entry {
+	e := Entry{}
+	flags := r.uint32()
+	if flags&ssh_filexfer_attr_size != 0 {
+		e.Size = int64(r.uint64())
+	}
+	if flags&ssh_filexfer_attr_uidgid != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&ssh_filexfer_attr_permissions != 0 {
+		e.IsDir = os.FileMode(r.uint32()&0170000) == 0040000
+	}
+	if flags&ssh_filexfer_attr_acmodtime != 0 {
+		r.uint32()
+		e.ModTime = time.Unix(int64(r.uint32()), 0)
+	}
+	if flags&ssh_filexfer_attr_extended != 0 {
+		count := r.uint32()
+		for i := uint32(0); i < count; i++ {
+			r.string()
+			r.string()
+		}
+	}
+	return e
+}
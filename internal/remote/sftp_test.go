@@ -0,0 +1,566 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type nop_closer struct {
+	io.Writer
+}
+
+func (nop_closer) Close() error {
+	return nil
+}
+
+func TestPacket(t *testing.T) {
+	var buf bytes.Buffer
+	c := &sftp_conn{in: nop_closer{&buf}, out: &buf}
+
+	p := new_packet(ssh_fxp_write)
+	p.uint32(7)
+	p.string("ab")
+	p.uint64(1 << 33)
+	p.bytes([]byte{0xff})
+	if err := c.send(p); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0, 0, 0, 24, ssh_fxp_write,
+		0, 0, 0, 7,
+		0, 0, 0, 2, 'a', 'b',
+		0, 0, 0, 2, 0, 0, 0, 0,
+		0, 0, 0, 1, 0xff,
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("packet = % x\nwant % x", buf.Bytes(), want)
+	}
+
+	ptype, payload, err := c.recv()
+	if err != nil || ptype != ssh_fxp_write {
+		t.Fatalf("recv = %d, %v", ptype, err)
+	}
+	r := &packet_reader{buf: payload}
+	if id, s, off, b := r.uint32(), r.string(), r.uint64(), r.string(); id != 7 || s != "ab" || off != 1<<33 || b != "\xff" {
+		t.Errorf("decoded %d %q %d %q", id, s, off, b)
+	}
+	// short packets read as zero values
+	if r.remaining() != 0 || r.uint32() != 0 || r.uint64() != 0 || r.string() != "" {
+		t.Error("reading past the end is not zero")
+	}
+	if s := (&packet_reader{buf: []byte{0, 0, 0, 9, 'x'}}).string(); s != "x" {
+		t.Errorf("string longer than the packet = %q", s)
+	}
+
+	// a length of zero has no type
+	buf.Write([]byte{0, 0, 0, 0, 0})
+	if _, _, err := c.recv(); err == nil {
+		t.Error("recv accepted an empty packet")
+	}
+	buf.Reset()
+	buf.Write([]byte{0, 0, 0, 9, ssh_fxp_data, 0})
+	if _, _, err := c.recv(); err == nil {
+		t.Error("recv accepted a truncated packet")
+	}
+}
+
+func TestPacketAttrs(t *testing.T) {
+	p := new_packet(ssh_fxp_attrs)
+	p.uint32(ssh_filexfer_attr_size | ssh_filexfer_attr_uidgid | ssh_filexfer_attr_permissions |
+		ssh_filexfer_attr_acmodtime | ssh_filexfer_attr_extended)
+	p.uint64(1234)
+	p.uint32(1000)
+	p.uint32(1000)
+	p.uint32(0040755)
+	p.uint32(1700000000)
+	p.uint32(1700000001)
+	p.uint32(1)
+	p.string("name")
+	p.string("value")
+	p.uint32(42)
+
+	r := &packet_reader{buf: p.buf.Bytes()[5:]}
+	e := r.attrs()
+	if e.Size != 1234 || !e.IsDir || e.ModTime.Unix() != 1700000001 {
+		t.Errorf("attrs = %+v", e)
+	}
+	if r.uint32() != 42 {
+		t.Error("attrs did not read all its fields")
+	}
+
+	r = &packet_reader{buf: []byte{0, 0, 0, ssh_filexfer_attr_permissions, 0, 0, 0x81, 0xa4}}
+	if e := r.attrs(); e.IsDir || e.Size != 0 {
+		t.Errorf("attrs of a file = %+v", e)
+	}
+}
+
+func TestSftpError(t *testing.T) {
+	if err := sftp_error("get", "k", &sftp_status{code: ssh_fx_no_such_file}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("no such file = %v", err)
+	}
+	if err := sftp_error("get", "k", &sftp_status{code: ssh_fx_permission_denied}); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("permission denied = %v", err)
+	}
+	if err := sftp_error("get", "k", &sftp_status{code: 4, msg: "failure"}); err == nil || !strings.Contains(err.Error(), "failure") {
+		t.Errorf("failure = %v", err)
+	}
+	if err := sftp_error("get", "k", nil); err != nil {
+		t.Errorf("no error = %v", err)
+	}
+}
+
+// Sftp server of a directory, connected by pipes. Requests are
+// answered concurrently, so the responses can be out of order.
+type fake_sftp struct {
+	root        string
+	posixRename bool
+	// a stat of a key named hold waits until it is closed
+	hold chan struct{}
+
+	mu      sync.Mutex
+	dials   int
+	served  int
+	outs    []*io.PipeWriter
+	handles map[string]*fake_handle
+	nexth   int
+}
+
+type fake_handle struct {
+	file    *os.File
+	entries []os.DirEntry
+	listed  bool
+}
+
+func new_fake_sftp(t *testing.T, posixRename bool) (*fake_sftp, *SFTP) {
+	f := &fake_sftp{root: t.TempDir(), posixRename: posixRename, handles: make(map[string]*fake_handle)}
+	s, err := NewSFTP("sftp://user@host" + filepath.ToSlash(f.root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dial = f.dial
+	t.Cleanup(func() { s.Close() })
+	return f, s
+}
+
+func (f *fake_sftp) dial() (*sftp_conn, error) {
+	reqr, reqw := io.Pipe()
+	respr, respw := io.Pipe()
+	f.mu.Lock()
+	f.dials++
+	f.outs = append(f.outs, respw)
+	f.mu.Unlock()
+	go f.serve(reqr, respw)
+	return open_sftp_conn(nil, reqw, respr)
+}
+
+func (f *fake_sftp) count_dials() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dials
+}
+
+// Requests waiting for their response.
+func pending(s *SFTP) int {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return len(conn.pending)
+}
+
+// Break the last connection, as a dropped ssh session.
+func (f *fake_sftp) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.outs[len(f.outs)-1].CloseWithError(errors.New("connection lost"))
+}
+
+func (f *fake_sftp) serve(in io.Reader, out *io.PipeWriter) {
+	srv := &sftp_conn{in: out, out: in}
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		out.Close()
+		f.mu.Lock()
+		f.served++
+		f.mu.Unlock()
+	}()
+
+	ptype, _, err := srv.recv()
+	if err != nil || ptype != ssh_fxp_init {
+		return
+	}
+	version := new_packet(ssh_fxp_version)
+	version.uint32(3)
+	if f.posixRename {
+		version.string("posix-rename@openssh.com")
+		version.string("1")
+	}
+	srv.send(version)
+
+	for {
+		ptype, payload, err := srv.recv()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := f.handle(ptype, &packet_reader{buf: payload})
+			srv.wmu.Lock()
+			srv.send(resp)
+			srv.wmu.Unlock()
+		}()
+	}
+}
+
+func status_packet(id uint32, code uint32, msg string) *packet {
+	p := new_packet(ssh_fxp_status)
+	p.uint32(id)
+	p.uint32(code)
+	p.string(msg)
+	p.string("")
+	return p
+}
+
+func error_packet(id uint32, err error) *packet {
+	switch {
+	case err == nil:
+		return status_packet(id, ssh_fx_ok, "")
+	case errors.Is(err, fs.ErrNotExist):
+		return status_packet(id, ssh_fx_no_such_file, err.Error())
+	case errors.Is(err, fs.ErrPermission):
+		return status_packet(id, ssh_fx_permission_denied, err.Error())
+	}
+	return status_packet(id, 4, err.Error())
+}
+
+func (f *fake_sftp) new_handle(h *fake_handle) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nexth++
+	name := strconv.Itoa(f.nexth)
+	f.handles[name] = h
+	return name
+}
+
+func (f *fake_sftp) get_handle(name string) *fake_handle {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.handles[name]
+}
+
+func (f *fake_sftp) handle(ptype byte, r *packet_reader) *packet {
+	id := r.uint32()
+	switch ptype {
+	case ssh_fxp_open:
+		name := r.string()
+		pflags := r.uint32()
+		flags := os.O_RDONLY
+		if pflags&ssh_fxf_write != 0 {
+			flags = os.O_WRONLY
+		}
+		if pflags&ssh_fxf_creat != 0 {
+			flags |= os.O_CREATE
+		}
+		if pflags&ssh_fxf_trunc != 0 {
+			flags |= os.O_TRUNC
+		}
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			return status_packet(id, 4, "is a directory")
+		}
+		file, err := os.OpenFile(name, flags, 0644)
+		if err != nil {
+			return error_packet(id, err)
+		}
+		p := new_packet(ssh_fxp_handle)
+		p.uint32(id)
+		p.string(f.new_handle(&fake_handle{file: file}))
+		return p
+
+	case ssh_fxp_opendir:
+		entries, err := os.ReadDir(r.string())
+		if err != nil {
+			return error_packet(id, err)
+		}
+		p := new_packet(ssh_fxp_handle)
+		p.uint32(id)
+		p.string(f.new_handle(&fake_handle{entries: entries}))
+		return p
+
+	case ssh_fxp_close:
+		name := r.string()
+		f.mu.Lock()
+		h, ok := f.handles[name]
+		delete(f.handles, name)
+		f.mu.Unlock()
+		if !ok {
+			return status_packet(id, 4, "invalid handle")
+		}
+		if h.file != nil {
+			return error_packet(id, h.file.Close())
+		}
+		return error_packet(id, nil)
+
+	case ssh_fxp_read:
+		h := f.get_handle(r.string())
+		offset := r.uint64()
+		buf := make([]byte, r.uint32())
+		if h == nil || h.file == nil {
+			return status_packet(id, 4, "invalid handle")
+		}
+		n, err := h.file.ReadAt(buf, int64(offset))
+		if n == 0 && err == io.EOF {
+			return status_packet(id, ssh_fx_eof, "")
+		}
+		if n == 0 {
+			return error_packet(id, err)
+		}
+		p := new_packet(ssh_fxp_data)
+		p.uint32(id)
+		p.bytes(buf[:n])
+		return p
+
+	case ssh_fxp_write:
+		h := f.get_handle(r.string())
+		offset := r.uint64()
+		data := r.string()
+		if h == nil || h.file == nil {
+			return status_packet(id, 4, "invalid handle")
+		}
+		_, err := h.file.WriteAt([]byte(data), int64(offset))
+		return error_packet(id, err)
+
+	case ssh_fxp_readdir:
+		h := f.get_handle(r.string())
+		if h == nil || h.file != nil {
+			return status_packet(id, 4, "invalid handle")
+		}
+		if h.listed {
+			return status_packet(id, ssh_fx_eof, "")
+		}
+		h.listed = true
+		p := new_packet(ssh_fxp_name)
+		p.uint32(id)
+		p.uint32(uint32(len(h.entries) + 2))
+		for _, name := range []string{".", ".."} {
+			p.string(name)
+			p.string(name)
+			p.uint32(ssh_filexfer_attr_permissions)
+			p.uint32(0040755)
+		}
+		for _, e := range h.entries {
+			info, _ := e.Info()
+			p.string(e.Name())
+			p.string(e.Name())
+			attrs(p, info)
+		}
+		return p
+
+	case ssh_fxp_stat:
+		name := r.string()
+		if filepath.Base(name) == "hold" && f.hold != nil {
+			<-f.hold
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return error_packet(id, err)
+		}
+		p := new_packet(ssh_fxp_attrs)
+		p.uint32(id)
+		attrs(p, info)
+		return p
+
+	case ssh_fxp_setstat:
+		name := r.string()
+		if r.uint32()&ssh_filexfer_attr_permissions != 0 {
+			return error_packet(id, os.Chmod(name, os.FileMode(r.uint32()&0777)))
+		}
+		return error_packet(id, nil)
+
+	case ssh_fxp_remove:
+		name := r.string()
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			return status_packet(id, 4, "is a directory")
+		}
+		return error_packet(id, os.Remove(name))
+
+	case ssh_fxp_mkdir:
+		return error_packet(id, os.Mkdir(r.string(), 0755))
+
+	case ssh_fxp_rmdir:
+		name := r.string()
+		if info, err := os.Stat(name); err == nil && !info.IsDir() {
+			return status_packet(id, 4, "not a directory")
+		}
+		return error_packet(id, os.Remove(name))
+
+	case ssh_fxp_rename:
+		from, to := r.string(), r.string()
+		if _, err := os.Lstat(to); err == nil {
+			return status_packet(id, 4, "target exists")
+		}
+		return error_packet(id, os.Rename(from, to))
+
+	case ssh_fxp_extended:
+		if r.string() == "posix-rename@openssh.com" && f.posixRename {
+			return error_packet(id, os.Rename(r.string(), r.string()))
+		}
+		return status_packet(id, 8, "unsupported")
+	}
+	return status_packet(id, 8, fmt.Sprintf("unsupported packet %d", ptype))
+}
+
+func attrs(p *packet, info os.FileInfo) {
+	mode := uint32(info.Mode().Perm())
+	if info.IsDir() {
+		mode |= 0040000
+	} else {
+		mode |= 0100000
+	}
+	p.uint32(ssh_filexfer_attr_size | ssh_filexfer_attr_permissions | ssh_filexfer_attr_acmodtime)
+	p.uint64(uint64(info.Size()))
+	p.uint32(mode)
+	p.uint32(uint32(info.ModTime().Unix()))
+	p.uint32(uint32(info.ModTime().Unix()))
+}
+
+func TestSFTP(t *testing.T) {
+	_, s := new_fake_sftp(t, true)
+	conformance(t, s)
+}
+
+// Servers without the posix-rename extension.
+func TestSFTPPlainRename(t *testing.T) {
+	_, s := new_fake_sftp(t, false)
+	conformance(t, s)
+
+	// a failed rename keeps the target
+	put(t, s, "r/history/0001.shot", "kept")
+	if err := s.Rename("r/history/missing", "r/history/0001.shot"); !IsNotExist(err) {
+		t.Errorf("Rename of a missing key = %v, want not exist", err)
+	}
+	if got := get(t, s, "r/history/0001.shot"); got != "kept" {
+		t.Errorf("target after a failed Rename = %q", got)
+	}
+	if got := names(t, s, "r/history"); len(got) != 1 {
+		t.Errorf("List after a failed Rename = %v", got)
+	}
+}
+
+func TestSFTPReadWrite(t *testing.T) {
+	_, s := new_fake_sftp(t, true)
+	data := strings.Repeat("0123456789", 3*sftp_chunk_size/10+7)
+	put(t, s, "r/files/big.txt", data)
+	if got := get(t, s, "r/files/big.txt"); got != data {
+		t.Errorf("Get = %d bytes, want %d", len(got), len(data))
+	}
+
+	// status errors of the server
+	put(t, s, "r/file", "")
+	if _, err := s.Put("r/file/a.txt", strings.NewReader("x")); err == nil {
+		t.Error("Put under a file succeeded")
+	}
+	if _, err := s.Get("r/files"); err == nil || IsNotExist(err) {
+		t.Errorf("Get of a directory = %v", err)
+	}
+	if _, err := s.List("r/file"); err == nil {
+		t.Error("List of a file succeeded")
+	}
+}
+
+func TestSFTPPipeline(t *testing.T) {
+	f, s := new_fake_sftp(t, true)
+	put(t, s, "r/a.txt", "a")
+	f.hold = make(chan struct{})
+
+	held := make(chan error, 1)
+	go func() {
+		_, err := s.Stat("r/hold")
+		held <- err
+	}()
+
+	// answered while the first request waits
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("r/files/%d.txt", i)
+			if _, err := s.Put(key, strings.NewReader(key)); err != nil {
+				t.Errorf("Put %s: %s", key, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(names(t, s, "r/files")) != 8 {
+		t.Error("concurrent Puts were lost")
+	}
+
+	close(f.hold)
+	if err := <-held; !IsNotExist(err) {
+		t.Errorf("held Stat = %v, want not exist", err)
+	}
+	if f.count_dials() != 1 {
+		t.Errorf("%d connections, want 1", f.count_dials())
+	}
+}
+
+func TestSFTPReconnect(t *testing.T) {
+	f, s := new_fake_sftp(t, true)
+	put(t, s, "r/a.txt", "a")
+	f.hold = make(chan struct{})
+	defer close(f.hold)
+
+	held := make(chan error, 1)
+	go func() {
+		_, err := s.Stat("r/hold")
+		held <- err
+	}()
+	for deadline := time.Now().Add(time.Second); pending(s) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the pending request fails, the next one connects again
+	f.drop()
+	if err := <-held; err == nil || IsNotExist(err) {
+		t.Errorf("Stat on a lost connection = %v", err)
+	}
+	if got := get(t, s, "r/a.txt"); got != "a" {
+		t.Errorf("Get after a reconnect = %q", got)
+	}
+	if f.count_dials() != 2 {
+		t.Errorf("%d connections, want 2", f.count_dials())
+	}
+}
+
+func TestSFTPClose(t *testing.T) {
+	f, s := new_fake_sftp(t, true)
+	put(t, s, "r/a.txt", "a")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	served := f.served
+	f.mu.Unlock()
+	if served != 1 {
+		t.Error("the server did not exit on Close")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close = %v", err)
+	}
+	if got := get(t, s, "r/a.txt"); got != "a" || f.count_dials() != 2 {
+		t.Errorf("Get after Close = %q with %d connections", got, f.count_dials())
+	}
+}
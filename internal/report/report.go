@@ -0,0 +1,363 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/diff"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
+)
+
+const (
+	Text = "text"
+	JSON = "json"
+	TSV  = "tsv"
+)
+
+var format = Text
+
+// machine readable output goes to stdout, the messages to stderr
+var out io.Writer = os.Stdout
+
+// File entry of a snapshot, the same fields as a line of the shot file.
+type Entry struct {
+	Crud     string `json:"crud"`
+	RelPath  string `json:"relpath"`
+	Name     string `json:"name"`
+	Target   int    `json:"target"`
+	FileHash string `json:"filehash"`
+	ObjectId string `json:"object,omitempty"`
+	Codec    string `json:"codec,omitempty"`
+	BlobSize int64  `json:"blobsize,omitempty"`
+}
+
+// Number of the entries of a snapshot by CRUD.
+type Counts struct {
+	Create int `json:"create"`
+	Retain int `json:"retain"`
+	Update int `json:"update"`
+	Delete int `json:"delete"`
+	Ignore int `json:"ignore"`
+}
+
+// Snapshot without its entries, as listed by 'list'.
+type Summary struct {
+	SnapId int               `json:"ssid"`
+	Meta   map[string]string `json:"meta"`
+	Tags   []string          `json:"tags"`
+	Counts Counts            `json:"counts"`
+}
+
+type Snapshot struct {
+	Summary
+	Entries []Entry `json:"entries"`
+}
+
+// Output of 'list'.
+type List struct {
+	LastSynced int       `json:"last_synced"`
+	Snapshots  []Summary `json:"snapshots"`
+}
+
+// Output of 'shot' and 'pull', and of 'list <snapshot id>'.
+type Result struct {
+	Command   string   `json:"command"`
+	Committed bool     `json:"committed"`
+	Last      int      `json:"last"`
+	Snapshot  Snapshot `json:"snapshot"`
+}
+
+// Output of 'diff', a snapshot id of 0 is the working tree.
+type Diff struct {
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []diff.Change `json:"changes"`
+}
+
+// Change of a file in a snapshot, as listed by 'log'.
+type LogEntry struct {
+	SnapId int `json:"ssid"`
+	// C created, U updated, D deleted, R renamed
+	Crud    string `json:"crud"`
+	RelPath string `json:"relpath"`
+	// path before a rename
+	OldPath  string `json:"old_relpath,omitempty"`
+	Date     string `json:"date"`
+	Host     string `json:"host"`
+	Desc     string `json:"desc,omitempty"`
+	Size     int64  `json:"size"`
+	Target   int    `json:"target"`
+	FileHash string `json:"filehash"`
+}
+
+// Output of 'log', the newest change first.
+type Log struct {
+	RelPath string     `json:"relpath"`
+	Entries []LogEntry `json:"entries"`
+}
+
+// Take the output format from the --json and --format options,
+// the messages are printed to stderr for the machine readable ones.
+func Setup(args *argparser.Parser) error {
+	format = args.GetKeyStr("format", Text)
+	if args.HasFlag("json") {
+		format = JSON
+	}
+	switch format {
+	case Text:
+		return nil
+	case JSON, TSV:
+		logger.SetOutput(os.Stderr)
+		return nil
+	}
+	return logger.FailCode(logger.ExitUsage, "report-format", format,
+		"Unknown output format, expected text, json or tsv.")
+}
+
+// Whether the output is JSON or TSV instead of the text for people.
+func Machine() bool {
+	return format != Text
+}
+
+// Summary of the history, the counts are taken from the CRUD meta
+// if only the meta of the shot file is loaded.
+func SummaryOf(hist *history.Hist, tags []string) Summary {
+	sum := Summary{
+		SnapId: hist.SnapId,
+		Meta:   make(map[string]string),
+		Tags:   tags,
+	}
+	if sum.Tags == nil {
+		sum.Tags = []string{}
+	}
+	for key, val := range hist.Meta {
+		sum.Meta[key] = val
+	}
+	if len(hist.Name) == 0 {
+		sum.Counts = parse_counts(hist.GetMeta("CRUD"))
+	} else {
+		sum.Counts = Counts{
+			Create: hist.CountCrud("C"),
+			Retain: hist.CountCrud("R"),
+			Update: hist.CountCrud("U"),
+			Delete: hist.CountCrud("D"),
+			Ignore: hist.CountCrud("I"),
+		}
+	}
+	return sum
+}
+
+// List of the snapshots of the root in the remote, from the meta
+// sections of the shot files.
+func ListOf(rem remote.Remote, rootname string, lastsynced int, log *logger.Logger) (List, error) {
+	l := List{LastSynced: lastsynced, Snapshots: []Summary{}}
+	snaptags, err := tags.Load(rem, rootname)
+	if err != nil {
+		return l, err
+	}
+	for _, ssid := range history.SnapIds(rem, rootname) {
+		hist := history.Make(ssid, rem, rootname)
+		hist.Log = log
+		if err := hist.LoadFileMeta(fileutils.FormatSnapFile(ssid)); err != nil {
+			return l, err
+		}
+		l.Snapshots = append(l.Snapshots, SummaryOf(hist, snaptags.Of(ssid)))
+	}
+	return l, nil
+}
+
+// Snapshot of the history, with the entries of the cruds, or all
+// but the ignored ones if none given.
+func Of(hist *history.Hist, tags []string, cruds ...string) Snapshot {
+	snap := Snapshot{Summary: SummaryOf(hist, tags), Entries: []Entry{}}
+	if len(cruds) == 0 {
+		cruds = []string{"C", "R", "U", "D"}
+	}
+	for _, phash := range hist.PathHashList() {
+		crud := hist.GetCrud(phash)
+		if !has(cruds, crud) {
+			continue
+		}
+		snap.Entries = append(snap.Entries, Entry{
+			Crud:     crud,
+			RelPath:  hist.GetRelPath(phash),
+			Name:     hist.GetName(phash),
+			Target:   hist.GetTarget(phash),
+			FileHash: hist.GetFileHash(phash),
+			ObjectId: hist.GetObjectId(phash),
+			Codec:    hist.GetCodec(phash),
+			BlobSize: hist.GetBlobSize(phash),
+		})
+	}
+	sort.Slice(snap.Entries, func(i, j int) bool {
+		return snap.Entries[i].RelPath < snap.Entries[j].RelPath
+	})
+	return snap
+}
+
+// Print the created, updated and deleted entries of the snapshot, a section
+// for each, and its meta, the text output of shot, pull and list. The ignored
+// entries are printed first if ignores.
+func PrintChanges(snap Snapshot, rootname string, ignores bool) {
+	cruds := []string{"C", "U", "D"}
+	if ignores {
+		cruds = append([]string{"I"}, cruds...)
+	}
+	for _, crud := range cruds {
+		logger.Print(crud + " ----------------------------------------------------")
+		for _, e := range snap.Entries {
+			if e.Crud == crud {
+				logger.Print(format_entry(e, rootname))
+			}
+		}
+	}
+
+	logger.Print("M ----------------------------------------------------")
+	keys := []string{}
+	for key := range snap.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		logger.Print(fmt.Sprintf("    %s\t=\t%s", key, snap.Meta[key]))
+	}
+	logger.Print("------------------------------------------------------")
+}
+
+func format_entry(e Entry, rootname string) string {
+	// Root1>RelPath>CU>PathHash>02>Name>FileHash
+	line := fmt.Sprintf("  %s > %s\n      FileHash: %s\n      LastSnapshot: %s > %04d > %s\n",
+		rootname,
+		e.RelPath,
+		e.FileHash,
+		fileutils.CalcPathHash(e.RelPath),
+		e.Target,
+		e.Name)
+	if e.ObjectId != "" {
+		line += fmt.Sprintf("      Object: %s\n", e.ObjectId)
+	}
+	if e.Codec != "" {
+		line += fmt.Sprintf("      Codec: %s\n", e.Codec)
+	}
+	if e.BlobSize > 0 {
+		line += fmt.Sprintf("      BlobSize: %d\n", e.BlobSize)
+	}
+	return line
+}
+
+// Print the list of snapshots, one line per snapshot for TSV.
+func PrintList(l List) error {
+	if format == JSON {
+		return print_json(l)
+	}
+	lines := []string{"ssid\tdate\tcreate\tretain\tupdate\tdelete\tignore\ttags\tdesc"}
+	for _, snap := range l.Snapshots {
+		c := snap.Counts
+		lines = append(lines, fmt.Sprintf("%d\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s",
+			snap.SnapId, tsv(snap.Meta["DATE"]), c.Create, c.Retain, c.Update, c.Delete, c.Ignore,
+			tsv(strings.Join(snap.Tags, ",")), tsv(snap.Meta["DESC"])))
+	}
+	return print_lines(lines)
+}
+
+// Print the result of a command, one line per entry for TSV.
+func PrintResult(r Result) error {
+	if format == JSON {
+		return print_json(r)
+	}
+	lines := []string{"crud\trelpath\ttarget\tfilehash\tobject\tcodec"}
+	for _, e := range r.Snapshot.Entries {
+		lines = append(lines, fmt.Sprintf("%s\t%s\t%d\t%s\t%s\t%s",
+			e.Crud, tsv(e.RelPath), e.Target, e.FileHash, e.ObjectId, e.Codec))
+	}
+	return print_lines(lines)
+}
+
+// Print the changes between two snapshots, one line per change for TSV.
+func PrintDiff(d Diff) error {
+	if format == JSON {
+		return print_json(d)
+	}
+	lines := []string{"status\trelpath\told_relpath\tdelta"}
+	for _, c := range d.Changes {
+		lines = append(lines, fmt.Sprintf("%s\t%s\t%s\t%d", c.Status, tsv(c.RelPath), tsv(c.OldPath), c.Delta))
+	}
+	return print_lines(lines)
+}
+
+// Print the changes of a file, one line per change for TSV.
+func PrintLog(l Log) error {
+	if format == JSON {
+		return print_json(l)
+	}
+	lines := []string{"ssid\tcrud\trelpath\told_relpath\tdate\thost\tsize\ttarget\tdesc"}
+	for _, e := range l.Entries {
+		lines = append(lines, fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s",
+			e.SnapId, e.Crud, tsv(e.RelPath), tsv(e.OldPath), tsv(e.Date), tsv(e.Host), e.Size, e.Target, tsv(e.Desc)))
+	}
+	return print_lines(lines)
+}
+
+// Value of a TSV column, the tabs, line breaks and backslashes are
+// escaped as \t, \n, \r and \\.
+var tsv = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r").Replace
+
+func print_json(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return logger.Fail("report-json", "", fmt.Sprintf("Failed to encode the output.\n\n%s", err))
+	}
+	_, err = out.Write(append(data, '\n'))
+	return err
+}
+
+func print_lines(lines []string) error {
+	_, err := io.WriteString(out, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// Counts of the CRUD meta, e.g. +9;=20;^2;-1;*0
+func parse_counts(meta string) Counts {
+	c := Counts{}
+	for _, part := range strings.Split(meta, ";") {
+		if len(part) < 2 {
+			continue
+		}
+		n, err := strconv.Atoi(part[1:])
+		if err != nil {
+			continue
+		}
+		switch part[0] {
+		case '+':
+			c.Create = n
+		case '=':
+			c.Retain = n
+		case '^':
+			c.Update = n
+		case '-':
+			c.Delete = n
+		case '*':
+			c.Ignore = n
+		}
+	}
+	return c
+}
+
+func has(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/akhlakm/Snap_Shot/internal/diff"
+)
+
+// Lines of the TSV output, each with the columns of the header.
+func print_tsv(t *testing.T, print func() error) [][]string {
+	t.Helper()
+	var buf bytes.Buffer
+	saved, savedformat := out, format
+	out, format = &buf, TSV
+	defer func() { out, format = saved, savedformat }()
+	if err := print(); err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		rows = append(rows, strings.Split(line, "\t"))
+	}
+	for i, row := range rows {
+		if len(row) != len(rows[0]) {
+			t.Errorf("line %d has %d columns, want %d: %q", i, len(row), len(rows[0]), row)
+		}
+	}
+	return rows
+}
+
+func TestTSV(t *testing.T) {
+	path := "dir\\tab\there/new\nline.txt"
+	escaped := "dir\\\\tab\\there/new\\nline.txt"
+
+	rows := print_tsv(t, func() error {
+		return PrintList(List{Snapshots: []Summary{{SnapId: 1,
+			Meta: map[string]string{"DATE": "2024-01-02", "DESC": "first\tline\r\nsecond"}, Tags: []string{"v1"}}}})
+	})
+	if len(rows) != 2 || rows[1][8] != "first\\tline\\r\\nsecond" {
+		t.Errorf("PrintList = %q", rows)
+	}
+
+	rows = print_tsv(t, func() error {
+		return PrintResult(Result{Snapshot: Snapshot{Entries: []Entry{{Crud: "C", RelPath: path, FileHash: "h"}}}})
+	})
+	if len(rows) != 2 || rows[1][1] != escaped {
+		t.Errorf("PrintResult = %q", rows)
+	}
+
+	rows = print_tsv(t, func() error {
+		return PrintDiff(Diff{Changes: []diff.Change{{Status: "R", RelPath: path, OldPath: "old\tpath"}}})
+	})
+	if len(rows) != 2 || rows[1][1] != escaped || rows[1][2] != "old\\tpath" {
+		t.Errorf("PrintDiff = %q", rows)
+	}
+
+	rows = print_tsv(t, func() error {
+		return PrintLog(Log{Entries: []LogEntry{{SnapId: 2, Crud: "U", RelPath: path, Desc: "a\nb"}}})
+	})
+	if len(rows) != 2 || rows[1][2] != escaped || rows[1][8] != "a\\nb" {
+		t.Errorf("PrintLog = %q", rows)
+	}
+}
@@ -0,0 +1,172 @@
+package restore
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/diff"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/progress"
+	"github.com/akhlakm/Snap_Shot/internal/workpool"
+)
+
+// Handling of the local files that differ from the restored ones.
+const (
+	Overwrite = "overwrite"
+	KeepBoth  = "keep-both"
+	Skip      = "skip"
+)
+
+// File of a snapshot to restore, and its destination.
+type FileRestore struct {
+	PathHash string
+	RelPath  string
+	DstPath  string
+	// the local file differs from the snapshot
+	Conflict bool
+	// the local path is a directory, it is never replaced
+	Directory bool
+	// the local file is the same as in the snapshot, or kept
+	Skip    bool
+	bytes   int64
+	warning string
+}
+
+// Files of the snapshot under the paths, with their destinations
+// under dest. The local files that differ are handled by the mode.
+func PlanFiles(hist *history.Hist, paths []string, dest string, mode string) []*FileRestore {
+	items := []*FileRestore{}
+	// the kept copies must not replace the restored files either
+	taken := make(map[string]bool)
+	for _, phash := range sorted_paths(hist) {
+		if diff.Present(hist, phash) {
+			taken[fileutils.PathJoin(dest, hist.GetRelPath(phash))] = true
+		}
+	}
+	for _, phash := range sorted_paths(hist) {
+		relpath := hist.GetRelPath(phash)
+		if !diff.Present(hist, phash) || !fileutils.InScope(paths, relpath) {
+			continue
+		}
+		it := &FileRestore{
+			PathHash: phash,
+			RelPath:  relpath,
+			DstPath:  fileutils.PathJoin(dest, relpath),
+		}
+		if info, err := os.Lstat(it.DstPath); err == nil {
+			if !info.IsDir() && local_same(it.DstPath, hist.GetFileHash(phash)) {
+				it.Skip = true
+			} else {
+				it.Conflict = true
+				it.Directory = info.IsDir()
+				it.Skip = mode == Skip
+				if mode == KeepBoth {
+					it.DstPath = keep_both_path(it.DstPath, hist.SnapId, taken)
+				}
+			}
+		}
+		items = append(items, it)
+	}
+	return items
+}
+
+// Whether the local file has the contents of the file hash, by the
+// digest if the snapshot has one, otherwise by the size and modification time.
+func local_same(path string, filehash string) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	digest := fileutils.FileHashDigest(filehash)
+	if !strings.HasPrefix(digest, "sha256:") {
+		stathash, err := fileutils.CalcFileHash(path, fs.FileInfoToDirEntry(info))
+		return err == nil && fileutils.FileHashSame(stathash, filehash)
+	}
+	if !fileutils.FileSizeSame(filehash, info.Size()) {
+		return false
+	}
+	local, err := fileutils.CalcContentDigest(path)
+	return err == nil && "sha256:"+local == digest
+}
+
+// Free name of the restored copy next to a local file, e.g. notes_0003.txt,
+// then notes_0003_2.txt and so on. Dotfiles keep their whole name, .bashrc_0003.
+func keep_both_path(path string, ssid int, taken map[string]bool) string {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	stem := dir + strings.TrimSuffix(base, ext) + fileutils.FormatSnap(ssid)
+
+	candidate := stem + ext
+	for n := 2; taken[candidate] || exists(candidate); n++ {
+		candidate = fmt.Sprintf("%s_%d%s", stem, n, ext)
+	}
+	taken[candidate] = true
+	return candidate
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// Copy the files not skipped from the remote, jobs at a time.
+func CopyFiles(hist *history.Hist, items []*FileRestore, jobs int, log *logger.Logger) error {
+	copies := []*FileRestore{}
+	var planned int64
+	for _, it := range items {
+		if !it.Skip {
+			copies = append(copies, it)
+			planned += fileutils.FileHashSize(hist.GetFileHash(it.PathHash))
+		}
+	}
+	prog := progress.Start(log, "restore", len(copies), planned)
+
+	// the workers only read the history
+	work := func(i int) error {
+		it := copies[i]
+		log.Trace("restore-copyfile", it.DstPath)
+		cpbytes, err := fileutils.Download(hist.Remote, hist.GetRestorePath(it.PathHash), it.DstPath, hist.GetCodec(it.PathHash), prog)
+		if err != nil {
+			return fileutils.CopyError(hist.Remote, err)
+		}
+		it.bytes = cpbytes
+		if err = fileutils.SetModTime(it.DstPath, hist.GetFileHash(it.PathHash)); err != nil {
+			it.warning = fmt.Sprintf("failed to set the modification time of %s.", it.RelPath)
+		}
+		return nil
+	}
+
+	failed := 0
+	done := func(i int, err error) {
+		it := copies[i]
+		prog.FileDone(0)
+		if err != nil {
+			failed++
+			log.Print(fmt.Sprintf("FAILED -- %s, %s", it.RelPath, err))
+			return
+		}
+		if it.warning != "" {
+			log.Warn(it.warning)
+		}
+		log.Print(fmt.Sprintf("OK -- %s (%d bytes)", it.DstPath, it.bytes))
+	}
+
+	workpool.Run(jobs, len(copies), work, done)
+	prog.Finish()
+
+	if failed > 0 {
+		return logger.FailCode(logger.ExitPartial, "restore-files", fmt.Sprintf("%d of %d files", failed, len(copies)),
+			"Failed to restore files.\n"+
+				"\nPlease fix the errors above and restore again.")
+	}
+	log.Print(fmt.Sprintf("DONE -- %d files restored, %d files skipped", len(copies), len(items)-len(copies)))
+	return nil
+}
@@ -0,0 +1,119 @@
+package restore
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+)
+
+func TestKeepBothPath(t *testing.T) {
+	dir := t.TempDir()
+	join := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	for _, name := range []string{"notes.txt", "notes_0003.txt", ".bashrc"} {
+		if err := ioutil.WriteFile(join(name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// restored by the same run
+	taken := map[string]bool{join("notes_0003_2.txt"): true}
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"notes.txt", "notes_0003_3.txt"},
+		{"notes.txt", "notes_0003_4.txt"},
+		{".bashrc", ".bashrc_0003"},
+		{"archive.tar.gz", "archive.tar_0003.gz"},
+		{"Makefile", "Makefile_0003"},
+	}
+	for _, c := range cases {
+		if got := keep_both_path(join(c.path), 3, taken); got != join(c.want) {
+			t.Errorf("keep_both_path(%s) = %s, want %s", c.path, filepath.Base(got), c.want)
+		}
+	}
+}
+
+func TestPlanFiles(t *testing.T) {
+	dest := t.TempDir()
+	for _, name := range []string{"same.txt", "differs.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dest, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dest, "dir.txt"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dest, "same.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := fileutils.CalcFileHash(filepath.Join(dest, "same.txt"), fs.FileInfoToDirEntry(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hist := history.Make(3, remote.NewMemory(), "r")
+	for relpath, filehash := range map[string]string{
+		"same.txt": same, "differs.txt": "4; t0", "dir.txt": "4; t0", "new.txt": "3; t0", "out/other.txt": "1; t0",
+	} {
+		hist.AddPath(relpath, relpath, filepath.Base(relpath), filehash)
+		hist.SetCrud(relpath, "C")
+	}
+
+	type planned struct {
+		conflict  bool
+		directory bool
+		skip      bool
+		dst       string
+	}
+	cases := []struct {
+		mode string
+		want map[string]planned
+	}{
+		{"", map[string]planned{
+			"differs.txt": {true, false, false, "differs.txt"},
+			"dir.txt":     {true, true, false, "dir.txt"},
+			"new.txt":     {false, false, false, "new.txt"},
+			"same.txt":    {false, false, true, "same.txt"},
+		}},
+		{Overwrite, map[string]planned{
+			"differs.txt": {true, false, false, "differs.txt"},
+			"dir.txt":     {true, true, false, "dir.txt"},
+			"new.txt":     {false, false, false, "new.txt"},
+			"same.txt":    {false, false, true, "same.txt"},
+		}},
+		{KeepBoth, map[string]planned{
+			"differs.txt": {true, false, false, "differs_0003.txt"},
+			"dir.txt":     {true, true, false, "dir_0003.txt"},
+			"new.txt":     {false, false, false, "new.txt"},
+			"same.txt":    {false, false, true, "same.txt"},
+		}},
+		{Skip, map[string]planned{
+			"differs.txt": {true, false, true, "differs.txt"},
+			"dir.txt":     {true, true, true, "dir.txt"},
+			"new.txt":     {false, false, false, "new.txt"},
+			"same.txt":    {false, false, true, "same.txt"},
+		}},
+	}
+	for _, c := range cases {
+		items := PlanFiles(hist, []string{"differs.txt", "dir.txt", "new.txt", "same.txt"}, fileutils.PathNormalize(dest), c.mode)
+		if len(items) != len(c.want) {
+			t.Errorf("mode %q: %d files planned, want %d", c.mode, len(items), len(c.want))
+		}
+		for _, it := range items {
+			got := planned{it.Conflict, it.Directory, it.Skip, filepath.Base(it.DstPath)}
+			if got != c.want[it.RelPath] {
+				t.Errorf("mode %q: %s planned as %+v, want %+v", c.mode, it.RelPath, got, c.want[it.RelPath])
+			}
+		}
+	}
+}
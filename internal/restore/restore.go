@@ -1,142 +1,286 @@
 package restore
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"snap/internal/argparser"
-	"snap/internal/fileutils"
-	"snap/internal/history"
-	"snap/internal/logger"
-	"snap/internal/settings"
+	"sort"
+
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/hashcache"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/lock"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/progress"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/workpool"
 )
 
-func Execute() {
-	args := argparser.GetParser()
+// Options of a pull.
+type Options struct {
+	Jobs int
+	// change the files, a dry run otherwise
+	Commit bool
+	// messages of the pull, the logger of the process if nil
+	Log *logger.Logger
+}
+
+// No snapshot in the remote to pull.
+var ErrNoSnapshot = errors.New("no available snapshot to restore from remote")
+
+// Pull of a snapshot to a root directory. Holds the lock of the root
+// when committing, until closed.
+type Pull struct {
+	// the changes to the files of the root
+	Hist *history.Hist
+	// the snapshot pulled
+	Target *history.Hist
+	// the last snapshot synced
+	Last int
+
+	dir  string
+	conf *settings.Settings
+	opts Options
+	lock *lock.Lock
+	log  *logger.Logger
+}
 
-	remote := settings.DefaultRemote()
-	if !fileutils.DirExists(remote) {
+// Compare the root directory with the snapshot to pull, the latest
+// one if ssid is 0. Nothing is changed until committed.
+func Prepare(dir string, conf *settings.Settings, rem remote.Remote, ssid int, opts Options) (*Pull, error) {
+	if !remote.Available(rem) {
 		errmsg := "Remote directory does not exist.\n" +
 			"\nMake sure it is mounted. Or take your first snapshot and it will be created automatically.\n"
-		logger.Error("restore-execute", remote, errmsg)
+		return nil, logger.FailCode(logger.ExitRemote, "restore-execute", rem.String(), errmsg)
+	}
+
+	pull := &Pull{dir: dir, conf: conf, opts: opts, log: opts.Log}
+	if pull.log == nil {
+		pull.log = logger.Default()
+	}
+	if opts.Jobs < 1 {
+		pull.opts.Jobs = workpool.DefaultJobs
 	}
 
-	rootname := settings.RootName()
+	// snapshots and blobs must not be pruned while they are copied
+	if opts.Commit {
+		rootlock, err := lock.Acquire(rem, conf.RootName(), "pull", pull.log)
+		if err != nil {
+			return nil, err
+		}
+		pull.lock = rootlock
+	}
+
+	if err := pull.prepare(rem, ssid); err != nil {
+		pull.Close()
+		return nil, err
+	}
+	return pull, nil
+}
+
+func (pull *Pull) prepare(rem remote.Remote, newss int) error {
+	rootname := pull.conf.RootName()
 
 	// load the last ss
 	// can be 0 when new, or specific int
-	lastss := settings.LastSnapshot()
-	lastHistory := history.Make(lastss, remote, rootname)
-	if lastss > 0 && !fileutils.SSExists(lastss, remote, rootname) {
-		logger.Error("restore-load", fmt.Sprint(lastss),
+	lastss := pull.conf.LastSnapshot()
+	lastHistory := history.Make(lastss, rem, rootname)
+	lastHistory.Log = pull.log
+	if lastss > 0 && !fileutils.SSExists(lastss, rem, rootname) {
+		return logger.Fail("restore-load", fmt.Sprint(lastss),
 			"Last snapshot does not exist in remote.\n"+
 				"\nRoot settings suggest existence of previous snapshots.\n"+
 				"Please rerun 'init' if needed, or run 'list' to see the available snapshots in the remote.")
 	}
 
-	lastHistory.Load()
+	if err := lastHistory.Load(); err != nil {
+		return err
+	}
 
 	// status of current files in root
-	localHistory := history.Make(0, remote, rootname)
-	localHistory = walk_root(localHistory)
-	check_local_modifications(lastHistory, localHistory)
-
-	// calculate restore items
-	newss, err := args.GetInt(1)
-	if err != nil || newss < 1 {
-		// no argument given
-		newss = calc_latest_ssid(remote, rootname)
+	localHistory := history.Make(0, rem, rootname)
+	localHistory.Log = pull.log
+	cache := hashcache.Load(fileutils.PathJoin(pull.dir, fileutils.GetHashCachePath()), pull.conf.HashMode(), pull.log)
+	localHistory, err := walk_root(pull.dir, localHistory, cache, pull.opts.Jobs, pull.log)
+	if err != nil {
+		return err
+	}
+	cache.Write()
+	if err := check_local_modifications(pull.conf, lastHistory, localHistory); err != nil {
+		return err
+	}
+
+	if newss < 1 {
+		// no snapshot given
+		newss = calc_latest_ssid(rem, rootname)
 		if newss == 0 {
-			logger.Print("No available snapshot to restore from remote.")
-			return
+			return ErrNoSnapshot
 		}
 	}
 
-	remoteHistory := history.Make(newss, remote, rootname)
-	if newss > 0 && !fileutils.SSExists(newss, remote, rootname) {
-		logger.Error("snapshot-load", fmt.Sprint(newss),
+	remoteHistory := history.Make(newss, rem, rootname)
+	remoteHistory.Log = pull.log
+	if !fileutils.SSExists(newss, rem, rootname) {
+		return logger.Fail("snapshot-load", fmt.Sprint(newss),
 			"No such snapshot exists to restore.")
 	}
-	remoteHistory.Load()
-	localHistory = calc_action_items(remoteHistory, localHistory)
+	if err := remoteHistory.Load(); err != nil {
+		return err
+	}
+	localHistory = calc_action_items(pull.conf, remoteHistory, localHistory)
 	localHistory, _ = calculate_meta_items(localHistory)
 
-	if args.HasFlag("--ignores") || args.HasFlag("-i") {
-		localHistory.PrintCrud("I")
+	pull.Hist = localHistory
+	pull.Target = remoteHistory
+	pull.Last = lastss
+	return nil
+}
+
+// Change the files of the root to the snapshot, it becomes the last one synced.
+func (pull *Pull) Commit() error {
+	if pull.lock == nil {
+		return logger.Fail("restore-commit", fmt.Sprint(pull.Target.SnapId),
+			"The pull was prepared as a dry run, nothing is restored.")
+	}
+	if err := perform_actions(pull.dir, pull.Hist, pull.opts.Jobs, pull.log); err != nil {
+		return err
+	}
+	pull.conf.SetLastSnapshot(pull.Target.SnapId)
+	if err := pull.conf.Write(); err != nil {
+		return err
 	}
-	logger.Print("\nChanges to commit:\n")
-	localHistory.Print()
-
-	if args.HasFlag("--dry") || args.HasFlag("-n") {
-		// --dry has a higher priority over --go
-		logger.Print(fmt.Sprintf("\nDry run %d < %d. Snapshot is NOT restored.", lastss, newss))
-		logger.Print("Please specify --go to commit the changes, -i to list the ignored items.")
-	} else if args.HasFlag("--go") || args.HasFlag("-go") {
-		perform_actions(localHistory)
-		settings.SetLastSnapshot(remoteHistory.SnapId)
-		settings.Write()
-		prune_empty_dirs()
-		logger.Print(fmt.Sprintf("Last snapshot synced: %d", remoteHistory.SnapId))
-	} else {
-		logger.Print(fmt.Sprintf("\nDry run %d < %d. Snapshot is NOT restored.", lastss, newss))
-		logger.Print("Please specify --go to commit the changes, -i to list the ignored items.")
+	prune_empty_dirs(pull.dir, pull.log)
+	return nil
+}
+
+// Release the lock of the root, if held.
+func (pull *Pull) Close() {
+	if pull.lock != nil {
+		pull.lock.Release()
 	}
 }
 
-func perform_actions(loc *history.Hist) {
+type action struct {
+	phash   string
+	crud    string
+	relpath string
+	dstpath string
+	bytes   int64
+	warning string
+}
+
+func perform_actions(rootpath string, loc *history.Hist, jobs int, log *logger.Logger) error {
 	ccount := 0
 	dcount := 0
-	rootpath := fileutils.CurrentWD()
-	for phash := range loc.RelPath {
-		crud := loc.GetCrud(phash)
-		relpath := loc.GetRelPath(phash)
-		dstpath := fileutils.PathJoin(rootpath, relpath)
-		// copy is create
-		if crud == "C" || crud == "U" {
-			srcpath := loc.GetRestorePath(phash)
 
-			if !fileutils.FileExists(srcpath) {
-				errmsg := "File does not exist in remote.\n" +
-					"\nMake sure the files/ directory of the current root is okay\n" +
-					"and the files are not missing. If you have manually deleted files\n" +
-					"the file pointers in the shot files might be broken.\n" +
-					"See a detail list of files first using the list <snapshot number> command.\n"
+	actions := []*action{}
+	for _, phash := range sorted_paths(loc) {
+		crud := loc.GetCrud(phash)
+		if crud == "C" || crud == "U" || crud == "D" {
+			relpath := loc.GetRelPath(phash)
+			actions = append(actions, &action{
+				phash:   phash,
+				crud:    crud,
+				relpath: relpath,
+				dstpath: fileutils.PathJoin(rootpath, relpath),
+			})
+		}
+	}
 
-				logger.Error("restore-action", srcpath, errmsg)
-			}
-			logger.Trace("restore-copyfile", dstpath)
-			cpbytes, err := fileutils.CopyFile(srcpath, dstpath)
-			if err != nil {
-				fmt.Println(err)
-				logger.Error("restore-copyfile", srcpath, "Failed to copy file.")
-			}
-			ccount++
-			// we know how many bytes should have been copied
-			if !fileutils.FileSizeSame(loc.GetFileHash(phash), cpbytes) {
-				logger.Print(fmt.Sprintf("WARNING -- %s (%d bytes) copy does not match with "+
-					"the expected file size recorded in the remote.\n"+
-					"\nIt can happen if remote file has been manually modified.\n"+
-					"Please take a new snapshot if this is the case,\n"+
-					"otherwise, make sure your remote files are in good conditions.\n", relpath, cpbytes))
-			} else {
-				logger.Print(fmt.Sprintf("OK -- %s (%d bytes)", relpath, cpbytes))
-			}
-		} else if crud == "D" {
-			err := fileutils.DeleteFile(dstpath)
-			if err != nil {
-				errmsg := "Failed to delete file.\n" +
-					"\nMake sure the file is not being accessed by another process.\n" +
-					"Or try manually deleting it first.\n"
-				logger.Error("restore-delete", dstpath, errmsg)
-			} else {
-				dcount++
-				logger.Print(fmt.Sprintf("OK -- %s (delete)", relpath))
+	var planned int64
+	for _, a := range actions {
+		if a.crud != "D" {
+			planned += fileutils.FileHashSize(loc.GetFileHash(a.phash))
+		}
+	}
+	prog := progress.Start(log, "pull", len(actions), planned)
+
+	// the workers only read the history
+	work := func(i int) error {
+		a := actions[i]
+		if a.crud == "D" {
+			if err := fileutils.DeleteFile(a.dstpath); err != nil {
+				return fmt.Errorf("%s\n"+
+					"\nMake sure the file is not being accessed by another process.\n"+
+					"Or try manually deleting it first.\n", err)
 			}
+			return nil
+		}
+
+		// copy is create
+		srcpath := loc.GetRestorePath(a.phash)
+		if !remote.Exists(loc.Remote, srcpath) {
+			return fmt.Errorf("file does not exist in remote: %s\n"+
+				"\nMake sure the files/ directory of the current root is okay\n"+
+				"and the files are not missing. If you have manually deleted files\n"+
+				"the file pointers in the shot files might be broken.\n"+
+				"See a detail list of files first using the list <snapshot number> command.\n", srcpath)
+		}
+		log.Trace("restore-copyfile", a.dstpath)
+		cpbytes, err := fileutils.Download(loc.Remote, srcpath, a.dstpath, loc.GetCodec(a.phash), prog)
+		if err != nil {
+			return fileutils.CopyError(loc.Remote, err)
+		}
+		a.bytes = cpbytes
+		if err = fileutils.SetModTime(a.dstpath, loc.GetFileHash(a.phash)); err != nil {
+			a.warning = fmt.Sprintf("failed to set the modification time of %s.", a.relpath)
 		}
+		return nil
+	}
+
+	failed := 0
+	done := func(i int, err error) {
+		a := actions[i]
+		prog.FileDone(0)
+		if err != nil {
+			failed++
+			log.Print(fmt.Sprintf("FAILED -- %s, %s", a.relpath, err))
+			return
+		}
+		if a.crud == "D" {
+			dcount++
+			log.Print(fmt.Sprintf("OK -- %s (delete)", a.relpath))
+			return
+		}
+		ccount++
+		if a.warning != "" {
+			log.Warn(a.warning)
+		}
+		// we know how many bytes should have been copied
+		if !fileutils.FileSizeSame(loc.GetFileHash(a.phash), a.bytes) {
+			log.Print(fmt.Sprintf("WARNING -- %s (%d bytes) copy does not match with "+
+				"the expected file size recorded in the remote.\n"+
+				"\nIt can happen if remote file has been manually modified.\n"+
+				"Please take a new snapshot if this is the case,\n"+
+				"otherwise, make sure your remote files are in good conditions.\n", a.relpath, a.bytes))
+		} else {
+			log.Print(fmt.Sprintf("OK -- %s (%d bytes)", a.relpath, a.bytes))
+		}
+	}
+
+	workpool.Run(jobs, len(actions), work, done)
+	prog.Finish()
+
+	if failed > 0 {
+		return logger.FailCode(logger.ExitPartial, "restore-action", fmt.Sprintf("%d of %d files", failed, len(actions)),
+			"Failed to restore files, the snapshot is NOT synced.\n"+
+				"\nPlease fix the errors above and pull again.")
 	}
-	logger.Print(fmt.Sprintf("DONE -- %d files copied, %d files removed", ccount, dcount))
+	log.Print(fmt.Sprintf("DONE -- %d files copied, %d files removed", ccount, dcount))
+	return nil
+}
+
+// Path hashes of the history, in the order of the relative paths.
+func sorted_paths(hist *history.Hist) []string {
+	phashes := hist.PathHashList()
+	sort.Slice(phashes, func(i, j int) bool {
+		return hist.GetRelPath(phashes[i]) < hist.GetRelPath(phashes[j])
+	})
+	return phashes
 }
 
 func calculate_meta_items(hist *history.Hist) (*history.Hist, []int) {
@@ -157,10 +301,10 @@ func calculate_meta_items(hist *history.Hist) (*history.Hist, []int) {
 	return hist, ncrud
 }
 
-func calc_action_items(rem, loc *history.Hist) *history.Hist {
+func calc_action_items(conf *settings.Settings, rem, loc *history.Hist) *history.Hist {
 	// For each path in the root,
 	for _, phash := range loc.PathHashList() {
-		if settings.ShouldIgnore(loc.GetRelPath(phash)) {
+		if conf.ShouldIgnore(loc.GetRelPath(phash)) {
 			loc.SetCrud(phash, "I")
 		} else if !rem.IsPathHash(phash) {
 			// no such file in the remote
@@ -172,7 +316,7 @@ func calc_action_items(rem, loc *history.Hist) *history.Hist {
 	for _, phash := range rem.PathHashList() {
 		// similar local file exists
 		if loc.IsPathHash(phash) {
-			if settings.ShouldIgnore(loc.GetRelPath(phash)) {
+			if conf.ShouldIgnore(loc.GetRelPath(phash)) {
 				loc.SetCrud(phash, "I")
 			} else if rem.GetCrud(phash) == "D" {
 				// the file was set to be deleted in the remote
@@ -191,6 +335,9 @@ func calc_action_items(rem, loc *history.Hist) *history.Hist {
 				}
 				remTarget := rem.GetTarget(phash)
 				loc.SetTarget(phash, remTarget)
+				loc.SetObjectId(phash, rem.GetObjectId(phash))
+				loc.SetCodec(phash, rem.GetCodec(phash))
+				loc.SetBlobSize(phash, rem.GetBlobSize(phash))
 			}
 		} else {
 			// copy everything else that hasn't been deleted in the remote
@@ -198,7 +345,7 @@ func calc_action_items(rem, loc *history.Hist) *history.Hist {
 				loc.SetAction(phash, rem.GetAction(phash))
 				remTarget := rem.GetTarget(phash)
 				loc.SetTarget(phash, remTarget)
-				if settings.ShouldIgnore(rem.GetRelPath(phash)) {
+				if conf.ShouldIgnore(rem.GetRelPath(phash)) {
 					loc.SetCrud(phash, "I")
 				} else {
 					loc.SetCrud(phash, "C")
@@ -209,19 +356,19 @@ func calc_action_items(rem, loc *history.Hist) *history.Hist {
 	return loc
 }
 
-func check_local_modifications(last, curr *history.Hist) {
+func check_local_modifications(conf *settings.Settings, last, curr *history.Hist) error {
 	if last.SnapId == 0 {
-		return
+		return nil
 	}
 	for _, phash := range curr.PathHashList() {
 		relpath := curr.GetRelPath(phash)
-		if settings.ShouldIgnore(relpath) {
+		if conf.ShouldIgnore(relpath) {
 			continue
 		}
 		if !last.IsPathHash(phash) {
 			// 	if PathHash not in LAST,
 			// 	throw error, must shot first before restoring.
-			logger.Error("restore-check-modifications", fmt.Sprintf("C %s", relpath),
+			return logger.Fail("restore-check-modifications", fmt.Sprintf("C %s", relpath),
 				"Local modifications found, please take a snapshot first.")
 		} else {
 			// 	if PathHash in LAST,
@@ -230,31 +377,38 @@ func check_local_modifications(last, curr *history.Hist) {
 			oldFHash := last.GetFileHash(phash)
 			newFHash := curr.GetFileHash(phash)
 			if !fileutils.FileHashSame(oldFHash, newFHash) {
-				logger.Error("restore-check-modifications",
+				return logger.Fail("restore-check-modifications",
 					fmt.Sprintf("U %s\n      (%s =/=> %s)", relpath, oldFHash, newFHash),
 					"\nLocal modifications found, please take a snapshot first.")
 			}
 		}
 	}
+	return nil
+}
+
+type walked struct {
+	fullpath string
+	relpath  string
+	entry    fs.DirEntry
+	filehash string
 }
 
-func walk_root(hist *history.Hist) *history.Hist {
-	rootpath := fileutils.CurrentWD()
+func walk_root(rootpath string, hist *history.Hist, cache *hashcache.Cache, jobs int, log *logger.Logger) (*history.Hist, error) {
 	hist.SetMetaString("PWD", rootpath)
 
-	filepath.WalkDir(rootpath, func(s string, d fs.DirEntry, e error) error {
+	files := []*walked{}
+	err := filepath.WalkDir(rootpath, func(s string, d fs.DirEntry, e error) error {
 		if e != nil {
-			logger.Error("restore-walk-root", rootpath, "Failed to walk root directory.")
-			return e
+			return logger.Fail("restore-walk-root", s, fmt.Sprintf("Failed to walk root directory.\n\n%s", e))
 		}
 
 		// ignore items here
-		if d.Name() == fileutils.GetRootSettingsPath() {
+		if d.Name() == fileutils.GetRootSettingsPath() || d.Name() == fileutils.GetHashCachePath() {
 			return nil
 		}
 
 		// ignore the _.shot directory
-		if d.IsDir() && s == fileutils.ShotPath("") {
+		if d.IsDir() && s == fileutils.ShotDir(rootpath) {
 			return fs.SkipDir
 		}
 
@@ -262,33 +416,50 @@ func walk_root(hist *history.Hist) *history.Hist {
 		if !d.IsDir() {
 			relpath, err := fileutils.CalcRelativePath(rootpath, s)
 			if err != nil {
-				logger.Error("restore-walk-root", s, "Failed to determine relative path.")
-			}
-			fhash, err := fileutils.CalcFileHash(s, d)
-			if err != nil {
-				logger.Error("restore-walk-root", s, "Failed to read file info.")
+				return logger.Fail("restore-walk-root", s, "Failed to determine relative path.")
 			}
-			phash := fileutils.CalcPathHash(relpath)
-
-			hist.AddPath(phash, relpath, d.Name(), fhash)
+			files = append(files, &walked{fullpath: s, relpath: relpath, entry: d})
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return hist
+	// hash the files concurrently, add them in the walk order
+	failed := 0
+	workpool.Run(jobs, len(files), func(i int) error {
+		f := files[i]
+		fhash, err := cache.FileHash(f.fullpath, f.relpath, f.entry)
+		f.filehash = fhash
+		return err
+	}, func(i int, err error) {
+		f := files[i]
+		if err != nil {
+			failed++
+			log.Print(fmt.Sprintf("FAILED -- %s, %s", f.relpath, err))
+			return
+		}
+		phash := fileutils.CalcPathHash(f.relpath)
+		hist.AddPath(phash, f.relpath, f.entry.Name(), f.filehash)
+	})
+
+	if failed > 0 {
+		return nil, logger.FailCode(logger.ExitPartial, "restore-walk-root", fmt.Sprintf("%d files", failed), "Failed to read file info.")
+	}
+
+	return hist, nil
 }
 
-func calc_latest_ssid(remote string, rootname string) int {
-	for i := 1; i < 1000; i++ {
-		if !fileutils.SSExists(i, remote, rootname) {
-			return i - 1
-		}
+func calc_latest_ssid(rem remote.Remote, rootname string) int {
+	snapids := history.SnapIds(rem, rootname)
+	if len(snapids) == 0 {
+		return 0
 	}
-	return 0
+	return snapids[len(snapids)-1]
 }
 
-func prune_empty_dirs() {
-	rootpath := fileutils.CurrentWD()
+func prune_empty_dirs(rootpath string, log *logger.Logger) {
 
 	filepath.WalkDir(rootpath, func(fullpath string, d fs.DirEntry, e error) error {
 		if e != nil {
@@ -300,7 +471,7 @@ func prune_empty_dirs() {
 		if d.IsDir() {
 			files, err := ioutil.ReadDir(fullpath)
 			if err != nil {
-				fmt.Printf("Warning -- failed to list directory: %s, %s\n", fullpath, err)
+				log.Warn(fmt.Sprintf("failed to list directory: %s, %s", fullpath, err))
 				return nil
 			}
 
@@ -310,7 +481,7 @@ func prune_empty_dirs() {
 
 			err = os.Remove(fullpath)
 			if err != nil {
-				fmt.Printf("Warning -- failed to remove empty directory: %s, %s\n", fullpath, err)
+				log.Warn(fmt.Sprintf("failed to remove empty directory: %s, %s", fullpath, err))
 			}
 		}
 		return nil
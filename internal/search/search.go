@@ -0,0 +1,325 @@
+package search
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/diff"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
+	"github.com/akhlakm/Snap_Shot/internal/workpool"
+)
+
+// A path with the snapshots it is in, with the same blob for grep.
+type found struct {
+	relpath string
+	blob    string
+	snapids []int
+}
+
+type match struct {
+	line int
+	text string
+}
+
+// Contents of a blob searched, shared by the snapshots and paths referring to it.
+type searched struct {
+	blob    string
+	codec   string
+	relpath string
+	matches []match
+}
+
+// Paths matching a glob in the snapshots.
+func ExecuteFind() error {
+	args := argparser.GetParser()
+	rem, rootname, err := open_remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	glob, err := args.ReqStr(1, "\nUSAGE: find <glob> [--snap <range>]\n")
+	if err != nil {
+		return err
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		return logger.FailCode(logger.ExitUsage, "find-glob", glob, "Invalid pattern.")
+	}
+
+	hists, err := load_range(rem, rootname, args.GetKeyStr("snap", ""))
+	if err != nil {
+		return err
+	}
+	results := collect(hists, []string{glob}, false)
+	if len(results) == 0 {
+		logger.Print(fmt.Sprintf("No path matches %s.", glob))
+		return nil
+	}
+	for _, f := range results {
+		logger.Print(fmt.Sprintf("%s  (%s)", f.relpath, format_snapids(f.snapids)))
+	}
+	return nil
+}
+
+// Lines of the files matching a regular expression in the snapshots,
+// each blob is read once however many snapshots refer to it.
+func ExecuteGrep() error {
+	args := argparser.GetParser()
+	rem, rootname, err := open_remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	errmsg := "\nUSAGE: grep <pattern> [--snap <range>] [-- <path glob>...]\n"
+	undashed := args.GetUndashed(1)
+	if len(undashed) == 0 {
+		return logger.FailCode(logger.ExitUsage, "required-arg", "not enough arguments", errmsg)
+	}
+	if len(undashed) > 1 {
+		return logger.FailCode(logger.ExitUsage, "grep-args", undashed[1], "Too many arguments, give the path globs after --.\n"+errmsg)
+	}
+	expr := undashed[0]
+	if args.HasFlag("ignore-case") {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return logger.FailCode(logger.ExitUsage, "grep-pattern", undashed[0], fmt.Sprintf("Invalid regular expression.\n\n%s", err))
+	}
+	globs := args.GetDashed()
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return logger.FailCode(logger.ExitUsage, "grep-glob", glob, "Invalid pattern.")
+		}
+	}
+
+	hists, err := load_range(rem, rootname, args.GetKeyStr("snap", ""))
+	if err != nil {
+		return err
+	}
+	results := collect(hists, globs, true)
+
+	// the unique blobs, in the order of their first path
+	blobs := []*searched{}
+	byblob := make(map[string]*searched)
+	for _, f := range results {
+		if _, ok := byblob[f.blob]; ok {
+			continue
+		}
+		hist := hist_of(hists, f.snapids[0])
+		s := &searched{blob: f.blob, codec: hist.GetCodec(fileutils.CalcPathHash(f.relpath)), relpath: f.relpath}
+		byblob[f.blob] = s
+		blobs = append(blobs, s)
+	}
+
+	failed := 0
+	workpool.Run(args.GetKeyInt("jobs", workpool.DefaultJobs), len(blobs), func(i int) error {
+		return grep_blob(rem, blobs[i], re)
+	}, func(i int, err error) {
+		if err != nil {
+			failed++
+			logger.Print(fmt.Sprintf("FAILED -- %s, %s", blobs[i].relpath, err))
+		}
+	})
+
+	nmatch := 0
+	for _, f := range results {
+		s := byblob[f.blob]
+		if len(s.matches) == 0 {
+			continue
+		}
+		nmatch++
+		lines := []string{fmt.Sprintf("%s  (%s)", f.relpath, format_snapids(f.snapids))}
+		for _, m := range s.matches {
+			lines = append(lines, fmt.Sprintf("  %d: %s", m.line, m.text))
+		}
+		logger.Print(strings.Join(lines, "\n"))
+	}
+	logger.Info(fmt.Sprintf("%d blobs searched, %d with matches", len(blobs), nmatch))
+
+	if failed > 0 {
+		return logger.FailCode(logger.ExitPartial, "grep-blob", fmt.Sprintf("%d of %d blobs", failed, len(blobs)),
+			"Failed to read some files of the snapshots, they are not searched.")
+	}
+	if nmatch == 0 {
+		logger.Print(fmt.Sprintf("No file matches %s.", undashed[0]))
+	}
+	return nil
+}
+
+func open_remote() (remote.Remote, string, error) {
+	rem, err := settings.Remote()
+	if err != nil {
+		return nil, "", err
+	}
+	if !remote.Available(rem) {
+		errmsg := "Remote directory does not exist.\n" +
+			"\nMake sure it is mounted or reachable.\n"
+		rem.Close()
+		return nil, "", logger.FailCode(logger.ExitRemote, "search-execute", rem.String(), errmsg)
+	}
+	return rem, settings.RootName(), nil
+}
+
+// Snapshots of a range a..b, a.. or ..b, or a single snapshot, given
+// by their ids or tags. All the snapshots if empty.
+func load_range(rem remote.Remote, rootname string, arg string) ([]*history.Hist, error) {
+	lo, hi := 0, math.MaxInt
+	var err error
+	if arg != "" {
+		a, b, isrange := strings.Cut(arg, "..")
+		if a != "" {
+			if lo, err = tags.ResolveArg(rem, rootname, a); err != nil {
+				return nil, err
+			}
+		}
+		if !isrange {
+			hi = lo
+		} else if b != "" {
+			if hi, err = tags.ResolveArg(rem, rootname, b); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	hists := []*history.Hist{}
+	for _, ssid := range history.SnapIds(rem, rootname) {
+		if ssid < lo || ssid > hi {
+			continue
+		}
+		hist := history.Make(ssid, rem, rootname)
+		if err := hist.Load(); err != nil {
+			return nil, err
+		}
+		hists = append(hists, hist)
+	}
+	if len(hists) == 0 {
+		return nil, logger.Fail("search-range", arg, "No snapshot in the range.\n"+
+			"\nPlease run 'list' to see the snapshots and their tags.")
+	}
+	return hists, nil
+}
+
+// Paths of the files in the snapshots matching one of the globs, or all
+// if none, with the snapshots they are in. Split by blob if byblob.
+func collect(hists []*history.Hist, globs []string, byblob bool) []*found {
+	results := []*found{}
+	index := make(map[string]*found)
+	for _, hist := range hists {
+		for _, phash := range hist.PathHashList() {
+			relpath := hist.GetRelPath(phash)
+			if !diff.Present(hist, phash) || !match_any(globs, relpath) {
+				continue
+			}
+			key := relpath
+			blob := ""
+			if byblob {
+				blob = hist.GetRestorePath(phash)
+				key += "\n" + blob
+			}
+			f, ok := index[key]
+			if !ok {
+				f = &found{relpath: relpath, blob: blob}
+				index[key] = f
+				results = append(results, f)
+			}
+			f.snapids = append(f.snapids, hist.SnapId)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].relpath != results[j].relpath {
+			return results[i].relpath < results[j].relpath
+		}
+		return results[i].snapids[0] < results[j].snapids[0]
+	})
+	return results
+}
+
+// A glob with a slash matches the whole relative path, otherwise the name.
+func match_any(globs []string, relpath string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, glob := range globs {
+		name := relpath
+		if !strings.Contains(glob, "/") {
+			name = path.Base(relpath)
+		}
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hist_of(hists []*history.Hist, ssid int) *history.Hist {
+	for _, hist := range hists {
+		if hist.SnapId == ssid {
+			return hist
+		}
+	}
+	return nil
+}
+
+// Matching lines of a blob, binary blobs are skipped.
+func grep_blob(rem remote.Remote, s *searched, re *regexp.Regexp) error {
+	logger.Trace("grep-blob", s.blob)
+	in, err := fileutils.OpenBlob(rem, s.blob, s.codec)
+	if err != nil {
+		return fmt.Errorf("failed to open the file in the remote: %s", err)
+	}
+	defer in.Close()
+
+	reader := bufio.NewReader(in)
+	head, _ := reader.Peek(8000)
+	if diff.IsBinary(head) {
+		return nil
+	}
+	for n := 1; ; n++ {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			line = strings.TrimRight(line, "\r\n")
+			if re.MatchString(line) {
+				s.matches = append(s.matches, match{line: n, text: line})
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read the file: %s", err)
+		}
+	}
+}
+
+// Snapshot ids with the consecutive ones as ranges, e.g. 1-3, 5
+func format_snapids(snapids []int) string {
+	parts := []string{}
+	for i := 0; i < len(snapids); {
+		j := i
+		for j+1 < len(snapids) && snapids[j+1] == snapids[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", snapids[i], snapids[j]))
+		} else {
+			parts = append(parts, fmt.Sprint(snapids[i]))
+		}
+		i = j + 1
+	}
+	label := "snapshot "
+	if len(snapids) > 1 {
+		label = "snapshots "
+	}
+	return label + strings.Join(parts, ", ")
+}
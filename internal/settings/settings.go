@@ -2,82 +2,330 @@ package settings
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
-	"log"
+	"io"
 	"os"
-	"snap/internal/fileutils"
-	"snap/internal/logger"
 	"strconv"
 	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/codec"
+	"github.com/akhlakm/Snap_Shot/internal/crypt"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
 )
 
 type Settings struct {
 	root    map[string]string
 	remotes map[string]string
+	dir     string
 	file    string
 	ignores []string
+	// messages of the reads and writes
+	log *logger.Logger
 }
 
+// settings of the current directory, for the commands
 var initialized *Settings = nil
 
+const default_compress_min int64 = 512
+
+// New settings of a root directory, written by Write.
+func New(dir string, rootname string, remotepath string) *Settings {
+	s := &Settings{
+		root:    make(map[string]string),
+		remotes: make(map[string]string),
+		dir:     dir,
+		file:    fileutils.PathJoin(dir, fileutils.GetRootSettingsPath()),
+		ignores: []string{},
+		log:     logger.Default(),
+	}
+	s.root["name"] = rootname
+	s.root["snapshot"] = "0"
+	s.remotes["default"] = normalize_remote(remotepath)
+	return s
+}
+
+// Read the settings file of the root directory and check the values,
+// so that the getters cannot fail.
+func Open(dir string) (*Settings, error) {
+	s := &Settings{
+		root:    make(map[string]string),
+		remotes: make(map[string]string),
+		dir:     dir,
+		file:    fileutils.PathJoin(dir, fileutils.GetRootSettingsPath()),
+		log:     logger.Default(),
+	}
+	if !fileutils.FileExists(s.file) {
+		return nil, logger.Fail("settings-load", s.file,
+			"No settings file found.\n"+
+				"\nPlease run 'init' with a rootname (a name for the current project directory),\n"+
+				"and a path to a remote folder to backup to.\n"+
+				"\nUSAGE: init <rootname> <remote folder path>\n")
+	}
+	if err := s.read(); err != nil {
+		return nil, logger.Fail("settings-load", s.file, fmt.Sprintf("Failed to read the settings file.\n\n%s", err))
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Open the settings of the root of dir, the nearest parent directory
+// with a settings file if dir is not a root itself.
+func Find(dir string) (*Settings, error) {
+	root, ok := fileutils.FindRoot(dir)
+	if !ok {
+		root = dir
+	}
+	return Open(root)
+}
+
+// Create the settings of the current directory.
 func Create(rootname string, remotepath string) {
+	initialized = New(fileutils.CurrentWD(), rootname, remotepath)
+}
+
+// Read the settings of the root of the current directory.
+func Load() error {
+	s, err := Find(fileutils.CurrentWD())
+	if err != nil {
+		return err
+	}
+	initialized = s
+	return nil
+}
+
+// Settings of the current directory, loaded or created.
+func Current() *Settings {
+	return initialized
+}
+
+// Whether the current directory is in a root.
+func Exists() bool {
+	_, ok := fileutils.FindRoot(fileutils.CurrentWD())
+	return ok
+}
+
+// Open the default remote of the current directory.
+func Remote() (remote.Remote, error) {
+	return initialized.Remote()
+}
+
+func UnlockRemote(rem remote.Remote) (*crypt.Keys, error) {
+	return initialized.UnlockRemote(rem)
+}
+
+func Passphrase() ([]byte, error) {
+	return initialized.Passphrase()
+}
+
+func SetEncryption(keyfile string) {
+	initialized.SetEncryption(keyfile)
+}
+
+func RootName() string {
+	return initialized.RootName()
+}
+
+func LastSnapshot() int {
+	return initialized.LastSnapshot()
+}
+
+func Write() error {
 	if initialized == nil {
-		initialized = &Settings{
-			root:    make(map[string]string),
-			remotes: make(map[string]string),
-			file:    fileutils.GetRootSettingsPath(),
-			ignores: []string{},
+		return logger.Fail("settings-write", "", "Settings not initialized")
+	}
+	return initialized.Write()
+}
+
+// Print the messages of the later writes with log.
+func (s *Settings) SetLog(log *logger.Logger) {
+	s.log = log
+}
+
+// Directory of the root, the paths of its files are relative to it.
+func (s *Settings) Dir() string {
+	return s.dir
+}
+
+func (s *Settings) DefaultRemote() string {
+	return s.remotes["default"]
+}
+
+// Open the default remote, decrypted if the root was initialized with encryption.
+func (s *Settings) Remote() (remote.Remote, error) {
+	return s.OpenRemote(s.DefaultRemote())
+}
+
+// Open a remote of the root, decrypted if the root was initialized with encryption.
+func (s *Settings) OpenRemote(location string) (remote.Remote, error) {
+	rem, err := remote.Open(location)
+	if err != nil {
+		return nil, logger.FailCode(logger.ExitRemote, "settings-remote", location,
+			fmt.Sprintf("Cannot open the default remote.\n\n%s", err))
+	}
+
+	if !s.Encrypted() {
+		if remote.Exists(rem, fileutils.KeyInfoPath()) {
+			rem.Close()
+			return nil, logger.Fail("settings-remote", location,
+				"The remote is encrypted, but the root is not initialized with encryption.\n"+
+					"\nPlease rerun 'init' with --encrypt.")
 		}
+		return rem, nil
 	}
 
-	initialized.root["name"] = rootname
-	initialized.root["snapshot"] = "0"
-	initialized.remotes["default"] = fileutils.PathNormalize(remotepath)
+	if !remote.Available(rem) {
+		// never fall back to writing unencrypted
+		rem.Close()
+		return nil, logger.FailCode(logger.ExitRemote, "settings-remote", location,
+			"Remote directory does not exist.\n"+
+				"\nMake sure it is mounted or reachable.\n")
+	}
+	keys, err := s.UnlockRemote(rem)
+	if err != nil {
+		rem.Close()
+		return nil, logger.Fail("settings-remote", location,
+			fmt.Sprintf("Cannot unlock the encrypted remote.\n\n%s", err))
+	}
+	return remote.NewEncrypted(rem, keys), nil
 }
 
-func DefaultRemote() string {
-	if _, ok := initialized.remotes["default"]; !ok {
-		logger.Error("settings-default-remote", "",
-			"No 'default' remote exists in the settings file.\n"+
-				"\nPlease make sure the remotes section contains a default field to a remote path."+
-				"\nOr, run init again.")
+// Unwrap the encryption key stored in the remote with the passphrase.
+func (s *Settings) UnlockRemote(rem remote.Remote) (*crypt.Keys, error) {
+	in, err := rem.Get(fileutils.KeyInfoPath())
+	if err != nil {
+		return nil, fmt.Errorf("no encryption key in the remote: %s", err)
+	}
+	defer in.Close()
+	info, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
 	}
+	passphrase, err := s.Passphrase()
+	if err != nil {
+		return nil, err
+	}
+	return crypt.OpenKeyInfo(info, passphrase)
+}
 
-	return initialized.remotes["default"]
+// Whether the remote data of the root is encrypted.
+// [ROOT] encrypt = yes
+func (s *Settings) Encrypted() bool {
+	return strings.ToLower(s.root["encrypt"]) == "yes"
 }
 
-func RootName() string {
-	if _, ok := initialized.root["name"]; !ok {
-		logger.Error("settings-root-name", "",
-			"No root name in the settings file.\n"+
-				"\nPlease make sure the root section contains a name field for the current directory."+
-				"\nOr, run init again.")
+// Passphrase of the encryption key, the contents of the key file
+// if set in the settings, or the SNAP_PASSPHRASE environment variable.
+// [ROOT] keyfile = /path/to/keyfile
+func (s *Settings) Passphrase() ([]byte, error) {
+	if keyfile, ok := s.root["keyfile"]; ok && keyfile != "" {
+		data, err := os.ReadFile(keyfile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the key file: %s", err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
 	}
-	return initialized.root["name"]
+	if passphrase := os.Getenv("SNAP_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, fmt.Errorf("no passphrase, please set SNAP_PASSPHRASE or a keyfile in the root settings")
 }
 
-func LastSnapshot() int {
-	if _, ok := initialized.root["snapshot"]; !ok {
-		logger.Error("settings-last-snapshot", "",
-			"No snapshot number in the settings file.\n"+
-				"\nPlease make sure the settings file contains a valid snapshot number."+
-				"\nOr, run init again.")
+// Enable the encryption of the root, with an optional key file.
+func (s *Settings) SetEncryption(keyfile string) {
+	s.root["encrypt"] = "yes"
+	if keyfile != "" {
+		s.root["keyfile"] = keyfile
 	}
+}
 
-	ss, err := strconv.Atoi(initialized.root["snapshot"])
-	if err != nil {
-		logger.Error("settings-last-snapshot", "",
-			"Invalid snapshot number in the settings file.\n"+
-				"\nPlease make sure the settings file contains a valid snapshot number."+
-				"\nOr, run init again.")
+// Urls are kept verbatim, local paths use forward slashes
+func normalize_remote(location string) string {
+	if remote.IsURL(location) {
+		return location
 	}
+	return fileutils.PathNormalize(location)
+}
+
+func (s *Settings) RootName() string {
+	return s.root["name"]
+}
 
+func (s *Settings) LastSnapshot() int {
+	ss, _ := strconv.Atoi(s.root["snapshot"])
 	return ss
 }
 
-func ignore_patterns() []string {
+func (s *Settings) SetLastSnapshot(ssid int) {
+	s.root["snapshot"] = strconv.Itoa(ssid)
+}
+
+// Store new files in the content addressed object store of the remote,
+// instead of the files/ tree of the root.
+// [ROOT] store = objects
+func (s *Settings) ObjectStore() bool {
+	store, ok := s.root["store"]
+	if !ok {
+		return false
+	}
+	return strings.ToLower(store) == "objects"
+}
+
+// How the file contents are compared between snapshots.
+// stat compares size and modification time only,
+// sha256 records a content digest for every file.
+// [ROOT] hash = stat|sha256
+func (s *Settings) HashMode() string {
+	mode, ok := s.root["hash"]
+	if !ok {
+		return "stat"
+	}
+	return strings.ToLower(mode)
+}
+
+// Compression of the new blobs uploaded to the remote.
+// [ROOT] compress = zstd|gzip|none
+func (s *Settings) Compression() string {
+	comp, _ := codec.Parse(s.root["compress"])
+	return comp
+}
+
+// Files smaller than this are stored uncompressed.
+// [ROOT] compress_min = 512
+func (s *Settings) CompressMin() int64 {
+	value, ok := s.root["compress_min"]
+	if !ok {
+		return default_compress_min
+	}
+	size, _ := strconv.ParseInt(value, 10, 64)
+	return size
+}
+
+// Extensions of the files stored uncompressed, replaces the defaults.
+// [ROOT] compress_skip = .zip, .jpg, .mp4
+func (s *Settings) CompressSkip() []string {
+	value, ok := s.root["compress_skip"]
+	if !ok {
+		return codec.DefaultSkip
+	}
+	skip := []string{}
+	for _, ext := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		skip = append(skip, ext)
+	}
+	return skip
+}
+
+func (s *Settings) ignore_patterns() []string {
 	uncomment := []string{}
-	for _, v := range initialized.ignores {
+	for _, v := range s.ignores {
 		if strings.Contains(v, "#") {
 			parts := strings.Split(v, "#")
 			uncomment = append(uncomment, strings.TrimSpace(parts[0]))
@@ -89,9 +337,9 @@ func ignore_patterns() []string {
 	return uncomment
 }
 
-func ShouldIgnore(relpath string) bool {
+func (s *Settings) ShouldIgnore(relpath string) bool {
 	nrel := fileutils.PathNormalize(relpath)
-	for _, pattern := range ignore_patterns() {
+	for _, pattern := range s.ignore_patterns() {
 		if fileutils.PathMatch(pattern, nrel) {
 			// fmt.Printf("Ignore (%s): %s\n", pattern, nrel)
 			return true
@@ -100,48 +348,58 @@ func ShouldIgnore(relpath string) bool {
 	return false
 }
 
-func SetLastSnapshot(ssid int) {
-	initialized.root["snapshot"] = strconv.Itoa(ssid)
-}
-
-func Write() {
-	if initialized != nil {
-		initialized.write()
-	} else {
-		logger.Error("settings-write", "", "Settings not initialized")
+func (s *Settings) validate() error {
+	if _, ok := s.remotes["default"]; !ok {
+		return logger.Fail("settings-default-remote", "",
+			"No 'default' remote exists in the settings file.\n"+
+				"\nPlease make sure the remotes section contains a default field to a remote path."+
+				"\nOr, run init again.")
 	}
-}
-
-func Exists() bool {
-	file := fileutils.GetRootSettingsPath()
-	return fileutils.FileExists(file)
-}
-
-func Load() {
-	if initialized == nil {
-		initialized = &Settings{
-			root:    make(map[string]string),
-			remotes: make(map[string]string),
-			file:    fileutils.GetRootSettingsPath(),
-		}
+	if _, ok := s.root["name"]; !ok {
+		return logger.Fail("settings-root-name", "",
+			"No root name in the settings file.\n"+
+				"\nPlease make sure the root section contains a name field for the current directory."+
+				"\nOr, run init again.")
 	}
-	if fileutils.FileExists(initialized.file) {
-		initialized.read()
-	} else {
-		logger.Error("settings-load", initialized.file,
-			"No settings file found.\n"+
-				"\nPlease run 'init' with a rootname (a name for the current project directory),\n"+
-				"and a path to a remote folder to backup to.\n"+
-				"\nUSAGE: init <rootname> <remote folder path>\n")
+	if _, ok := s.root["snapshot"]; !ok {
+		return logger.Fail("settings-last-snapshot", "",
+			"No snapshot number in the settings file.\n"+
+				"\nPlease make sure the settings file contains a valid snapshot number."+
+				"\nOr, run init again.")
 	}
+	if _, err := strconv.Atoi(s.root["snapshot"]); err != nil {
+		return logger.Fail("settings-last-snapshot", "",
+			"Invalid snapshot number in the settings file.\n"+
+				"\nPlease make sure the settings file contains a valid snapshot number."+
+				"\nOr, run init again.")
+	}
+	if mode, ok := s.root["hash"]; ok && strings.ToLower(mode) != "stat" && strings.ToLower(mode) != "sha256" {
+		return logger.Fail("settings-hash-mode", mode,
+			"Unsupported hash mode in the settings file.\n"+
+				"\nPlease set the hash field of the root section to one of: stat, sha256.")
+	}
+	if _, err := codec.Parse(s.root["compress"]); err != nil {
+		return logger.Fail("settings-compress", s.root["compress"],
+			"Unsupported compression in the settings file.\n"+
+				"\nPlease set the compress field of the root section to one of: zstd, gzip, none.\n"+
+				err.Error())
+	}
+	if value, ok := s.root["compress_min"]; ok {
+		if size, err := strconv.ParseInt(value, 10, 64); err != nil || size < 0 {
+			return logger.Fail("settings-compress-min", value,
+				"Invalid compress_min in the settings file.\n"+
+					"\nPlease set it to a size in bytes.")
+		}
+	}
+	return nil
 }
 
-func (s *Settings) write() {
-	logger.Trace("settings-write", s.file)
+func (s *Settings) Write() error {
+	s.log.Trace("settings-write", s.file)
 	file, err := os.OpenFile(s.file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 
 	if err != nil {
-		log.Fatalf("failed creating file: %s", err)
+		return logger.Fail("settings-write", s.file, fmt.Sprintf("Failed to write the settings file.\n\n%s", err))
 	}
 	defer file.Close()
 
@@ -165,7 +423,7 @@ func (s *Settings) write() {
 	datawriter.WriteString("\n[IGNORES]\n")
 
 	// new settings file
-	if !Exists() {
+	if !fileutils.FileExists(s.file) {
 		datawriter.WriteString("# Add one ignore pattern per line.\n")
 		datawriter.WriteString("# Comments will be retained only if it comes after a pattern.\n")
 		datawriter.WriteString(".git # Ignore git repository\n")
@@ -174,68 +432,55 @@ func (s *Settings) write() {
 		datawriter.WriteString(fmt.Sprintf("%s\n", v))
 	}
 
-	datawriter.Flush()
-	logger.Done("settings-write", s.file)
+	if err := datawriter.Flush(); err != nil {
+		return logger.Fail("settings-write", s.file, fmt.Sprintf("Failed to write the settings file.\n\n%s", err))
+	}
+	s.log.Done("settings-write", s.file)
+	return nil
 }
 
-func (s *Settings) read() {
-	logger.Trace("read-settings", s.file)
-	if fileutils.FileExists(s.file) {
-		file, err := os.Open(s.file)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer file.Close()
+func (s *Settings) read() error {
+	s.log.Trace("read-settings", s.file)
+	file, err := os.Open(s.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-		scanner := bufio.NewScanner(file)
-		section := "MAIN"
+	scanner := bufio.NewScanner(file)
+	section := "MAIN"
 
-		for scanner.Scan() {
-			line := scanner.Text()
-			line = strings.TrimSpace(line)
-			n := len(line)
-			if n == 0 || line[0] == '#' {
-				continue
-			}
-			if line[0] == '[' && line[n-1] == ']' {
-				section = line[1 : n-1]
-				section = strings.ToUpper(section)
-			} else if strings.Contains(line, "=") {
-				parts := strings.Split(line, "=")
-				k := strings.TrimSpace(parts[0])
-				v := strings.TrimSpace(parts[1])
-				k = strings.ToLower(k)
-				if section == "ROOT" {
-					s.root[k] = v
-				} else if section == "REMOTES" {
-					s.remotes[k] = fileutils.PathNormalize(v)
-				}
-			} else if section == "IGNORES" {
-				s.ignores = append(s.ignores, line)
-			}
+	for scanner.Scan() {
+		line := scanner.Text()
+		line = strings.TrimSpace(line)
+		n := len(line)
+		if n == 0 || line[0] == '#' {
+			continue
 		}
-
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
+		if line[0] == '[' && line[n-1] == ']' {
+			section = line[1 : n-1]
+			section = strings.ToUpper(section)
+		} else if strings.Contains(line, "=") {
+			parts := strings.SplitN(line, "=", 2)
+			k := strings.TrimSpace(parts[0])
+			v := strings.TrimSpace(parts[1])
+			k = strings.ToLower(k)
+			if section == "ROOT" {
+				s.root[k] = v
+			} else if section == "REMOTES" {
+				s.remotes[k] = normalize_remote(v)
+			}
+		} else if section == "IGNORES" {
+			s.ignores = append(s.ignores, line)
 		}
+	}
 
-		// Sanity check
-		// if _, ok := s.root["name"]; !ok {
-		// 	fmt.Print(s.root)
-		// 	logger.Error("read-settings", s.file, "No root 'name' exists in the settings file.")
-		// }
-		// if _, ok := s.root["snapshot"]; !ok {
-		// 	logger.Error("read-settings", s.file, "No root 'snapshot' exists in the settings file.")
-		// }
-		// if _, ok := s.remotes["default"]; !ok {
-		// 	logger.Error("read-settings", s.file, "No 'default' remote exists in the settings file.")
-		// }
-
-		logger.Done("read-settings", "")
-	} else {
-		logger.Error("read-settings", s.file, "Directory does not contain a settings file.")
+	if err := scanner.Err(); err != nil {
+		return err
 	}
 
+	s.log.Done("read-settings", "")
+	return nil
 }
 
 // read_settings():
@@ -0,0 +1,81 @@
+package shot
+
+import (
+	"fmt"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/report"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/workpool"
+	"github.com/akhlakm/Snap_Shot/repo"
+)
+
+// Take a snapshot of the root, a dry run unless --go or --resume.
+func Execute() error {
+	args := argparser.GetParser()
+	r, err := repo.Open(settings.Current().Dir(), "")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	r.SetOutput(logger.Default())
+
+	// paths are relative to the working directory, which can be below the root
+	paths := []string{}
+	for _, arg := range args.GetRest(1) {
+		relpath, err := fileutils.RootRelPath(r.Root(), arg)
+		if err != nil {
+			return logger.FailCode(logger.ExitUsage, "snapshot-path", arg, err.Error())
+		}
+		paths = append(paths, relpath)
+	}
+
+	// --dry has a higher priority over --go
+	dry := args.HasFlag("dry")
+	resume := !dry && args.HasFlag("resume")
+	committed := resume || !dry && args.HasFlag("go")
+	shot, err := r.PrepareSnapshot(repo.SnapshotOptions{
+		Jobs:    args.GetKeyInt("jobs", workpool.DefaultJobs),
+		Message: args.GetKeyStr("message", ""),
+		DryRun:  !committed,
+		Resume:  resume,
+		Paths:   paths,
+	})
+	if err != nil {
+		return err
+	}
+	defer shot.Close()
+
+	ignores := args.HasFlag("ignores")
+	// the machine readable result is printed once committed
+	if !report.Machine() {
+		logger.Print("\nChanges to commit:\n")
+		report.PrintChanges(*shot.Snapshot(ignores), r.Name(), ignores)
+	}
+
+	if id := shot.Interrupted(); id > 0 && !resume {
+		logger.Print(fmt.Sprintf("\nSnapshot %d was interrupted before it was committed.", id))
+		logger.Print("Please run 'shot --resume' to finish it, the files uploaded so far are reused.")
+	}
+
+	if committed {
+		if err := shot.Commit(); err != nil {
+			return err
+		}
+	} else {
+		logger.Print(fmt.Sprintf("\nDry run %d > %d. Snapshot is NOT committed.", shot.Last(), shot.SnapId()))
+		logger.Print("Please specify --go to commit the changes.")
+	}
+
+	if !report.Machine() {
+		return nil
+	}
+	return report.PrintResult(report.Result{
+		Command:   "shot",
+		Committed: committed,
+		Last:      shot.Last(),
+		Snapshot:  *shot.Snapshot(ignores),
+	})
+}
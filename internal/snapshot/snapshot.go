@@ -5,108 +5,508 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
-	"snap/internal/argparser"
-	"snap/internal/fileutils"
-	"snap/internal/history"
-	"snap/internal/logger"
-	"snap/internal/settings"
+	"sort"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/codec"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/hashcache"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/lock"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/progress"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/workpool"
 )
 
-func Execute() {
-	args := argparser.GetParser()
-	remote := settings.DefaultRemote()
-	rootname := settings.RootName()
+// Options of a snapshot.
+type Options struct {
+	Jobs    int
+	Message string
+	// upload and publish the snapshot, a dry run otherwise
+	Commit bool
+	// finish the interrupted snapshot, implies Commit
+	Resume bool
+	// only walk the files under these paths relative to the root,
+	// the others are kept as in the last snapshot
+	Paths []string
+	// nothing is written to the root directory, not even the hash cache
+	ReadOnly bool
+	// messages of the snapshot, the logger of the process if nil
+	Log *logger.Logger
+}
+
+// Snapshot of a root directory, compared with the last one.
+// Holds the lock of the root when committing, until closed.
+type Shot struct {
+	// the new snapshot
+	Hist *history.Hist
+	// the last snapshot synced
+	Last int
+	// journal of an interrupted commit, nil if none
+	Pending *history.Hist
+
+	dir  string
+	conf *settings.Settings
+	rem  remote.Remote
+	opts Options
+	lock *lock.Lock
+	log  *logger.Logger
+}
+
+// Walk the root directory and compare it with the last snapshot synced.
+// Nothing is uploaded until committed.
+func Prepare(dir string, conf *settings.Settings, rem remote.Remote, opts Options) (*Shot, error) {
+	rootname := conf.RootName()
+	shot := &Shot{dir: dir, conf: conf, rem: rem, opts: opts, log: opts.Log}
+	if shot.log == nil {
+		shot.log = logger.Default()
+	}
+	if opts.Jobs < 1 {
+		shot.opts.Jobs = workpool.DefaultJobs
+	}
+	shot.opts.Paths = scope_paths(opts.Paths)
+
+	// the last snapshot and the new id must not change until committed
+	if opts.Commit || opts.Resume {
+		rootlock, err := lock.Acquire(rem, rootname, "shot", shot.log)
+		if err != nil {
+			return nil, err
+		}
+		shot.lock = rootlock
+	}
+
+	if err := shot.prepare(); err != nil {
+		shot.Close()
+		return nil, err
+	}
+	return shot, nil
+}
+
+func (shot *Shot) prepare() error {
+	rem := shot.rem
+	rootname := shot.conf.RootName()
 
 	// load the last ss
-	lastss := settings.LastSnapshot()
-	lastHistory := history.Make(lastss, remote, rootname)
-	if lastss > 0 && !fileutils.SSExists(lastss, remote, rootname) {
+	lastss := shot.conf.LastSnapshot()
+	lastHistory := history.Make(lastss, rem, rootname)
+	lastHistory.Log = shot.log
+	if lastss > 0 && !fileutils.SSExists(lastss, rem, rootname) {
 
-		if !fileutils.DirExists(remote) {
+		if !remote.Available(rem) {
 			errmsg := "Remote directory does not exist.\n" +
 				"\nMake sure it is mounted.\n"
-			logger.Error("snapshot-execute", remote, errmsg)
+			return logger.FailCode(logger.ExitRemote, "snapshot-execute", rem.String(), errmsg)
 		}
 
-		logger.Error("snapshot-load", fmt.Sprint(lastss),
+		return logger.Fail("snapshot-load", fmt.Sprint(lastss),
 			"Last snapshot does not exist in remote.\n"+
 				"\nRoot settings suggest existence of previous snapshots.\n"+
 				"Please rerun 'init' if needed, or run 'list' to see the available snapshots in the remote.")
 	}
 
-	lastHistory.Load()
-	// lastHistory.Print()
+	if err := lastHistory.Load(); err != nil {
+		return err
+	}
+
+	pending, err := history.LoadPending(rem, rootname, shot.log)
+	if err != nil {
+		return err
+	}
 
-	// new history
-	newss := calc_new_ssid(remote, rootname)
-	newHistory := history.Make(newss, remote, rootname)
-	newHistory = walk_root(newHistory)
-	newHistory = compare(lastHistory, newHistory)
+	// new history, an interrupted commit keeps its id, its blobs are reused
+	newss := calc_new_ssid(rem, rootname)
+	if pending != nil && shot.opts.Resume {
+		newss = pending.SnapId
+	}
+	newHistory := history.Make(newss, rem, rootname)
+	newHistory.Log = shot.log
+	cache := hashcache.Load(fileutils.PathJoin(shot.dir, fileutils.GetHashCachePath()), shot.conf.HashMode(), shot.log)
+	cache.Limit(shot.opts.Paths)
+	newHistory, err = walk_root(shot.dir, shot.opts.Paths, newHistory, cache, shot.opts.Jobs, shot.log)
+	if err != nil {
+		return err
+	}
+	if !shot.opts.ReadOnly {
+		cache.Write()
+	}
+	newHistory = compare(shot.conf, lastHistory, newHistory, shot.opts.Paths)
 	newHistory = calculate_meta_items(newHistory)
 
-	if args.HasFlag("--ignores") || args.HasFlag("-i") {
-		newHistory.PrintCrud("I")
+	// a resumed commit keeps its message unless a new one is given
+	message := shot.opts.Message
+	if message == "" && pending != nil && shot.opts.Resume && pending.GetMeta("DESC") != "<none>" {
+		message = pending.GetMeta("DESC")
+	}
+	if message != "" {
+		// shot files are line based
+		newHistory.SetMetaString("DESC", strings.Join(strings.Fields(message), " "))
 	}
 
-	logger.Print("\nChanges to commit:\n")
-	newHistory.Print()
+	shot.Hist = newHistory
+	shot.Last = lastss
+	shot.Pending = pending
+	return nil
+}
 
-	if args.HasFlag("--dry") || args.HasFlag("-n") {
-		// --dry has a higher priority over --go
-		logger.Print(fmt.Sprintf("\nDry run %d > %d. Snapshot is NOT committed.", lastss, newss))
-		logger.Print("Please specify --go to commit the changes.")
-	} else if args.HasFlag("--go") || args.HasFlag("-go") {
-		perform_actions(newHistory)
-		newHistory.Write()
-		newHistory.MakeReadOnly()
-		settings.SetLastSnapshot(newHistory.SnapId)
-		settings.Write()
-	} else {
-		logger.Print(fmt.Sprintf("\nDry run %d > %d. Snapshot is NOT committed.", lastss, newss))
-		logger.Print("Please specify --go to commit the changes.")
+// Upload the files and publish the snapshot, it becomes the last one synced.
+func (shot *Shot) Commit() error {
+	if shot.lock == nil {
+		return logger.Fail("snapshot-commit", fmt.Sprint(shot.Hist.SnapId),
+			"The snapshot was prepared as a dry run, nothing is committed.")
+	}
+	rem := shot.rem
+	rootname := shot.conf.RootName()
+	pending := shot.Pending
+
+	if pending != nil && !shot.opts.Resume {
+		return logger.Fail("snapshot-pending", fmt.Sprint(pending.SnapId),
+			"An interrupted snapshot is pending, nothing is committed.\n"+
+				"\nPlease run 'shot --resume' to finish it first.")
+	}
+	if shot.opts.Resume && pending == nil {
+		shot.log.Print("\nNo interrupted snapshot to resume, committing a new one.")
+	}
+	clean_tmp_files(rem, rootname, shot.log)
+
+	// journal first, the shot file is published only when all the blobs are in place.
+	// It lists the keys of the blobs to upload, so prune and verify keep them.
+	assign_codecs(shot.conf, shot.Hist)
+	if shot.conf.ObjectStore() {
+		if err := assign_object_ids(shot.dir, shot.Hist, shot.opts.Jobs, shot.log); err != nil {
+			return err
+		}
+	}
+	if err := shot.Hist.WritePending(); err != nil {
+		return err
+	}
+	if err := perform_actions(shot.dir, shot.conf, shot.Hist, pending, shot.opts.Jobs, shot.log); err != nil {
+		return err
+	}
+	if err := shot.lock.Check(); err != nil {
+		return err
+	}
+	if err := shot.Hist.Write(); err != nil {
+		return err
 	}
+	shot.Hist.MakeReadOnly()
+	if err := history.ClearPending(rem, rootname); err != nil {
+		shot.log.Warn(fmt.Sprintf("failed to remove the pending snapshot file, %s", err))
+	}
+	shot.conf.SetLastSnapshot(shot.Hist.SnapId)
+	return shot.conf.Write()
+}
 
+// Release the lock of the root, if held.
+func (shot *Shot) Close() {
+	if shot.lock != nil {
+		shot.lock.Release()
+	}
 }
 
-func perform_actions(hist *history.Hist) {
-	count := 0
-	rootpath := fileutils.CurrentWD()
-	for phash := range hist.RelPath {
+type upload struct {
+	phash    string
+	relpath  string
+	srcpath  string
+	filehash string
+	codec    string
+	dstpath  string
+	bytes    int64
+	stored   int64 // size of the blob in the remote
+	dedup    bool
+	resumed  bool
+	// the files with the same object, uploaded once with this one
+	same []*upload
+}
+
+// Decide the compression of the files to upload.
+func assign_codecs(conf *settings.Settings, hist *history.Hist) {
+	compression := conf.Compression()
+	compressMin := conf.CompressMin()
+	compressSkip := conf.CompressSkip()
+	for _, phash := range hist.PathHashList() {
+		crud := hist.GetCrud(phash)
+		if crud != "C" && crud != "U" {
+			continue
+		}
+		size := fileutils.FileHashSize(hist.GetFileHash(phash))
+		if codec.ShouldCompress(compression, hist.GetRelPath(phash), size, compressMin, compressSkip) {
+			hist.SetCodec(phash, compression)
+		} else {
+			hist.SetCodec(phash, codec.None)
+		}
+	}
+}
+
+// Object ids of the files to upload to the object store, digests of
+// their contents. The files are read concurrently unless already hashed.
+func assign_object_ids(rootpath string, hist *history.Hist, jobs int, log *logger.Logger) error {
+	phashes := []string{}
+	for _, phash := range sorted_paths(hist) {
 		crud := hist.GetCrud(phash)
 		if crud == "C" || crud == "U" {
-			// copy file to remote
-			relpath := hist.GetRelPath(phash)
-			srcpath := fileutils.PathJoin(rootpath, relpath)
-			dstpath := hist.GetBackupPath(phash)
+			phashes = append(phashes, phash)
+		}
+	}
+
+	objectids := make([]string, len(phashes))
+	failed := 0
+	workpool.Run(jobs, len(phashes), func(i int) error {
+		srcpath := fileutils.PathJoin(rootpath, hist.GetRelPath(phashes[i]))
+		if !fileutils.FileExists(srcpath) {
+			return fmt.Errorf("file does not exists")
+		}
+		var err error
+		objectids[i], err = calc_object_id(srcpath, hist.GetFileHash(phashes[i]))
+		if err != nil {
+			return fmt.Errorf("failed to read file contents: %s", err)
+		}
+		return nil
+	}, func(i int, err error) {
+		if err != nil {
+			failed++
+			log.Print(fmt.Sprintf("FAILED -- %s, %s", hist.GetRelPath(phashes[i]), err))
+			return
+		}
+		hist.SetObjectId(phashes[i], objectids[i])
+	})
+
+	if failed > 0 {
+		return logger.FailCode(logger.ExitPartial, "snapshot-objectid", fmt.Sprintf("%d of %d files", failed, len(phashes)),
+			"Failed to read files, the snapshot is NOT committed.\n"+
+				"\nPlease fix the errors above and retry.")
+	}
+	return nil
+}
+
+// Upload the created and updated files. The blobs of the pending
+// snapshot of an interrupted commit are reused if the files are unchanged.
+// The files with the same object id, assigned beforehand, are uploaded once.
+func perform_actions(rootpath string, conf *settings.Settings, hist *history.Hist, pending *history.Hist, jobs int, log *logger.Logger) error {
+	count := 0
+	dedup := 0
+	resumed := 0
+	objectstore := conf.ObjectStore()
+
+	total := 0
+	uploads := []*upload{}
+	bykey := make(map[string]*upload)
+	for _, phash := range sorted_paths(hist) {
+		crud := hist.GetCrud(phash)
+		if crud != "C" && crud != "U" {
+			continue
+		}
+		relpath := hist.GetRelPath(phash)
+		u := &upload{
+			phash:    phash,
+			relpath:  relpath,
+			srcpath:  fileutils.PathJoin(rootpath, relpath),
+			filehash: hist.GetFileHash(phash),
+			codec:    hist.GetCodec(phash),
+			dstpath:  hist.GetBackupPath(phash),
+		}
+		total++
+		if first, ok := bykey[u.dstpath]; ok {
+			first.same = append(first.same, u)
+			continue
+		}
+		bykey[u.dstpath] = u
+		uploads = append(uploads, u)
+	}
+
+	var planned int64
+	for _, u := range uploads {
+		planned += fileutils.FileHashSize(u.filehash)
+		for _, same := range u.same {
+			planned += fileutils.FileHashSize(same.filehash)
+		}
+	}
+	prog := progress.Start(log, "shot", total, planned)
+	failed := 0
+
+	work := func(i int) error {
+		u := uploads[i]
+		// copy file to remote
+		if !fileutils.FileExists(u.srcpath) {
+			return fmt.Errorf("file does not exists")
+		}
 
-			if !fileutils.FileExists(srcpath) {
-				logger.Error("snapshot-copyfile", srcpath, "File does not exists.")
+		if objectstore {
+			if info, err := hist.Remote.Stat(u.dstpath); err == nil && !info.IsDir {
+				// same contents already stored by an earlier snapshot or another root
+				u.dedup = true
+				u.stored = info.Size
+				return nil
 			}
-			logger.Trace("snapshot-copyfile", dstpath)
-			// fmt.Println("copy :", srcpath, "==>", dstpath)
-			cpbytes, err := fileutils.CopyFile(srcpath, dstpath)
-			if err != nil {
-				fmt.Println(err)
-				logger.Error("snapshot-copyfile", srcpath, "Failed to copy file.")
+		}
+		if already_uploaded(pending, u, hist.Remote, u.dstpath) {
+			u.resumed = true
+			return nil
+		}
+		log.Trace("snapshot-copyfile", u.dstpath)
+		var err error
+		u.bytes, u.stored, err = fileutils.Upload(hist.Remote, u.srcpath, u.dstpath, u.codec, prog)
+		if err != nil {
+			return fileutils.CopyError(hist.Remote, err)
+		}
+
+		// we know how many bytes should have been copied
+		if fileutils.FileSizeSame(u.filehash, u.bytes) {
+			// make file read only
+			if err = hist.Remote.ReadOnly(u.dstpath); err != nil {
+				log.Warn(fmt.Sprintf("failed to set read-only attribute of %s.", u.relpath))
 			}
+		}
+		return nil
+	}
+
+	done := func(i int, err error) {
+		u := uploads[i]
+		if u.dedup || u.resumed {
+			prog.FileDone(fileutils.FileHashSize(u.filehash))
+		} else {
+			prog.FileDone(0)
+		}
+		if err != nil {
+			failed++
+			log.Print(fmt.Sprintf("FAILED -- %s, %s", u.relpath, err))
+		} else if u.dedup {
+			dedup++
+			log.Print(fmt.Sprintf("OK -- %s (deduplicated)", u.relpath))
+		} else if u.resumed {
+			resumed++
+			log.Print(fmt.Sprintf("OK -- %s (already uploaded)", u.relpath))
+		} else if !fileutils.FileSizeSame(u.filehash, u.bytes) {
+			count++
+			log.Print(fmt.Sprintf("WARNING -- %s (%d bytes) copy does not match with "+
+				"the expected file size in the root.\n"+
+				"\nIt can happen if another process is currently accessing the local files.\n"+
+				"Please take a new snapshot if this is the case.\n", u.relpath, u.bytes))
+		} else {
 			count++
+			log.Print(fmt.Sprintf("OK -- %s (%d bytes)", u.relpath, u.bytes))
+		}
 
-			// we know how many bytes should have been copied
-			if !fileutils.FileSizeSame(hist.GetFileHash(phash), cpbytes) {
-				logger.Print(fmt.Sprintf("WARNING -- %s (%d bytes) copy does not match with "+
-					"the expected file size in the root.\n"+
-					"\nIt can happen if another process is currently accessing the local files.\n"+
-					"Please take a new snapshot if this is the case.\n", relpath, cpbytes))
+		// the other files of the object share its upload
+		for _, same := range u.same {
+			prog.FileDone(fileutils.FileHashSize(same.filehash))
+			if err != nil {
+				failed++
+				log.Print(fmt.Sprintf("FAILED -- %s, same contents as %s", same.relpath, u.relpath))
 			} else {
-				logger.Print(fmt.Sprintf("OK -- %s (%d bytes)", relpath, cpbytes))
-				// make file read only
-				if err = fileutils.ReadOnly(dstpath); err != nil {
-					logger.Print("WARN -- failed to set read-only attribute.")
+				dedup++
+				log.Print(fmt.Sprintf("OK -- %s (deduplicated)", same.relpath))
+			}
+		}
+	}
+
+	workpool.Run(jobs, len(uploads), work, done)
+	prog.Finish()
+
+	// verify --quick checks the size of the compressed blobs
+	for _, u := range uploads {
+		if u.codec == codec.None {
+			continue
+		}
+		hist.SetBlobSize(u.phash, u.stored)
+		for _, same := range u.same {
+			hist.SetBlobSize(same.phash, u.stored)
+		}
+	}
+
+	if failed > 0 {
+		return logger.FailCode(logger.ExitPartial, "snapshot-copyfile", fmt.Sprintf("%d of %d files", failed, total),
+			"Failed to copy files, the snapshot is NOT committed.\n"+
+				"\nThe files copied so far are kept in the remote. Please fix the errors above and retry.")
+	}
+
+	if objectstore {
+		log.Print(fmt.Sprintf("DONE -- %d files copied, %d files deduplicated", count, dedup))
+	} else if pending != nil {
+		log.Print(fmt.Sprintf("DONE -- %d files copied, %d files already uploaded", count, resumed))
+	} else {
+		log.Print(fmt.Sprintf("DONE -- %d files copied", count))
+	}
+	return nil
+}
+
+// A blob of the interrupted commit can be reused if the file has not
+// changed since, and the blob was uploaded completely. Uploads are atomic,
+// the size is checked in case the remote was modified.
+func already_uploaded(pending *history.Hist, u *upload, rem remote.Remote, key string) bool {
+	if pending == nil || !pending.IsPathHash(u.phash) {
+		return false
+	}
+	if pending.GetFileHash(u.phash) != u.filehash || pending.GetCodec(u.phash) != u.codec {
+		return false
+	}
+	info, err := rem.Stat(key)
+	if err != nil || info.IsDir {
+		return false
+	}
+	// the size of a compressed blob is only known after reading it
+	if u.codec == codec.None && !fileutils.FileSizeSame(u.filehash, info.Size) {
+		return false
+	}
+	u.stored = info.Size
+	return true
+}
+
+// Remove the partial uploads of the interrupted commits. The object
+// store is shared by the roots, it is left alone while another root is
+// locked, since that root may be uploading to it.
+func clean_tmp_files(rem remote.Remote, rootname string, log *logger.Logger) {
+	dirs := []string{rootname}
+	if other, _ := lock.OtherHolder(rem, rootname); other == "" {
+		dirs = append(dirs, fileutils.ObjectsDir())
+	} else {
+		log.Trace("snapshot-clean-tmp", fmt.Sprintf("root %s is locked, partial uploads of the objects are kept", other))
+	}
+
+	removed := 0
+	lockpath := fileutils.LockPath(rootname)
+	for _, dir := range dirs {
+		if !remote.DirExists(rem, dir) {
+			continue
+		}
+		err := remote.Walk(rem, dir, func(key string, e remote.Entry) error {
+			// the lock of the root is rewritten while we hold it
+			if remote.IsTmpKey(key) && remote.TmpTarget(key) != lockpath {
+				if err := rem.Delete(key); err != nil {
+					log.Warn(fmt.Sprintf("failed to remove partial upload: %s, %s", key, err))
+				} else {
+					removed++
 				}
 			}
+			return nil
+		})
+		if err != nil {
+			log.Warn(fmt.Sprintf("failed to look for partial uploads in %s, %s", dir, err))
 		}
 	}
-	logger.Print(fmt.Sprintf("DONE -- %d files copied", count))
+	if removed > 0 {
+		log.Print(fmt.Sprintf("OK -- %d partial uploads removed", removed))
+	}
+}
+
+// Path hashes of the history, in the order of the relative paths.
+func sorted_paths(hist *history.Hist) []string {
+	phashes := hist.PathHashList()
+	sort.Slice(phashes, func(i, j int) bool {
+		return hist.GetRelPath(phashes[i]) < hist.GetRelPath(phashes[j])
+	})
+	return phashes
+}
+
+// Object ids are sha256 digests of the contents,
+// reuse the digest of the file hash if we already have it.
+func calc_object_id(srcpath string, filehash string) (string, error) {
+	digest := fileutils.FileHashDigest(filehash)
+	if strings.HasPrefix(digest, "sha256:") {
+		return strings.TrimPrefix(digest, "sha256:"), nil
+	}
+	return fileutils.CalcContentDigest(srcpath)
 }
 
 func calculate_meta_items(hist *history.Hist) *history.Hist {
@@ -132,10 +532,12 @@ func calculate_meta_items(hist *history.Hist) *history.Hist {
 	return hist
 }
 
-func compare(last, new *history.Hist) *history.Hist {
+// Paths of the files not walked are only in the last snapshot,
+// they are retained.
+func compare(conf *settings.Settings, last, new *history.Hist, paths []string) *history.Hist {
 	// loop over the new files
 	for _, phash := range new.PathHashList() {
-		if settings.ShouldIgnore(new.GetRelPath(phash)) {
+		if conf.ShouldIgnore(new.GetRelPath(phash)) {
 			new.SetCrud(phash, "I")
 			continue
 		}
@@ -151,6 +553,9 @@ func compare(last, new *history.Hist) *history.Hist {
 				new.SetCrud(phash, "R")
 				lastTarget := last.GetTarget(phash)
 				new.SetTarget(phash, lastTarget)
+				new.SetObjectId(phash, last.GetObjectId(phash))
+				new.SetCodec(phash, last.GetCodec(phash))
+				new.SetBlobSize(phash, last.GetBlobSize(phash))
 			} else {
 				// 	U = If PathHash in 01 and FileHash not same
 				new.SetCrud(phash, "U")
@@ -163,6 +568,17 @@ func compare(last, new *history.Hist) *history.Hist {
 	// 	D = [for all PathHash:CRU in 01 not in 02]
 	for _, phash := range last.PathHashList() {
 		lastcrud := last.GetCrud(phash)
+		if !fileutils.InScope(paths, last.GetRelPath(phash)) {
+			if lastcrud != "D" {
+				new.SetAction(phash, last.GetAction(phash))
+				if lastcrud == "I" {
+					new.SetCrud(phash, "I")
+				} else {
+					new.SetCrud(phash, "R")
+				}
+			}
+			continue
+		}
 		// file was not deleted/ignored in the last ss
 		if lastcrud != "D" {
 			// no such file exist now, it has been deleted
@@ -178,58 +594,128 @@ func compare(last, new *history.Hist) *history.Hist {
 	return new
 }
 
-func walk_root(hist *history.Hist) *history.Hist {
-	rootpath := fileutils.CurrentWD()
+type walked struct {
+	fullpath string
+	relpath  string
+	entry    fs.DirEntry
+	filehash string
+}
+
+// Paths relative to the root, without the ones under another path,
+// nil for the whole root.
+func scope_paths(paths []string) []string {
+	cleaned := []string{}
+	for _, p := range paths {
+		p = strings.Trim(fileutils.PathNormalize(p), "/")
+		if p == "" || p == "." {
+			return nil
+		}
+		cleaned = append(cleaned, p)
+	}
+	if len(cleaned) == 0 {
+		return nil
+	}
+	sort.Strings(cleaned)
+	// sorted, a path under another one follows it
+	scope := []string{cleaned[0]}
+	for _, p := range cleaned[1:] {
+		if !fileutils.InScope(scope, p) {
+			scope = append(scope, p)
+		}
+	}
+	return scope
+}
+
+// Walk the files under the paths of the root, all of them if no paths.
+func walk_root(rootpath string, paths []string, hist *history.Hist, cache *hashcache.Cache, jobs int, log *logger.Logger) (*history.Hist, error) {
 	hist.SetMetaString("ROOTDIR", rootpath)
 
-	filepath.WalkDir(rootpath, func(s string, d fs.DirEntry, e error) error {
+	starts := []string{rootpath}
+	if len(paths) > 0 {
+		starts = []string{}
+		for _, p := range paths {
+			start := fileutils.PathJoin(rootpath, p)
+			// deleted, the files of the last snapshot under it are deleted
+			if _, err := os.Lstat(start); os.IsNotExist(err) {
+				continue
+			}
+			starts = append(starts, start)
+		}
+	}
+
+	files := []*walked{}
+	for _, start := range starts {
+		if err := walk_files(rootpath, start, &files); err != nil {
+			return nil, err
+		}
+	}
+
+	// hash the files concurrently, add them in the walk order
+	failed := 0
+	workpool.Run(jobs, len(files), func(i int) error {
+		f := files[i]
+		fhash, err := cache.FileHash(f.fullpath, f.relpath, f.entry)
+		f.filehash = fhash
+		return err
+	}, func(i int, err error) {
+		f := files[i]
+		if err != nil {
+			failed++
+			log.Print(fmt.Sprintf("FAILED -- %s, %s", f.relpath, err))
+			return
+		}
+		phash := fileutils.CalcPathHash(f.relpath)
+		hist.AddPath(phash, f.relpath, f.entry.Name(), f.filehash)
+	})
+
+	if failed > 0 {
+		return nil, logger.FailCode(logger.ExitPartial, "snapshot-walk-root", fmt.Sprintf("%d files", failed), "Failed to read file info.")
+	}
+
+	return hist, nil
+}
+
+// Add the files under start to the walked files, skipping the settings
+// and the _.shot directory of the root.
+func walk_files(rootpath string, start string, files *[]*walked) error {
+	return filepath.WalkDir(start, func(s string, d fs.DirEntry, e error) error {
 		if e != nil {
-			logger.Error("snapshot-walk-root", rootpath, "Failed to walk root directory.")
-			return e
+			return logger.Fail("snapshot-walk-root", s, fmt.Sprintf("Failed to walk root directory.\n\n%s", e))
 		}
 
 		// path relative to root
 		relpath, err := fileutils.CalcRelativePath(rootpath, s)
 
 		// ignore items here
-		if d.Name() == fileutils.GetRootSettingsPath() {
+		if d.Name() == fileutils.GetRootSettingsPath() || d.Name() == fileutils.GetHashCachePath() {
 			return nil
 		}
 
 		// ignore the _.shot directory
-		if d.IsDir() && s == fileutils.ShotPath("") {
+		if d.IsDir() && s == fileutils.ShotDir(rootpath) {
 			return fs.SkipDir
 		}
 
 		// add the files
 		if !d.IsDir() {
 			if err != nil {
-				logger.Error("snapshot-walk-root", s, "Failed to determine relative path.")
+				return logger.Fail("snapshot-walk-root", s, "Failed to determine relative path.")
 			}
-			fhash, err := fileutils.CalcFileHash(s, d)
-			if err != nil {
-				logger.Error("snapshot-walk-root", s, "Failed to read file info.")
-			}
-			phash := fileutils.CalcPathHash(relpath)
-
-			hist.AddPath(phash, relpath, d.Name(), fhash)
-			// fmt.Println(phash, relpath, d.Name(), fhash)
+			*files = append(*files, &walked{fullpath: s, relpath: relpath, entry: d})
 		}
 		return nil
 	})
 
-	return hist
 }
 
-func calc_new_ssid(remote string, rootname string) int {
-	for i := 1; i < 1000; i++ {
-		if !fileutils.SSExists(i, remote, rootname) {
-			return i
-		}
+// One after the latest snapshot, ids of pruned snapshots are never reused
+// since their blobs can still be referenced by the newer snapshots.
+func calc_new_ssid(rem remote.Remote, rootname string) int {
+	snapids := history.SnapIds(rem, rootname)
+	if len(snapids) == 0 {
+		return 1
 	}
-	logger.Error("snapshot-calc-new-ssid", remote+":"+rootname,
-		"Cannot determine a new snapshot id.")
-	return -1
+	return snapids[len(snapids)-1] + 1
 }
 
 // let LAST = last snapshot = 01 = read from .shot file.
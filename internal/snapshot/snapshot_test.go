@@ -0,0 +1,331 @@
+package snapshot
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+)
+
+func TestMain(m *testing.M) {
+	logger.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Root directory with its settings file, the remote is never opened.
+func make_root(t *testing.T, root string, ignores string) (string, *settings.Settings) {
+	dir := t.TempDir()
+	contents := "[ROOT]\nname = r\nsnapshot = 0\n" + root +
+		"\n[REMOTES]\ndefault = /nonexistent\n\n[IGNORES]\n" + ignores
+	write_file(t, dir, fileutils.GetRootSettingsPath(), contents)
+	conf, err := settings.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, conf
+}
+
+func write_file(t *testing.T, dir string, relpath string, contents string) {
+	path := filepath.Join(dir, filepath.FromSlash(relpath))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func take(t *testing.T, dir string, conf *settings.Settings, rem remote.Remote, opts Options) *history.Hist {
+	opts.Commit = true
+	shot, err := Prepare(dir, conf, rem, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shot.Close()
+	if err := shot.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return shot.Hist
+}
+
+func check_cruds(t *testing.T, hist *history.Hist, want map[string]string) {
+	t.Helper()
+	for phash, crud := range want {
+		if got := hist.GetCrud(phash); got != crud {
+			t.Errorf("snapshot %d: %s is %q, want %q", hist.SnapId, phash, got, crud)
+		}
+	}
+	if len(hist.PathHashList()) != len(want) {
+		t.Errorf("snapshot %d: %d files, want %d", hist.SnapId, len(hist.PathHashList()), len(want))
+	}
+}
+
+func TestCompareFileHash(t *testing.T) {
+	_, conf := make_root(t, "", "")
+	rem := remote.NewMemory()
+
+	last := history.Make(1, rem, "r")
+	hashes := map[string]string{
+		"touched.txt": "5; t0; sha256:aaaa",
+		"changed.txt": "5; t0; sha256:bbbb",
+		"stat.txt":    "5; t0",
+		"gone.txt":    "5; t0",
+	}
+	for phash, filehash := range hashes {
+		last.AddPath(phash, phash, phash, filehash)
+		last.SetCrud(phash, "C")
+		last.SetTarget(phash, 1)
+	}
+
+	cur := history.Make(2, rem, "r")
+	// the same contents under a new modification time
+	cur.AddPath("touched.txt", "touched.txt", "touched.txt", "5; t1; sha256:aaaa")
+	// other contents of the same size and time
+	cur.AddPath("changed.txt", "changed.txt", "changed.txt", "5; t0; sha256:cccc")
+	// no digest on one side, size and time are compared
+	cur.AddPath("stat.txt", "stat.txt", "stat.txt", "5; t1; sha256:dddd")
+
+	cur = compare(conf, last, cur, nil)
+	check_cruds(t, cur, map[string]string{
+		"touched.txt": "R",
+		"changed.txt": "U",
+		"stat.txt":    "U",
+		"gone.txt":    "D",
+	})
+	for phash, target := range map[string]int{"touched.txt": 1, "changed.txt": 2, "stat.txt": 2, "gone.txt": 1} {
+		if got := cur.GetTarget(phash); got != target {
+			t.Errorf("%s target = %d, want %d", phash, got, target)
+		}
+	}
+}
+
+func TestContentHashMode(t *testing.T) {
+	dir, conf := make_root(t, "hash = sha256\n", "")
+	rem := remote.NewMemory()
+
+	write_file(t, dir, "a.txt", "hello")
+	write_file(t, dir, "b.txt", "world")
+	first := take(t, dir, conf, rem, Options{})
+	if digest := fileutils.FileHashDigest(first.GetFileHash("a.txt")); digest == "" {
+		t.Fatalf("no digest in %q", first.GetFileHash("a.txt"))
+	}
+
+	// touched but unchanged, and changed under the same size and time
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "a.txt"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write_file(t, dir, "b.txt", "WORLD")
+	if err := os.Chtimes(filepath.Join(dir, "b.txt"), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	// written within the racy window, so not cached, b.txt is read again
+	second := take(t, dir, conf, rem, Options{})
+	check_cruds(t, second, map[string]string{"a.txt": "R", "b.txt": "U"})
+}
+
+func TestScopePaths(t *testing.T) {
+	cases := []struct {
+		paths []string
+		want  []string
+	}{
+		{nil, nil},
+		{[]string{"."}, nil},
+		{[]string{"src", "."}, nil},
+		{[]string{"src/", "docs"}, []string{"docs", "src"}},
+		{[]string{"src/a", "src", "srcx"}, []string{"src", "srcx"}},
+	}
+	for _, c := range cases {
+		got := scope_paths(c.paths)
+		if len(got) != len(c.want) {
+			t.Errorf("scope_paths(%v) = %v, want %v", c.paths, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("scope_paths(%v) = %v, want %v", c.paths, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCompareScope(t *testing.T) {
+	_, conf := make_root(t, "", "in/*.log\n")
+	rem := remote.NewMemory()
+
+	last := history.Make(1, rem, "r")
+	for _, phash := range []string{"in/same.txt", "in/changed.txt", "in/gone.txt", "out/kept.txt", "out/old.log"} {
+		last.AddPath(phash, phash, filepath.Base(phash), "5; t0")
+		last.SetCrud(phash, "C")
+		last.SetTarget(phash, 1)
+	}
+	last.SetCrud("out/old.log", "I")
+	last.AddPath("in/deleted.txt", "in/deleted.txt", "deleted.txt", "5; t0")
+	last.SetCrud("in/deleted.txt", "D")
+	last.SetTarget("in/deleted.txt", 1)
+
+	cur := history.Make(2, rem, "r")
+	cur.AddPath("in/same.txt", "in/same.txt", "same.txt", "5; t0")
+	cur.AddPath("in/changed.txt", "in/changed.txt", "changed.txt", "6; t1")
+	cur.AddPath("in/new.txt", "in/new.txt", "new.txt", "5; t1")
+	cur.AddPath("in/debug.log", "in/debug.log", "debug.log", "5; t1")
+
+	// only in/ is walked, the files of out/ are retained
+	cur = compare(conf, last, cur, []string{"in"})
+	check_cruds(t, cur, map[string]string{
+		"in/same.txt":    "R",
+		"in/changed.txt": "U",
+		"in/new.txt":     "C",
+		"in/debug.log":   "I",
+		"in/gone.txt":    "D",
+		"out/kept.txt":   "R",
+		"out/old.log":    "I",
+	})
+	for phash, target := range map[string]int{"in/same.txt": 1, "in/changed.txt": 2, "in/new.txt": 2, "in/gone.txt": 1, "out/kept.txt": 1} {
+		if got := cur.GetTarget(phash); got != target {
+			t.Errorf("%s target = %d, want %d", phash, got, target)
+		}
+	}
+}
+
+func TestShotPaths(t *testing.T) {
+	dir, conf := make_root(t, "", "")
+	rem := remote.NewMemory()
+
+	write_file(t, dir, "in/a.txt", "a")
+	write_file(t, dir, "out/b.txt", "b")
+	take(t, dir, conf, rem, Options{})
+
+	write_file(t, dir, "in/a.txt", "aa")
+	write_file(t, dir, "in/c.txt", "c")
+	write_file(t, dir, "out/b.txt", "bb")
+	if err := os.Remove(filepath.Join(dir, "out", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	second := take(t, dir, conf, rem, Options{Paths: []string{"in/"}})
+	check_cruds(t, second, map[string]string{"in/a.txt": "U", "in/c.txt": "C", "out/b.txt": "R"})
+}
+
+func TestCommit(t *testing.T) {
+	dir, conf := make_root(t, "store = objects\ncompress = gzip\ncompress_min = 1\n", "*.log\n")
+	rem := remote.NewMemory()
+
+	write_file(t, dir, "a.txt", "hello hello hello")
+	write_file(t, dir, "sub/b.txt", "hello hello hello")
+	write_file(t, dir, "sub/c.txt", "bye")
+	write_file(t, dir, "debug.log", "ignored")
+
+	first := take(t, dir, conf, rem, Options{})
+	check_cruds(t, first, map[string]string{"a.txt": "C", "sub/b.txt": "C", "sub/c.txt": "C", "debug.log": "I"})
+	if conf.LastSnapshot() != 1 {
+		t.Fatalf("last snapshot = %d, want 1", conf.LastSnapshot())
+	}
+	if first.GetObjectId("a.txt") == "" || first.GetObjectId("a.txt") != first.GetObjectId("sub/b.txt") {
+		t.Errorf("object ids of the same contents: %q, %q", first.GetObjectId("a.txt"), first.GetObjectId("sub/b.txt"))
+	}
+	if p, _ := history.LoadPending(rem, "r", logger.Default()); p != nil {
+		t.Error("pending journal left after the commit")
+	}
+	// recorded for verify --quick, the second file shares the blob
+	info, err := rem.Stat(first.GetRestorePath("a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, phash := range []string{"a.txt", "sub/b.txt"} {
+		if first.GetBlobSize(phash) != info.Size {
+			t.Errorf("%s blob size = %d, want %d", phash, first.GetBlobSize(phash), info.Size)
+		}
+	}
+
+	// a different size, the stat hash changes
+	write_file(t, dir, "a.txt", "hello again")
+	if err := os.Remove(filepath.Join(dir, "sub", "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	write_file(t, dir, "d.txt", "new")
+
+	second := take(t, dir, conf, rem, Options{})
+	check_cruds(t, second, map[string]string{"a.txt": "U", "sub/b.txt": "R", "sub/c.txt": "D", "d.txt": "C", "debug.log": "I"})
+	if second.GetTarget("sub/b.txt") != 1 || second.GetBlobSize("sub/b.txt") != info.Size {
+		t.Errorf("sub/b.txt target = %d, blob size = %d, want 1, %d",
+			second.GetTarget("sub/b.txt"), second.GetBlobSize("sub/b.txt"), info.Size)
+	}
+
+	// the published snapshot restores the contents
+	loaded := history.Make(2, rem, "r")
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for relpath, want := range map[string]string{"a.txt": "hello again", "sub/b.txt": "hello hello hello", "d.txt": "new"} {
+		r, err := fileutils.OpenBlob(rem, loaded.GetRestorePath(relpath), loaded.GetCodec(relpath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", relpath, got, err, want)
+		}
+	}
+
+	// nothing changed, nothing uploaded
+	third := take(t, dir, conf, rem, Options{})
+	if n := third.CountCrud("C") + third.CountCrud("U") + third.CountCrud("D"); n != 0 {
+		t.Errorf("%d changes in an unchanged root", n)
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir, conf := make_root(t, "", "")
+	rem := remote.NewMemory()
+	write_file(t, dir, "a.txt", "a")
+	take(t, dir, conf, rem, Options{})
+
+	// interrupted after the journal was written
+	write_file(t, dir, "b.txt", "b")
+	shot, err := Prepare(dir, conf, rem, Options{Commit: true, Message: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shot.Hist.WritePending(); err != nil {
+		t.Fatal(err)
+	}
+	shot.Close()
+
+	shot, err = Prepare(dir, conf, rem, Options{Commit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shot.Pending == nil || shot.Pending.SnapId != 2 {
+		t.Fatalf("pending = %+v, want snapshot 2", shot.Pending)
+	}
+	if err := shot.Commit(); err == nil {
+		t.Error("committed a new snapshot over an interrupted one")
+	}
+	shot.Close()
+
+	resumed := take(t, dir, conf, rem, Options{Resume: true})
+	if resumed.SnapId != 2 || resumed.GetMeta("DESC") != "second" {
+		t.Errorf("resumed snapshot %d %q, want 2 \"second\"", resumed.SnapId, resumed.GetMeta("DESC"))
+	}
+	check_cruds(t, resumed, map[string]string{"a.txt": "R", "b.txt": "C"})
+	if p, _ := history.LoadPending(rem, "r", logger.Default()); p != nil {
+		t.Error("pending journal left after the resumed commit")
+	}
+	if conf.LastSnapshot() != 2 {
+		t.Errorf("last snapshot = %d, want 2", conf.LastSnapshot())
+	}
+}
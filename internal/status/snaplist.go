@@ -2,78 +2,91 @@ package status
 
 import (
 	"fmt"
-	"io/ioutil"
-	"snap/internal/argparser"
-	"snap/internal/fileutils"
-	"snap/internal/history"
-	"snap/internal/logger"
-	"snap/internal/settings"
-	"sort"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/report"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/repo"
 )
 
-func Execute() {
+func Execute() error {
 	args := argparser.GetParser()
-	remote := settings.DefaultRemote()
-	if !fileutils.DirExists(remote) {
-		errmsg := "Remote directory does not exist.\n" +
-			"\nMake sure it is mounted. Or take your first snapshot and it will be created automatically.\n"
-		logger.Error("show-history", remote, errmsg)
+	r, err := repo.Open(settings.Current().Dir(), "")
+	if err != nil {
+		return err
 	}
+	defer r.Close()
+	r.SetOutput(logger.Default())
 
-	rootname := settings.RootName()
-
-	ssid, err := args.GetInt(1)
-	if err != nil {
-		snaplist := list_snap_files(remote, rootname)
-		for _, snap := range snaplist {
-			show_snap_info(remote, rootname, snap)
+	ssid := 0
+	if arg, err := args.GetStr(1); err == nil {
+		if ssid, err = r.Resolve(arg); err != nil {
+			return err
+		}
+	}
+	if ssid < 1 {
+		snaps, err := r.List()
+		if err != nil {
+			return err
+		}
+		if report.Machine() {
+			return report.PrintList(report.List{LastSynced: r.LastSnapshot(), Snapshots: snaps})
+		}
+		if len(snaps) == 0 {
+			errmsg := "Remote history does not exist.\n" +
+				"\nMake sure the remote is mounted. Or take your first snapshot and it will be created automatically.\n"
+			return logger.Fail("show-history", r.Name(), errmsg)
+		}
+		for _, snap := range snaps {
+			show_snap_info(snap)
 		}
 	} else {
-		hist := history.Make(ssid, remote, rootname)
-		if !hist.SnapFileExists() {
-			logger.Error("show-history", fmt.Sprint(ssid), "No such snapshot exists in the remote.")
+		snap, err := r.Get(ssid)
+		if err != nil {
+			return err
+		}
+		if report.Machine() {
+			return report.PrintResult(report.Result{
+				Command:   "list",
+				Committed: true,
+				Last:      r.LastSnapshot(),
+				Snapshot:  *snap,
+			})
+		}
+		if desc := snap.Meta["DESC"]; desc != "" {
+			logger.Print(fmt.Sprintf("\n%s", desc))
+		}
+		if len(snap.Tags) > 0 {
+			logger.Print(fmt.Sprintf("Tags: %s", strings.Join(snap.Tags, ", ")))
 		}
-		hist.Load()
 		logger.Print("\nCommitted Changes:\n")
-		hist.Print()
+		report.PrintChanges(*snap, r.Name(), false)
 	}
 
-	currSS := settings.LastSnapshot()
-	logger.Print(fmt.Sprintf("Last snapshot synced: %d", currSS))
-	logger.Print("\nPlease specify a snapshot number to see a list of file changes.")
+	logger.Print(fmt.Sprintf("Last snapshot synced: %d", r.LastSnapshot()))
+	logger.Print("\nPlease specify a snapshot number or tag to see a list of file changes.")
 	logger.Print("Or run 'shot' to see a list of current changes from the last snapshot.")
+	return nil
 }
 
-func show_snap_info(remote string, rootname string, ssname string) {
-	snap := history.Make(0, remote, rootname)
-	if snap.SnapFileOfNameExists(ssname) {
-		snap.LoadFileMeta(ssname)
-
-		logger.Print(fmt.Sprintf(
-			"%s\n       %s      [%s]\n", snap.GetMeta("DATE"), ssname, snap.GetMeta("CRUD")))
-		// logger.Print(fmt.Sprintf("       %s\n", snap.GetMeta("DESC")))
-	} else {
-		logger.Trace("snaplist-show", fmt.Sprintf("no such snapshot: %s ", ssname))
+func show_snap_info(snap repo.Summary) {
+	line := fmt.Sprintf("%s\n       %s      [%s]", meta(snap, "DATE"), fileutils.FormatSnapFile(snap.SnapId), meta(snap, "CRUD"))
+	if len(snap.Tags) > 0 {
+		line += fmt.Sprintf("  (%s)", strings.Join(snap.Tags, ", "))
 	}
-}
-
-func list_snap_files(remote, rootname string) []string {
-	histDir := fileutils.SSHistoryDir(remote, rootname)
-	files, err := ioutil.ReadDir(histDir)
-	if err != nil {
-		if !fileutils.DirExists(histDir) {
-			errmsg := "Remote history does not exist.\n" +
-				"\nMake sure the remote is mounted. Or take your first snapshot and it will be created automatically.\n"
-			logger.Error("show-history", histDir, errmsg)
-		}
+	if desc := snap.Meta["DESC"]; desc != "" {
+		line += fmt.Sprintf("\n       %s", desc)
 	}
+	logger.Print(line + "\n")
+}
 
-	var snapnames []string
-	for _, f := range files {
-		if !f.IsDir() {
-			snapnames = append(snapnames, f.Name())
-		}
+// Meta value of the snapshot, <none> if not recorded.
+func meta(snap repo.Summary, key string) string {
+	if val, ok := snap.Meta[key]; ok {
+		return val
 	}
-	sort.Strings(snapnames)
-	return snapnames
+	return "<none>"
 }
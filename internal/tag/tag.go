@@ -0,0 +1,122 @@
+package tag
+
+import (
+	"fmt"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/lock"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
+)
+
+const usage = "\nUSAGE: tag                            list the tags\n" +
+	"       tag <snapshot id|tag> <name>    tag a snapshot\n" +
+	"       tag --delete <name>             remove a tag\n"
+
+func Execute() error {
+	args := argparser.GetParser()
+
+	rem, err := settings.Remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	if !remote.Available(rem) {
+		errmsg := "Remote directory does not exist.\n" +
+			"\nMake sure it is mounted. Or take your first snapshot and it will be created automatically.\n"
+		return logger.FailCode(logger.ExitRemote, "tag-execute", rem.String(), errmsg)
+	}
+
+	rootname := settings.RootName()
+
+	if name := args.GetKeyStr("delete", ""); name != "" {
+		return delete_tag(rem, rootname, name)
+	}
+
+	arg, err := args.GetStr(1)
+	if err != nil {
+		return list_tags(rem, rootname)
+	}
+
+	name, err := args.ReqStr(2, "Tag name not given.\n"+usage)
+	if err != nil {
+		return err
+	}
+	if err := tags.ValidName(name); err != nil {
+		return logger.FailCode(logger.ExitUsage, "tag-name", name, fmt.Sprintf("Invalid tag name, %s.\n", err)+
+			"\nTag names can contain letters, digits and - _ . / + @, and cannot be a number.")
+	}
+
+	ssid, err := tags.Resolve(rem, rootname, arg)
+	if err != nil || !history.Make(ssid, rem, rootname).SnapFileExists() {
+		return logger.Fail("tag-ssid", arg, "No such snapshot exists in the remote.")
+	}
+
+	rootlock, err := lock.Acquire(rem, rootname, "tag", logger.Default())
+	if err != nil {
+		return err
+	}
+	defer rootlock.Release()
+
+	snaptags, err := tags.Load(rem, rootname)
+	if err != nil {
+		return err
+	}
+	if old := snaptags.Get(name); old == ssid {
+		logger.Print(fmt.Sprintf("Snapshot %d is already tagged %s.", ssid, name))
+		return nil
+	} else if old > 0 && !args.HasFlag("force") {
+		return logger.Fail("tag-exists", name, fmt.Sprintf("The tag is already on snapshot %d.\n", old)+
+			"\nPlease use --force to move it.")
+	}
+	snaptags.Set(name, ssid)
+	if err := snaptags.Write(); err != nil {
+		return err
+	}
+	logger.Print(fmt.Sprintf("OK -- snapshot %d tagged %s", ssid, name))
+	return nil
+}
+
+func list_tags(rem remote.Remote, rootname string) error {
+	snaptags, err := tags.Load(rem, rootname)
+	if err != nil {
+		return err
+	}
+	names := snaptags.List()
+	if len(names) == 0 {
+		logger.Print("No tags in the remote.")
+		logger.Print(usage)
+		return nil
+	}
+	for _, name := range names {
+		logger.Print(fmt.Sprintf("%04d  %s", snaptags.Get(name), name))
+	}
+	return nil
+}
+
+func delete_tag(rem remote.Remote, rootname string, name string) error {
+	rootlock, err := lock.Acquire(rem, rootname, "tag", logger.Default())
+	if err != nil {
+		return err
+	}
+	defer rootlock.Release()
+
+	snaptags, err := tags.Load(rem, rootname)
+	if err != nil {
+		return err
+	}
+	ssid := snaptags.Get(name)
+	if ssid == 0 {
+		return logger.Fail("tag-delete", name, "No such tag exists in the remote.\n"+
+			"\nPlease run 'tag' to list the tags.")
+	}
+	snaptags.Delete(name)
+	if err := snaptags.Write(); err != nil {
+		return err
+	}
+	logger.Print(fmt.Sprintf("OK -- tag %s removed from snapshot %d", name, ssid))
+	return nil
+}
@@ -0,0 +1,161 @@
+package tags
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+)
+
+// Named tags of the snapshots of a root, kept in a single file next to
+// the history, since the shot files are read-only once committed.
+type Tags struct {
+	Remote   remote.Remote
+	RootName string
+	ids      map[string]int
+}
+
+func Load(rem remote.Remote, rootname string) (*Tags, error) {
+	t := &Tags{
+		Remote:   rem,
+		RootName: rootname,
+		ids:      make(map[string]int),
+	}
+	tagfile := fileutils.TagsPath(rootname)
+	if !remote.Exists(rem, tagfile) {
+		return t, nil
+	}
+	file, err := rem.Get(tagfile)
+	if err != nil {
+		return nil, logger.Fail("tags-load", tagfile, fmt.Sprintf("Failed to read the tags file.\n\n%s", err))
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		ssid, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			continue
+		}
+		t.ids[strings.TrimSpace(parts[0])] = ssid
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, logger.Fail("tags-load", tagfile, fmt.Sprintf("Failed to read the tags file.\n\n%s", err))
+	}
+	return t, nil
+}
+
+func (t *Tags) Write() error {
+	var content bytes.Buffer
+	for _, name := range t.List() {
+		content.WriteString(fmt.Sprintf("%s\t=\t%d\n", name, t.ids[name]))
+	}
+	tagfile := fileutils.TagsPath(t.RootName)
+	if _, err := t.Remote.Put(tagfile, &content); err != nil {
+		return logger.Fail("tags-write", tagfile, fmt.Sprintf("Failed to write the tags file.\n\n%s", err))
+	}
+	return nil
+}
+
+// Snapshot id of the tag, 0 if no such tag.
+func (t *Tags) Get(name string) int {
+	return t.ids[name]
+}
+
+func (t *Tags) Set(name string, ssid int) {
+	t.ids[name] = ssid
+}
+
+func (t *Tags) Delete(name string) {
+	delete(t.ids, name)
+}
+
+// Names of all the tags, sorted.
+func (t *Tags) List() []string {
+	names := []string{}
+	for name := range t.ids {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Names of the tags of a snapshot, sorted.
+func (t *Tags) Of(ssid int) []string {
+	names := []string{}
+	for _, name := range t.List() {
+		if t.ids[name] == ssid {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Tag names must not be taken for snapshot ids, nor break the tags file.
+func ValidName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty tag name")
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		return fmt.Errorf("tag name cannot be a number")
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '/' || c == '+' || c == '@') {
+			return fmt.Errorf("invalid character in tag name: %q", c)
+		}
+	}
+	return nil
+}
+
+// Snapshot id of a snapshot id or tag name given as an argument.
+func Resolve(rem remote.Remote, rootname string, arg string) (int, error) {
+	if ssid, err := strconv.Atoi(arg); err == nil {
+		return ssid, nil
+	}
+	t, err := Load(rem, rootname)
+	if err != nil {
+		return 0, err
+	}
+	ssid := t.Get(arg)
+	if ssid == 0 {
+		return 0, fmt.Errorf("no such snapshot id or tag: %s", arg)
+	}
+	return ssid, nil
+}
+
+// Snapshot id given as an id or a tag at the position of the arguments,
+// 0 if not given.
+func ArgSnapId(rem remote.Remote, rootname string, position int) (int, error) {
+	arg, err := argparser.GetParser().GetStr(position)
+	if err != nil {
+		return 0, nil
+	}
+	return ResolveArg(rem, rootname, arg)
+}
+
+// Snapshot id of an argument given as an id or a tag, with the error
+// to print if there is no such snapshot.
+func ResolveArg(rem remote.Remote, rootname string, arg string) (int, error) {
+	ssid, err := Resolve(rem, rootname, arg)
+	var failure *logger.Failure
+	if errors.As(err, &failure) {
+		return 0, err
+	} else if err != nil {
+		return 0, logger.Fail("snapshot-id", arg, "No such snapshot id or tag.\n"+
+			"\nPlease run 'list' to see the snapshots and their tags.")
+	}
+	return ssid, nil
+}
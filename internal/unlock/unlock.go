@@ -0,0 +1,49 @@
+package unlock
+
+import (
+	"fmt"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/lock"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+)
+
+func Execute() error {
+	args := argparser.GetParser()
+
+	rem, err := settings.Remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	if !remote.Available(rem) {
+		errmsg := "Remote directory does not exist.\n" +
+			"\nMake sure it is mounted.\n"
+		return logger.FailCode(logger.ExitRemote, "unlock-execute", rem.String(), errmsg)
+	}
+
+	rootname := settings.RootName()
+	owner, err := lock.Read(rem, rootname)
+	if err != nil {
+		return logger.Fail("unlock-read", rootname, fmt.Sprintf("Failed to read the lock file of the root.\n\n%s", err))
+	}
+	if owner == nil {
+		logger.Print("The root is not locked.")
+		return nil
+	}
+
+	force := args.HasFlag("force")
+	if !owner.Stale() && !force {
+		return logger.FailCode(logger.ExitLocked, "unlock-active", rootname, "The root is locked by "+owner.String()+".\n"+
+			"\nIt still seems to be running. If you are sure it is not,\n"+
+			"run 'unlock --force' to remove the lock anyway.")
+	}
+
+	if err := lock.Remove(rem, rootname); err != nil {
+		return logger.Fail("unlock-remove", rootname, fmt.Sprintf("Failed to remove the lock file.\n\n%s", err))
+	}
+	logger.Print("OK -- removed the lock of " + owner.String())
+	return nil
+}
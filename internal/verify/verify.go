@@ -0,0 +1,279 @@
+package verify
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/codec"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
+)
+
+// exit code when the remote has problems
+const exit_problems = 1
+
+type problem struct {
+	kind    string
+	ssid    int
+	relpath string
+	blob    string
+	detail  string
+}
+
+type audit struct {
+	quick      bool
+	snapshots  int
+	blobs      int
+	referenced map[string]bool
+	problems   []problem
+}
+
+func Execute() error {
+	args := argparser.GetParser()
+
+	rem, err := settings.Remote()
+	if err != nil {
+		return err
+	}
+	defer rem.Close()
+	if !remote.Available(rem) {
+		errmsg := "Remote directory does not exist.\n" +
+			"\nMake sure it is mounted.\n"
+		return logger.FailCode(logger.ExitRemote, "verify-execute", rem.String(), errmsg)
+	}
+
+	rootname := settings.RootName()
+
+	a := &audit{
+		quick:      args.HasFlag("quick"),
+		referenced: make(map[string]bool),
+	}
+
+	ssid, err := tags.ArgSnapId(rem, rootname, 1)
+	if err != nil {
+		return err
+	}
+	if ssid > 0 {
+		hist := history.Make(ssid, rem, rootname)
+		if !hist.SnapFileExists() {
+			return logger.Fail("verify-ssid", fmt.Sprint(ssid), "No such snapshot exists in the remote.")
+		}
+		a.verify_snapshot(hist)
+	} else {
+		for _, id := range history.SnapIds(rem, rootname) {
+			a.verify_snapshot(history.Make(id, rem, rootname))
+		}
+		// orphans can only be known if all the snapshots were loaded
+		if err := a.find_orphans(rem, rootname); err != nil {
+			return err
+		}
+	}
+
+	a.print()
+
+	if len(a.problems) > 0 {
+		// deferred calls do not run on exit
+		rem.Close()
+		os.Exit(exit_problems)
+	}
+	return nil
+}
+
+func (a *audit) verify_snapshot(hist *history.Hist) {
+	a.snapshots++
+	if err := hist.Load(); err != nil {
+		a.report("UNREADABLE", hist.SnapId, "-", hist.SnapFilePath, err.Error())
+		return
+	}
+
+	phashes := hist.PathHashList()
+	sort.Strings(phashes)
+
+	for _, phash := range phashes {
+		if hist.GetCrud(phash) == "D" {
+			continue
+		}
+		blob := hist.GetRestorePath(phash)
+		if a.referenced[blob] {
+			continue
+		}
+		a.referenced[blob] = true
+		a.blobs++
+		a.verify_blob(hist, phash, blob)
+	}
+}
+
+func (a *audit) verify_blob(hist *history.Hist, phash string, blob string) {
+	relpath := hist.GetRelPath(phash)
+	filehash := hist.GetFileHash(phash)
+	comp := hist.GetCodec(phash)
+	logger.Trace("verify-blob", blob)
+
+	info, err := hist.Remote.Stat(blob)
+	if err != nil || info.IsDir {
+		a.report("MISSING", hist.SnapId, relpath, blob, "")
+		return
+	}
+
+	// the size of a compressed blob is recorded at upload, unknown for the older snapshots
+	if comp == codec.None && !fileutils.FileSizeSame(filehash, info.Size) {
+		a.report("SIZE", hist.SnapId, relpath, blob,
+			fmt.Sprintf("expected %s bytes, found %d bytes", strings.Split(filehash, ";")[0], info.Size))
+		return
+	}
+	if stored := hist.GetBlobSize(phash); comp != codec.None && stored > 0 && stored != info.Size {
+		a.report("SIZE", hist.SnapId, relpath, blob,
+			fmt.Sprintf("expected %d bytes stored, found %d bytes", stored, info.Size))
+		return
+	}
+
+	if a.quick {
+		return
+	}
+
+	// the object id is a digest too
+	expected := ""
+	if objectid := hist.GetObjectId(phash); objectid != "" {
+		expected = objectid
+	} else if digest := fileutils.FileHashDigest(filehash); strings.HasPrefix(digest, "sha256:") {
+		expected = strings.TrimPrefix(digest, "sha256:")
+	}
+
+	// reading the whole blob also authenticates an encrypted one
+	digest, size, err := blob_digest(hist.Remote, blob, comp)
+	if err != nil {
+		a.report("UNREADABLE", hist.SnapId, relpath, blob, err.Error())
+	} else if !fileutils.FileSizeSame(filehash, size) {
+		a.report("SIZE", hist.SnapId, relpath, blob,
+			fmt.Sprintf("expected %s bytes, found %d bytes", strings.Split(filehash, ";")[0], size))
+	} else if expected != "" && digest != expected {
+		a.report("CORRUPT", hist.SnapId, relpath, blob, "sha256:"+digest)
+	}
+}
+
+// Digest and size of the original contents of a blob.
+func blob_digest(rem remote.Remote, blob string, comp string) (string, int64, error) {
+	in, err := fileutils.OpenBlob(rem, blob, comp)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+	return fileutils.CalcReaderDigest(in)
+}
+
+// Blobs in files/ of the root, or in the shared object store,
+// which are not referenced by any snapshot.
+func (a *audit) find_orphans(rem remote.Remote, rootname string) error {
+	// blobs uploaded by an interrupted commit are kept for shot --resume
+	if err := a.add_pending(rem, rootname); err != nil {
+		return err
+	}
+	if err := a.walk_orphans(rem, fileutils.BackPath(rootname)); err != nil {
+		return err
+	}
+
+	objectsDir := fileutils.ObjectsDir()
+	if !remote.DirExists(rem, objectsDir) {
+		return nil
+	}
+
+	// objects are shared, other roots of the remote can reference them
+	for _, other := range history.RootNames(rem) {
+		if other == rootname {
+			continue
+		}
+		for _, id := range history.SnapIds(rem, other) {
+			hist := history.Make(id, rem, other)
+			if err := hist.Load(); err != nil {
+				return err
+			}
+			for _, blob := range hist.BlobPaths() {
+				a.referenced[blob] = true
+			}
+		}
+		if err := a.add_pending(rem, other); err != nil {
+			return err
+		}
+	}
+
+	return a.walk_orphans(rem, objectsDir)
+}
+
+func (a *audit) add_pending(rem remote.Remote, rootname string) error {
+	pending, err := history.LoadPending(rem, rootname, logger.Default())
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		for _, blob := range pending.BlobPaths() {
+			a.referenced[blob] = true
+		}
+	}
+	return nil
+}
+
+func (a *audit) walk_orphans(rem remote.Remote, dir string) error {
+	if !remote.DirExists(rem, dir) {
+		return nil
+	}
+	err := remote.Walk(rem, dir, func(key string, e remote.Entry) error {
+		if !a.referenced[key] {
+			a.report("ORPHAN", 0, "", key, fmt.Sprintf("%d bytes", e.Size))
+		}
+		return nil
+	})
+	if err != nil {
+		return logger.FailCode(logger.ExitRemote, "verify-orphans", dir, fmt.Sprintf("Failed to walk remote directory.\n\n%s", err))
+	}
+	return nil
+}
+
+func (a *audit) report(kind string, ssid int, relpath string, blob string, detail string) {
+	a.problems = append(a.problems, problem{
+		kind:    kind,
+		ssid:    ssid,
+		relpath: relpath,
+		blob:    blob,
+		detail:  detail,
+	})
+}
+
+func (a *audit) count(kind string) int {
+	total := 0
+	for _, p := range a.problems {
+		if p.kind == kind {
+			total++
+		}
+	}
+	return total
+}
+
+// One tab separated line per problem:
+//
+//	KIND  ssid  relpath  blob  detail
+//
+// followed by a summary line of key=value pairs.
+func (a *audit) print() {
+	for _, p := range a.problems {
+		relpath := p.relpath
+		if relpath == "" {
+			relpath = "-"
+		}
+		logger.Print(fmt.Sprintf("%s\t%04d\t%s\t%s\t%s", p.kind, p.ssid, relpath, p.blob, p.detail))
+	}
+
+	status := "OK"
+	if len(a.problems) > 0 {
+		status = "FAILED"
+	}
+	logger.Print(fmt.Sprintf("VERIFY status=%s snapshots=%d blobs=%d missing=%d size=%d corrupt=%d unreadable=%d orphans=%d",
+		status, a.snapshots, a.blobs,
+		a.count("MISSING"), a.count("SIZE"), a.count("CORRUPT"), a.count("UNREADABLE"), a.count("ORPHAN")))
+}
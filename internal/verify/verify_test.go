@@ -0,0 +1,80 @@
+package verify
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/akhlakm/Snap_Shot/internal/codec"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+)
+
+func TestMain(m *testing.M) {
+	logger.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Snapshot of one gzip compressed file, with the size of its blob if record.
+func compressed_snapshot(t *testing.T, rem remote.Remote, ssid int, contents string, record bool) *history.Hist {
+	hist := history.Make(ssid, rem, "r")
+	hist.AddPath("a.txt", "a.txt", "a.txt", "17; 2024-01-01 10:00:00AM UTC+00:00")
+	hist.SetCrud("a.txt", "C")
+	hist.SetTarget("a.txt", ssid)
+	hist.SetCodec("a.txt", codec.Gzip)
+
+	blob, err := codec.Compress(codec.Gzip, strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rem.Put(hist.GetRestorePath("a.txt"), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if record {
+		hist.SetBlobSize("a.txt", int64(len(data)))
+	}
+	if err := hist.Write(); err != nil {
+		t.Fatal(err)
+	}
+	return hist
+}
+
+func quick_audit(rem remote.Remote, ssid int) *audit {
+	a := &audit{quick: true, referenced: make(map[string]bool)}
+	a.verify_snapshot(history.Make(ssid, rem, "r"))
+	return a
+}
+
+func TestQuickBlobSize(t *testing.T) {
+	rem := remote.NewMemory()
+	hist := compressed_snapshot(t, rem, 1, "hello hello hello", true)
+	if a := quick_audit(rem, 1); len(a.problems) != 0 {
+		t.Fatalf("problems in an intact snapshot: %+v", a.problems)
+	}
+
+	// a truncated upload
+	if _, err := rem.Put(hist.GetRestorePath("a.txt"), strings.NewReader("short")); err != nil {
+		t.Fatal(err)
+	}
+	a := quick_audit(rem, 1)
+	if a.count("SIZE") != 1 {
+		t.Errorf("problems = %+v, want one SIZE", a.problems)
+	}
+
+	// snapshots taken before the size was recorded
+	old := compressed_snapshot(t, rem, 2, "hello hello hello", false)
+	if _, err := rem.Put(old.GetRestorePath("a.txt"), strings.NewReader("short")); err != nil {
+		t.Fatal(err)
+	}
+	if a := quick_audit(rem, 2); len(a.problems) != 0 {
+		t.Errorf("problems without a recorded size: %+v", a.problems)
+	}
+}
@@ -0,0 +1,97 @@
+package workpool
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// Number of workers when not given.
+const DefaultJobs int = 4
+
+// Error of the items not started after a work returned a Stop error.
+var ErrStopped = errors.New("not started after an earlier error")
+
+type stop struct {
+	err error
+}
+
+func (s *stop) Error() string { return s.err.Error() }
+func (s *stop) Unwrap() error { return s.err }
+
+// Error of a work that stops the items not started yet, e.g. when the
+// remote is gone and every other item would fail the same way.
+func Stop(err error) error {
+	return &stop{err}
+}
+
+// Run work(i) for the items 0..count-1 on the given number of workers.
+//
+// done(i, err) is called for every item in the order of the items, as
+// soon as the item and all the items before it are finished. It is never
+// called concurrently, so it can print the output of the items and update
+// the shared state without locking. After a work returns a Stop error,
+// the items not started yet are done with ErrStopped.
+func Run(jobs int, count int, work func(i int) error, done func(i int, err error)) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	if limit := runtime.NumCPU() * 8; jobs > limit {
+		jobs = limit
+	}
+
+	errs := make([]error, count)
+	finished := make([]bool, count)
+	var mu sync.Mutex
+	next := 0
+	stopped := false
+
+	items := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				mu.Lock()
+				skip := stopped
+				mu.Unlock()
+				err := ErrStopped
+				if !skip {
+					err = work(i)
+				}
+
+				mu.Lock()
+				var s *stop
+				if errors.As(err, &s) {
+					stopped = true
+				}
+				errs[i] = err
+				finished[i] = true
+				// flush the finished prefix in order
+				for next < count && finished[next] {
+					done(next, errs[next])
+					next++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		mu.Lock()
+		skip := stopped
+		mu.Unlock()
+		if skip {
+			break
+		}
+		items <- i
+	}
+	close(items)
+	wg.Wait()
+
+	// the workers are gone, the rest is done here
+	for ; next < count; next++ {
+		done(next, ErrStopped)
+	}
+}
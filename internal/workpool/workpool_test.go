@@ -0,0 +1,146 @@
+package workpool
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// done runs in the order of the items, never concurrently, whatever
+// the order in which the items finish.
+func TestRunOrder(t *testing.T) {
+	const count = 200
+	delays := make([]time.Duration, count)
+	r := rand.New(rand.NewSource(1))
+	for i := range delays {
+		delays[i] = time.Duration(r.Intn(2000)) * time.Microsecond
+	}
+
+	var running int32
+	var ran int32
+	order := []int{}
+	indone := 0
+	Run(8, count, func(i int) error {
+		atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		time.Sleep(delays[i])
+		atomic.AddInt32(&ran, 1)
+		if i%7 == 0 {
+			return fmt.Errorf("item %d", i)
+		}
+		return nil
+	}, func(i int, err error) {
+		// shared state without a lock, -race tells if done overlaps
+		indone++
+		if indone != 1 {
+			t.Errorf("done(%d) called concurrently", i)
+		}
+		if (i%7 == 0) != (err != nil) {
+			t.Errorf("done(%d) with the error %v", i, err)
+		}
+		order = append(order, i)
+		indone--
+	})
+
+	if ran != count || len(order) != count {
+		t.Fatalf("%d items run, %d done, want %d", ran, len(order), count)
+	}
+	for i, item := range order {
+		if item != i {
+			t.Fatalf("done of item %d called at %d", item, i)
+		}
+	}
+	if running != 0 {
+		t.Errorf("%d items still running after Run", running)
+	}
+}
+
+// After a Stop error no item is started, the rest is done with ErrStopped.
+func TestRunStop(t *testing.T) {
+	const count = 100
+	failure := errors.New("remote is gone")
+	ran := make([]bool, count)
+	errs := make([]error, count)
+	ndone := 0
+	Run(4, count, func(i int) error {
+		ran[i] = true
+		if i == 10 {
+			return Stop(failure)
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	}, func(i int, err error) {
+		if i != ndone {
+			t.Errorf("done(%d) called at %d", i, ndone)
+		}
+		ndone++
+		errs[i] = err
+	})
+
+	if ndone != count {
+		t.Fatalf("%d items done, want %d", ndone, count)
+	}
+	if !errors.Is(errs[10], failure) || errs[10].Error() != failure.Error() {
+		t.Errorf("error of the stopping item = %v", errs[10])
+	}
+	// the items running with the stopping one finish, no other one starts
+	started := 0
+	for i, err := range errs {
+		if ran[i] {
+			started++
+		}
+		switch {
+		case i == 10:
+		case ran[i] && err != nil:
+			t.Errorf("item %d failed: %v", i, err)
+		case !ran[i] && err != ErrStopped:
+			t.Errorf("item %d not started, done with %v", i, err)
+		}
+	}
+	if started > 30 {
+		t.Errorf("%d of %d items started, the stop is ignored", started, count)
+	}
+}
+
+// With one job the items run one after the other, each done before
+// the next one starts, as for --jobs 1.
+func TestRunOneJob(t *testing.T) {
+	for _, jobs := range []int{1, 0, -3} {
+		events := []string{}
+		var running int32
+		Run(jobs, 5, func(i int) error {
+			if atomic.AddInt32(&running, 1) != 1 {
+				t.Errorf("jobs %d: item %d runs with another one", jobs, i)
+			}
+			defer atomic.AddInt32(&running, -1)
+			events = append(events, fmt.Sprintf("work %d", i))
+			return nil
+		}, func(i int, err error) {
+			events = append(events, fmt.Sprintf("done %d", i))
+		})
+
+		want := ""
+		for i := 0; i < 5; i++ {
+			want += fmt.Sprintf("[work %d done %d]", i, i)
+		}
+		got := ""
+		for i := 0; i+1 < len(events); i += 2 {
+			got += "[" + events[i] + " " + events[i+1] + "]"
+		}
+		if got != want || len(events) != 10 {
+			t.Errorf("jobs %d: events %q", jobs, events)
+		}
+	}
+}
+
+func TestRunEmpty(t *testing.T) {
+	Run(4, 0, func(i int) error {
+		t.Errorf("work(%d) without items", i)
+		return nil
+	}, func(i int, err error) {
+		t.Errorf("done(%d) without items", i)
+	})
+}
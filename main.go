@@ -1,60 +1,364 @@
 package main
 
 import (
+	"fmt"
 	"os"
-	"snap/internal/argparser"
-	"snap/internal/check"
-	"snap/internal/initialize"
-	"snap/internal/logger"
-	"snap/internal/restore"
-	"snap/internal/settings"
-	"snap/internal/snapshot"
-	"snap/internal/status"
+	"strings"
+
+	"github.com/akhlakm/Snap_Shot/internal/argparser"
+	"github.com/akhlakm/Snap_Shot/internal/cat"
+	"github.com/akhlakm/Snap_Shot/internal/check"
+	"github.com/akhlakm/Snap_Shot/internal/compare"
+	"github.com/akhlakm/Snap_Shot/internal/filelog"
+	"github.com/akhlakm/Snap_Shot/internal/filerestore"
+	"github.com/akhlakm/Snap_Shot/internal/initialize"
+	"github.com/akhlakm/Snap_Shot/internal/lock"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/ls"
+	"github.com/akhlakm/Snap_Shot/internal/prune"
+	"github.com/akhlakm/Snap_Shot/internal/pull"
+	"github.com/akhlakm/Snap_Shot/internal/report"
+	"github.com/akhlakm/Snap_Shot/internal/search"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/shot"
+	"github.com/akhlakm/Snap_Shot/internal/status"
+	"github.com/akhlakm/Snap_Shot/internal/tag"
+	"github.com/akhlakm/Snap_Shot/internal/unlock"
+	"github.com/akhlakm/Snap_Shot/internal/verify"
 )
 
+var dry_option = argparser.Option{Name: "dry", Short: "n", Kind: argparser.Flag,
+	Help: "only show the changes, the default"}
+var go_option = argparser.Option{Name: "go", Aliases: []string{"-go"}, Kind: argparser.Flag,
+	Help: "perform the changes"}
+var ignores_option = argparser.Option{Name: "ignores", Short: "i", Kind: argparser.Flag,
+	Help: "also list the ignored files"}
+var jobs_option = argparser.Option{Name: "jobs", Short: "j", Kind: argparser.Int, Value: "N",
+	Help: "number of files to hash and copy concurrently, default 4"}
+var snap_option = argparser.Option{Name: "snap", Kind: argparser.String, Value: "RANGE",
+	Help: "only the snapshots of the range, e.g. 3..7, 3.., ..release or a single id or tag"}
+var json_option = argparser.Option{Name: "json", Kind: argparser.Flag,
+	Help: "print the result as JSON, the same as --format json"}
+var format_option = argparser.Option{Name: "format", Kind: argparser.String, Value: "FORMAT",
+	Help: "format of the result, text, json or tsv"}
+
+// options of every command
+var log_options = []argparser.Option{
+	{Name: "verbose", Short: "v", Kind: argparser.Count, Help: "show the steps, -vv every file and remote operation"},
+	{Name: "quiet", Kind: argparser.Flag, Help: "only show the errors and warnings"},
+	{Name: "log-file", Kind: argparser.String, Value: "PATH", Help: "also write the messages as JSON lines to the file"},
+}
+
+var commands = []*argparser.Command{
+	{
+		Name:    "init",
+		Args:    "<rootname> <remote>",
+		MaxArgs: 2,
+		Summary: "Initialize the current directory as a root, backed up to the remote.",
+		Options: []argparser.Option{
+			{Name: "encrypt", Kind: argparser.Flag, Help: "encrypt the remote data of the root"},
+			{Name: "key-file", Kind: argparser.String, Value: "PATH", Help: "file with the passphrase of the encryption"},
+		},
+		Run: initialize.Execute,
+	},
+	{
+		Name:    "shot",
+		Args:    "[<path>...]",
+		MaxArgs: -1,
+		Summary: "Take a snapshot of the changes since the last one, only under the paths if given.",
+		Options: []argparser.Option{
+			dry_option, go_option, ignores_option, jobs_option, json_option, format_option,
+			{Name: "message", Short: "m", Kind: argparser.String, Value: "TEXT", Help: "description of the snapshot"},
+			{Name: "resume", Kind: argparser.Flag, Help: "finish an interrupted snapshot"},
+		},
+		Run: shot.Execute,
+	},
+	{
+		Name:    "pull",
+		Args:    "[<snapshot id|tag>]",
+		MaxArgs: 1,
+		Summary: "Restore the current directory to a snapshot, the latest one if not given.",
+		Options: []argparser.Option{dry_option, go_option, ignores_option, jobs_option, json_option, format_option},
+		Run:     pull.Execute,
+	},
+	{
+		Name:    "restore",
+		Args:    "<snapshot id|tag> <path>...",
+		MaxArgs: -1,
+		Summary: "Restore files or directories of a snapshot, the other files are not changed.",
+		Options: []argparser.Option{
+			{Name: "to", Kind: argparser.String, Value: "DIR", Help: "restore under the directory instead of the root"},
+			{Name: "overwrite", Kind: argparser.Flag, Help: "replace the local files that differ"},
+			{Name: "keep-both", Kind: argparser.Flag, Help: "restore next to the local files that differ, as name_NNNN.ext"},
+			{Name: "skip", Kind: argparser.Flag, Help: "keep the local files that differ"},
+			dry_option, go_option, jobs_option,
+		},
+		Run: filerestore.Execute,
+	},
+	{
+		Name:    "diff",
+		Args:    "[<snapshot id|tag> [<snapshot id|tag>]] [-- <path>...]",
+		MaxArgs: -1,
+		Summary: "List the files changed between two snapshots, or a snapshot and the current files.",
+		Options: []argparser.Option{
+			{Name: "stat", Kind: argparser.Flag, Help: "only show the number of changes and the size change"},
+			{Name: "name-status", Kind: argparser.Flag, Help: "list the changed files under the paths instead of their differences"},
+			{Name: "unified", Short: "U", Kind: argparser.Int, Value: "N", Help: "lines of context around the differences, default 3"},
+			{Name: "word-diff", Kind: argparser.Flag, Help: "mark the changed words inline as [-deleted-]{+added+}"},
+			json_option, format_option,
+		},
+		Run: compare.Execute,
+	},
+	{
+		Name:    "log",
+		Args:    "<path>",
+		MaxArgs: 1,
+		Summary: "List the snapshots in which a file changed, following its renames.",
+		Options: []argparser.Option{json_option, format_option},
+		Run:     filelog.Execute,
+	},
+	{
+		Name:    "cat",
+		Args:    "<snapshot id|tag> <path>",
+		MaxArgs: 2,
+		Summary: "Write the contents of a file in a snapshot to stdout.",
+		Run:     cat.Execute,
+	},
+	{
+		Name:    "ls",
+		Args:    "<snapshot id|tag> [<dir>]",
+		MaxArgs: 2,
+		Summary: "List the files of a snapshot, as they were when it was taken.",
+		Options: []argparser.Option{
+			{Name: "long", Short: "l", Kind: argparser.Flag, Help: "show the sizes, modification times and the snapshots of the blobs"},
+			{Name: "recursive", Short: "R", Kind: argparser.Flag, Help: "list the files of the subdirectories"},
+			{Name: "tree", Kind: argparser.Flag, Help: "show the subdirectories as a tree"},
+			{Name: "glob", Short: "g", Kind: argparser.String, Value: "PATTERN", Help: "only the files with names matching the pattern, e.g. '*.go'"},
+		},
+		Run: ls.Execute,
+	},
+	{
+		Name:    "find",
+		Args:    "<glob>",
+		MaxArgs: 1,
+		Summary: "List the paths matching a pattern in all the snapshots, e.g. '*.md' or 'docs/*'.",
+		Options: []argparser.Option{snap_option},
+		Run:     search.ExecuteFind,
+	},
+	{
+		Name:    "grep",
+		Args:    "<pattern> [-- <path glob>...]",
+		MaxArgs: -1,
+		Summary: "Search the contents of the files in the snapshots for a regular expression.",
+		Options: []argparser.Option{
+			snap_option,
+			{Name: "ignore-case", Short: "i", Kind: argparser.Flag, Help: "match the letters of any case"},
+			jobs_option,
+		},
+		Run: search.ExecuteGrep,
+	},
+	{
+		Name:    "list",
+		Args:    "[<snapshot id|tag>]",
+		MaxArgs: 1,
+		Summary: "List the snapshots, or the changes of a snapshot.",
+		Options: []argparser.Option{json_option, format_option},
+		Run:     status.Execute,
+	},
+	{
+		Name:    "check",
+		Args:    "<path> [<snapshot id|tag>]",
+		MaxArgs: 2,
+		Summary: "Copy the versions of a file or directory in the snapshots to the _.shot directory.",
+		Run:     check.Execute,
+	},
+	{
+		Name:    "verify",
+		Args:    "[<snapshot id|tag>]",
+		MaxArgs: 1,
+		Summary: "Check the blobs of the snapshots in the remote.",
+		Options: []argparser.Option{
+			{Name: "quick", Short: "q", Kind: argparser.Flag, Help: "only check the existence and size of the blobs"},
+		},
+		Run: verify.Execute,
+	},
+	{
+		Name:    "prune",
+		MaxArgs: 0,
+		Summary: "Remove old snapshots and the blobs no snapshot refers to.",
+		Options: []argparser.Option{
+			{Name: "keep-last", Kind: argparser.Int, Value: "N", Help: "keep the N newest snapshots"},
+			{Name: "keep-daily", Kind: argparser.Int, Value: "N", Help: "keep the newest snapshot of the last N days"},
+			{Name: "keep-weekly", Kind: argparser.Int, Value: "N", Help: "keep the newest snapshot of the last N weeks"},
+			{Name: "keep-monthly", Kind: argparser.Int, Value: "N", Help: "keep the newest snapshot of the last N months"},
+			{Name: "keep-tagged", Kind: argparser.Flag, Help: "keep the tagged snapshots"},
+			dry_option, go_option,
+		},
+		Run: prune.Execute,
+	},
+	{
+		Name:    "tag",
+		Args:    "[<snapshot id|tag> <name>]",
+		MaxArgs: 2,
+		Summary: "Tag a snapshot, or list the tags.",
+		Options: []argparser.Option{
+			{Name: "delete", Short: "d", Kind: argparser.String, Value: "NAME", Help: "remove the tag"},
+			{Name: "force", Short: "f", Kind: argparser.Flag, Help: "move the tag if it is on another snapshot"},
+		},
+		Run: tag.Execute,
+	},
+	{
+		Name:    "unlock",
+		MaxArgs: 0,
+		Summary: "Remove a stale lock of the root.",
+		Options: []argparser.Option{
+			{Name: "force", Short: "f", Kind: argparser.Flag, Help: "remove the lock even if its owner seems to be running"},
+		},
+		Run: unlock.Execute,
+	},
+	{
+		Name:    "help",
+		Args:    "[<command>]",
+		MaxArgs: 1,
+		Summary: "Show the usage of a command.",
+	},
+}
+
+func init() {
+	// the help lists the commands, it cannot refer to them statically
+	find_command("help").Run = show_help
+	for _, cmd := range commands {
+		cmd.Options = append(cmd.Options, log_options...)
+	}
+}
+
 func main() {
+	if err := setup_logging(nil); err != nil {
+		logger.Exit(err)
+	}
+	// the library checks the locks instead
+	lock.ExitOnSignal()
 	logger.Trace("main", "")
 
 	// parse args
 	args := os.Args
-	argparser.Create(args[1:])
 	if len(args) > 1 {
-		cmd := args[1]
-		if cmd == "init" {
-			initialize.Execute()
-		} else {
-			settings.Load()
-			if cmd == "pull" {
-				restore.Execute()
-			} else if cmd == "list" {
-				status.Execute()
-			} else if cmd == "check" {
-				check.Execute()
-			} else if cmd == "shot" {
-				snapshot.Execute()
-			} else {
-				logger.Error("main", cmd,
-					"Unknown argument.\n"+
-						"Please use one of the init, pull, shot, list commands.")
+		cmd := find_command(args[1])
+		if cmd == nil {
+			logger.Exit(logger.FailCode(logger.ExitUsage, "main", args[1],
+				"Unknown command.\n"+
+					"Please use one of the "+command_names()+" commands."))
+		}
+		if err := argparser.Create(cmd, args[2:]); err != nil {
+			logger.Exit(logger.FailCode(logger.ExitUsage, "main", cmd.Name,
+				fmt.Sprintf("Invalid arguments, %s.\n\n", err)+cmd.Help()))
+		}
+		if err := setup_logging(argparser.GetParser()); err != nil {
+			logger.Exit(err)
+		}
+		if err := report.Setup(argparser.GetParser()); err != nil {
+			logger.Exit(err)
+		}
+		if argparser.GetParser().HasFlag("help") {
+			logger.Print(cmd.Help())
+			return
+		}
+		if cmd.Name != "init" && cmd.Name != "help" {
+			if err := settings.Load(); err != nil {
+				logger.Exit(err)
 			}
 		}
+		if err := cmd.Run(); err != nil {
+			logger.Exit(err)
+		}
 	} else {
 		if settings.Exists() {
-			logger.Error("main", "",
+			logger.Exit(logger.FailCode(logger.ExitUsage, "main", "",
 				"No argument.\n"+
 					"\nPlease specify one of the following commands, all of them are safe to run.\n"+
-					"pull, shot, list")
+					"pull, shot, list, check, verify\n"+
+					"\nRun 'help' for all the commands, 'help <command>' for their options."))
 		} else {
-			logger.Error("main", "",
+			logger.Exit(logger.FailCode(logger.ExitUsage, "main", "",
 				"Not initialized as a project root.\n"+
 					"\nPlease run 'init' with a rootname (a name for the current project directory),\n"+
 					"and a path to a remote folder to backup to, or restore from.\n\n"+
 					"Make sure your rootname is future-proof. Each remote can contain multiple roots.\n"+
 					"Once you initialized, you will be able to take a snapshot of the current directory,\n"+
 					"or view a list of snapshots if you have an existing remote and restore them.\n"+
-					"\nUSAGE: init <rootname> <remote folder path>\n")
+					"\nUSAGE: init <rootname> <remote folder path>\n"))
 		}
 	}
 
 	logger.Print("~")
 }
+
+func find_command(name string) *argparser.Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func command_names() string {
+	names := []string{}
+	for _, cmd := range commands {
+		names = append(names, cmd.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Log level and file from the environment, then from the options
+// of the command if parsed.
+func setup_logging(args *argparser.Parser) error {
+	if args == nil {
+		level, err := logger.ParseLevel(os.Getenv("SNAP_LOG_LEVEL"))
+		if err != nil {
+			return logger.FailCode(logger.ExitUsage, "main", "SNAP_LOG_LEVEL", err.Error())
+		}
+		logger.SetLevel(level)
+		if path := os.Getenv("SNAP_LOG_FILE"); path != "" {
+			if err := logger.SetLogFile(path); err != nil {
+				return logger.Fail("main", path, fmt.Sprintf("Cannot open the log file.\n\n%s", err))
+			}
+		}
+		return nil
+	}
+
+	if args.HasFlag("quiet") {
+		logger.SetLevel(logger.LevelQuiet)
+	} else if n := args.GetKeyInt("verbose", 0); n > 0 {
+		level := logger.LevelInfo
+		if n > 1 {
+			level = logger.LevelTrace
+		}
+		logger.SetLevel(level)
+	}
+	if path := args.GetKeyStr("log-file", ""); path != "" {
+		if err := logger.SetLogFile(path); err != nil {
+			return logger.Fail("main", path, fmt.Sprintf("Cannot open the log file.\n\n%s", err))
+		}
+	}
+	return nil
+}
+
+func show_help() error {
+	name, err := argparser.GetParser().GetStr(1)
+	if err != nil {
+		logger.Print("USAGE: snap <command> [arguments] [options]\n\nCommands:")
+		for _, cmd := range commands {
+			logger.Print(fmt.Sprintf("  %-8s  %s", cmd.Name, cmd.Summary))
+		}
+		logger.Print("\nRun 'help <command>' for the arguments and options of a command.")
+		return nil
+	}
+	cmd := find_command(name)
+	if cmd == nil {
+		return logger.FailCode(logger.ExitUsage, "help", name, "Unknown command.\n"+
+			"Please use one of the "+command_names()+" commands.")
+	}
+	logger.Print(cmd.Help())
+	return nil
+}
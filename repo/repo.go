@@ -0,0 +1,383 @@
+// Package repo takes and restores the snapshots of a root directory,
+// for programs embedding snap. A root is initialized with 'snap init',
+// its settings file names the remote and the last snapshot synced.
+//
+// Nothing here exits the process, the errors are returned. The messages
+// and the progress of the copies are printed to the output of each repo,
+// see SetOutput. No state is shared by the repos of a process.
+package repo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/akhlakm/Snap_Shot/internal/diff"
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/history"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+	"github.com/akhlakm/Snap_Shot/internal/remote"
+	"github.com/akhlakm/Snap_Shot/internal/report"
+	"github.com/akhlakm/Snap_Shot/internal/restore"
+	"github.com/akhlakm/Snap_Shot/internal/settings"
+	"github.com/akhlakm/Snap_Shot/internal/snapshot"
+	"github.com/akhlakm/Snap_Shot/internal/tags"
+)
+
+// The types of the machine readable output of the command line.
+type (
+	Summary  = report.Summary
+	Snapshot = report.Snapshot
+	Entry    = report.Entry
+	Counts   = report.Counts
+	Change   = diff.Change
+)
+
+// Error returned by the repo, with the exit code of the command line.
+type Failure = logger.Failure
+
+// No snapshot in the remote to restore.
+var ErrNoSnapshot = restore.ErrNoSnapshot
+
+// Root directory and its remote.
+type Repo struct {
+	dir  string
+	conf *settings.Settings
+	rem  remote.Remote
+	log  *logger.Logger
+}
+
+type SnapshotOptions struct {
+	// description of the snapshot
+	Message string
+	// files hashed and uploaded concurrently, 4 if not set
+	Jobs int
+	// compare only, nothing is uploaded
+	DryRun bool
+	// finish the snapshot of an interrupted commit
+	Resume bool
+	// only the changes under these paths, relative to the root
+	Paths []string
+}
+
+type RestoreOptions struct {
+	// files copied concurrently, 4 if not set
+	Jobs int
+	// compare only, no file is changed
+	DryRun bool
+}
+
+// Open the initialized root directory of dir, dir itself or its nearest
+// parent with a settings file, with the remote at the location,
+// the default remote of its settings if empty.
+func Open(dir string, location string) (*Repo, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, logger.Fail("repo-open", dir, fmt.Sprintf("Cannot determine the root directory.\n\n%s", err))
+	}
+	conf, err := settings.Find(fileutils.PathNormalize(abs))
+	if err != nil {
+		return nil, err
+	}
+	if location == "" {
+		location = conf.DefaultRemote()
+	}
+	rem, err := conf.OpenRemote(location)
+	if err != nil {
+		return nil, err
+	}
+	r := &Repo{dir: conf.Dir(), conf: conf, rem: rem}
+	r.SetOutput(os.Stdout)
+	return r, nil
+}
+
+// Print the messages of the repo to w, stdout by default, io.Discard
+// to silence them. The command line gives its logger, with its level.
+func (r *Repo) SetOutput(w io.Writer) {
+	if log, ok := w.(*logger.Logger); ok {
+		r.log = log
+	} else {
+		r.log = logger.New(w, logger.LevelNormal)
+	}
+	r.conf.SetLog(r.log)
+}
+
+// Release the connections to the remote. The repo is not used after.
+func (r *Repo) Close() error {
+	return r.rem.Close()
+}
+
+// Absolute path of the root directory.
+func (r *Repo) Root() string {
+	return r.dir
+}
+
+// Name of the root in the remote.
+func (r *Repo) Name() string {
+	return r.conf.RootName()
+}
+
+// Id of the snapshot the root directory was last synced with, 0 if none.
+func (r *Repo) LastSnapshot() int {
+	return r.conf.LastSnapshot()
+}
+
+// Snapshot compared with the root directory, see PrepareSnapshot.
+type PreparedSnapshot struct {
+	shot *snapshot.Shot
+}
+
+// Walk the root directory and compare it with the last snapshot, nothing is
+// uploaded until committed. Unless a dry run, the root is locked until closed.
+func (r *Repo) PrepareSnapshot(opts SnapshotOptions) (*PreparedSnapshot, error) {
+	shot, err := snapshot.Prepare(r.dir, r.conf, r.rem, snapshot.Options{
+		Jobs:    opts.Jobs,
+		Message: opts.Message,
+		Commit:  !opts.DryRun,
+		Resume:  !opts.DryRun && opts.Resume,
+		Paths:   opts.Paths,
+		Log:     r.log,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PreparedSnapshot{shot: shot}, nil
+}
+
+// Id of the new snapshot.
+func (p *PreparedSnapshot) SnapId() int {
+	return p.shot.Hist.SnapId
+}
+
+// Id of the snapshot the root directory was last synced with, 0 if none.
+func (p *PreparedSnapshot) Last() int {
+	return p.shot.Last
+}
+
+// Id of the snapshot of an interrupted commit, 0 if none. It must be
+// finished with the Resume option before a new one is committed.
+func (p *PreparedSnapshot) Interrupted() int {
+	if p.shot.Pending == nil {
+		return 0
+	}
+	return p.shot.Pending.SnapId
+}
+
+// The new snapshot, every file but the ignored ones, or with them too.
+func (p *PreparedSnapshot) Snapshot(ignores bool) *Snapshot {
+	cruds := []string{"C", "R", "U", "D"}
+	if ignores {
+		cruds = append(cruds, "I")
+	}
+	snap := report.Of(p.shot.Hist, nil, cruds...)
+	return &snap
+}
+
+// Upload the files and publish the snapshot, it becomes the last one synced.
+func (p *PreparedSnapshot) Commit() error {
+	return p.shot.Commit()
+}
+
+// Release the lock of the root, if held.
+func (p *PreparedSnapshot) Close() {
+	p.shot.Close()
+}
+
+// Take a snapshot of the changes of the root directory since the last one.
+// The snapshot returned lists every file but the ignored ones.
+func (r *Repo) Snapshot(opts SnapshotOptions) (*Snapshot, error) {
+	p, err := r.PrepareSnapshot(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+
+	if !opts.DryRun {
+		if err := p.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return p.Snapshot(false), nil
+}
+
+// Restore compared with the root directory, see PrepareRestore.
+type PreparedRestore struct {
+	pull *restore.Pull
+}
+
+// Compare the root directory with the snapshot, the latest one if id is 0,
+// nothing is changed until committed. Unless a dry run, the root is locked
+// until closed. Returns ErrNoSnapshot if the remote has no snapshot.
+func (r *Repo) PrepareRestore(id int, opts RestoreOptions) (*PreparedRestore, error) {
+	pull, err := restore.Prepare(r.dir, r.conf, r.rem, id, restore.Options{
+		Jobs:   opts.Jobs,
+		Commit: !opts.DryRun,
+		Log:    r.log,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PreparedRestore{pull: pull}, nil
+}
+
+// Id of the snapshot restored.
+func (p *PreparedRestore) SnapId() int {
+	return p.pull.Target.SnapId
+}
+
+// Id of the snapshot the root directory was last synced with, 0 if none.
+func (p *PreparedRestore) Last() int {
+	return p.pull.Last
+}
+
+// The changes to the files of the root, with the ignored files too if ignores.
+func (p *PreparedRestore) Snapshot(ignores bool) *Snapshot {
+	cruds := []string{"C", "R", "U", "D"}
+	if ignores {
+		cruds = append(cruds, "I")
+	}
+	snap := report.Of(p.pull.Hist, nil, cruds...)
+	snap.SnapId = p.pull.Target.SnapId
+	snap.Meta["SSID"] = fmt.Sprint(p.pull.Target.SnapId)
+	return &snap
+}
+
+// Change the files of the root to the snapshot, it becomes the last one synced.
+func (p *PreparedRestore) Commit() error {
+	return p.pull.Commit()
+}
+
+// Release the lock of the root, if held.
+func (p *PreparedRestore) Close() {
+	p.pull.Close()
+}
+
+// Restore the root directory to the snapshot, the latest one if id is 0.
+// The snapshot returned lists the changes to the files of the root.
+func (r *Repo) Restore(id int, opts RestoreOptions) (*Snapshot, error) {
+	p, err := r.PrepareRestore(id, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+
+	if !opts.DryRun {
+		if err := p.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return p.Snapshot(false), nil
+}
+
+// The snapshots of the root in the remote, oldest first.
+func (r *Repo) List() ([]Summary, error) {
+	if err := r.available(); err != nil {
+		return nil, err
+	}
+	l, err := report.ListOf(r.rem, r.conf.RootName(), r.conf.LastSnapshot(), r.log)
+	if err != nil {
+		return nil, err
+	}
+	return l.Snapshots, nil
+}
+
+// The snapshot with its files.
+func (r *Repo) Get(id int) (*Snapshot, error) {
+	hist, err := r.load(id)
+	if err != nil {
+		return nil, err
+	}
+	snaptags, err := tags.Load(r.rem, r.conf.RootName())
+	if err != nil {
+		return nil, err
+	}
+	snap := report.Of(hist, snaptags.Of(id))
+	return &snap, nil
+}
+
+// Id of a snapshot given by its id or a tag.
+func (r *Repo) Resolve(arg string) (int, error) {
+	return tags.ResolveArg(r.rem, r.conf.RootName(), arg)
+}
+
+// Files added, modified, deleted and renamed from snapshot a to snapshot b,
+// under the paths relative to the root if given. No snapshot if a is 0, every
+// file is added, and the files of the root directory if b is 0. Nothing is
+// written to the root directory.
+func (r *Repo) Diff(a int, b int, paths ...string) ([]Change, error) {
+	older := history.Make(0, r.rem, r.conf.RootName())
+	older.Log = r.log
+	if a > 0 {
+		var err error
+		if older, err = r.load(a); err != nil {
+			return nil, err
+		}
+	}
+	var newer *history.Hist
+	if b > 0 {
+		var err error
+		if newer, err = r.load(b); err != nil {
+			return nil, err
+		}
+	} else {
+		shot, err := snapshot.Prepare(r.dir, r.conf, r.rem, snapshot.Options{
+			Paths:    paths,
+			ReadOnly: true,
+			Log:      r.log,
+		})
+		if err != nil {
+			return nil, err
+		}
+		shot.Close()
+		newer = shot.Hist
+	}
+	return diff.Filter(diff.Snapshots(older, newer), paths), nil
+}
+
+// Files of a snapshot, to read their contents.
+type Files struct {
+	hist *history.Hist
+}
+
+// The files of the snapshot.
+func (r *Repo) Files(id int) (*Files, error) {
+	hist, err := r.load(id)
+	if err != nil {
+		return nil, err
+	}
+	return &Files{hist: hist}, nil
+}
+
+// Contents of the file of the snapshot, its path relative to the root.
+func (f *Files) Open(relpath string) (io.ReadCloser, error) {
+	phash := fileutils.CalcPathHash(relpath)
+	if !diff.Present(f.hist, phash) {
+		return nil, fmt.Errorf("no such file in snapshot %d: %s", f.hist.SnapId, relpath)
+	}
+	return fileutils.OpenBlob(f.hist.Remote, f.hist.GetRestorePath(phash), f.hist.GetCodec(phash))
+}
+
+func (r *Repo) available() error {
+	if !remote.Available(r.rem) {
+		errmsg := "Remote directory does not exist.\n" +
+			"\nMake sure it is mounted. Or take your first snapshot and it will be created automatically.\n"
+		return logger.FailCode(logger.ExitRemote, "repo-remote", r.rem.String(), errmsg)
+	}
+	return nil
+}
+
+func (r *Repo) load(id int) (*history.Hist, error) {
+	if err := r.available(); err != nil {
+		return nil, err
+	}
+	hist := history.Make(id, r.rem, r.conf.RootName())
+	hist.Log = r.log
+	if id < 1 || !hist.SnapFileExists() {
+		return nil, logger.Fail("repo-snapshot", fmt.Sprint(id), "No such snapshot exists in the remote.")
+	}
+	if err := hist.Load(); err != nil {
+		return nil, err
+	}
+	return hist, nil
+}
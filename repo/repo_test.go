@@ -0,0 +1,160 @@
+package repo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akhlakm/Snap_Shot/internal/fileutils"
+	"github.com/akhlakm/Snap_Shot/internal/logger"
+)
+
+func write_file(t *testing.T, dir string, relpath string, contents string) {
+	path := filepath.Join(dir, filepath.FromSlash(relpath))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read_file(t *testing.T, dir string, relpath string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(relpath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Initialized root directory with a local remote.
+func make_root(t *testing.T) string {
+	dir := t.TempDir()
+	remotedir := filepath.ToSlash(t.TempDir())
+	write_file(t, dir, fileutils.GetRootSettingsPath(),
+		"[ROOT]\nname = r\nsnapshot = 0\n\n[REMOTES]\ndefault = "+remotedir+"\n\n[IGNORES]\n")
+	return dir
+}
+
+func TestRepo(t *testing.T) {
+	// nothing is printed by the logger of the process
+	var std bytes.Buffer
+	logger.SetOutput(&std)
+	defer logger.SetOutput(os.Stdout)
+
+	dir := make_root(t)
+	write_file(t, dir, "a.txt", "first")
+	write_file(t, dir, "sub/b.txt", "b")
+
+	r, err := Open(filepath.Join(dir, "sub"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var out bytes.Buffer
+	r.SetOutput(&out)
+	if r.Root() != fileutils.PathNormalize(dir) || r.Name() != "r" {
+		t.Errorf("opened root %s named %s", r.Root(), r.Name())
+	}
+
+	snap, err := r.Snapshot(SnapshotOptions{Message: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.SnapId != 1 || len(snap.Entries) != 2 || r.LastSnapshot() != 1 {
+		t.Fatalf("snapshot %d with %d entries, last %d", snap.SnapId, len(snap.Entries), r.LastSnapshot())
+	}
+	if !strings.Contains(out.String(), "OK -- a.txt") {
+		t.Errorf("output of the snapshot:\n%s", out.String())
+	}
+
+	list, err := r.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].SnapId != 1 || list[0].Meta["DESC"] != "first" {
+		t.Errorf("List = %+v", list)
+	}
+
+	// a diff with the root directory does not write the hash cache
+	cache := filepath.Join(dir, fileutils.GetHashCachePath())
+	os.Remove(cache)
+	write_file(t, dir, "a.txt", "second")
+	changes, err := r.Diff(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Status != "M" || changes[0].RelPath != "a.txt" {
+		t.Errorf("Diff = %+v", changes)
+	}
+	if _, err := os.Stat(cache); !os.IsNotExist(err) {
+		t.Error("Diff wrote the hash cache")
+	}
+
+	if _, err := r.Snapshot(SnapshotOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = r.Diff(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].RelPath != "a.txt" {
+		t.Errorf("Diff of the snapshots = %+v", changes)
+	}
+
+	// a dry run changes nothing
+	if _, err := r.Restore(1, RestoreOptions{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if read_file(t, dir, "a.txt") != "second" {
+		t.Error("dry run restored the file")
+	}
+	restored, err := r.Restore(1, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.SnapId != 1 || r.LastSnapshot() != 1 {
+		t.Errorf("restored %d, last %d", restored.SnapId, r.LastSnapshot())
+	}
+	if got := read_file(t, dir, "a.txt"); got != "first" {
+		t.Errorf("restored a.txt = %q", got)
+	}
+
+	files, err := r.Files(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := files.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(data) != "second" {
+		t.Errorf("a.txt of snapshot 2 = %q", data)
+	}
+
+	if std.Len() > 0 {
+		t.Errorf("printed by the logger of the process:\n%s", std.String())
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := Open(t.TempDir(), ""); err == nil {
+		t.Error("opened a directory without settings")
+	}
+	r, err := Open(make_root(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetOutput(ioutil.Discard)
+	if _, err := r.Restore(0, RestoreOptions{DryRun: true}); err != ErrNoSnapshot {
+		t.Errorf("Restore without snapshots = %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+}